@@ -40,7 +40,8 @@ func main() {
 	case "cloud":
 		switch args[1] {
 		case "delete":
-			err := dClient.DestroyServer(args[2])
+			force := len(args) > 3 && args[3] == "force"
+			err := dClient.DestroyServer(args[2], force)
 			if err != nil {
 				rb.Write([]byte("Error deleting the server: " + args[2] + " Error: " + err.Error()))
 			} else {
@@ -62,6 +63,33 @@ func main() {
 		case "show":
 			resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud", "show")
 			rb.Write(resp.Body)
+		case "tag":
+			resp := dClient.TagServer(args[2])
+			rb.Write(resp.Body)
+		case "cost":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud", "cost")
+			rb.Write(resp.Body)
+		case "firewall":
+			switch args[2] {
+			case "show":
+				resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud-firewall", "show")
+				rb.Write(resp.Body)
+			case "sync":
+				resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud-firewall", "reload")
+				rb.Write(resp.Body)
+			}
+		case "image":
+			switch args[2] {
+			case "build":
+				resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud-image", "build")
+				rb.Write(resp.Body)
+			case "show":
+				resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud-image", "show")
+				rb.Write(resp.Body)
+			case "status":
+				resp := dClient.Call([]byte(dclient.BLANK_JSON), "cloud-image", "status")
+				rb.Write(resp.Body)
+			}
 		}
 	case "keyring":
 		switch args[1] {
@@ -78,8 +106,84 @@ func main() {
 		case "reload":
 			resp := dClient.Call([]byte(dclient.BLANK_JSON), "keyring", "reload")
 			rb.Write(resp.Body)
+		case "import", "export":
+			resp := dClient.TransferKeyring(args[1], args[2])
+			rb.Write(resp.Body)
+		case "add", "rotate":
+			resp, err := dClient.WriteKey(args[1], args[2])
+			if err != nil {
+				rb.Write([]byte(err.Error()))
+			}
+			rb.Write(resp.Body)
+		case "delete":
+			var rung string
+			if len(args) > 3 {
+				rung = args[3]
+			}
+			resp := dClient.DeleteKey(args[2], rung)
+			rb.Write(resp.Body)
 
 		}
+	case "keys":
+		switch args[1] {
+		case "rotate":
+			var name string
+			if len(args) > 2 {
+				name = args[2]
+			}
+			resp := dClient.RotateKey(name)
+			rb.Write(resp.Body)
+		}
+	case "reconcile":
+		switch args[1] {
+		case "show":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "reconcile", "show")
+			rb.Write(resp.Body)
+		case "repair":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "reconcile", "run")
+			rb.Write(resp.Body)
+		}
+	case "rotation":
+		switch args[1] {
+		case "show":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "rotation", "show")
+			rb.Write(resp.Body)
+		case "run":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "rotation", "run")
+			rb.Write(resp.Body)
+		}
+	case "health":
+		switch args[1] {
+		case "show":
+			resp, err := dClient.HealthCheck()
+			if err != nil {
+				rb.Write([]byte(err.Error()))
+			}
+			rb.Write(resp.Body)
+		case "run":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "health", "run")
+			rb.Write(resp.Body)
+		}
+	case "workflow":
+		switch args[1] {
+		case "run":
+			params := ""
+			if len(args) > 3 {
+				params = args[3]
+			}
+			resp := dClient.RunWorkflow(args[2], params, false)
+			rb.Write(resp.Body)
+		case "show":
+			var target string
+			if len(args) > 2 {
+				target = args[2]
+			}
+			resp := dClient.ShowWorkflow(target)
+			rb.Write(resp.Body)
+		case "resume":
+			resp := dClient.ResumeWorkflow(args[2])
+			rb.Write(resp.Body)
+		}
 	case "routes":
 		switch args[1] {
 		case "show":
@@ -94,6 +198,31 @@ func main() {
 		case "show":
 			resp := dClient.RenderWgConfig(args[2])
 			rb.Write(resp.Body)
+		case "qr":
+			resp := dClient.RenderWgQrCode(args[2])
+			rb.Write(resp.Body)
+		}
+	case "vpn":
+		switch args[1] {
+		case "up":
+			var server string
+			if len(args) > 2 {
+				server = args[2]
+			}
+			resp := dClient.TunnelUp(server)
+			rb.Write(resp.Body)
+		case "down":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "vpn", "down")
+			rb.Write(resp.Body)
+		case "status":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "vpn", "status")
+			rb.Write(resp.Body)
+		case "lock":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "vpn", "lock")
+			rb.Write(resp.Body)
+		case "unlock":
+			resp := dClient.Call([]byte(dclient.BLANK_JSON), "vpn", "unlock")
+			rb.Write(resp.Body)
 		}
 	case "daemon":
 		switch args[1] {
@@ -129,12 +258,15 @@ func main() {
 		case "client":
 			switch args[2] {
 			case "add":
-				b, _ := json.Marshal(config.VpnClient{Name: args[3]})
-				resp := dClient.Call(b, "config-peer", "delete")
-				rb.Write(resp.Body)
+				err := dClient.AddClientToConfig(args[3])
+				if err != nil {
+					rb.Write([]byte(err.Error()))
+				} else {
+					rb.Write([]byte("Client added."))
+				}
 			case "delete":
 				b, _ := json.Marshal(config.VpnClient{Name: args[3]})
-				resp := dClient.Call(b, "config-peer", "add")
+				resp := dClient.Call(b, "config-peer", "delete")
 				rb.Write(resp.Body)
 			}
 		case "reload":
@@ -11,10 +11,15 @@ import (
 	"git.aetherial.dev/aeth/yosai/pkg/config"
 	"git.aetherial.dev/aeth/yosai/pkg/daemon"
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/health"
 	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/killswitch"
+	"git.aetherial.dev/aeth/yosai/pkg/reconcile"
+	"git.aetherial.dev/aeth/yosai/pkg/rotation"
 	"git.aetherial.dev/aeth/yosai/pkg/secrets/hashicorp"
 	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
 	"git.aetherial.dev/aeth/yosai/pkg/semaphore"
+	"git.aetherial.dev/aeth/yosai/pkg/wireguard/iface"
 )
 
 const UNIX_DOMAIN_SOCK_PATH = "/tmp/yosaid.sock"
@@ -62,7 +67,36 @@ func main() {
 		KeyRing:   apikeyring,
 		Client:    &http.Client{},
 	}
-	apikeyring.Rungs = append(apikeyring.Rungs, hashiConn)
+	// the local keyring either keeps a copy of what is in vault, so that the daemon can run while vault is
+	// unreachable, or holds every key itself on hosts that dont have vault
+	var localKeyring *keyring.FileKeyRing
+	if conf.HostInfo.KeyringPath != "" {
+		secret, err := keyring.KeyringSecret(conf.HostInfo.KeyringKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		localKeyring, err = keyring.NewFileKeyRing(conf.HostInfo.KeyringPath, secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case localKeyring == nil:
+		apikeyring.AddRung(keyring.RungVault, hashiConn)
+	case conf.HostInfo.KeyringMode == config.KeyringModeStandalone:
+		apikeyring.AddRung(keyring.RungLocal, localKeyring)
+	default:
+		apikeyring.AddRung(keyring.RungVault, keyring.NewCachedKeyRing(hashiConn, localKeyring, conf))
+	}
+	// keys that arent in the secrets backend can be kept on the kernel keyring, or in the desktop keychain
+	// on workstations. Writes still go to the backend, since it is the first rung
+	if conf.HostInfo.SystemKeyring != "" {
+		systemKeyring, err := keyring.NewSystemKeyRing(conf.HostInfo.SystemKeyring, conf.HostInfo.SystemKeyringTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apikeyring.AddRung(keyring.RungSystem, systemKeyring)
+	}
 	err = apikeyring.Bootstrap()
 	if err != nil {
 		log.Fatal(err)
@@ -72,15 +106,34 @@ func main() {
 	// as this clients keyring. This allows the API key we added earlier to be used when calling the API
 	lnConn := linode.LinodeConnection{Client: &http.Client{}, Keyring: apikeyring, Config: conf, KeyTagger: keytags.ConstKeytag{}}
 	semaphoreConn := semaphore.NewSemaphoreClient(conf.Service.AnsibleBackendUrl, "https", apikeyring, conf, keytags.ConstKeytag{})
-	apikeyring.Rungs = append(apikeyring.Rungs, semaphoreConn)
+	apikeyring.AddRung(keyring.RungSemaphore, semaphoreConn)
 
 	ctx := daemon.NewContext(UNIX_DOMAIN_SOCK_PATH, os.Stdout, apikeyring, conf)
+	workflows, err := daemon.NewWorkflowEngine(ctx, conf)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	lnRouter := linode.NewLinodeRouter()
 	lnRouter.Register(daemonproto.ADD, lnConn.AddLinodeHandler)
 	lnRouter.Register(daemonproto.SHOW, lnConn.ShowLinodeHandler)
 	lnRouter.Register(daemonproto.DELETE, lnConn.DeleteLinodeHandler)
 	lnRouter.Register(daemonproto.POLL, lnConn.PollLinodeHandler)
+	lnRouter.Register(daemonproto.COST, lnConn.CostHandler)
+
+	lnFirewallRouter := linode.NewLinodeRouter()
+	lnFirewallRouter.Register(daemonproto.SHOW, lnConn.ShowFirewallsHandler)
+	lnFirewallRouter.Register(daemonproto.RELOAD, lnConn.SyncFirewallsHandler)
+	conf.OnReload(lnConn.FirewallReloadHook())
+
+	lnImageRouter := linode.NewLinodeRouter()
+	imageBuilder := linode.NewImageBuilder(lnConn)
+	lnImageRouter.Register(daemonproto.BUILD, imageBuilder.BuildImageHandler)
+	lnImageRouter.Register(daemonproto.STATUS, imageBuilder.ImageStatusHandler)
+	lnImageRouter.Register(daemonproto.SHOW, lnConn.ShowImageHandler)
+
+	lnTagRouter := linode.NewLinodeRouter()
+	lnTagRouter.Register(daemonproto.ADD, lnConn.TagLinodeHandler)
 
 	semHostsRouter := semaphore.NewSemaphoreRouter()
 	semHostsRouter.Register(daemonproto.ADD, semaphoreConn.AddHostHandler)
@@ -112,20 +165,99 @@ func main() {
 	configRouter.Register(daemonproto.SAVE, conf.SaveConfigHandler)
 	configRouter.Register(daemonproto.RELOAD, conf.ReloadConfigHandler)
 
+	keyRotator := keyring.NewKeyRotator(conf, apikeyring, keytags.ConstKeytag{})
+	conf.SetKeyGenerator(keyRotator.Generate)
+	keysRouter := keyring.NewKeyRingRouter()
+	keysRouter.Register(daemonproto.ROTATE, keyRotator.RotateKeyHandler)
+
 	keyringRouter := keyring.NewKeyRingRouter()
 	keyringRouter.Register(daemonproto.SHOW, apikeyring.ShowKeyringHandler)
 	keyringRouter.Register(daemonproto.BOOTSTRAP, apikeyring.BootstrapKeyringHandler)
 	keyringRouter.Register(daemonproto.RELOAD, apikeyring.ReloadKeyringHandler)
+	keyringRouter.Register(daemonproto.ADD, apikeyring.AddKeyHandler)
+	keyringRouter.Register(daemonproto.DELETE, apikeyring.DeleteKeyHandler)
+	keyringRouter.Register(daemonproto.ROTATE, apikeyring.RotateKeyHandler)
+	if localKeyring != nil {
+		keyringRouter.Register(daemonproto.IMPORT, localKeyring.ImportKeyringHandler)
+		keyringRouter.Register(daemonproto.EXPORT, localKeyring.ExportKeyringHandler)
+	}
 
 	vpnRouter := daemon.NewVpnRouter()
 	vpnRouter.Register(daemonproto.SHOW, ctx.VpnShowHandler)
 	vpnRouter.Register(daemonproto.SAVE, ctx.VpnSaveHandler)
 
+	reconciler := reconcile.Reconciler{Cloud: lnConn, Workflows: workflows, Config: conf}
+	if conf.Service.AnsibleBackendUrl != "" {
+		reconciler.Inventory = semaphoreConn
+	}
+	reconcileRouter := reconcile.NewReconcileRouter()
+	reconcileRouter.Register(daemonproto.SHOW, reconciler.ShowDriftHandler)
+	reconcileRouter.Register(daemonproto.RUN, reconciler.RepairDriftHandler)
+
+	wgManager := iface.NewManager(conf.Log)
+	if conf.Dns.Enabled {
+		wgManager.Resolver = iface.NewResolver(conf.Dns.Local)
+	}
+	var tunnel rotation.Tunnel = iface.ConfTunnel{Manager: wgManager}
+	if conf.HostInfo.TunnelDriver == config.TunnelDriverWgQuick {
+		tunnel = rotation.WgQuickTunnel{}
+	}
+	killSwitch := killswitch.NewKillSwitch(conf, killswitch.NftFirewall{})
+	tunnel = killswitch.Tunnel{Tunnel: tunnel, KillSwitch: killSwitch}
+	rotator, err := rotation.NewRotator(ctx, workflows, conf, tunnel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.KillSwitch.Enabled {
+		// the tunnel may still be up from before the daemon restarted
+		if active := rotator.Active(); active != "" {
+			if err := killSwitch.Allow(rotation.TunnelConf(conf, active)); err != nil {
+				conf.Log("Couldnt allow the tunnel in use through the kill switch: ", err.Error())
+			}
+		}
+		if err := killSwitch.Lock(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	conf.OnReload(rotator.Reschedule)
+	rotationRouter := rotation.NewRotationRouter()
+	rotationRouter.Register(daemonproto.SHOW, rotator.ShowRotationHandler)
+	rotationRouter.Register(daemonproto.RUN, rotator.RunRotationHandler)
+
+	monitor := health.NewMonitor(ctx, conf, rotator, tunnel)
+	healthRouter := health.NewHealthRouter()
+	healthRouter.Register(daemonproto.SHOW, monitor.ShowHealthHandler)
+	healthRouter.Register(daemonproto.RUN, monitor.RunHealthHandler)
+	// failover configs only include the servers that are passing their health checks
+	ctx.Healthy = monitor.Healthy
+	peerFailover := daemon.NewPeerFailover(conf, apikeyring, keytags.ConstKeytag{}, wgManager, rotator)
+
+	tunnelRouter := iface.NewInterfaceRouter()
+	tunnelRouter.Register(daemonproto.UP, rotator.TunnelUpHandler)
+	tunnelRouter.Register(daemonproto.DOWN, rotator.TunnelDownHandler)
+	tunnelRouter.Register(daemonproto.STATUS, wgManager.StatusHandler)
+	tunnelRouter.Register(daemonproto.LOCK, killSwitch.LockHandler)
+	tunnelRouter.Register(daemonproto.UNLOCK, killSwitch.UnlockHandler)
+
+	for _, wf := range daemon.ServerWorkflows() {
+		if err := workflows.Declare(wf); err != nil {
+			log.Fatal(err)
+		}
+	}
+	workflowRouter := daemon.NewWorkflowRouter()
+	workflowRouter.Register(daemonproto.RUN, workflows.RunWorkflowHandler)
+	workflowRouter.Register(daemonproto.SHOW, workflows.ShowWorkflowHandler)
+	workflowRouter.Register(daemonproto.RESUME, workflows.ResumeWorkflowHandler)
+
 	ctxRouter := daemon.NewContextRouter()
 	ctxRouter.Register(daemonproto.SHOW, ctx.ShowRoutesHandler)
 
 	ctx.Register("cloud", lnRouter)
+	ctx.Register("cloud-tag", lnTagRouter)
+	ctx.Register("cloud-firewall", lnFirewallRouter)
+	ctx.Register("cloud-image", lnImageRouter)
 	ctx.Register("keyring", keyringRouter)
+	ctx.Register("keys", keysRouter)
 	ctx.Register("config", configRouter)
 	ctx.Register("config-peer", configPeerRouter)
 	ctx.Register("config-server", configServerRouter)
@@ -134,6 +266,16 @@ func main() {
 	ctx.Register("ansible-projects", semProjRouter)
 	ctx.Register("ansible-task", semTaskRouter)
 	ctx.Register("vpn-config", vpnRouter)
+	ctx.Register("vpn", tunnelRouter)
+	ctx.Register("reconcile", reconcileRouter)
+	ctx.Register("rotation", rotationRouter)
+	ctx.Register("workflow", workflowRouter)
+	ctx.Register("health", healthRouter)
 	ctx.Register("routes", ctxRouter)
+	// the rotator calls the routes above, so it can only start once theyre all registered
+	go rotator.Run()
+	go monitor.Run()
+	go keyRotator.Run()
+	go peerFailover.Run()
 	ctx.ListenAndServe()
 }
@@ -0,0 +1,197 @@
+package cloudinit
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
+)
+
+const DefaultInterfaceName = "wg0"
+
+//go:embed user-data.templ
+var userDataTmpl string
+
+//go:embed image-build.templ
+var imageBuildTmpl string
+
+type CloudInitSeed struct {
+	InterfaceName          string
+	ServiceAccount         string
+	ServiceAccountPassword string
+	ServiceAccountPubkey   string
+	ServerVpnAddress       string
+	ServerVpnAddressV6     string // empty when the VPN has no IPv6 address space
+	ServerPort             int
+	VpnMask                int
+	VpnMaskV6              int
+	VpnNetwork             string
+	VpnNetworkV6           string
+	ServerConfig           string // the servers wireguard configuration, see wg.RenderServerConfiguration
+	GoldenImage            bool   // the server boots from a golden image that already has the packages installed
+	DnsResolver            bool   // run unbound on the servers VPN addresses for the clients
+	DnsUpstream            string
+	DnsUpstreamServers     []string
+}
+
+type ImageBuildSeed struct {
+	Message string // logged when the build server powers off
+}
+
+/*
+Build the seed data for a servers user-data document from the daemon configuration and keyring
+
+	:param conf: the daemon configuration, used for the VPN address space and the peer list
+	:param kr: a keyring.DaemonKeyRing implementer with the service account and wireguard keys
+	:param keytagger: a keytags.Keytagger implementer to resolve key names with
+	:param server: the VPN server that the document is being rendered for
+*/
+func NewCloudInitSeed(conf *config.Configuration, kr keyring.DaemonKeyRing, keytagger keytags.Keytagger, server config.VpnServer) (CloudInitSeed, error) {
+	var seed CloudInitSeed
+	svcAcc, err := kr.GetKey(keytagger.VpsSvcAccKeyname())
+	if err != nil {
+		return seed, &CloudInitError{Msg: "Couldnt get the service account credentials: " + err.Error()}
+	}
+	svcSshKey, err := kr.GetKey(keytagger.VpsSvcAccSshKeyname())
+	if err != nil {
+		return seed, &CloudInitError{Msg: "Couldnt get the service account ssh key: " + err.Error()}
+	}
+	if conf.ExitNodeResolver() && conf.DnsUpstream() == config.DnsUpstreamHttps {
+		return seed, &CloudInitError{Msg: "unbound cant forward over DNS over HTTPS, use the ansible bootstrap or a DNS over TLS upstream"}
+	}
+	wgSeed, err := wg.NewServerTemplateSeed(conf, kr, keytagger, server)
+	if err != nil {
+		return seed, &CloudInitError{Msg: err.Error()}
+	}
+	wgConf, err := wg.RenderServerConfiguration(wgSeed)
+	if err != nil {
+		return seed, &CloudInitError{Msg: err.Error()}
+	}
+	mask, _ := conf.Service.VpnAddressSpace.Mask.Size()
+	maskV6, _ := conf.Service.VpnAddressSpaceV6.Mask.Size()
+	return CloudInitSeed{
+		InterfaceName:          DefaultInterfaceName,
+		ServiceAccount:         svcAcc.GetPublic(),
+		ServiceAccountPassword: svcAcc.GetSecret(),
+		ServiceAccountPubkey:   svcSshKey.GetPublic(),
+		ServerVpnAddress:       server.VpnIpv4.String(),
+		ServerVpnAddressV6:     config.IpString(server.VpnIpv6),
+		ServerPort:             wgSeed.ListenPort,
+		ServerConfig:           string(wgConf),
+		VpnMask:                mask,
+		VpnMaskV6:              maskV6,
+		VpnNetwork:             fmt.Sprintf("%s/%v", conf.Service.VpnAddressSpace.IP.String(), mask),
+		VpnNetworkV6:           conf.VpnNetworkV6(),
+		DnsResolver:            conf.ExitNodeResolver(),
+		DnsUpstream:            conf.DnsUpstream(),
+		DnsUpstreamServers:     conf.Dns.UpstreamServers,
+	}, nil
+}
+
+/*
+Quote a string so that it is safe to place into the YAML document. JSON strings are valid YAML
+double quoted scalars, so the JSON encoder does the escaping for us
+
+	:param val: the value to quote
+*/
+func quote(val string) string {
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
+/*
+Indent every line of a block so that it can be placed into a YAML block scalar
+
+	    :param spaces: the number of spaces to indent each line by
+		:param val: the block to indent
+*/
+func indent(spaces int, val string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(strings.TrimRight(val, "\n"), "\n")
+	for i := range lines {
+		if lines[i] != "" {
+			lines[i] = pad + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+Render out a cloud-init user-data document that brings a server up as a fully configured VPN node
+
+	:param seed: a CloudInitSeed struct that contains all the info needed to populate the document
+*/
+func RenderUserData(seed CloudInitSeed) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	tmpl, err := template.New("user-data.templ").Funcs(template.FuncMap{"quote": quote, "indent": indent}).Parse(userDataTmpl)
+	if err != nil {
+		return buff.Bytes(), &CloudInitError{Msg: err.Error()}
+	}
+	err = tmpl.Execute(buff, seed)
+	if err != nil {
+		return buff.Bytes(), &CloudInitError{Msg: err.Error()}
+	}
+	return buff.Bytes(), nil
+}
+
+/*
+Render out a cloud-init user-data document for the server that a golden image is captured from. It installs
+everything a VPN node needs but no per-node secrets, resets the machine identity so that every server booted
+from the image is unique, then powers the server off so that its disk can be captured.
+
+	:param seed: an ImageBuildSeed struct that contains the info needed to populate the document
+*/
+func RenderImageBuildData(seed ImageBuildSeed) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	tmpl, err := template.New("image-build.templ").Funcs(template.FuncMap{"quote": quote}).Parse(imageBuildTmpl)
+	if err != nil {
+		return buff.Bytes(), &CloudInitError{Msg: err.Error()}
+	}
+	err = tmpl.Execute(buff, seed)
+	if err != nil {
+		return buff.Bytes(), &CloudInitError{Msg: err.Error()}
+	}
+	return buff.Bytes(), nil
+}
+
+/*
+Render the image build document and encode it the way that cloud provider metadata APIs expect it
+
+	:param seed: an ImageBuildSeed struct that contains the info needed to populate the document
+*/
+func EncodedImageBuildData(seed ImageBuildSeed) (string, error) {
+	b, err := RenderImageBuildData(seed)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+/*
+Render the user-data document and encode it the way that cloud provider metadata APIs expect it
+
+	:param seed: a CloudInitSeed struct that contains all the info needed to populate the document
+*/
+func EncodedUserData(seed CloudInitSeed) (string, error) {
+	b, err := RenderUserData(seed)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+type CloudInitError struct {
+	Msg string
+}
+
+func (c *CloudInitError) Error() string {
+	return "There was an error rendering the cloud-init user-data: " + c.Msg
+}
@@ -0,0 +1,153 @@
+package cloudinit
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
+	"gopkg.in/yaml.v3"
+)
+
+type userData struct {
+	Users    []interface{} `yaml:"users"`
+	Chpasswd struct {
+		Users []struct {
+			Name     string `yaml:"name"`
+			Password string `yaml:"password"`
+		} `yaml:"users"`
+	} `yaml:"chpasswd"`
+	Packages   []string `yaml:"packages"`
+	WriteFiles []struct {
+		Path        string `yaml:"path"`
+		Permissions string `yaml:"permissions"`
+		Content     string `yaml:"content"`
+	} `yaml:"write_files"`
+	Runcmd [][]string `yaml:"runcmd"`
+}
+
+func (u userData) file(path string) (string, bool) {
+	for i := range u.WriteFiles {
+		if u.WriteFiles[i].Path == path {
+			return u.WriteFiles[i].Content, true
+		}
+	}
+	return "", false
+}
+
+func newTestSeed(t *testing.T) (CloudInitSeed, string) {
+	conf := config.NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	_, spaceV6, _ := net.ParseCIDR("fd00::/64")
+	conf.Service.VpnAddressSpaceV6 = *spaceV6
+	conf.Service.VpnServerPort = 51820
+	conf.Dns.Enabled = true
+	conf.Dns.Upstream = config.DnsUpstreamTls
+	conf.Dns.UpstreamServers = []string{"1.1.1.1@853#cloudflare-dns.com"}
+	conf.AddClient(net.ParseIP("10.8.0.2"), "alicepub", "alice")
+	server := config.VpnServer{Name: "exit", VpnIpv4: net.ParseIP("10.8.0.1"), VpnIpv6: net.ParseIP("fd00::1"), Port: 51820, Options: config.TunnelOptions{MTU: 1380}}
+
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	kr.AddKey(keytags.ConstKeytag{}.VpsSvcAccKeyname(), keyring.BasicAuth{Username: "yosai", Password: "hunter2: \"quoted\""})
+	kr.AddKey(keytags.ConstKeytag{}.VpsSvcAccSshKeyname(), keyring.BearerAuth{Secret: "ssh-ed25519 AAAA"})
+	kr.AddKey(keyring.WireguardKeyname(keytags.ConstKeytag{}, "exit"), keyring.WireguardKeypair{PrivateKey: "serverpriv", PublicKey: "serverpub"})
+	seed, err := NewCloudInitSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgSeed, err := wg.ReadServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgConf, err := wg.RenderServerConfiguration(wgSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seed, string(wgConf)
+}
+
+func TestRenderUserData(t *testing.T) {
+	seed, wgConf := newTestSeed(t)
+	b, err := RenderUserData(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "#cloud-config\n") {
+		t.Errorf("expected the document to start with the cloud-config header:\n%s", b)
+	}
+	var doc userData
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("the user-data isnt valid YAML: %v\n%s", err, b)
+	}
+	if len(doc.Chpasswd.Users) != 1 || doc.Chpasswd.Users[0].Password != "hunter2: \"quoted\"" {
+		t.Errorf("expected the service account password to survive quoting, got: %+v", doc.Chpasswd)
+	}
+
+	// the wireguard configuration is embedded as a block scalar, so it has to come back out unchanged
+	content, ok := doc.file("/etc/wireguard/wg0.conf")
+	if !ok {
+		t.Fatalf("expected the wireguard configuration to be written:\n%s", b)
+	}
+	if content != wgConf {
+		t.Errorf("unexpected wireguard configuration:\n got: %q\nwant: %q", content, wgConf)
+	}
+	for _, line := range []string{"MTU = 1380\n", "AllowedIPs = 10.8.0.2/32, fd00::2/128\n"} {
+		if !strings.Contains(content, line) {
+			t.Errorf("expected %q in the wireguard configuration:\n%s", line, content)
+		}
+	}
+
+	unbound, ok := doc.file("/etc/unbound/unbound.conf.d/yosai.conf")
+	if !ok {
+		t.Fatalf("expected the resolver configuration to be written:\n%s", b)
+	}
+	for _, line := range []string{
+		"  interface: 10.8.0.1\n",
+		"  interface: fd00::1\n",
+		"  access-control: fd00::/64 allow\n",
+		"  forward-tls-upstream: yes\n",
+		"  forward-addr: 1.1.1.1@853#cloudflare-dns.com\n",
+	} {
+		if !strings.Contains(unbound, line) {
+			t.Errorf("expected %q in the resolver configuration:\n%s", line, unbound)
+		}
+	}
+	nft, _ := doc.file("/etc/nftables.conf")
+	if !strings.Contains(nft, "udp dport 51820 accept") || !strings.Contains(nft, "ip6 saddr fd00::/64") {
+		t.Errorf("unexpected firewall:\n%s", nft)
+	}
+	if !strings.Contains(strings.Join(doc.Packages, ","), "unbound") {
+		t.Errorf("expected unbound to be installed, got: %v", doc.Packages)
+	}
+	if got := doc.Runcmd[len(doc.Runcmd)-1]; strings.Join(got, " ") != "systemctl restart unbound" {
+		t.Errorf("expected the resolver to be restarted last, got: %v", got)
+	}
+}
+
+func TestRenderUserDataGoldenImage(t *testing.T) {
+	seed, _ := newTestSeed(t)
+	seed.GoldenImage = true
+	seed.DnsResolver = false
+	b, err := RenderUserData(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc userData
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("the user-data isnt valid YAML: %v\n%s", err, b)
+	}
+	if len(doc.Packages) != 0 {
+		t.Errorf("expected a golden image not to install packages, got: %v", doc.Packages)
+	}
+	if _, ok := doc.file("/etc/unbound/unbound.conf.d/yosai.conf"); ok {
+		t.Error("expected no resolver configuration without the resolver")
+	}
+	if _, ok := doc.file("/etc/wireguard/wg0.conf"); !ok {
+		t.Error("expected the wireguard configuration to be written")
+	}
+}
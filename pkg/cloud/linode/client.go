@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/cloudinit"
 	"git.aetherial.dev/aeth/yosai/pkg/config"
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
 	"git.aetherial.dev/aeth/yosai/pkg/keytags"
@@ -21,6 +24,15 @@ const LinodeImages = "images"
 const LinodeApiVers = "v4"
 const LinodeRegions = "regions"
 const LinodeTypes = "linode/types"
+const LinodePageSize = 500
+
+const (
+	DefaultMaxRetries   = 5
+	DefaultRetryBackoff = time.Second
+)
+
+// Prefix of the tag that marks a Linode as managed by yosai, followed by the owning username
+const YosaiTagPrefix = "yosai:"
 
 const (
 	DEFAULT_TYPE   = "g6-nanode-1"
@@ -32,13 +44,49 @@ type GetAllLinodes struct {
 	Data []GetLinodeResponse `json:"data"`
 }
 
+// the envelope that Linode wraps every list endpoint in
+type paginatedResponse struct {
+	Data    []json.RawMessage `json:"data"`
+	Page    int               `json:"page"`
+	Pages   int               `json:"pages"`
+	Results int               `json:"results"`
+}
+
 type GetLinodeResponse struct {
 	Id      int      `json:"id"`
 	Ipv4    []string `json:"ipv4"`
+	Ipv6    string   `json:"ipv6"` // the SLAAC address in CIDR notation, i.e. '2600:3c03::f03c:91ff:fe24:3a2f/128'
 	Label   string   `json:"label"`
 	Created string   `json:"created"`
 	Region  string   `json:"region"`
 	Status  string   `json:"status"`
+	Tags    []string `json:"tags"`
+}
+
+/*
+Get the public IPv6 address of the linode without the prefix length, or an empty string if it doesnt have one
+*/
+func (g GetLinodeResponse) WanIpv6() string {
+	addr, _, _ := strings.Cut(g.Ipv6, "/")
+	return addr
+}
+
+/*
+Check if the linode has been tagged with a tag
+
+	:param tag: the tag to look for
+*/
+func (g GetLinodeResponse) HasTag(tag string) bool {
+	for i := range g.Tags {
+		if g.Tags[i] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateLinodeTagsBody struct {
+	Tags []string `json:"tags"`
 }
 
 type TypesResponse struct {
@@ -46,7 +94,14 @@ type TypesResponse struct {
 }
 
 type TypesResponseInner struct {
-	Id string `json:"id"`
+	Id    string     `json:"id"`
+	Label string     `json:"label"`
+	Price TypesPrice `json:"price"`
+}
+
+type TypesPrice struct {
+	Hourly  float64 `json:"hourly"`
+	Monthly float64 `json:"monthly"`
 }
 
 type ImagesResponse struct {
@@ -66,20 +121,31 @@ type RegionResponseInner struct {
 }
 
 type NewLinodeBody struct {
-	Label          string   `json:"label"`
-	AuthorizedKeys []string `json:"authorized_keys"`
-	Booted         bool     `json:"booted"`
-	Image          string   `json:"image"`
-	RootPass       string   `json:"root_pass"`
-	Region         string   `json:"region"`
-	Type           string   `json:"type"`
+	Label          string          `json:"label"`
+	AuthorizedKeys []string        `json:"authorized_keys"`
+	Booted         bool            `json:"booted"`
+	Image          string          `json:"image"`
+	RootPass       string          `json:"root_pass"`
+	Region         string          `json:"region"`
+	Type           string          `json:"type"`
+	Tags           []string        `json:"tags,omitempty"`
+	Metadata       *LinodeMetadata `json:"metadata,omitempty"`
+	FirewallId     int             `json:"firewall_id,omitempty"`
+}
+
+type LinodeMetadata struct {
+	UserData string `json:"user_data"` // base64 encoded cloud-init user-data
 }
 
 type LinodeConnection struct {
-	Client    *http.Client
-	Keyring   keyring.DaemonKeyRing
-	KeyTagger keytags.Keytagger
-	Config    *config.Configuration
+	Client       *http.Client
+	Keyring      keyring.DaemonKeyRing
+	KeyTagger    keytags.Keytagger
+	Config       *config.Configuration
+	BaseUrl      string        // Overrides the default 'https://api.linode.com/v4' base URL when set
+	MaxRetries   int           // How many times a retryable call is attempted again, DefaultMaxRetries when unset
+	RetryBackoff time.Duration // The initial backoff between retries, doubled on every attempt. DefaultRetryBackoff when unset
+	PollInterval time.Duration // How long to wait between status checks on long running jobs, DefaultPollInterval when unset
 }
 
 // Logging wrapper
@@ -89,6 +155,13 @@ func (ln LinodeConnection) Log(msg ...string) {
 	ln.Config.Log(lnMsg...)
 }
 
+/*
+Return the tag that yosai puts on every server it creates for the configured user
+*/
+func (ln LinodeConnection) OwnerTag() string {
+	return YosaiTagPrefix + string(ln.Config.Username)
+}
+
 // Construct a NewLinodeBody struct for a CreateNewLinode call
 func NewLinodeBodyBuilder(image string, region string, linodeType string, label string, keyring keyring.DaemonKeyRing) (NewLinodeBody, error) {
 	var newLnBody NewLinodeBody
@@ -117,7 +190,7 @@ Get all regions that a server can be deployed in from Linode
 */
 func (ln LinodeConnection) GetRegions() (RegionsResponse, error) {
 	var regions RegionsResponse
-	b, err := ln.Get(LinodeRegions)
+	b, err := ln.GetAll(LinodeRegions)
 	if err != nil {
 		return regions, err
 	}
@@ -136,7 +209,7 @@ Get all of the available image types from linode
 */
 func (ln LinodeConnection) GetImages() (ImagesResponse, error) {
 	var imgResp ImagesResponse
-	b, err := ln.Get(LinodeImages)
+	b, err := ln.GetAll(LinodeImages)
 	if err != nil {
 		return imgResp, err
 	}
@@ -156,7 +229,7 @@ Get all of the available Linode types from linode
 */
 func (ln LinodeConnection) GetTypes() (TypesResponse, error) {
 	var typesResp TypesResponse
-	b, err := ln.Get(LinodeTypes)
+	b, err := ln.GetAll(LinodeTypes)
 	if err != nil {
 		return typesResp, err
 	}
@@ -169,6 +242,24 @@ func (ln LinodeConnection) GetTypes() (TypesResponse, error) {
 
 }
 
+/*
+Get a single Linode type, including its pricing
+
+	:param id: the ID of the type, i.e. 'g6-nanode-1'
+*/
+func (ln LinodeConnection) GetType(id string) (TypesResponseInner, error) {
+	var typeResp TypesResponseInner
+	b, err := ln.Get(fmt.Sprintf("%s/%s", LinodeTypes, id))
+	if err != nil {
+		return typeResp, err
+	}
+	err = json.Unmarshal(b, &typeResp)
+	if err != nil {
+		return typeResp, &LinodeClientError{Msg: err.Error()}
+	}
+	return typeResp, nil
+}
+
 /*
 Get a Linode by its ID, used for assertion when deleting an old linode
 */
@@ -192,7 +283,7 @@ List all linodes on your account
 */
 func (ln LinodeConnection) ListLinodes() (GetAllLinodes, error) {
 	var allLinodes GetAllLinodes
-	b, err := ln.Get(LinodeInstances)
+	b, err := ln.GetAll(LinodeInstances)
 	if err != nil {
 		return allLinodes, err
 	}
@@ -204,18 +295,69 @@ func (ln LinodeConnection) ListLinodes() (GetAllLinodes, error) {
 }
 
 /*
-Get linode by IP Address
+List the linodes on your account that are tagged as being managed by yosai for the configured user
+*/
+func (ln LinodeConnection) ListOwnedLinodes() (GetAllLinodes, error) {
+	owned := GetAllLinodes{Data: []GetLinodeResponse{}}
+	allLinodes, err := ln.ListLinodes()
+	if err != nil {
+		return owned, err
+	}
+	tag := ln.OwnerTag()
+	for i := range allLinodes.Data {
+		if allLinodes.Data[i].HasTag(tag) {
+			owned.Data = append(owned.Data, allLinodes.Data[i])
+		}
+	}
+	return owned, nil
+}
 
-	:param addr: the IPv4 address of your linode
+/*
+Add the yosai ownership tag to an existing linode, keeping any tags it already has
+
+	:param id: the id of the linode
+*/
+func (ln LinodeConnection) TagLinode(id string) (GetLinodeResponse, error) {
+	server, err := ln.GetLinode(id)
+	if err != nil {
+		return server, err
+	}
+	if server.HasTag(ln.OwnerTag()) {
+		return server, nil
+	}
+	body, err := json.Marshal(UpdateLinodeTagsBody{Tags: append(server.Tags, ln.OwnerTag())})
+	if err != nil {
+		return server, &LinodeClientError{Msg: err.Error()}
+	}
+	b, err := ln.Put(fmt.Sprintf("%s/%s", LinodeInstances, id), body)
+	if err != nil {
+		return server, err
+	}
+	err = json.Unmarshal(b, &server)
+	if err != nil {
+		return server, &LinodeClientError{Msg: err.Error()}
+	}
+	return server, nil
+}
+
+/*
+Get linode by IP Address. Only linodes tagged as owned by yosai are searched
+
+	:param addr: the public IPv4 or IPv6 address of your linode
 */
 func (ln LinodeConnection) GetByIp(addr string) (GetLinodeResponse, error) {
 	var out GetLinodeResponse
-	servers, err := ln.ListLinodes()
+	servers, err := ln.ListOwnedLinodes()
 	if err != nil {
 		return out, err
 	}
 	for i := range servers.Data {
-		if servers.Data[i].Ipv4[0] == addr {
+		for j := range servers.Data[i].Ipv4 {
+			if servers.Data[i].Ipv4[j] == addr {
+				return servers.Data[i], nil
+			}
+		}
+		if wan6 := servers.Data[i].WanIpv6(); wan6 != "" && net.ParseIP(wan6).Equal(net.ParseIP(addr)) {
 			return servers.Data[i], nil
 		}
 	}
@@ -224,23 +366,39 @@ func (ln LinodeConnection) GetByIp(addr string) (GetLinodeResponse, error) {
 }
 
 /*
-Get a linode by its name/label
+Get a linode by its name/label. Only linodes tagged as owned by yosai are searched
 
 	:param name: the name/label of the linode
 */
 func (ln LinodeConnection) GetByName(name string) (GetLinodeResponse, error) {
-	var out GetLinodeResponse
+	servers, err := ln.ListOwnedLinodes()
+	if err != nil {
+		return GetLinodeResponse{}, err
+	}
+	return findByName(servers, name)
+
+}
+
+/*
+Get a linode by its name/label, regardless of whether it is owned by yosai or not
+
+	:param name: the name/label of the linode
+*/
+func (ln LinodeConnection) GetAnyByName(name string) (GetLinodeResponse, error) {
 	servers, err := ln.ListLinodes()
 	if err != nil {
-		return out, err
+		return GetLinodeResponse{}, err
 	}
+	return findByName(servers, name)
+}
+
+func findByName(servers GetAllLinodes, name string) (GetLinodeResponse, error) {
 	for i := range servers.Data {
 		if servers.Data[i].Label == name {
 			return servers.Data[i], nil
 		}
 	}
-	return out, &LinodeClientError{Msg: "Linode with name: " + name + " not found."}
-
+	return GetLinodeResponse{}, &LinodeClientError{Msg: "Linode with name: " + name + " not found."}
 }
 
 /*
@@ -255,25 +413,10 @@ func (ln LinodeConnection) CreateNewLinode(body NewLinodeBody) (GetLinodeRespons
 	if err != nil {
 		return newLnResp, err
 	}
-	apiKey, err := ln.Keyring.GetKey(ln.KeyTagger.LinodeApiKeyname())
-	if err != nil {
-		return newLnResp, &LinodeClientError{Msg: err.Error()}
-	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/%s/%s", LinodeApiUrl, LinodeApiVers, LinodeInstances), bytes.NewReader(reqBody))
-	req.Header.Add("Authorization", apiKey.Prepare())
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := ln.Client.Do(req)
+	b, err := ln.Post(LinodeInstances, reqBody)
 	if err != nil {
 		return newLnResp, err
 	}
-	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return newLnResp, &LinodeClientError{Msg: err.Error()}
-	}
-	if resp.StatusCode != 200 {
-		return newLnResp, &LinodeClientError{Msg: resp.Status + "\n" + string(b)}
-	}
 	err = json.Unmarshal(b, &newLnResp)
 	if err != nil {
 		return newLnResp, &LinodeClientError{Msg: err.Error()}
@@ -290,11 +433,11 @@ Delete a linode instance. Internally, this function will check that the linode I
 func (ln LinodeConnection) DeleteLinode(id string) error {
 	_, err := ln.GetLinode(id)
 	if err != nil {
-		return &LinodeClientError{Msg: err.Error()}
+		return err
 	}
 	_, err = ln.Delete(fmt.Sprintf("%s/%s", LinodeInstances, id))
 	if err != nil {
-		return &LinodeClientError{Msg: err.Error()}
+		return err
 	}
 	return nil
 }
@@ -302,61 +445,176 @@ func (ln LinodeConnection) DeleteLinode(id string) error {
 /*
 Agnostic GET method for calling the upstream linode server
 
-	:param keyring: a keyring.DaemonKeyRing implementer to get the linode API key from
 	:param path: the path to GET, added into the base API url
 */
 func (ln LinodeConnection) Get(path string) ([]byte, error) {
-	var b []byte
-	apiKey, err := ln.Keyring.GetKey(ln.KeyTagger.LinodeApiKeyname())
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
-	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/%s", LinodeApiUrl, LinodeApiVers, strings.TrimPrefix(path, "/")), nil)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
-	}
-	req.Header.Add("Authorization", apiKey.Prepare())
-	resp, err := ln.Client.Do(req)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
+	return ln.request(http.MethodGet, path, nil)
+}
+
+/*
+GET every page of a paginated Linode collection, returning a single payload shaped like
+the first page with the 'data' field holding the items from all of the pages
+
+	:param path: the path of the collection to GET, added into the base API url
+*/
+func (ln LinodeConnection) GetAll(path string) ([]byte, error) {
+	var all paginatedResponse
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
 	}
-	defer resp.Body.Close()
-	b, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
+	page := 1
+	for {
+		b, err := ln.Get(fmt.Sprintf("%s%spage=%v&page_size=%v", path, sep, page, LinodePageSize))
+		if err != nil {
+			return nil, err
+		}
+		var current paginatedResponse
+		err = json.Unmarshal(b, &current)
+		if err != nil {
+			return nil, &LinodeClientError{Msg: err.Error()}
+		}
+		all.Data = append(all.Data, current.Data...)
+		all.Results = current.Results
+		all.Pages = current.Pages
+		if current.Page >= current.Pages {
+			break
+		}
+		page = current.Page + 1
 	}
-	return b, nil
+	all.Page = 1
+	return json.Marshal(all)
+}
+
+/*
+Agnostic POST method for creating a resource on Linode. POST calls are not idempotent, so
+they are only retried when Linode rate limits the request before processing it
+
+	:param path: the path to POST to, added into the base API url
+	:param body: the JSON encoded request body
+*/
+func (ln LinodeConnection) Post(path string, body []byte) ([]byte, error) {
+	return ln.request(http.MethodPost, path, body)
+}
 
+/*
+Agnostic PUT method for updating a resource on Linode
+
+	:param path: the path to PUT to, added into the base API url
+	:param body: the JSON encoded request body
+*/
+func (ln LinodeConnection) Put(path string, body []byte) ([]byte, error) {
+	return ln.request(http.MethodPut, path, body)
 }
 
 /*
 Agnostic DELETE method for deleting a resource from Linode
 
-	:param keyring: a keyring.DaemonKeyRing implementer for getting the linode API key
 	:param path: the path to perform the DELETE method on
 */
 func (ln LinodeConnection) Delete(path string) ([]byte, error) {
+	return ln.request(http.MethodDelete, path, nil)
+}
+
+/*
+Send a request to the Linode API, retrying on rate limiting and, for idempotent methods, on
+server errors and transport failures. Non-2XX responses are returned as a *LinodeApiError
+
+	:param method: the HTTP method to use
+	:param path: the path of the resource, added into the base API url
+	:param body: the request body, nil for methods without one
+*/
+func (ln LinodeConnection) request(method string, path string, body []byte) ([]byte, error) {
 	var b []byte
 	apiKey, err := ln.Keyring.GetKey(ln.KeyTagger.LinodeApiKeyname())
 	if err != nil {
 		return b, &LinodeClientError{Msg: err.Error()}
 	}
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("https://%s/%s/%s", LinodeApiUrl, LinodeApiVers, strings.TrimPrefix(path, "/")), nil)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
+	maxRetries := ln.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultMaxRetries
 	}
-	req.Header.Add("Authorization", apiKey.Prepare())
-	resp, err := ln.Client.Do(req)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
+	backoff := ln.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
 	}
-	defer resp.Body.Close()
-	b, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return b, &LinodeClientError{Msg: err.Error()}
+	idempotent := method != http.MethodPost
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, ln.url(path), bytes.NewReader(body))
+		if err != nil {
+			return b, &LinodeClientError{Msg: err.Error()}
+		}
+		req.Header.Add("Authorization", apiKey.Prepare())
+		if body != nil {
+			req.Header.Add("Content-Type", "application/json")
+		}
+		resp, err := ln.Client.Do(req)
+		if err != nil {
+			if idempotent && attempt < maxRetries {
+				ln.Log(method, path, "failed, retrying. Error:", err.Error())
+				time.Sleep(backoff << attempt)
+				continue
+			}
+			return b, &LinodeClientError{Msg: err.Error()}
+		}
+		b, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return b, &LinodeClientError{Msg: err.Error()}
+		}
+		if resp.StatusCode < 300 {
+			return b, nil
+		}
+		apiErr := newLinodeApiError(resp, b)
+		if attempt < maxRetries {
+			if resp.StatusCode == http.StatusTooManyRequests {
+				wait := retryAfter(resp.Header.Get("Retry-After"), backoff<<attempt)
+				ln.Log(method, path, "was rate limited, retrying in:", wait.String())
+				time.Sleep(wait)
+				continue
+			}
+			if idempotent && resp.StatusCode >= 500 {
+				ln.Log(method, path, "returned:", resp.Status, "retrying.")
+				time.Sleep(backoff << attempt)
+				continue
+			}
+		}
+		return b, apiErr
 	}
-	return b, nil
+}
+
+/*
+Build the full URL for a path on the Linode API
 
+	:param path: the path of the resource, leading slashes are trimmed
+*/
+func (ln LinodeConnection) url(path string) string {
+	base := ln.BaseUrl
+	if base == "" {
+		base = fmt.Sprintf("https://%s/%s", LinodeApiUrl, LinodeApiVers)
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(base, "/"), strings.TrimPrefix(path, "/"))
+}
+
+/*
+Parse the value of a Retry-After header, which can either be a number of seconds or an HTTP date
+
+	:param val: the value of the header
+	:param fallback: the duration to use when the header is missing or malformed
+*/
+func retryAfter(val string, fallback time.Duration) time.Duration {
+	if val == "" {
+		return fallback
+	}
+	secs, err := strconv.Atoi(val)
+	if err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	at, err := http.ParseTime(val)
+	if err == nil {
+		return time.Until(at)
+	}
+	return fallback
 }
 
 /*
@@ -400,8 +658,13 @@ func (ln LinodeConnection) Bootstrap() error { return nil }
 */
 
 type DeleteLinodeRequest struct {
+	Name  string `json:"name"`
+	Id    string `json:"id"`
+	Force bool   `json:"force"` // allow deleting a linode that isnt tagged as owned by yosai
+}
+
+type TagLinodeRequest struct {
 	Name string `json:"name"`
-	Id   string `json:"id"`
 }
 
 type AddLinodeRequest struct {
@@ -422,15 +685,33 @@ func (ln LinodeConnection) DeleteLinodeHandler(msg daemonproto.SockMessage) daem
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
 
-	resp, err := ln.GetByName(req.Name)
+	resp, err := ln.GetAnyByName(req.Name)
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
+	if !resp.HasTag(ln.OwnerTag()) && !req.Force {
+		ln.Log("Refusing to delete linode: ", resp.Label, " as it is not tagged with: ", ln.OwnerTag())
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_UNAUTHORIZED,
+			[]byte("Server: "+resp.Label+" is not tagged with: "+ln.OwnerTag()+", pass force to delete it anyway."))
+	}
 
+	fws, err := ln.GetLinodeFirewalls(resp.Id)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
 	err = ln.DeleteLinode(fmt.Sprint(resp.Id))
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_ACCEPTED, []byte(err.Error()))
 	}
+	err = ln.Config.RecordServerDeleted(resp.Id, time.Now().UTC())
+	if err != nil {
+		ln.Log(err.Error())
+	}
+	err = ln.DeleteOwnedFirewalls(fws)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED,
+			[]byte("Server: "+fmt.Sprint(resp.Id)+" was deleted, but its firewall couldnt be removed: "+err.Error()))
+	}
 	responseMessage := []byte("Server: " + fmt.Sprint(resp.Id) + " was deleted.")
 	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, responseMessage)
 
@@ -456,18 +737,97 @@ func (ln LinodeConnection) AddLinodeHandler(msg daemonproto.SockMessage) daemonp
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	resp, err := ln.CreateNewLinode(newLinodeReq)
+	newLinodeReq.Tags = []string{ln.OwnerTag()}
+	linodeType, err := ln.GetType(payload.Type)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	err = ln.Config.CheckBudget(linodeType.Price.Hourly, linodeType.Price.Monthly, time.Now().UTC())
+	if err != nil {
+		ln.Log("Refusing to create server: ", payload.Name, err.Error())
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	// the firewall is created first so that the server is never reachable without it
+	fw, err := ln.CreateFirewall(payload.Name)
+	if err != nil {
+		ln.Log("There was an error creating the firewall for server: ", payload.Name, err.Error())
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	newLinodeReq.FirewallId = fw.Id
+	var resp GetLinodeResponse
+	if ln.Config.UsesCloudInit() {
+		resp, err = ln.createWithCloudInit(payload.Name, newLinodeReq)
+	} else {
+		resp, err = ln.CreateNewLinode(newLinodeReq)
+	}
 	if err != nil {
 		ln.Log("There was an error creating server: ", payload.Name, err.Error())
+		if fwErr := ln.DeleteFirewall(fw.Id); fwErr != nil {
+			ln.Log("Failed to clean up the firewall: ", fw.Label, fwErr.Error())
+		}
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
 	ln.Log("Server: ", payload.Name, " Created successfully.")
+	ln.Config.RecordServerCreated(config.ServerUsage{
+		Username:     ln.Config.Username,
+		Name:         resp.Label,
+		Id:           resp.Id,
+		Type:         linodeType.Id,
+		HourlyPrice:  linodeType.Price.Hourly,
+		MonthlyPrice: linodeType.Price.Monthly,
+		Created:      parseLinodeTime(resp.Created),
+	})
 
 	b, _ := json.Marshal(resp)
 	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
 
 }
 
+/*
+Create a linode that configures itself on first boot. The servers VPN address has to be known before
+the user-data can be rendered, so it is reserved up front and the server is added to the configuration
+once the linode exists.
+
+	:param name: the name of the server
+	:param body: the request body for the new linode, the metadata is set on it here
+*/
+func (ln LinodeConnection) createWithCloudInit(name string, body NewLinodeBody) (GetLinodeResponse, error) {
+	var resp GetLinodeResponse
+	addr, err := ln.Config.GetAvailableVpnIpv4()
+	if err != nil {
+		return resp, err
+	}
+	server := config.VpnServer{Name: name, VpnIpv4: addr, Port: ln.Config.Service.VpnServerPort, Options: ln.Config.Service.ServerOptions}
+	seed, err := cloudinit.NewCloudInitSeed(ln.Config, ln.Keyring, ln.KeyTagger, server)
+	if err != nil {
+		ln.Config.FreeAddress(addr.String())
+		return resp, err
+	}
+	golden := ln.Config.GoldenImage()
+	seed.GoldenImage = golden != "" && body.Image == golden
+	userData, err := cloudinit.EncodedUserData(seed)
+	if err != nil {
+		ln.Config.FreeAddress(addr.String())
+		return resp, err
+	}
+	body.Metadata = &LinodeMetadata{UserData: userData}
+	resp, err = ln.CreateNewLinode(body)
+	if err != nil {
+		ln.Config.FreeAddress(addr.String())
+		return resp, err
+	}
+	if len(resp.Ipv4) == 0 {
+		// the server cant be added to the configuration without an address, so it isnt kept
+		ln.Config.FreeAddress(addr.String())
+		if err := ln.DeleteLinode(fmt.Sprint(resp.Id)); err != nil {
+			ln.Log("Failed to delete the server: ", name, " that came up without an IPv4 address: ", err.Error())
+		}
+		return resp, &LinodeClientError{Msg: "The server: " + name + " was created without an IPv4 address."}
+	}
+	ln.Config.AddServer(addr, name, resp.Ipv4[0], resp.WanIpv6(), server.Port)
+	return resp, nil
+}
+
 /*
 Wraps the polling feature of the client in a Handler function
 
@@ -494,7 +854,7 @@ Wraps the show servers functionality in a the correct Route interface
 	:param msg: a daemonproto.SockMessage that contains a request
 */
 func (ln LinodeConnection) ShowLinodeHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
-	servers, err := ln.ListLinodes()
+	servers, err := ln.ListOwnedLinodes()
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
@@ -503,6 +863,54 @@ func (ln LinodeConnection) ShowLinodeHandler(msg daemonproto.SockMessage) daemon
 
 }
 
+/*
+Wraps the tagging of an existing linode so that it can be managed by yosai
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (ln LinodeConnection) TagLinodeHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req TagLinodeRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	server, err := ln.GetAnyByName(req.Name)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	_, err = ln.TagLinode(fmt.Sprint(server.Id))
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Server: "+server.Label+" tagged with: "+ln.OwnerTag()))
+}
+
+/*
+Wraps the month to date cost report in a route friendly interface
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (ln LinodeConnection) CostHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	b, err := json.MarshalIndent(ln.Config.MonthToDateCost(time.Now().UTC()), "", "    ")
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Parse a timestamp returned from the Linode API, falling back to the current time if it cant be parsed
+
+	:param val: the timestamp from Linode, which is in UTC without a zone designator
+*/
+func parseLinodeTime(val string) time.Time {
+	t, err := time.Parse("2006-01-02T15:04:05", val)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return t
+}
+
 type LinodeRouter struct {
 	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
 }
@@ -532,6 +940,39 @@ func (ln *LinodeClientError) Error() string {
 	return fmt.Sprintf("There was an error calling linode: '%s'", ln.Msg)
 }
 
+type LinodeApiErrorReason struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Returned when the Linode API responds with a non-2XX status code
+type LinodeApiError struct {
+	StatusCode int
+	Status     string
+	Errors     []LinodeApiErrorReason `json:"errors"`
+}
+
+func newLinodeApiError(resp *http.Response, body []byte) *LinodeApiError {
+	apiErr := &LinodeApiError{StatusCode: resp.StatusCode, Status: resp.Status}
+	json.Unmarshal(body, apiErr)
+	if len(apiErr.Errors) == 0 && len(body) > 0 {
+		apiErr.Errors = []LinodeApiErrorReason{{Reason: string(body)}}
+	}
+	return apiErr
+}
+
+func (ln *LinodeApiError) Error() string {
+	reasons := []string{}
+	for i := range ln.Errors {
+		if ln.Errors[i].Field != "" {
+			reasons = append(reasons, ln.Errors[i].Field+": "+ln.Errors[i].Reason)
+			continue
+		}
+		reasons = append(reasons, ln.Errors[i].Reason)
+	}
+	return fmt.Sprintf("Linode API returned: '%s' Reasons: %v", ln.Status, reasons)
+}
+
 type LinodeTimeOutError struct {
 	Tries int
 }
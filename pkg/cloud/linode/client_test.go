@@ -1 +1,600 @@
 package linode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+const testApiKey = "test-linode-key"
+
+func newTestConnection(t *testing.T, handler http.HandlerFunc) LinodeConnection {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testApiKey {
+			t.Errorf("unexpected Authorization header: %q", r.Header.Get("Authorization"))
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	conf := config.NewConfiguration(io.Discard, "test")
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	kr.AddKey(keytags.LINODE_API_KEYNAME, keyring.BearerAuth{Secret: testApiKey})
+	return LinodeConnection{
+		Client:       srv.Client(),
+		Keyring:      kr,
+		KeyTagger:    keytags.ConstKeytag{},
+		Config:       conf,
+		BaseUrl:      srv.URL,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	}
+}
+
+func writePage(w http.ResponseWriter, page int, pages int, data ...interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data":    data,
+		"page":    page,
+		"pages":   pages,
+		"results": len(data) * pages,
+	})
+}
+
+func TestListLinodesFollowsPages(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+LinodeInstances {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("page_size") != strconv.Itoa(LinodePageSize) {
+			t.Errorf("unexpected page_size: %s", r.URL.Query().Get("page_size"))
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		writePage(w, page, 3, GetLinodeResponse{Id: page, Label: fmt.Sprintf("server-%v", page)})
+	})
+	resp, err := ln.ListLinodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 3 {
+		t.Fatalf("expected 3 linodes across all pages, got %v", len(resp.Data))
+	}
+	for i := range resp.Data {
+		if resp.Data[i].Id != i+1 {
+			t.Errorf("expected linode %v at index %v, got %v", i+1, i, resp.Data[i].Id)
+		}
+	}
+}
+
+func TestGetRegionsSinglePage(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writePage(w, 1, 1, RegionResponseInner{Id: "us-east"}, RegionResponseInner{Id: "us-west"})
+	})
+	resp, err := ln.GetRegions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 {
+		t.Errorf("expected 2 regions, got %v", len(resp.Data))
+	}
+	if calls != 1 {
+		t.Errorf("expected a single call for a single page, got %v", calls)
+	}
+}
+
+func TestGetRetriesRateLimit(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(GetLinodeResponse{Id: 1234, Status: "running"})
+	})
+	resp, err := ln.GetLinode("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != 1234 {
+		t.Errorf("unexpected linode: %+v", resp)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %v", calls)
+	}
+}
+
+func TestGetRetriesServerError(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(GetLinodeResponse{Id: 1})
+	})
+	_, err := ln.GetLinode("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %v", calls)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	_, err := ln.Get(LinodeInstances + "/1")
+	var apiErr *LinodeApiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a *LinodeApiError, got %T: %v", err, err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("unexpected status code: %v", apiErr.StatusCode)
+	}
+	if calls != int32(ln.MaxRetries+1) {
+		t.Errorf("expected %v calls, got %v", ln.MaxRetries+1, calls)
+	}
+}
+
+func TestPostNotRetriedOnServerError(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	_, err := ln.CreateNewLinode(NewLinodeBody{Label: "test"})
+	if err == nil {
+		t.Fatal("expected an error creating the linode")
+	}
+	if calls != 1 {
+		t.Errorf("POST should not be retried on a server error, got %v calls", calls)
+	}
+}
+
+func TestPostRetriedOnRateLimit(t *testing.T) {
+	var calls int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected Content-Type: %s", r.Header.Get("Content-Type"))
+		}
+		var body NewLinodeBody
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(GetLinodeResponse{Id: 1, Label: body.Label})
+	})
+	resp, err := ln.CreateNewLinode(NewLinodeBody{Label: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Label != "test" {
+		t.Errorf("request body was not resent on retry, got label: %q", resp.Label)
+	}
+}
+
+func TestApiErrorBody(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors": [{"field": "region", "reason": "region is not valid"}]}`))
+	})
+	_, err := ln.CreateNewLinode(NewLinodeBody{Region: "nowhere"})
+	var apiErr *LinodeApiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a *LinodeApiError, got %T: %v", err, err)
+	}
+	if len(apiErr.Errors) != 1 || apiErr.Errors[0].Field != "region" || apiErr.Errors[0].Reason != "region is not valid" {
+		t.Errorf("unexpected errors parsed from the body: %+v", apiErr.Errors)
+	}
+}
+
+func TestDeleteLinodeChecksStatus(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 1})
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": [{"reason": "Unauthorized"}]}`))
+		}
+	})
+	err := ln.DeleteLinode("1")
+	var apiErr *LinodeApiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a *LinodeApiError, got %T: %v", err, err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status code: %v", apiErr.StatusCode)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("2", time.Millisecond); d != 2*time.Second {
+		t.Errorf("expected 2s, got %v", d)
+	}
+	if d := retryAfter("", time.Millisecond); d != time.Millisecond {
+		t.Errorf("expected the fallback, got %v", d)
+	}
+	if d := retryAfter("garbage", time.Millisecond); d != time.Millisecond {
+		t.Errorf("expected the fallback, got %v", d)
+	}
+}
+
+func TestListOwnedLinodes(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		writePage(w, 1, 1,
+			GetLinodeResponse{Id: 1, Label: "vpn", Tags: []string{YosaiTagPrefix + "test"}},
+			GetLinodeResponse{Id: 2, Label: "database"},
+			GetLinodeResponse{Id: 3, Label: "other-user", Tags: []string{YosaiTagPrefix + "someone-else"}})
+	})
+	owned, err := ln.ListOwnedLinodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned.Data) != 1 || owned.Data[0].Id != 1 {
+		t.Errorf("expected only the linode tagged for the test user, got %+v", owned.Data)
+	}
+	_, err = ln.GetByName("database")
+	if err == nil {
+		t.Error("GetByName should not find untagged linodes")
+	}
+}
+
+func TestDeleteLinodeHandlerRefusesUntagged(t *testing.T) {
+	var deleted int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			atomic.AddInt32(&deleted, 1)
+		case r.URL.Path == "/"+LinodeInstances:
+			writePage(w, 1, 1, GetLinodeResponse{Id: 2, Label: "database"})
+		default:
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 2, Label: "database"})
+		}
+	})
+	body, _ := json.Marshal(DeleteLinodeRequest{Name: "database"})
+	resp := ln.DeleteLinodeHandler(daemonproto.SockMessage{Body: body})
+	if resp.StatusCode != daemonproto.REQUEST_UNAUTHORIZED {
+		t.Errorf("expected the delete to be refused, got status: %v body: %s", resp.StatusCode, resp.Body)
+	}
+	if deleted != 0 {
+		t.Fatal("untagged linode was deleted")
+	}
+	body, _ = json.Marshal(DeleteLinodeRequest{Name: "database", Force: true})
+	resp = ln.DeleteLinodeHandler(daemonproto.SockMessage{Body: body})
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		t.Errorf("expected a forced delete to succeed, got status: %v body: %s", resp.StatusCode, resp.Body)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 delete call, got %v", deleted)
+	}
+}
+
+func TestAddLinodeHandlerRefusesOverBudget(t *testing.T) {
+	var created int32
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			atomic.AddInt32(&created, 1)
+		case r.URL.Path == "/"+LinodeTypes+"/g6-standard-1":
+			json.NewEncoder(w).Encode(TypesResponseInner{Id: "g6-standard-1", Price: TypesPrice{Hourly: 1, Monthly: 720}})
+		default:
+			writePage(w, 1, 1)
+		}
+	})
+	ln.Keyring.AddKey(keytags.VPS_ROOT_PASS_KEYNAME, keyring.BearerAuth{Secret: "root"})
+	ln.Keyring.AddKey(keytags.VPS_SSH_KEY_KEYNAME, keyring.BearerAuth{Secret: "ssh"})
+	ln.Config.Cloud.MonthlyBudget = 0.5
+	body, _ := json.Marshal(AddLinodeRequest{Name: "vpn", Image: "linode/debian12", Region: "us-east", Type: "g6-standard-1"})
+	resp := ln.AddLinodeHandler(daemonproto.SockMessage{Body: body})
+	if resp.StatusCode != daemonproto.REQUEST_FAILED || !strings.Contains(string(resp.Body), "budget") {
+		t.Errorf("expected the add to be refused, got status: %v body: %s", resp.StatusCode, resp.Body)
+	}
+	if created != 0 {
+		t.Fatal("linode was created over budget")
+	}
+	var budgetErr *config.BudgetExceeded
+	if !errors.As(ln.Config.CheckBudget(1, 720, time.Now().UTC()), &budgetErr) {
+		t.Error("expected a *config.BudgetExceeded from the budget check")
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {})
+	ln.Config.Service.VpnServerPort = 51820
+	anywhere := FirewallAddresses{Ipv4: []string{"0.0.0.0/0"}, Ipv6: []string{"::/0"}}
+	for _, mgmt := range [][]string{nil, {}, {"garbage"}} {
+		ln.Config.Cloud.ManagementIps = mgmt
+		rules := ln.FirewallRules()
+		if rules.InboundPolicy != "DROP" || len(rules.Inbound) != 2 {
+			t.Fatalf("expected the wireguard and SSH ports open without management addresses, got %+v", rules)
+		}
+		if rules.Inbound[0].Protocol != "UDP" || rules.Inbound[0].Ports != "51820" {
+			t.Errorf("unexpected wireguard rule: %+v", rules.Inbound[0])
+		}
+		if ssh := rules.Inbound[1]; ssh.Ports != "22" || !reflect.DeepEqual(ssh.Addresses, anywhere) {
+			t.Errorf("expected SSH to be open to everyone without management addresses, got %+v", ssh)
+		}
+	}
+	ln.Config.Cloud.ManagementIps = []string{"203.0.113.7", "198.51.100.0/24", "2001:db8::1", "garbage"}
+	rules := ln.FirewallRules()
+	if len(rules.Inbound) != 2 {
+		t.Fatalf("expected an SSH rule for the management addresses, got %+v", rules)
+	}
+	ssh := rules.Inbound[1]
+	want := FirewallAddresses{Ipv4: []string{"203.0.113.7/32", "198.51.100.0/24"}, Ipv6: []string{"2001:db8::1/128"}}
+	if ssh.Protocol != "TCP" || ssh.Ports != "22" || !reflect.DeepEqual(ssh.Addresses, want) {
+		t.Errorf("unexpected SSH rule: %+v", ssh)
+	}
+	if label := FirewallLabel("a-very-long-server-name-for-the-firewall"); len(label) != 32 {
+		t.Errorf("firewall label should be truncated to 32 characters, got %q", label)
+	}
+}
+
+func TestDeleteLinodeHandlerRemovesFirewall(t *testing.T) {
+	var deleted []string
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+		case r.URL.Path == "/"+LinodeInstances:
+			writePage(w, 1, 1, GetLinodeResponse{Id: 1, Label: "vpn", Tags: []string{YosaiTagPrefix + "test"}})
+		case r.URL.Path == "/"+LinodeInstances+"/1/firewalls":
+			writePage(w, 1, 1,
+				FirewallResponse{Id: 10, Label: FirewallLabel("vpn"), Tags: []string{YosaiTagPrefix + "test"}},
+				FirewallResponse{Id: 11, Label: "shared"})
+		default:
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 1, Label: "vpn", Tags: []string{YosaiTagPrefix + "test"}})
+		}
+	})
+	body, _ := json.Marshal(DeleteLinodeRequest{Name: "vpn"})
+	resp := ln.DeleteLinodeHandler(daemonproto.SockMessage{Body: body})
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		t.Fatalf("expected the delete to succeed, got status: %v body: %s", resp.StatusCode, resp.Body)
+	}
+	want := []string{"/" + LinodeInstances + "/1", "/" + LinodeFirewalls + "/10"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("expected the linode and only its yosai firewall to be deleted, got %v", deleted)
+	}
+}
+
+func TestGetByIpMatchesIpv6(t *testing.T) {
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		writePage(w, 1, 1, GetLinodeResponse{
+			Id:    1,
+			Label: "vpn",
+			Ipv4:  []string{"203.0.113.7"},
+			Ipv6:  "2600:3c03::f03c:91ff:fe24:3a2f/128",
+			Tags:  []string{YosaiTagPrefix + "test"},
+		})
+	})
+	for _, addr := range []string{"203.0.113.7", "2600:3c03::f03c:91ff:fe24:3a2f", "2600:3c03:0::f03c:91ff:fe24:3a2f"} {
+		resp, err := ln.GetByIp(addr)
+		if err != nil {
+			t.Errorf("expected to find the linode by %s: %v", addr, err)
+			continue
+		}
+		if resp.WanIpv6() != "2600:3c03::f03c:91ff:fe24:3a2f" {
+			t.Errorf("unexpected WAN IPv6: %q", resp.WanIpv6())
+		}
+	}
+	if _, err := ln.GetByIp("2600:3c03::1"); err == nil {
+		t.Error("expected no linode for an unknown IPv6")
+	}
+}
+
+/*
+A connection to a fake linode API that a golden image build goes through, and the paths that the build deletes
+*/
+func newImageBuildConnection(t *testing.T) (LinodeConnection, *[]string) {
+	var polls int32
+	var deleted []string
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+		case r.Method == http.MethodPost && r.URL.Path == "/"+LinodeFirewalls:
+			json.NewEncoder(w).Encode(FirewallResponse{Id: 5})
+		case r.Method == http.MethodPost && r.URL.Path == "/"+LinodeInstances:
+			var body NewLinodeBody
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Metadata == nil || body.FirewallId != 5 || body.Image != "linode/debian12" {
+				t.Errorf("unexpected build server body: %+v", body)
+			}
+			if !reflect.DeepEqual(body.Tags, []string{YosaiTagPrefix + "test", ImageBuildTag}) {
+				t.Errorf("expected the build server to be owned, got tags: %v", body.Tags)
+			}
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 9, Label: body.Label, Status: "provisioning"})
+		case r.URL.Path == "/"+LinodeTypes+"/g6-standard-1":
+			json.NewEncoder(w).Encode(TypesResponseInner{Id: "g6-standard-1", Price: TypesPrice{Hourly: 0.01, Monthly: 5}})
+		case r.URL.Path == "/"+LinodeInstances+"/9":
+			status := []string{"provisioning", "running", "running", "offline"}
+			n := int(atomic.AddInt32(&polls, 1)) - 1
+			if n >= len(status) {
+				n = len(status) - 1
+			}
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 9, Status: status[n]})
+		case r.URL.Path == "/"+LinodeInstances+"/9/disks":
+			writePage(w, 1, 1, LinodeDisk{Id: 76, Filesystem: "swap", Size: 512}, LinodeDisk{Id: 77, Filesystem: "ext4", Size: 25000})
+		case r.Method == http.MethodPost && r.URL.Path == "/"+LinodeImages:
+			var body NewImageBody
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.DiskId != 77 {
+				t.Errorf("expected the boot disk to be captured, got disk: %v", body.DiskId)
+			}
+			json.NewEncoder(w).Encode(ImageResponse{Id: "private/1", Status: "creating"})
+		case r.URL.Path == "/"+LinodeImages+"/private/1":
+			json.NewEncoder(w).Encode(ImageResponse{Id: "private/1", Status: "available"})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	})
+	ln.PollInterval = time.Millisecond
+	ln.Keyring.AddKey(keytags.VPS_ROOT_PASS_KEYNAME, keyring.BearerAuth{Secret: "root"})
+	ln.Keyring.AddKey(keytags.VPS_SSH_KEY_KEYNAME, keyring.BearerAuth{Secret: "ssh"})
+	ln.Config.Cloud.Image = "linode/debian12"
+	ln.Config.Cloud.LinodeType = "g6-standard-1"
+	ln.Config.Cloud.GoldenImage = "private/old"
+	return ln, &deleted
+}
+
+func TestBuildGoldenImage(t *testing.T) {
+	ln, deleted := newImageBuildConnection(t)
+	img, err := ln.BuildGoldenImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Id != "private/1" || ln.Config.Cloud.GoldenImage != "private/1" || ln.Config.BootImage() != "private/1" {
+		t.Errorf("expected the new image to be recorded, got image: %+v config: %q", img, ln.Config.Cloud.GoldenImage)
+	}
+	want := []string{"/" + LinodeImages + "/private/old", "/" + LinodeInstances + "/9", "/" + LinodeFirewalls + "/5"}
+	if !reflect.DeepEqual(*deleted, want) {
+		t.Errorf("expected the old image and the build server to be cleaned up, got %v", *deleted)
+	}
+	// the build server is billed for while it runs
+	if usage := ln.Config.Cloud.Usage; len(usage) != 1 || usage[0].Id != 9 || usage[0].HourlyPrice != 0.01 || usage[0].Deleted == nil {
+		t.Errorf("expected the build server to be recorded as created and deleted, got: %+v", usage)
+	}
+}
+
+func TestBuildGoldenImageBudget(t *testing.T) {
+	ln, deleted := newImageBuildConnection(t)
+	ln.Config.Cloud.MonthlyBudget = 1
+	if _, err := ln.BuildGoldenImage(); err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Fatalf("expected the build to be refused over the budget, got: %v", err)
+	}
+	if len(*deleted) != 0 || len(ln.Config.Cloud.Usage) != 0 || ln.Config.GoldenImage() != "private/old" {
+		t.Errorf("expected nothing to be built, got deletes: %v usage: %v", *deleted, ln.Config.Cloud.Usage)
+	}
+}
+
+func TestStaleImageBuild(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		server GetLinodeResponse
+		stale  bool
+	}{
+		{GetLinodeResponse{Tags: []string{ImageBuildTag}, Created: "2024-01-01T11:00:00"}, false},
+		{GetLinodeResponse{Tags: []string{ImageBuildTag}, Created: "2024-01-01T06:00:00"}, true},
+		{GetLinodeResponse{Created: "2024-01-01T06:00:00"}, false},
+	} {
+		if got := tc.server.StaleImageBuild(now); got != tc.stale {
+			t.Errorf("expected stale: %v for %+v, got: %v", tc.stale, tc.server, got)
+		}
+	}
+}
+
+func TestImageBuilder(t *testing.T) {
+	ln, _ := newImageBuildConnection(t)
+	builder := NewImageBuilder(ln)
+	resp := builder.ImageStatusHandler(daemonproto.SockMessage{})
+	if resp.StatusCode != daemonproto.REQUEST_OK || !strings.Contains(string(resp.Body), "No image build") {
+		t.Errorf("expected no build to be shown, got: %s", resp.Body)
+	}
+
+	done := make(chan ImageBuild, 1)
+	started, err := builder.Start(func(build ImageBuild) { done <- build })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.Status != ImageBuildRunning || !strings.HasPrefix(started.Id, ImageBuildLabelPrefix) {
+		t.Errorf("expected a running build, got: %+v", started)
+	}
+	if _, err := builder.Start(nil); err == nil || !strings.Contains(err.Error(), started.Id) {
+		t.Errorf("expected a second build to be refused while one runs, got: %v", err)
+	}
+	var finished ImageBuild
+	select {
+	case finished = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the image build didnt finish")
+	}
+	if finished.Id != started.Id || finished.Status != ImageBuildFinished || finished.Image.Id != "private/1" {
+		t.Errorf("expected the build to finish with the new image, got: %+v", finished)
+	}
+	if ln.Config.BootImage() != "private/1" {
+		t.Errorf("expected the new image to be booted from, got: %s", ln.Config.BootImage())
+	}
+	resp = builder.ImageStatusHandler(daemonproto.SockMessage{})
+	var shown ImageBuild
+	json.Unmarshal(resp.Body, &shown)
+	if shown.Status != ImageBuildFinished || shown.Id != started.Id {
+		t.Errorf("expected the finished build to be shown, got: %s", resp.Body)
+	}
+
+	// the handler returns as soon as the build is started
+	resp = builder.BuildImageHandler(daemonproto.SockMessage{})
+	var build ImageBuild
+	if err := json.Unmarshal(resp.Body, &build); err != nil || resp.StatusCode != daemonproto.REQUEST_OK || build.Status != ImageBuildRunning {
+		t.Errorf("expected the build to be started in the background, got: %s", resp.Body)
+	}
+	for i := 0; i < 500; i++ {
+		if last, _ := builder.Last(); last.Status != ImageBuildRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddLinodeHandlerWithoutIpv4(t *testing.T) {
+	var deleted []string
+	ln := newTestConnection(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+		case r.Method == http.MethodPost && r.URL.Path == "/"+LinodeFirewalls:
+			json.NewEncoder(w).Encode(FirewallResponse{Id: 5})
+		case r.Method == http.MethodPost && r.URL.Path == "/"+LinodeInstances:
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 9, Label: "vpn", Ipv4: []string{}})
+		case r.URL.Path == "/"+LinodeInstances+"/9":
+			json.NewEncoder(w).Encode(GetLinodeResponse{Id: 9, Label: "vpn"})
+		case r.URL.Path == "/"+LinodeTypes+"/g6-standard-1":
+			json.NewEncoder(w).Encode(TypesResponseInner{Id: "g6-standard-1", Price: TypesPrice{Hourly: 0.01, Monthly: 5}})
+		default:
+			writePage(w, 1, 1)
+		}
+	})
+	ln.Keyring.AddKey(keytags.VPS_ROOT_PASS_KEYNAME, keyring.BearerAuth{Secret: "root"})
+	ln.Keyring.AddKey(keytags.VPS_SSH_KEY_KEYNAME, keyring.BearerAuth{Secret: "ssh"})
+	ln.Keyring.AddKey(keytags.ConstKeytag{}.VpsSvcAccKeyname(), keyring.BasicAuth{Username: "yosai", Password: "hunter2"})
+	ln.Keyring.AddKey(keytags.ConstKeytag{}.VpsSvcAccSshKeyname(), keyring.BearerAuth{Secret: "ssh-ed25519 AAAA"})
+	ln.Config.Cloud.Bootstrap = config.BootstrapCloudInit
+	ln.Config.Service.VpnAddresses = map[string]bool{"10.8.0.1": false}
+	body, _ := json.Marshal(AddLinodeRequest{Name: "vpn", Image: "linode/debian12", Region: "us-east", Type: "g6-standard-1"})
+	resp := ln.AddLinodeHandler(daemonproto.SockMessage{Body: body})
+	if resp.StatusCode != daemonproto.REQUEST_FAILED || !strings.Contains(string(resp.Body), "without an IPv4 address") {
+		t.Fatalf("expected the add to fail, got status: %v body: %s", resp.StatusCode, resp.Body)
+	}
+	if ln.Config.Service.VpnAddresses["10.8.0.1"] {
+		t.Error("expected the reserved VPN address to be freed")
+	}
+	if _, err := ln.Config.GetServer("vpn"); err == nil {
+		t.Error("expected the server not to be added to the configuration")
+	}
+	want := []string{"/" + LinodeInstances + "/9", "/" + LinodeFirewalls + "/5"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("expected the server and its firewall to be deleted, got: %v", deleted)
+	}
+}
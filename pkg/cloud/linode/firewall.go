@@ -0,0 +1,330 @@
+package linode
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+const LinodeFirewalls = "networking/firewalls"
+const FirewallLabelPrefix = "yosai-"
+const firewallLabelMax = 32
+const sshPort = 22
+
+type FirewallAddresses struct {
+	Ipv4 []string `json:"ipv4,omitempty"`
+	Ipv6 []string `json:"ipv6,omitempty"`
+}
+
+type FirewallRule struct {
+	Label     string            `json:"label"`
+	Action    string            `json:"action"`
+	Protocol  string            `json:"protocol"`
+	Ports     string            `json:"ports"`
+	Addresses FirewallAddresses `json:"addresses"`
+}
+
+type FirewallRules struct {
+	InboundPolicy  string         `json:"inbound_policy"`
+	OutboundPolicy string         `json:"outbound_policy"`
+	Inbound        []FirewallRule `json:"inbound"`
+	Outbound       []FirewallRule `json:"outbound"`
+}
+
+type FirewallDevices struct {
+	Linodes []int `json:"linodes,omitempty"`
+}
+
+type NewFirewallBody struct {
+	Label   string          `json:"label"`
+	Rules   FirewallRules   `json:"rules"`
+	Devices FirewallDevices `json:"devices"`
+	Tags    []string        `json:"tags,omitempty"`
+}
+
+type FirewallResponse struct {
+	Id     int           `json:"id"`
+	Label  string        `json:"label"`
+	Status string        `json:"status"`
+	Rules  FirewallRules `json:"rules"`
+	Tags   []string      `json:"tags"`
+}
+
+type GetAllFirewalls struct {
+	Data []FirewallResponse `json:"data"`
+}
+
+/*
+Check if a firewall has been tagged with the passed tag
+
+	:param tag: the tag to look for
+*/
+func (f FirewallResponse) HasTag(tag string) bool {
+	for i := range f.Tags {
+		if f.Tags[i] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Build the label for a servers firewall. Linode limits firewall labels to 32 characters
+
+	:param name: the name of the server the firewall is for
+*/
+func FirewallLabel(name string) string {
+	label := FirewallLabelPrefix + name
+	if len(label) > firewallLabelMax {
+		return label[:firewallLabelMax]
+	}
+	return label
+}
+
+/*
+Build the firewall rules for a VPN node from the configuration. Everything inbound is dropped apart from
+the wireguard port, and SSH from the configured management addresses. If there are no management
+addresses then SSH is left open to everyone, since ansible and the health checks need to reach it.
+*/
+func (ln LinodeConnection) FirewallRules() FirewallRules {
+	rules := FirewallRules{
+		InboundPolicy:  "DROP",
+		OutboundPolicy: "ACCEPT",
+		Inbound: []FirewallRule{
+			{
+				Label:     "yosai-wireguard",
+				Action:    "ACCEPT",
+				Protocol:  "UDP",
+				Ports:     fmt.Sprint(ln.Config.Service.VpnServerPort),
+				Addresses: FirewallAddresses{Ipv4: []string{"0.0.0.0/0"}, Ipv6: []string{"::/0"}},
+			},
+		},
+		Outbound: []FirewallRule{},
+	}
+	mgmt := managementAddresses(ln.Config.Cloud.ManagementIps)
+	if len(mgmt.Ipv4)+len(mgmt.Ipv6) == 0 {
+		// the servers are bootstrapped and health checked over SSH, so it cant be closed off
+		mgmt = FirewallAddresses{Ipv4: []string{"0.0.0.0/0"}, Ipv6: []string{"::/0"}}
+	}
+	rules.Inbound = append(rules.Inbound, FirewallRule{
+		Label:     "yosai-ssh",
+		Action:    "ACCEPT",
+		Protocol:  "TCP",
+		Ports:     fmt.Sprint(sshPort),
+		Addresses: mgmt,
+	})
+	return rules
+}
+
+/*
+Split the management addresses into the IPv4 and IPv6 CIDRs that the firewall API expects. Bare addresses
+are turned into single host networks, and anything that doesnt parse is dropped.
+
+	:param addrs: a list of addresses or CIDRs
+*/
+func managementAddresses(addrs []string) FirewallAddresses {
+	var out FirewallAddresses
+	for i := range addrs {
+		addr := strings.TrimSpace(addrs[i])
+		_, ntwrk, err := net.ParseCIDR(addr)
+		if err != nil {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			ntwrk = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		if ntwrk.IP.To4() != nil {
+			out.Ipv4 = append(out.Ipv4, ntwrk.String())
+		} else {
+			out.Ipv6 = append(out.Ipv6, ntwrk.String())
+		}
+	}
+	return out
+}
+
+/*
+Create a firewall for a server, tagged so that it can be found again when the rules change
+
+	:param name: the name of the server the firewall is for
+	:param linodes: the IDs of any linodes to attach the firewall to
+*/
+func (ln LinodeConnection) CreateFirewall(name string, linodes ...int) (FirewallResponse, error) {
+	var fwResp FirewallResponse
+	body, err := json.Marshal(NewFirewallBody{
+		Label:   FirewallLabel(name),
+		Rules:   ln.FirewallRules(),
+		Devices: FirewallDevices{Linodes: linodes},
+		Tags:    []string{ln.OwnerTag()},
+	})
+	if err != nil {
+		return fwResp, &LinodeClientError{Msg: err.Error()}
+	}
+	b, err := ln.Post(LinodeFirewalls, body)
+	if err != nil {
+		return fwResp, err
+	}
+	err = json.Unmarshal(b, &fwResp)
+	if err != nil {
+		return fwResp, &LinodeClientError{Msg: err.Error()}
+	}
+	return fwResp, nil
+}
+
+/*
+List the firewalls that yosai has created for the configured user
+*/
+func (ln LinodeConnection) ListOwnedFirewalls() (GetAllFirewalls, error) {
+	var owned GetAllFirewalls
+	b, err := ln.GetAll(LinodeFirewalls)
+	if err != nil {
+		return owned, err
+	}
+	var all GetAllFirewalls
+	err = json.Unmarshal(b, &all)
+	if err != nil {
+		return owned, &LinodeClientError{Msg: err.Error()}
+	}
+	for i := range all.Data {
+		if all.Data[i].HasTag(ln.OwnerTag()) {
+			owned.Data = append(owned.Data, all.Data[i])
+		}
+	}
+	return owned, nil
+}
+
+/*
+Get the firewalls attached to a linode
+
+	:param id: the ID of the linode
+*/
+func (ln LinodeConnection) GetLinodeFirewalls(id int) (GetAllFirewalls, error) {
+	var fws GetAllFirewalls
+	b, err := ln.GetAll(fmt.Sprintf("%s/%v/firewalls", LinodeInstances, id))
+	if err != nil {
+		return fws, err
+	}
+	err = json.Unmarshal(b, &fws)
+	if err != nil {
+		return fws, &LinodeClientError{Msg: err.Error()}
+	}
+	return fws, nil
+}
+
+/*
+Replace the rules on a firewall
+
+	:param id: the ID of the firewall
+	:param rules: the rules to replace the current ones with
+*/
+func (ln LinodeConnection) UpdateFirewallRules(id int, rules FirewallRules) error {
+	body, err := json.Marshal(rules)
+	if err != nil {
+		return &LinodeClientError{Msg: err.Error()}
+	}
+	_, err = ln.Put(fmt.Sprintf("%s/%v/rules", LinodeFirewalls, id), body)
+	return err
+}
+
+/*
+Delete a firewall
+
+	:param id: the ID of the firewall
+*/
+func (ln LinodeConnection) DeleteFirewall(id int) error {
+	_, err := ln.Delete(fmt.Sprintf("%s/%v", LinodeFirewalls, id))
+	return err
+}
+
+/*
+Delete the yosai firewalls attached to a server. Firewalls that werent created by yosai are left alone
+
+	:param fws: the firewalls that were attached to the server
+*/
+func (ln LinodeConnection) DeleteOwnedFirewalls(fws GetAllFirewalls) error {
+	for i := range fws.Data {
+		if !fws.Data[i].HasTag(ln.OwnerTag()) {
+			continue
+		}
+		err := ln.DeleteFirewall(fws.Data[i].Id)
+		if err != nil {
+			return err
+		}
+		ln.Log("Firewall: ", fws.Data[i].Label, " deleted.")
+	}
+	return nil
+}
+
+/*
+Push the rules built from the current configuration to every firewall yosai manages
+*/
+func (ln LinodeConnection) SyncFirewalls() error {
+	owned, err := ln.ListOwnedFirewalls()
+	if err != nil {
+		return err
+	}
+	rules := ln.FirewallRules()
+	for i := range owned.Data {
+		err = ln.UpdateFirewallRules(owned.Data[i].Id, rules)
+		if err != nil {
+			return err
+		}
+		ln.Log("Firewall: ", owned.Data[i].Label, " rules updated.")
+	}
+	return nil
+}
+
+/*
+Return a hook for the configuration reload that syncs the firewall rules, but only when the
+settings the rules are built from have actually changed
+*/
+func (ln LinodeConnection) FirewallReloadHook() func() {
+	applied := ln.FirewallRules()
+	return func() {
+		rules := ln.FirewallRules()
+		if reflect.DeepEqual(rules, applied) {
+			return
+		}
+		err := ln.SyncFirewalls()
+		if err != nil {
+			ln.Log("Failed to sync the firewall rules: ", err.Error())
+			return
+		}
+		applied = rules
+	}
+}
+
+/*
+Wrapping the firewall sync in a route friendly interface
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (ln LinodeConnection) SyncFirewallsHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	err := ln.SyncFirewalls()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Firewall rules synced."))
+}
+
+/*
+Wrapping the firewall listing in a route friendly interface
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (ln LinodeConnection) ShowFirewallsHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	owned, err := ln.ListOwnedFirewalls()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	b, _ := json.Marshal(owned)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
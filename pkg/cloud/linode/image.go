@@ -0,0 +1,427 @@
+package linode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/cloudinit"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+const DefaultPollInterval = time.Second * 10
+const ImageBuildLabelPrefix = "yosai-image-build-"
+const ImageLabelPrefix = "yosai-golden-"
+const ImageBuildMaxPolls = 180            // 30 minutes at the default poll interval
+const ImageBuildTag = "yosai-image-build" // marks the owned servers that are building an image, so that they dont show up as orphans while building
+const ImageBuildMaxAge = time.Hour * 3    // a build server older than this was left behind by a build that didnt clean up after itself
+
+type LinodeDisk struct {
+	Id         int    `json:"id"`
+	Label      string `json:"label"`
+	Filesystem string `json:"filesystem"`
+	Size       int    `json:"size"`
+}
+
+type GetAllDisks struct {
+	Data []LinodeDisk `json:"data"`
+}
+
+type NewImageBody struct {
+	DiskId      int    `json:"disk_id"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+}
+
+type ImageResponse struct {
+	Id          string `json:"id"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	IsPublic    bool   `json:"is_public"`
+	Created     string `json:"created"`
+	Size        int    `json:"size"`
+}
+
+func (ln LinodeConnection) pollInterval() time.Duration {
+	if ln.PollInterval > 0 {
+		return ln.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+/*
+Check if a linode is a build server that a golden image build left behind
+
+	:param now: the time to check its age against
+*/
+func (g GetLinodeResponse) StaleImageBuild(now time.Time) bool {
+	return g.HasTag(ImageBuildTag) && now.Sub(parseLinodeTime(g.Created)) > ImageBuildMaxAge
+}
+
+/*
+Get the disks attached to a linode
+
+	:param id: the ID of the linode
+*/
+func (ln LinodeConnection) GetLinodeDisks(id int) (GetAllDisks, error) {
+	var disks GetAllDisks
+	b, err := ln.GetAll(fmt.Sprintf("%s/%v/disks", LinodeInstances, id))
+	if err != nil {
+		return disks, err
+	}
+	err = json.Unmarshal(b, &disks)
+	if err != nil {
+		return disks, &LinodeClientError{Msg: err.Error()}
+	}
+	return disks, nil
+}
+
+/*
+Find the disk with the operating system on it, which is the largest disk that isnt swap
+
+	:param disks: the disks attached to a linode
+*/
+func bootDisk(disks GetAllDisks) (LinodeDisk, error) {
+	var boot LinodeDisk
+	for i := range disks.Data {
+		if disks.Data[i].Filesystem == "swap" {
+			continue
+		}
+		if disks.Data[i].Size > boot.Size {
+			boot = disks.Data[i]
+		}
+	}
+	if boot.Id == 0 {
+		return boot, &LinodeClientError{Msg: "No bootable disk was found to capture."}
+	}
+	return boot, nil
+}
+
+/*
+Capture a private image from a linodes disk. The image is created asynchronously, use ImagePoll to wait
+for it to become available
+
+	:param diskId: the ID of the disk to capture
+	:param label: the label for the new image
+	:param description: the description for the new image
+*/
+func (ln LinodeConnection) CaptureImage(diskId int, label string, description string) (ImageResponse, error) {
+	var img ImageResponse
+	body, err := json.Marshal(NewImageBody{DiskId: diskId, Label: label, Description: description})
+	if err != nil {
+		return img, &LinodeClientError{Msg: err.Error()}
+	}
+	b, err := ln.Post(LinodeImages, body)
+	if err != nil {
+		return img, err
+	}
+	err = json.Unmarshal(b, &img)
+	if err != nil {
+		return img, &LinodeClientError{Msg: err.Error()}
+	}
+	return img, nil
+}
+
+/*
+Get an image by its ID
+
+	:param id: the ID of the image, i.e. 'private/12345'
+*/
+func (ln LinodeConnection) GetImage(id string) (ImageResponse, error) {
+	var img ImageResponse
+	b, err := ln.Get(fmt.Sprintf("%s/%s", LinodeImages, id))
+	if err != nil {
+		return img, err
+	}
+	err = json.Unmarshal(b, &img)
+	if err != nil {
+		return img, &LinodeClientError{Msg: err.Error()}
+	}
+	return img, nil
+}
+
+/*
+Delete a private image
+
+	:param id: the ID of the image, i.e. 'private/12345'
+*/
+func (ln LinodeConnection) DeleteImage(id string) error {
+	_, err := ln.Delete(fmt.Sprintf("%s/%s", LinodeImages, id))
+	return err
+}
+
+/*
+Poll an image until it has finished being created
+
+	    :param id: the ID of the image
+		:param max_tries: the number of calls the client will send to linode before exiting
+*/
+func (ln LinodeConnection) ImagePoll(id string, max_tries int) (ImageResponse, error) {
+	for count := 1; count <= max_tries; count++ {
+		img, err := ln.GetImage(id)
+		if err != nil {
+			return img, err
+		}
+		if img.Status == "available" {
+			return img, nil
+		}
+		ln.Log("Image: ", id, " showing as: ", img.Status)
+		time.Sleep(ln.pollInterval())
+	}
+	return ImageResponse{}, &LinodeTimeOutError{Tries: max_tries}
+}
+
+/*
+Poll a linode until it reaches a status
+
+	    :param id: the ID of the linode
+		:param status: the status to wait for, i.e. 'offline'
+		:param max_tries: the number of calls the client will send to linode before exiting
+*/
+func (ln LinodeConnection) StatusPoll(id int, status string, max_tries int) error {
+	for count := 1; count <= max_tries; count++ {
+		resp, err := ln.GetLinode(fmt.Sprint(id))
+		if err != nil {
+			return err
+		}
+		if resp.Status == status {
+			return nil
+		}
+		ln.Log("Server: ", resp.Label, " showing as: ", resp.Status, " waiting for: ", status)
+		time.Sleep(ln.pollInterval())
+	}
+	return &LinodeTimeOutError{Tries: max_tries}
+}
+
+/*
+Build a golden image for new servers to boot from. A temporary server is created from the stock image and
+configured by cloud-init, which powers it off once it is done. Its disk is then captured into a private image,
+the temporary server is deleted, and the new image replaces the previous golden image in the configuration.
+*/
+func (ln LinodeConnection) BuildGoldenImage() (ImageResponse, error) {
+	return ln.buildGoldenImage(time.Now().UTC().Format("20060102150405"))
+}
+
+/*
+Build a golden image, labelling the build server and the image with a timestamp
+
+	:param stamp: the timestamp that the build server and image labels end in
+*/
+func (ln LinodeConnection) buildGoldenImage(stamp string) (ImageResponse, error) {
+	var img ImageResponse
+	body, err := NewLinodeBodyBuilder(ln.Config.Cloud.Image, ln.Config.Cloud.Region, ln.Config.Cloud.LinodeType, ImageBuildLabelPrefix+stamp, ln.Keyring)
+	if err != nil {
+		return img, err
+	}
+	// the build server is billed like any other server, so it counts against the budget
+	linodeType, err := ln.GetType(ln.Config.Cloud.LinodeType)
+	if err != nil {
+		return img, err
+	}
+	err = ln.Config.CheckBudget(linodeType.Price.Hourly, linodeType.Price.Monthly, time.Now().UTC())
+	if err != nil {
+		ln.Log("Refusing to create the image build server: ", body.Label, err.Error())
+		return img, err
+	}
+	userData, err := cloudinit.EncodedImageBuildData(cloudinit.ImageBuildSeed{Message: "yosai golden image build finished, powering off for capture."})
+	if err != nil {
+		return img, err
+	}
+	body.Tags = []string{ln.OwnerTag(), ImageBuildTag}
+	body.Metadata = &LinodeMetadata{UserData: userData}
+	fw, err := ln.CreateFirewall(ImageBuildLabelPrefix + stamp)
+	if err != nil {
+		return img, err
+	}
+	body.FirewallId = fw.Id
+	builder, err := ln.CreateNewLinode(body)
+	if err != nil {
+		ln.DeleteFirewall(fw.Id)
+		return img, err
+	}
+	ln.Log("Image build server: ", builder.Label, " created, waiting for it to configure itself.")
+	ln.Config.RecordServerCreated(config.ServerUsage{
+		Username:     ln.Config.Username,
+		Name:         builder.Label,
+		Id:           builder.Id,
+		Type:         linodeType.Id,
+		HourlyPrice:  linodeType.Price.Hourly,
+		MonthlyPrice: linodeType.Price.Monthly,
+		Created:      parseLinodeTime(builder.Created),
+	})
+	defer func() {
+		err := ln.DeleteLinode(fmt.Sprint(builder.Id))
+		if err != nil {
+			ln.Log("Failed to delete the image build server: ", builder.Label, err.Error())
+			return
+		}
+		ln.Config.RecordServerDeleted(builder.Id, time.Now().UTC())
+		err = ln.DeleteFirewall(fw.Id)
+		if err != nil {
+			ln.Log("Failed to delete the image build firewall: ", fw.Label, err.Error())
+		}
+	}()
+	// the server shows as offline while it is provisioning, so wait for it to come up before waiting for it to power off
+	err = ln.StatusPoll(builder.Id, "running", ImageBuildMaxPolls)
+	if err != nil {
+		return img, err
+	}
+	err = ln.StatusPoll(builder.Id, "offline", ImageBuildMaxPolls)
+	if err != nil {
+		return img, err
+	}
+	disks, err := ln.GetLinodeDisks(builder.Id)
+	if err != nil {
+		return img, err
+	}
+	disk, err := bootDisk(disks)
+	if err != nil {
+		return img, err
+	}
+	img, err = ln.CaptureImage(disk.Id, ImageLabelPrefix+stamp, "yosai VPN node built from: "+ln.Config.Cloud.Image)
+	if err != nil {
+		return img, err
+	}
+	img, err = ln.ImagePoll(img.Id, ImageBuildMaxPolls)
+	if err != nil {
+		return img, err
+	}
+	previous := ln.Config.SetGoldenImage(img.Id)
+	ln.Log("Golden image: ", img.Id, " is available.")
+	if previous != "" && previous != img.Id {
+		err = ln.DeleteImage(previous)
+		if err != nil {
+			ln.Log("Failed to delete the previous golden image: ", previous, err.Error())
+		}
+	}
+	return img, nil
+}
+
+const (
+	ImageBuildRunning  = "running"
+	ImageBuildFinished = "finished"
+	ImageBuildFailed   = "failed"
+)
+
+/*
+A golden image build running in the background, identified by the label of its build server
+*/
+type ImageBuild struct {
+	Id       string        `json:"id"`
+	Status   string        `json:"status"` // either ImageBuildRunning, ImageBuildFinished or ImageBuildFailed
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished,omitempty"`
+	Image    ImageResponse `json:"image"`
+	Error    string        `json:"error,omitempty"`
+}
+
+/*
+Runs golden image builds in the background, since a build takes far longer than a socket request should
+block for. Only one build runs at a time, and the last build is kept so that its status can be shown.
+*/
+type ImageBuilder struct {
+	Conn  LinodeConnection
+	mu    sync.Mutex
+	build *ImageBuild
+}
+
+func NewImageBuilder(conn LinodeConnection) *ImageBuilder {
+	return &ImageBuilder{Conn: conn}
+}
+
+/*
+Start a golden image build in the background, returning the build that was started
+
+	:param done: called once the build finishes, nil when nothing has to wait for it
+*/
+func (b *ImageBuilder) Start(done func(ImageBuild)) (ImageBuild, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.build != nil && b.build.Status == ImageBuildRunning {
+		return *b.build, &LinodeClientError{Msg: "An image build is already running: " + b.build.Id}
+	}
+	now := time.Now().UTC()
+	stamp := now.Format("20060102150405")
+	b.build = &ImageBuild{Id: ImageBuildLabelPrefix + stamp, Status: ImageBuildRunning, Started: now}
+	started := *b.build
+	go func() {
+		img, err := b.Conn.buildGoldenImage(stamp)
+		b.mu.Lock()
+		b.build.Finished = time.Now().UTC()
+		b.build.Image = img
+		b.build.Status = ImageBuildFinished
+		if err != nil {
+			b.build.Status = ImageBuildFailed
+			b.build.Error = err.Error()
+			b.Conn.Log("Image build: ", b.build.Id, " failed: ", err.Error())
+		}
+		build := *b.build
+		b.mu.Unlock()
+		if done != nil {
+			done(build)
+		}
+	}()
+	return started, nil
+}
+
+/*
+Get the last golden image build, and false if there hasnt been one since the daemon started
+*/
+func (b *ImageBuilder) Last() (ImageBuild, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.build == nil {
+		return ImageBuild{}, false
+	}
+	return *b.build, true
+}
+
+/*
+Wraps starting a golden image build in a route friendly interface. The build runs in the background, and
+its progress can be followed with the status route.
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (b *ImageBuilder) BuildImageHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	build, err := b.Start(nil)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	resp, _ := json.Marshal(build)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, resp)
+}
+
+/*
+Wraps showing the last golden image build in a route friendly interface
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (b *ImageBuilder) ImageStatusHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	build, ok := b.Last()
+	if !ok {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("No image build has been started."))
+	}
+	resp, _ := json.Marshal(build)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, resp)
+}
+
+/*
+Wraps showing the current golden image in a route friendly interface
+
+	:param msg: a daemonproto.SockMessage that contains the request info
+*/
+func (ln LinodeConnection) ShowImageHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	golden := ln.Config.GoldenImage()
+	if golden == "" {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("No golden image has been built, servers boot from: "+ln.Config.Cloud.Image))
+	}
+	img, err := ln.GetImage(golden)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	b, _ := json.Marshal(img)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
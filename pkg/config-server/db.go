@@ -6,6 +6,8 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strings"
+	"time"
 
 	"git.aetherial.dev/aeth/yosai/pkg/config"
 	"github.com/mattn/go-sqlite3"
@@ -68,7 +70,76 @@ func (s *SQLiteRepo) Migrate() {
 	    user_id INTEGER NOT NULL,
 		image TEXT NOT NULL,
 		region TEXT NOT NULL,
-		linode_type TEXT NOT NULL  
+		linode_type TEXT NOT NULL,
+		monthly_budget REAL NOT NULL DEFAULT 0,
+		management_ips TEXT NOT NULL DEFAULT '',
+		golden_image TEXT NOT NULL DEFAULT '',
+		bootstrap TEXT NOT NULL DEFAULT ''
+	);
+	`
+
+	usageTable := `
+	CREATE TABLE IF NOT EXISTS server_usage(
+	    user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		linode_id INTEGER NOT NULL,
+		linode_type TEXT NOT NULL,
+		hourly_price REAL NOT NULL,
+		monthly_price REAL NOT NULL,
+		created DATETIME NOT NULL,
+		deleted DATETIME
+	);
+	`
+
+	rotationTable := `
+	CREATE TABLE IF NOT EXISTS rotation(
+	    user_id INTEGER NOT NULL,
+		enabled INTEGER NOT NULL,
+		interval TEXT NOT NULL,
+		cron TEXT NOT NULL,
+		jitter TEXT NOT NULL,
+		maintenance_windows TEXT NOT NULL,
+		state_path TEXT NOT NULL
+	);
+	`
+
+	healthTable := `
+	CREATE TABLE IF NOT EXISTS health(
+	    user_id INTEGER NOT NULL,
+		enabled INTEGER NOT NULL,
+		interval TEXT NOT NULL,
+		failure_threshold INTEGER NOT NULL,
+		handshake_max_age TEXT NOT NULL,
+		probes TEXT NOT NULL,
+		history INTEGER NOT NULL
+	);
+	`
+
+	killSwitchTable := `
+	CREATE TABLE IF NOT EXISTS kill_switch(
+	    user_id INTEGER NOT NULL,
+		enabled INTEGER NOT NULL,
+		lan_ranges TEXT NOT NULL
+	);
+	`
+
+	dnsTable := `
+	CREATE TABLE IF NOT EXISTS dns(
+	    user_id INTEGER NOT NULL,
+		enabled INTEGER NOT NULL,
+		servers TEXT NOT NULL,
+		upstream TEXT NOT NULL,
+		upstream_servers TEXT NOT NULL,
+		local TEXT NOT NULL
+	);
+	`
+
+	keyRotationTable := `
+	CREATE TABLE IF NOT EXISTS key_rotation(
+	    user_id INTEGER NOT NULL,
+		enabled INTEGER NOT NULL,
+		interval TEXT NOT NULL,
+		overlap TEXT NOT NULL
 	);
 	`
 
@@ -88,7 +159,17 @@ func (s *SQLiteRepo) Migrate() {
 		name TEXT NOT NULL,
 		wan_ipv4 TEXT NOT NULL,
 		vpn_ipv4 TEXT NOT NULL,
-		port INTEGER NOT NULL  
+		port INTEGER NOT NULL,
+		wan_ipv6 TEXT NOT NULL DEFAULT '',
+		vpn_ipv6 TEXT NOT NULL DEFAULT '',
+		mtu INTEGER NOT NULL DEFAULT 0,
+		persistent_keepalive INTEGER NOT NULL DEFAULT 0,
+		preshared_key INTEGER NOT NULL DEFAULT 0,
+		listen_port INTEGER NOT NULL DEFAULT 0,
+		fwmark INTEGER NOT NULL DEFAULT 0,
+		routing_table TEXT NOT NULL DEFAULT '',
+		key_created TEXT NOT NULL DEFAULT '',
+		previous_key_expires TEXT NOT NULL DEFAULT ''
 	);
 	`
 
@@ -98,7 +179,19 @@ func (s *SQLiteRepo) Migrate() {
 		name TEXT NOT NULL,
 		pubkey TEXT NOT NULL,
 		vpn_ipv4 TEXT NOT NULL,
-		default_client INTEGER NOT NULL
+		default_client INTEGER NOT NULL,
+		vpn_ipv6 TEXT NOT NULL DEFAULT '',
+		routing TEXT NOT NULL DEFAULT '',
+		routes TEXT NOT NULL DEFAULT '',
+		mtu INTEGER NOT NULL DEFAULT 0,
+		persistent_keepalive INTEGER NOT NULL DEFAULT 0,
+		preshared_key INTEGER NOT NULL DEFAULT 0,
+		listen_port INTEGER NOT NULL DEFAULT 0,
+		fwmark INTEGER NOT NULL DEFAULT 0,
+		routing_table TEXT NOT NULL DEFAULT '',
+		key_created TEXT NOT NULL DEFAULT '',
+		previous_key_expires TEXT NOT NULL DEFAULT '',
+		previous_vpn_ipv4 TEXT NOT NULL DEFAULT ''
 	);
 	`
 
@@ -109,7 +202,13 @@ func (s *SQLiteRepo) Migrate() {
 		vpn_subnet_mask INTEGER NOT NULL,
 		vpn_server_port INTEGER NOT NULL,
 		secrets_backend TEXT NOT NULL,
-		secrets_backend_url TEXT NOT NULL
+		secrets_backend_url TEXT NOT NULL,
+		vpn_ipv6 TEXT NOT NULL DEFAULT '',
+		server_mtu INTEGER NOT NULL DEFAULT 0,
+		server_persistent_keepalive INTEGER NOT NULL DEFAULT 0,
+		server_preshared_key INTEGER NOT NULL DEFAULT 0,
+		server_fwmark INTEGER NOT NULL DEFAULT 0,
+		server_routing_table TEXT NOT NULL DEFAULT ''
 	);
 	`
 	queries := []string{
@@ -119,6 +218,12 @@ func (s *SQLiteRepo) Migrate() {
 		serverTable,
 		clientTable,
 		serviceTable,
+		usageTable,
+		rotationTable,
+		healthTable,
+		killSwitchTable,
+		dnsTable,
+		keyRotationTable,
 	}
 	for i := range queries {
 		_, err := s.db.Exec(queries[i])
@@ -126,6 +231,63 @@ func (s *SQLiteRepo) Migrate() {
 			s.Log(err.Error())
 		}
 	}
+	s.addColumn("cloud", "monthly_budget", "REAL NOT NULL DEFAULT 0")
+	s.addColumn("cloud", "management_ips", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("cloud", "golden_image", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("cloud", "bootstrap", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "wan_ipv6", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "vpn_ipv6", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "vpn_ipv6", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "routing", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "routes", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "mtu", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("servers", "persistent_keepalive", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("servers", "preshared_key", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("servers", "listen_port", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("servers", "fwmark", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("servers", "routing_table", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "mtu", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "persistent_keepalive", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "preshared_key", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "listen_port", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "fwmark", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "routing_table", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "key_created", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "previous_key_expires", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "key_created", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "previous_key_expires", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("servers", "priority", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("clients", "servers", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("clients", "previous_vpn_ipv4", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("service", "vpn_ipv6", "TEXT NOT NULL DEFAULT ''")
+	s.addColumn("service", "server_mtu", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("service", "server_persistent_keepalive", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("service", "server_preshared_key", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("service", "server_fwmark", "INTEGER NOT NULL DEFAULT 0")
+	s.addColumn("service", "server_routing_table", "TEXT NOT NULL DEFAULT ''")
+}
+
+/*
+Add a column to a table that was created by an older version of the schema, doing nothing if it already exists
+
+	    :param table: the name of the table to alter
+		:param column: the name of the column to add
+		:param definition: the type and constraints of the new column
+*/
+func (s *SQLiteRepo) addColumn(table string, column string, definition string) {
+	var count int
+	row := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	if err := row.Scan(&count); err != nil {
+		s.Log(err.Error())
+		return
+	}
+	if count > 0 {
+		return
+	}
+	_, err := s.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		s.Log(err.Error())
+	}
 }
 
 /*
@@ -165,10 +327,14 @@ func (s *SQLiteRepo) UpdateUser(username config.Username, config config.Configur
 		s.Log("Error getting the user: ", string(username), err.Error())
 		return err
 	}
-	_, err = trx.Exec("UPDATE cloud SET image = ?, region = ?, linode_type = ? WHERE user_id = ?",
+	_, err = trx.Exec("UPDATE cloud SET image = ?, region = ?, linode_type = ?, monthly_budget = ?, management_ips = ?, golden_image = ?, bootstrap = ? WHERE user_id = ?",
 		config.Cloud.Image,
 		config.Cloud.Region,
 		config.Cloud.LinodeType,
+		config.Cloud.MonthlyBudget,
+		strings.Join(config.Cloud.ManagementIps, ","),
+		config.Cloud.GoldenImage,
+		config.Cloud.Bootstrap,
 		user.Id)
 	if err != nil {
 		return err
@@ -203,13 +369,79 @@ func (s *SQLiteRepo) UpdateUser(username config.Username, config config.Configur
 		s.Log("Failed to propogate the VPN clients into the appropriate table: ", err.Error())
 		return err
 	}
+	_, err = trx.Exec("DELETE FROM server_usage WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users server usage entries: ", err.Error())
+		return err
+	}
+	err = s.insertServerUsage(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the server usage records into the appropriate table: ", err.Error())
+		return err
+	}
+	_, err = trx.Exec("DELETE FROM rotation WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users rotation entry: ", err.Error())
+		return err
+	}
+	err = s.insertRotation(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the rotation schedule into the appropriate table: ", err.Error())
+		return err
+	}
+	_, err = trx.Exec("DELETE FROM health WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users health check entry: ", err.Error())
+		return err
+	}
+	err = s.insertHealth(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the health check settings into the appropriate table: ", err.Error())
+		return err
+	}
+	_, err = trx.Exec("DELETE FROM kill_switch WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users kill switch entry: ", err.Error())
+		return err
+	}
+	err = s.insertKillSwitch(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the kill switch settings into the appropriate table: ", err.Error())
+		return err
+	}
+	_, err = trx.Exec("DELETE FROM dns WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users DNS entry: ", err.Error())
+		return err
+	}
+	err = s.insertDns(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the DNS settings into the appropriate table: ", err.Error())
+		return err
+	}
+	_, err = trx.Exec("DELETE FROM key_rotation WHERE user_id = ?", user.Id)
+	if err != nil {
+		s.Log("Failed to drop the users key rotation entry: ", err.Error())
+		return err
+	}
+	err = s.insertKeyRotation(user, config, trx)
+	if err != nil {
+		s.Log("Failed to propogate the key rotation settings into the appropriate table: ", err.Error())
+		return err
+	}
 
-	_, err = trx.Exec("UPDATE service SET vpn_ip = ?, vpn_subnet_mask = ?, vpn_server_port = ?, secrets_backend = ?, secrets_backend_url = ? WHERE user_id = ?",
+	_, err = trx.Exec("UPDATE service SET vpn_ip = ?, vpn_subnet_mask = ?, vpn_server_port = ?, secrets_backend = ?, secrets_backend_url = ?, vpn_ipv6 = ?, server_mtu = ?, server_persistent_keepalive = ?, server_preshared_key = ?, server_fwmark = ?, server_routing_table = ? WHERE user_id = ?",
 		config.Service.VpnAddressSpace.String(),
 		config.Service.VpnMask,
 		config.Service.VpnServerPort,
 		config.Service.SecretsBackend,
 		config.Service.SecretsBackendUrl,
+		config.VpnNetworkV6(),
+		config.Service.ServerOptions.MTU,
+		config.Service.ServerOptions.PersistentKeepalive,
+		config.Service.ServerOptions.PresharedKey,
+		config.Service.ServerOptions.FwMark,
+		config.Service.ServerOptions.Table,
 		user.Id)
 	if err != nil {
 		return err
@@ -240,13 +472,19 @@ func (s *SQLiteRepo) insertServiceInfo(user config.User, config config.Configura
 		return ErrDuplicate
 	}
 
-	_, err = trx.Exec("INSERT INTO service(user_id, vpn_ip, vpn_subnet_mask, vpn_server_port, secrets_backend, secrets_backend_url) values(?,?,?,?,?,?)",
+	_, err = trx.Exec("INSERT INTO service(user_id, vpn_ip, vpn_subnet_mask, vpn_server_port, secrets_backend, secrets_backend_url, vpn_ipv6, server_mtu, server_persistent_keepalive, server_preshared_key, server_fwmark, server_routing_table) values(?,?,?,?,?,?,?,?,?,?,?,?)",
 		user.Id,
 		config.Service.VpnAddressSpace.String(),
 		config.Service.VpnMask,
 		config.Service.VpnServerPort,
 		config.Service.SecretsBackend,
-		config.Service.SecretsBackendUrl)
+		config.Service.SecretsBackendUrl,
+		config.VpnNetworkV6(),
+		config.Service.ServerOptions.MTU,
+		config.Service.ServerOptions.PersistentKeepalive,
+		config.Service.ServerOptions.PresharedKey,
+		config.Service.ServerOptions.FwMark,
+		config.Service.ServerOptions.Table)
 	if err != nil {
 		var sqliteErr sqlite3.Error
 		if errors.As(err, &sqliteErr) {
@@ -265,7 +503,7 @@ Create an entry in the client table for a user
 	    :param user: the calling config.User
 		:param cloudConfig: the cloud specific configuration for the user
 */
-func (s *SQLiteRepo) insertClient(user config.User, config config.Configuration, trx *sql.Tx) error {
+func (s *SQLiteRepo) insertClient(user config.User, cfg config.Configuration, trx *sql.Tx) error {
 	rows, err := trx.Query("SELECT * FROM clients WHERE user_id = ?", user.Id)
 	if err != nil {
 		s.Log("Failed to perform pre-insert check", err.Error())
@@ -275,14 +513,27 @@ func (s *SQLiteRepo) insertClient(user config.User, config config.Configuration,
 		s.Log("Duplicate INSERT attempted, update instead.", err.Error())
 		return ErrDuplicate
 	}
-	for i := range config.Service.Clients {
-		client := config.Service.Clients[i]
-		_, err = trx.Exec("INSERT INTO clients(user_id, name, pubkey, vpn_ipv4, default_client) values(?,?,?,?,?)",
+	for i := range cfg.Service.Clients {
+		client := cfg.Service.Clients[i]
+		_, err = trx.Exec("INSERT INTO clients(user_id, name, pubkey, vpn_ipv4, default_client, vpn_ipv6, routing, routes, mtu, persistent_keepalive, preshared_key, listen_port, fwmark, routing_table, key_created, previous_key_expires, servers, previous_vpn_ipv4) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 			user.Id,
 			client.Name,
 			client.Pubkey,
 			client.VpnIpv4,
-			client.Default)
+			client.Default,
+			config.IpString(client.VpnIpv6),
+			client.Routing,
+			strings.Join(client.Routes, ","),
+			client.Options.MTU,
+			client.Options.PersistentKeepalive,
+			client.Options.PresharedKey,
+			client.Options.ListenPort,
+			client.Options.FwMark,
+			client.Options.Table,
+			timeString(client.Key.Created),
+			timeString(client.Key.PreviousExpires),
+			strings.Join(client.Servers, ","),
+			config.IpString(client.Key.PreviousVpnIpv4))
 		if err != nil {
 			s.Log("Failed to create row: ", err.Error())
 			return err
@@ -298,7 +549,7 @@ Create an entry in the server table for a user
 	    :param user: the calling config.User
 		:param cloudConfig: the cloud specific configuration for the user
 */
-func (s *SQLiteRepo) insertServer(user config.User, config config.Configuration, trx *sql.Tx) error {
+func (s *SQLiteRepo) insertServer(user config.User, cfg config.Configuration, trx *sql.Tx) error {
 	rows, err := trx.Query("SELECT * FROM servers WHERE user_id = ?", user.Id)
 	if err != nil {
 		s.Log("Failed to perform pre-insert check", err.Error())
@@ -308,14 +559,25 @@ func (s *SQLiteRepo) insertServer(user config.User, config config.Configuration,
 		s.Log("Duplicate INSERT attempted, update instead.", err.Error())
 		return ErrDuplicate
 	}
-	for i := range config.Service.Servers {
-		server := config.Service.Servers[i]
-		_, err = trx.Exec("INSERT INTO servers(user_id, name, wan_ipv4, vpn_ipv4, port) values(?,?,?,?,?)",
+	for i := range cfg.Service.Servers {
+		server := cfg.Service.Servers[i]
+		_, err = trx.Exec("INSERT INTO servers(user_id, name, wan_ipv4, vpn_ipv4, port, wan_ipv6, vpn_ipv6, mtu, persistent_keepalive, preshared_key, listen_port, fwmark, routing_table, key_created, previous_key_expires, priority) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 			user.Id,
 			server.Name,
 			server.WanIpv4,
 			server.VpnIpv4,
-			server.Port)
+			server.Port,
+			server.WanIpv6,
+			config.IpString(server.VpnIpv6),
+			server.Options.MTU,
+			server.Options.PersistentKeepalive,
+			server.Options.PresharedKey,
+			server.Options.ListenPort,
+			server.Options.FwMark,
+			server.Options.Table,
+			timeString(server.Key.Created),
+			timeString(server.Key.PreviousExpires),
+			server.Priority)
 		if err != nil {
 			s.Log("Failed to create row: ", err.Error())
 			return err
@@ -325,6 +587,175 @@ func (s *SQLiteRepo) insertServer(user config.User, config config.Configuration,
 
 }
 
+/*
+Format a time for storage, using an empty string for the zero time
+
+	:param t: the time to format
+*/
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+/*
+Parse a time that was formatted with timeString, an empty string is the zero time
+
+	:param val: the stored time
+*/
+func parseTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+/*
+Parse the stored keypair lifecycle of a client or server
+
+	    :param created: when the keypair was made
+		:param previousExpires: when the previous keypair is removed
+*/
+func parseKeyLifecycle(created string, previousExpires string) (config.KeyLifecycle, error) {
+	var lifecycle config.KeyLifecycle
+	var err error
+	if lifecycle.Created, err = parseTime(created); err != nil {
+		return lifecycle, err
+	}
+	lifecycle.PreviousExpires, err = parseTime(previousExpires)
+	return lifecycle, err
+}
+
+/*
+Create an entry in the server usage table for every server the user has created
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the usage records
+*/
+func (s *SQLiteRepo) insertServerUsage(user config.User, config config.Configuration, trx *sql.Tx) error {
+	for i := range config.Cloud.Usage {
+		usage := config.Cloud.Usage[i]
+		_, err := trx.Exec("INSERT INTO server_usage(user_id, name, linode_id, linode_type, hourly_price, monthly_price, created, deleted) values(?,?,?,?,?,?,?,?)",
+			user.Id,
+			usage.Name,
+			usage.Id,
+			usage.Type,
+			usage.HourlyPrice,
+			usage.MonthlyPrice,
+			usage.Created,
+			usage.Deleted)
+		if err != nil {
+			s.Log("Failed to create row: ", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Create an entry in the rotation table for a user. Maintenance windows can contain commas, so they are
+joined with semicolons instead
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the rotation schedule
+*/
+func (s *SQLiteRepo) insertRotation(user config.User, config config.Configuration, trx *sql.Tx) error {
+	_, err := trx.Exec("INSERT INTO rotation(user_id, enabled, interval, cron, jitter, maintenance_windows, state_path) values(?,?,?,?,?,?,?)",
+		user.Id,
+		config.Rotation.Enabled,
+		config.Rotation.Interval,
+		config.Rotation.Cron,
+		config.Rotation.Jitter,
+		strings.Join(config.Rotation.MaintenanceWindows, ";"),
+		config.Rotation.StatePath)
+	if err != nil {
+		s.Log("Failed to create row: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/*
+Create an entry in the health table for a user
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the health check settings
+*/
+func (s *SQLiteRepo) insertHealth(user config.User, config config.Configuration, trx *sql.Tx) error {
+	_, err := trx.Exec("INSERT INTO health(user_id, enabled, interval, failure_threshold, handshake_max_age, probes, history) values(?,?,?,?,?,?,?)",
+		user.Id,
+		config.Health.Enabled,
+		config.Health.Interval,
+		config.Health.FailureThreshold,
+		config.Health.HandshakeMaxAge,
+		strings.Join(config.Health.Probes, ","),
+		config.Health.History)
+	if err != nil {
+		s.Log("Failed to create row: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/*
+Create an entry in the key_rotation table for a user
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the key rotation settings
+*/
+func (s *SQLiteRepo) insertKeyRotation(user config.User, config config.Configuration, trx *sql.Tx) error {
+	_, err := trx.Exec("INSERT INTO key_rotation(user_id, enabled, interval, overlap) values(?,?,?,?)",
+		user.Id,
+		config.KeyRotation.Enabled,
+		config.KeyRotation.Interval,
+		config.KeyRotation.Overlap)
+	if err != nil {
+		s.Log("Failed to create row: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/*
+Create an entry in the kill_switch table for a user
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the kill switch settings
+*/
+func (s *SQLiteRepo) insertKillSwitch(user config.User, config config.Configuration, trx *sql.Tx) error {
+	_, err := trx.Exec("INSERT INTO kill_switch(user_id, enabled, lan_ranges) values(?,?,?)",
+		user.Id,
+		config.KillSwitch.Enabled,
+		strings.Join(config.KillSwitch.LanRanges, ","))
+	if err != nil {
+		s.Log("Failed to create row: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/*
+Create an entry in the dns table for a user
+
+	    :param user: the calling config.User
+		:param config: the config.Configuration with the DNS settings
+*/
+func (s *SQLiteRepo) insertDns(user config.User, config config.Configuration, trx *sql.Tx) error {
+	_, err := trx.Exec("INSERT INTO dns(user_id, enabled, servers, upstream, upstream_servers, local) values(?,?,?,?,?,?)",
+		user.Id,
+		config.Dns.Enabled,
+		strings.Join(config.Dns.Servers, ","),
+		config.Dns.Upstream,
+		strings.Join(config.Dns.UpstreamServers, ","),
+		config.Dns.Local)
+	if err != nil {
+		s.Log("Failed to create row: ", err.Error())
+		return err
+	}
+	return nil
+}
+
 /*
 Create an entry in the ansible table for a user
 
@@ -372,11 +803,15 @@ func (s *SQLiteRepo) insertUserCloud(user config.User, config config.Configurati
 		s.Log("Duplicate INSERT attempted, update instead.", err.Error())
 		return ErrDuplicate
 	}
-	_, err = trx.Exec("INSERT INTO cloud(user_id, image, region, linode_type) values(?,?,?,?)",
+	_, err = trx.Exec("INSERT INTO cloud(user_id, image, region, linode_type, monthly_budget, management_ips, golden_image, bootstrap) values(?,?,?,?,?,?,?,?)",
 		user.Id,
 		config.Cloud.Image,
 		config.Cloud.Region,
-		config.Cloud.LinodeType)
+		config.Cloud.LinodeType,
+		config.Cloud.MonthlyBudget,
+		strings.Join(config.Cloud.ManagementIps, ","),
+		config.Cloud.GoldenImage,
+		config.Cloud.Bootstrap)
 	if err != nil {
 		s.Log("Failed to create row: ", err.Error())
 		return err
@@ -403,6 +838,12 @@ func (s *SQLiteRepo) SeedUser(user config.User, cfg config.Configuration) error
 		s.insertUserAnsible,
 		s.insertUserCloud,
 		s.insertServiceInfo,
+		s.insertServerUsage,
+		s.insertRotation,
+		s.insertHealth,
+		s.insertKillSwitch,
+		s.insertDns,
+		s.insertKeyRotation,
 	}
 	for i := range seedFuncs {
 		err := seedFuncs[i](user, cfg, trx)
@@ -463,13 +904,17 @@ func (s *SQLiteRepo) GetConfigByUser(username config.Username) (config.Configura
 	if err != nil {
 		return *cfg, err
 	}
-	row := s.db.QueryRow("SELECT * FROM cloud WHERE user_id = ?", user.Id)
-	if err := row.Scan(&user.Id, &cfg.Cloud.Image, &cfg.Cloud.Region, &cfg.Cloud.LinodeType); err != nil {
+	var managementIps string
+	row := s.db.QueryRow("SELECT user_id, image, region, linode_type, monthly_budget, management_ips, golden_image, bootstrap FROM cloud WHERE user_id = ?", user.Id)
+	if err := row.Scan(&user.Id, &cfg.Cloud.Image, &cfg.Cloud.Region, &cfg.Cloud.LinodeType, &cfg.Cloud.MonthlyBudget, &managementIps, &cfg.Cloud.GoldenImage, &cfg.Cloud.Bootstrap); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return *cfg, ErrNotExists
 		}
 		return *cfg, err
 	}
+	if managementIps != "" {
+		cfg.Cloud.ManagementIps = strings.Split(managementIps, ",")
+	}
 	row = s.db.QueryRow("SELECT * FROM ansible WHERE user_id = ?", user.Id)
 	if err := row.Scan(
 		&user.Id,
@@ -483,38 +928,122 @@ func (s *SQLiteRepo) GetConfigByUser(username config.Username) (config.Configura
 		}
 		return *cfg, err
 	}
-	rows, err := s.db.Query("SELECT * FROM servers WHERE user_id = ?", user.Id)
+	rows, err := s.db.Query("SELECT user_id, name, wan_ipv4, vpn_ipv4, port, wan_ipv6, vpn_ipv6, mtu, persistent_keepalive, preshared_key, listen_port, fwmark, routing_table, key_created, previous_key_expires, priority FROM servers WHERE user_id = ?", user.Id)
 	if err != nil {
 		return *cfg, err
 	}
 	for rows.Next() {
 		var server config.VpnServer
-		if err := rows.Scan(&user.Id, &server.Name, &server.WanIpv4, &server.VpnIpv4, &server.Port); err != nil {
+		var vpnIpv6, keyCreated, previousExpires string
+		if err := rows.Scan(&user.Id, &server.Name, &server.WanIpv4, &server.VpnIpv4, &server.Port, &server.WanIpv6, &vpnIpv6, &server.Options.MTU, &server.Options.PersistentKeepalive, &server.Options.PresharedKey, &server.Options.ListenPort, &server.Options.FwMark, &server.Options.Table, &keyCreated, &previousExpires, &server.Priority); err != nil {
 			return *cfg, err
 		}
+		if server.Key, err = parseKeyLifecycle(keyCreated, previousExpires); err != nil {
+			return *cfg, err
+		}
+		server.VpnIpv6 = net.ParseIP(vpnIpv6)
 		cfg.Service.Servers[server.Name] = server
 	}
 	if err = rows.Err(); err != nil {
 		return *cfg, err
 	}
-	rows, err = s.db.Query("SELECT * FROM clients WHERE user_id = ?", user.Id)
+	rows, err = s.db.Query("SELECT user_id, name, pubkey, vpn_ipv4, default_client, vpn_ipv6, routing, routes, mtu, persistent_keepalive, preshared_key, listen_port, fwmark, routing_table, key_created, previous_key_expires, servers, previous_vpn_ipv4 FROM clients WHERE user_id = ?", user.Id)
 	if err != nil {
 		return *cfg, err
 	}
 	for rows.Next() {
 		var client config.VpnClient
-		if err := rows.Scan(&user.Id, &client.Name, &client.Pubkey, &client.VpnIpv4, &client.Default); err != nil {
+		var vpnIpv6, routes, keyCreated, previousExpires, servers, previousVpnIpv4 string
+		if err := rows.Scan(&user.Id, &client.Name, &client.Pubkey, &client.VpnIpv4, &client.Default, &vpnIpv6, &client.Routing, &routes, &client.Options.MTU, &client.Options.PersistentKeepalive, &client.Options.PresharedKey, &client.Options.ListenPort, &client.Options.FwMark, &client.Options.Table, &keyCreated, &previousExpires, &servers, &previousVpnIpv4); err != nil {
+			return *cfg, err
+		}
+		if client.Key, err = parseKeyLifecycle(keyCreated, previousExpires); err != nil {
 			return *cfg, err
 		}
+		client.Key.PreviousVpnIpv4 = net.ParseIP(previousVpnIpv4)
+		client.VpnIpv6 = net.ParseIP(vpnIpv6)
+		if routes != "" {
+			client.Routes = strings.Split(routes, ",")
+		}
+		if servers != "" {
+			client.Servers = strings.Split(servers, ",")
+		}
 		cfg.Service.Clients[client.Name] = client
 	}
-	row = s.db.QueryRow("SELECT * FROM service WHERE user_id = ?", user.Id)
+	rows, err = s.db.Query("SELECT name, linode_id, linode_type, hourly_price, monthly_price, created, deleted FROM server_usage WHERE user_id = ?", user.Id)
+	if err != nil {
+		return *cfg, err
+	}
+	for rows.Next() {
+		usage := config.ServerUsage{Username: username}
+		var deleted sql.NullTime
+		if err := rows.Scan(&usage.Name, &usage.Id, &usage.Type, &usage.HourlyPrice, &usage.MonthlyPrice, &usage.Created, &deleted); err != nil {
+			return *cfg, err
+		}
+		if deleted.Valid {
+			usage.Deleted = &deleted.Time
+		}
+		cfg.Cloud.Usage = append(cfg.Cloud.Usage, usage)
+	}
+	if err = rows.Err(); err != nil {
+		return *cfg, err
+	}
+	var windows string
+	row = s.db.QueryRow("SELECT enabled, interval, cron, jitter, maintenance_windows, state_path FROM rotation WHERE user_id = ?", user.Id)
+	err = row.Scan(&cfg.Rotation.Enabled, &cfg.Rotation.Interval, &cfg.Rotation.Cron, &cfg.Rotation.Jitter, &windows, &cfg.Rotation.StatePath)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return *cfg, err
+	}
+	if windows != "" {
+		cfg.Rotation.MaintenanceWindows = strings.Split(windows, ";")
+	}
+	var probes string
+	row = s.db.QueryRow("SELECT enabled, interval, failure_threshold, handshake_max_age, probes, history FROM health WHERE user_id = ?", user.Id)
+	err = row.Scan(&cfg.Health.Enabled, &cfg.Health.Interval, &cfg.Health.FailureThreshold, &cfg.Health.HandshakeMaxAge, &probes, &cfg.Health.History)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return *cfg, err
+	}
+	if probes != "" {
+		cfg.Health.Probes = strings.Split(probes, ",")
+	}
+	var lanRanges string
+	row = s.db.QueryRow("SELECT enabled, lan_ranges FROM kill_switch WHERE user_id = ?", user.Id)
+	err = row.Scan(&cfg.KillSwitch.Enabled, &lanRanges)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return *cfg, err
+	}
+	if lanRanges != "" {
+		cfg.KillSwitch.LanRanges = strings.Split(lanRanges, ",")
+	}
+	var dnsServers, upstreamServers string
+	row = s.db.QueryRow("SELECT enabled, servers, upstream, upstream_servers, local FROM dns WHERE user_id = ?", user.Id)
+	err = row.Scan(&cfg.Dns.Enabled, &dnsServers, &cfg.Dns.Upstream, &upstreamServers, &cfg.Dns.Local)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return *cfg, err
+	}
+	if dnsServers != "" {
+		cfg.Dns.Servers = strings.Split(dnsServers, ",")
+	}
+	if upstreamServers != "" {
+		cfg.Dns.UpstreamServers = strings.Split(upstreamServers, ",")
+	}
+	row = s.db.QueryRow("SELECT enabled, interval, overlap FROM key_rotation WHERE user_id = ?", user.Id)
+	err = row.Scan(&cfg.KeyRotation.Enabled, &cfg.KeyRotation.Interval, &cfg.KeyRotation.Overlap)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return *cfg, err
+	}
+	row = s.db.QueryRow("SELECT user_id, vpn_ip, vpn_subnet_mask, vpn_server_port, secrets_backend, secrets_backend_url, vpn_ipv6, server_mtu, server_persistent_keepalive, server_preshared_key, server_fwmark, server_routing_table FROM service WHERE user_id = ?", user.Id)
 	var vpnIp string
-	if err = row.Scan(&user.Id, &vpnIp, &cfg.Service.VpnMask, &cfg.Service.VpnServerPort, &cfg.Service.SecretsBackend, &cfg.Service.SecretsBackendUrl); err != nil {
+	var vpnIpv6 string
+	opts := &cfg.Service.ServerOptions
+	if err = row.Scan(&user.Id, &vpnIp, &cfg.Service.VpnMask, &cfg.Service.VpnServerPort, &cfg.Service.SecretsBackend, &cfg.Service.SecretsBackendUrl, &vpnIpv6, &opts.MTU, &opts.PersistentKeepalive, &opts.PresharedKey, &opts.FwMark, &opts.Table); err != nil {
 		return *cfg, err
 	}
 	_, vpnIpv4, _ := net.ParseCIDR(vpnIp)
 	cfg.Service.VpnAddressSpace = *vpnIpv4
+	if _, vpnNetV6, err := net.ParseCIDR(vpnIpv6); err == nil {
+		cfg.Service.VpnAddressSpaceV6 = *vpnNetV6
+	}
 
 	return *cfg, nil
 
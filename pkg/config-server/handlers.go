@@ -111,6 +111,11 @@ func (e *ExecutionHandler) UpdateUserConfiguration(w http.ResponseWriter, req *h
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err = cfg.ValidateServerOptions(); err != nil {
+		e.Log(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	if err = e.DbHook.UpdateUser(config.ValidateUsername(user), cfg); err != nil {
 		e.Log(err.Error())
 		w.WriteHeader(http.StatusBadRequest)
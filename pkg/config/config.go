@@ -10,8 +10,11 @@ import (
 	"net/http"
 	"net/netip"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
@@ -125,11 +128,29 @@ func (c *Configuration) AddPeerHandler(msg daemonproto.SockMessage) daemonproto.
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
+	if err := peer.ValidateRouting(); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
 	addr, err := c.GetAvailableVpnIpv4()
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Client: "+c.AddClient(addr, peer.Pubkey, peer.Name)+" Successfully added."))
+	name := c.AddClient(addr, peer.Pubkey, peer.Name)
+	client, _ := c.GetClient(peer.Name)
+	client.Routing = peer.Routing
+	client.Routes = peer.Routes
+	client.Servers = peer.Servers
+	if client.Pubkey == "" && c.keygen != nil {
+		pubkey, err := c.keygen(peer.Name)
+		if err != nil {
+			c.RemoveClient(peer.Name)
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		client.Pubkey = pubkey
+		client.Key = KeyLifecycle{Created: time.Now()}
+	}
+	c.putClient(peer.Name, client)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Client: "+name+" Successfully added."))
 }
 
 /*
@@ -148,8 +169,7 @@ func (c *Configuration) DeletePeerHandler(msg daemonproto.SockMessage) daemonpro
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
 
-	delete(c.Service.Clients, peer.Name)
-	err = c.FreeAddress(peer.VpnIpv4.String())
+	err = c.RemoveClient(peer.Name)
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
@@ -167,11 +187,20 @@ func (c *Configuration) AddServerHandler(msg daemonproto.SockMessage) daemonprot
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
+	if err := req.ValidateOptions(); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
 	addr, err := c.GetAvailableVpnIpv4()
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	name := c.AddServer(addr, req.Name, req.WanIpv4, req.Port)
+	name := c.AddServer(addr, req.Name, req.WanIpv4, req.WanIpv6, req.Port)
+	server, _ := c.GetServer(name)
+	server.Priority = req.Priority
+	if req.Options != (TunnelOptions{}) {
+		server.Options = req.Options
+	}
+	c.putServer(name, server)
 	c.Log("address: ", addr.String(), "name:", name)
 	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Server: "+name+" Successfully added."))
 }
@@ -192,8 +221,7 @@ func (c *Configuration) DeleteServerHandler(msg daemonproto.SockMessage) daemonp
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
 
-	delete(c.Service.Servers, server.Name)
-	err = c.FreeAddress(server.VpnIpv4.String())
+	err = c.RemoveServer(server.Name)
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
@@ -233,6 +261,9 @@ Wrapping the reload config functionality in a router friendly interface
 */
 func (c *Configuration) ReloadConfigHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
 	c.cfgIO.Propogate(c)
+	for i := range c.reloadHooks {
+		c.reloadHooks[i]()
+	}
 	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Configuration reloaded successfully."))
 }
 
@@ -264,17 +295,190 @@ type User struct {
 }
 
 type Configuration struct {
-	stream   io.Writer
-	cfgIO    DaemonConfigIO
-	Username Username      `json:"username"`
-	Cloud    cloudConfig   `json:"cloud"`
-	Ansible  ansibleConfig `json:"ansible"`
-	Service  serviceConfig `json:"service"`
-	HostInfo hostInfo      `json:"host_info"`
-}
+	stream      io.Writer
+	cfgIO       DaemonConfigIO
+	reloadHooks []func()
+	keygen      func(string) (string, error)
+	mu          *sync.RWMutex     // guards the servers, clients, VPN addresses and usage records, which the background jobs read while routes change them
+	Username    Username          `json:"username"`
+	Cloud       cloudConfig       `json:"cloud"`
+	Ansible     ansibleConfig     `json:"ansible"`
+	Service     serviceConfig     `json:"service"`
+	HostInfo    hostInfo          `json:"host_info"`
+	Rotation    rotationConfig    `json:"rotation"`
+	Health      healthConfig      `json:"health"`
+	KillSwitch  killSwitchConfig  `json:"kill_switch"`
+	Dns         dnsConfig         `json:"dns"`
+	KeyRotation keyRotationConfig `json:"key_rotation"`
+}
+
+const DefaultWorkflowStatePath = "./.workflow-state.json"
+
+// Ways that the local wireguard tunnel can be managed
+const (
+	TunnelDriverNative  = "native"   // the daemon creates the interface itself, over netlink or with wireguard-go
+	TunnelDriverWgQuick = "wg-quick" // shell out to wg-quick
+)
 
 type hostInfo struct {
 	WireguardSavePath string `json:"wireguard_save_path"`
+	WorkflowStatePath string `json:"workflow_state_path"` // where the progress of the daemons workflows is kept
+	TunnelDriver      string `json:"tunnel_driver"`       // either TunnelDriverNative or TunnelDriverWgQuick, defaults to TunnelDriverNative
+	KeyringPath       string `json:"keyring_path"`        // where the encrypted local keyring is kept, there is no local keyring when empty
+	KeyringKeyFile    string `json:"keyring_key_file"`    // a file with the secret that unlocks the local keyring, YOSAI_KEYRING_PASSPHRASE is used when empty
+	KeyringMode       string `json:"keyring_mode"`        // either KeyringModeCache or KeyringModeStandalone, defaults to KeyringModeCache
+	SystemKeyring     string `json:"system_keyring"`      // one of the SystemKeyring constants, keys are also looked for on the system keyring when set
+	SystemKeyringTTL  string `json:"system_keyring_ttl"`  // how long keys live on a kernel keyring, i.e. '8h', keys dont expire when empty
+}
+
+// How the encrypted local keyring is used
+const (
+	KeyringModeCache      = "cache"      // keys from the secrets backend are kept locally, and used when the backend cant be reached
+	KeyringModeStandalone = "standalone" // the local keyring is the secrets backend
+)
+
+// The system keyrings that keys can be kept on
+const (
+	SystemKeyringKernelSession = "kernel-session" // the kernel keyring of the login session
+	SystemKeyringKernelUser    = "kernel-user"    // the kernel keyring of the user
+	SystemKeyringSecretService = "secret-service" // the desktop keychain, through the freedesktop Secret Service
+)
+
+/*
+Get the path that the workflow runs are persisted to
+*/
+func (c *Configuration) WorkflowStatePath() string {
+	if c.HostInfo.WorkflowStatePath != "" {
+		return c.HostInfo.WorkflowStatePath
+	}
+	return DefaultWorkflowStatePath
+}
+
+const DefaultRotationStatePath = "./.rotation-state.json"
+
+type rotationConfig struct {
+	Enabled            bool     `json:"enabled"`
+	Interval           string   `json:"interval"`            // the time between rotations, i.e. '24h'
+	Cron               string   `json:"cron"`                // a five field cron expression, used instead of the interval when set
+	Jitter             string   `json:"jitter"`              // the most that a rotation is randomly delayed by, i.e. '30m'
+	MaintenanceWindows []string `json:"maintenance_windows"` // when rotations are allowed to start, i.e. 'mon-fri 02:00-04:00'. Empty means any time
+	StatePath          string   `json:"state_path"`          // where the progress of a rotation is kept, so it can be resumed after a restart
+}
+
+/*
+Get the path that the rotation state is persisted to
+*/
+func (c *Configuration) RotationStatePath() string {
+	if c.Rotation.StatePath != "" {
+		return c.Rotation.StatePath
+	}
+	return DefaultRotationStatePath
+}
+
+// The probes that the health checks can run against a server
+const (
+	ProbeHandshake = "handshake" // the age of the latest handshake on the local tunnel, only for the server in use
+	ProbeUdp       = "udp"       // the wireguard port isnt refusing datagrams, a silent port passes so it isnt run by default
+	ProbeSsh       = "ssh"       // the server answers with an SSH banner, not run by default since the firewall may only let the management IPs in
+	ProbeProvider  = "provider"  // the cloud provider reports the server as running
+)
+
+type healthConfig struct {
+	Enabled          bool     `json:"enabled"`
+	Interval         string   `json:"interval"`          // the time between checks, i.e. '30s'
+	FailureThreshold int      `json:"failure_threshold"` // the checks in a row that the server in use has to fail before failing over
+	HandshakeMaxAge  string   `json:"handshake_max_age"` // the oldest that the latest handshake can be before the tunnel is unhealthy, i.e. '5m'
+	Probes           []string `json:"probes"`            // the probes to run, the handshake and provider probes when empty
+	History          int      `json:"history"`           // the number of checks kept for each server
+}
+
+/*
+Get the health probes that are turned on. Only the probes that can tell a server is down are on by
+default, the UDP probe passes a server that drops everything and the SSH port may be firewalled off
+*/
+func (c *Configuration) HealthProbes() []string {
+	if len(c.Health.Probes) == 0 {
+		return []string{ProbeHandshake, ProbeProvider}
+	}
+	return c.Health.Probes
+}
+
+type killSwitchConfig struct {
+	Enabled   bool     `json:"enabled"`    // lock the firewall when the daemon starts
+	LanRanges []string `json:"lan_ranges"` // CIDRs that can still be reached outside of the tunnel, i.e. '192.168.1.0/24'
+}
+
+type keyRotationConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"` // the age that a keypair is due for rotation at, i.e. '2160h'
+	Overlap  string `json:"overlap"`  // how long the previous keypair is kept after a rotation, i.e. '24h'
+}
+
+/*
+When a client or servers keypair was made, and until when the keypair that it replaced is kept around
+*/
+type KeyLifecycle struct {
+	Created         time.Time `json:"created"`           // the zero time when the daemon didnt make the keypair
+	PreviousExpires time.Time `json:"previous_expires"`  // the zero time when there is no previous keypair
+	PreviousVpnIpv4 net.IP    `json:"previous_vpn_ipv4"` // the address kept for a clients previous keypair, nil when there is none
+}
+
+// How the resolver on the exit node forwards queries
+const (
+	DnsUpstreamPlain = "plain" // plain DNS over UDP and TCP
+	DnsUpstreamTls   = "tls"   // DNS over TLS, upstream servers are like '1.1.1.1@853#cloudflare-dns.com'
+	DnsUpstreamHttps = "https" // DNS over HTTPS, upstream servers are like 'https://cloudflare-dns.com/dns-query'
+)
+
+// How the tunnels resolvers are set on the host running the daemon
+const (
+	DnsLocalResolved   = "systemd-resolved"
+	DnsLocalResolvConf = "resolv.conf"
+	DnsLocalNone       = "none" // leave the hosts resolver alone
+)
+
+type dnsConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Servers         []string `json:"servers"`          // resolvers reached through the tunnel, the exit nodes own resolver when empty
+	Upstream        string   `json:"upstream"`         // either DnsUpstreamPlain, DnsUpstreamTls or DnsUpstreamHttps, defaults to DnsUpstreamPlain
+	UpstreamServers []string `json:"upstream_servers"` // where the exit nodes resolver forwards queries to
+	Local           string   `json:"local"`            // either DnsLocalResolved, DnsLocalResolvConf or DnsLocalNone, detected when empty
+}
+
+/*
+Get the resolvers that a client should use through the tunnel to a server, none when DNS is turned off
+
+	:param server: the server that the tunnel goes to
+*/
+func (c *Configuration) DnsServers(server VpnServer) []string {
+	if !c.Dns.Enabled {
+		return nil
+	}
+	if len(c.Dns.Servers) != 0 {
+		return c.Dns.Servers
+	}
+	servers := []string{server.VpnIpv4.String()}
+	if server.VpnIpv6 != nil {
+		servers = append(servers, server.VpnIpv6.String())
+	}
+	return servers
+}
+
+/*
+Check if the exit nodes run a resolver of their own for the clients
+*/
+func (c *Configuration) ExitNodeResolver() bool {
+	return c.Dns.Enabled && len(c.Dns.Servers) == 0
+}
+
+/*
+Get how the exit nodes resolver forwards queries
+*/
+func (c *Configuration) DnsUpstream() string {
+	if c.Dns.Upstream == "" {
+		return DnsUpstreamPlain
+	}
+	return c.Dns.Upstream
 }
 
 type ansibleConfig struct {
@@ -287,9 +491,11 @@ type serviceConfig struct {
 	Servers           map[string]VpnServer `json:"servers"`
 	Clients           map[string]VpnClient `json:"clients"`
 	VpnAddressSpace   net.IPNet            `json:"vpn_address_space"`
-	VpnAddresses      map[string]bool      `json:"vpn_addresses"` // Each key is a IPv4 in the VPN, and its corresponding value is what denotes if its in use or not. False == 'In use', True == 'available'
-	VpnMask           int                  `json:"vpn_mask"`      // The mask of the VPN
+	VpnAddressSpaceV6 net.IPNet            `json:"vpn_address_space_v6"` // a ULA prefix, allocated alongside the IPv4 address space
+	VpnAddresses      map[string]bool      `json:"vpn_addresses"`        // Each key is a IPv4 in the VPN, and its corresponding value is what denotes if its in use or not. False == 'In use', True == 'available'
+	VpnMask           int                  `json:"vpn_mask"`             // The mask of the VPN
 	VpnServerPort     int                  `json:"vpn_server_port"`
+	ServerOptions     TunnelOptions        `json:"server_options"` // the options that new servers start with
 	SecretsBackend    string               `json:"secrets_backend"`
 	SecretsBackendUrl string               `json:"secrets_backend_url"`
 	AnsibleBackend    string               `json:"ansible_backend"`
@@ -297,6 +503,7 @@ type serviceConfig struct {
 }
 
 func (c *Configuration) GetServer(name string) (VpnServer, error) {
+	defer c.rlock()()
 	server, ok := c.Service.Servers[name]
 	if ok {
 		return server, nil
@@ -311,6 +518,7 @@ func (c *Configuration) GetServer(name string) (VpnServer, error) {
 }
 
 func (c *Configuration) GetClient(name string) (VpnClient, error) {
+	defer c.rlock()()
 	client, ok := c.Service.Clients[name]
 	if ok {
 		return client, nil
@@ -324,12 +532,107 @@ func (c *Configuration) GetClient(name string) (VpnClient, error) {
 
 }
 
+/*
+Get a copy of the servers, so they can be ranged over while the configuration is being changed
+*/
+func (c *Configuration) Servers() map[string]VpnServer {
+	defer c.rlock()()
+	servers := make(map[string]VpnServer, len(c.Service.Servers))
+	for name, server := range c.Service.Servers {
+		servers[name] = server
+	}
+	return servers
+}
+
+/*
+Get a copy of the clients, so they can be ranged over while the configuration is being changed
+*/
+func (c *Configuration) Clients() map[string]VpnClient {
+	defer c.rlock()()
+	clients := make(map[string]VpnClient, len(c.Service.Clients))
+	for name, client := range c.Service.Clients {
+		clients[name] = client
+	}
+	return clients
+}
+
+/*
+Remove a server from the configuration and free up its VPN address
+
+	:param name: the name of the server
+*/
+func (c *Configuration) RemoveServer(name string) error {
+	defer c.lock()()
+	server, ok := c.Service.Servers[name]
+	if !ok {
+		return &ServerNotFound{}
+	}
+	delete(c.Service.Servers, name)
+	return c.freeAddress(server.VpnIpv4.String())
+}
+
+/*
+Remove a client from the configuration and free up its VPN address
+
+	:param name: the name of the client
+*/
+func (c *Configuration) RemoveClient(name string) error {
+	defer c.lock()()
+	client, ok := c.Service.Clients[name]
+	if !ok {
+		return &ServerNotFound{}
+	}
+	delete(c.Service.Clients, name)
+	if client.Key.PreviousVpnIpv4 != nil {
+		c.freeAddress(client.Key.PreviousVpnIpv4.String())
+	}
+	return c.freeAddress(client.VpnIpv4.String())
+}
+
+func (c *Configuration) putServer(name string, server VpnServer) {
+	defer c.lock()()
+	c.Service.Servers[name] = server
+}
+
+func (c *Configuration) putClient(name string, client VpnClient) {
+	defer c.lock()()
+	c.Service.Clients[name] = client
+}
+
+/*
+Lock the servers, clients and VPN addresses for writing, returning the function that unlocks them. Configurations
+that werent made with NewConfiguration arent shared between goroutines, so they arent locked.
+*/
+func (c *Configuration) lock() func() {
+	if c.mu == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	return c.mu.Unlock
+}
+
+/*
+Lock the servers, clients and VPN addresses for reading, returning the function that unlocks them
+*/
+func (c *Configuration) rlock() func() {
+	if c.mu == nil {
+		return func() {}
+	}
+	c.mu.RLock()
+	return c.mu.RUnlock
+}
+
 /*
 Add a VPN server to the Service configuration
 
-	:param server: a VpnServer struct modeling the data that comprises of a VPN server
+	:param addr: a net.IP gotten from GetAvailableVpnIpv4(), the servers VPN IPv6 is derived from it
+	:param name: the name of the server
+	:param wan: the public IPv4 of the server
+	:param wan6: the public IPv6 of the server, empty if it doesnt have one
+	:param port: the port wireguard listens on
 */
-func (c *Configuration) AddServer(addr net.IP, name string, wan string, port int) string {
+func (c *Configuration) AddServer(addr net.IP, name string, wan string, wan6 string, port int) string {
+	defer c.lock()()
 	server, ok := c.Service.Servers[name]
 	var serverLabel string
 	if ok {
@@ -337,7 +640,7 @@ func (c *Configuration) AddServer(addr net.IP, name string, wan string, port int
 	} else {
 		serverLabel = name
 	}
-	c.Service.Servers[serverLabel] = VpnServer{Name: serverLabel, WanIpv4: wan, VpnIpv4: addr, Port: port}
+	c.Service.Servers[serverLabel] = VpnServer{Name: serverLabel, WanIpv4: wan, WanIpv6: wan6, VpnIpv4: addr, VpnIpv6: c.VpnIpv6For(addr), Port: port, Options: c.Service.ServerOptions}
 	return serverLabel
 
 }
@@ -345,15 +648,96 @@ func (c *Configuration) AddServer(addr net.IP, name string, wan string, port int
 type VpnClient struct {
 	Name    string `json:"name"`
 	VpnIpv4 net.IP
-	Pubkey  string `json:"pubkey"`
-	Default bool   `json:"default"`
+	VpnIpv6 net.IP        `json:"vpn_ipv6"` // derived from the VpnIpv4, see VpnIpv6For
+	Pubkey  string        `json:"pubkey"`
+	Default bool          `json:"default"`
+	Routing string        `json:"routing"` // either RoutingFull, RoutingInclude or RoutingExclude, defaults to RoutingFull
+	Routes  []string      `json:"routes"`  // the CIDRs, addresses or domains that the routing policy includes or excludes
+	Servers []string      `json:"servers"` // the servers the client is authorized for, every server when empty
+	Options TunnelOptions `json:"options"`
+	Key     KeyLifecycle  `json:"key"`
 }
 
 type VpnServer struct {
-	Name    string `json:"name"`     // this Label is what is used to index that server and its data within the Daemons model of the VPN environment
-	WanIpv4 string `json:"wan_ipv4"` // Public IPv4
-	VpnIpv4 net.IP // the IP address that the server will occupy on the network
-	Port    int
+	Name     string `json:"name"`     // this Label is what is used to index that server and its data within the Daemons model of the VPN environment
+	WanIpv4  string `json:"wan_ipv4"` // Public IPv4
+	WanIpv6  string `json:"wan_ipv6"` // Public IPv6, empty if the provider didnt assign one
+	VpnIpv4  net.IP // the IP address that the server will occupy on the network
+	VpnIpv6  net.IP `json:"vpn_ipv6"` // the IPv6 address that the server will occupy on the network, derived from the VpnIpv4
+	Port     int
+	Priority int           `json:"priority"` // servers with a lower priority are preferred by failover tunnels, ties go by name
+	Options  TunnelOptions `json:"options"`  // servers always listen on their Port, so the ListenPort option is rejected, see ValidateOptions
+	Key      KeyLifecycle  `json:"key"`
+}
+
+/*
+Check that a servers options are ones that a server can use. Servers always listen on their Port, and a
+clients options are filled in from its servers, so a ListenPort on a server is rejected rather than ignored.
+*/
+func (v VpnServer) ValidateOptions() error {
+	if v.Options.ListenPort != 0 {
+		return &ConfigError{Msg: "server: " + v.Name + " sets the listen_port option, servers listen on their port"}
+	}
+	return nil
+}
+
+/*
+Check the options that new servers start with, and the options of every server
+*/
+func (c *Configuration) ValidateServerOptions() error {
+	defer c.rlock()()
+	if c.Service.ServerOptions.ListenPort != 0 {
+		return &ConfigError{Msg: "the server_options set the listen_port option, servers listen on their port"}
+	}
+	for _, server := range c.Service.Servers {
+		if err := server.ValidateOptions(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Get the servers own addresses on the VPN as host prefixes, i.e. '10.0.0.1/32'
+*/
+func (v VpnServer) VpnAddresses() []string {
+	addrs := []string{v.VpnIpv4.String() + "/32"}
+	if v.VpnIpv6 != nil {
+		addrs = append(addrs, v.VpnIpv6.String()+"/128")
+	}
+	return addrs
+}
+
+/*
+Options for a wireguard interface and its peers. A clients options take precedence over the options of
+the server it connects to, and the zero value of each option leaves it out of the configuration.
+*/
+type TunnelOptions struct {
+	MTU                 int    `json:"mtu"`
+	PersistentKeepalive int    `json:"persistent_keepalive"` // seconds between keepalives
+	PresharedKey        bool   `json:"preshared_key"`        // add a preshared key, generated for each client and server pair
+	ListenPort          int    `json:"listen_port"`
+	FwMark              int    `json:"fwmark"`
+	Table               string `json:"table"` // the routing table for the routes to the peers, 'off', 'auto' or a table number
+}
+
+/*
+Get the options for a clients tunnel to a server, taking the servers options where the client doesnt set them.
+The listen port, fwmark and routing table are only taken from the client, as they are local to its interface.
+
+	    :param client: the client that the tunnel is for
+		:param server: the server that the tunnel goes to
+*/
+func ClientTunnelOptions(client VpnClient, server VpnServer) TunnelOptions {
+	opts := client.Options
+	if opts.MTU == 0 {
+		opts.MTU = server.Options.MTU
+	}
+	if opts.PersistentKeepalive == 0 {
+		opts.PersistentKeepalive = server.Options.PersistentKeepalive
+	}
+	opts.PresharedKey = opts.PresharedKey || server.Options.PresharedKey
+	return opts
 }
 
 /*
@@ -361,6 +745,7 @@ Retrieve an available IPv4 from the VPN's set address space. Returns an error if
 parsed to a valid IPv4, or if there are no available addresses left.
 */
 func (c *Configuration) GetAvailableVpnIpv4() (net.IP, error) {
+	defer c.lock()()
 	for addr, used := range c.Service.VpnAddresses {
 		if !used {
 			parsedAddr := net.ParseIP(addr)
@@ -379,6 +764,7 @@ func (c *Configuration) GetAvailableVpnIpv4() (net.IP, error) {
 Return all of the clients from the client list
 */
 func (c *Configuration) VpnClients() []VpnClient {
+	defer c.rlock()()
 	clients := []VpnClient{}
 	for _, val := range c.Service.Clients {
 		clients = append(clients, val)
@@ -390,6 +776,7 @@ func (c *Configuration) VpnClients() []VpnClient {
 Get the default VPN client
 */
 func (c *Configuration) DefaultClient() (VpnClient, error) {
+	defer c.rlock()()
 	for name := range c.Service.Clients {
 		if c.Service.Clients[name].Default {
 			return c.Service.Clients[name], nil
@@ -422,6 +809,7 @@ Register a client as a VPN client. This configuration will be propogated into se
 		:param name: the name/label of this client
 */
 func (c *Configuration) AddClient(addr net.IP, pubkey string, name string) string {
+	defer c.lock()()
 	client, ok := c.Service.Clients[name]
 	var clientLabel string
 	if ok {
@@ -429,7 +817,7 @@ func (c *Configuration) AddClient(addr net.IP, pubkey string, name string) strin
 	} else {
 		clientLabel = name
 	}
-	c.Service.Clients[name] = VpnClient{Name: clientLabel, Pubkey: pubkey, VpnIpv4: addr}
+	c.Service.Clients[name] = VpnClient{Name: clientLabel, Pubkey: pubkey, VpnIpv4: addr, VpnIpv6: c.VpnIpv6For(addr)}
 	return clientLabel
 }
 
@@ -437,6 +825,11 @@ func (c *Configuration) AddClient(addr net.IP, pubkey string, name string) strin
 Frees up an address to be used
 */
 func (c *Configuration) FreeAddress(addr string) error {
+	defer c.lock()()
+	return c.freeAddress(addr)
+}
+
+func (c *Configuration) freeAddress(addr string) error {
 	_, ok := c.Service.VpnAddresses[addr]
 	if !ok {
 		return &VpnAddressSpaceError{Msg: "Address: " + addr + " is not in the designated VPN Address space."}
@@ -449,16 +842,44 @@ func (c *Configuration) FreeAddress(addr string) error {
 Get all of the in use addresses for the VPN
 */
 func (c *Configuration) AllVpnAddresses() []net.IP {
+	defer c.rlock()()
+	return c.allVpnAddresses()
+}
+
+func (c *Configuration) allVpnAddresses() []net.IP {
 	addrs := []net.IP{}
 	for i := range c.Service.Servers {
 		addrs = append(addrs, c.Service.Servers[i].VpnIpv4)
 	}
 	for i := range c.Service.Clients {
 		addrs = append(addrs, c.Service.Clients[i].VpnIpv4)
+		if c.Service.Clients[i].Key.PreviousVpnIpv4 != nil {
+			addrs = append(addrs, c.Service.Clients[i].Key.PreviousVpnIpv4)
+		}
 	}
 	return addrs
 }
 
+/*
+Get all of the addresses that are marked as in use, but arent assigned to a server or client
+*/
+func (c *Configuration) LeakedVpnAddresses() []string {
+	defer c.rlock()()
+	assigned := map[string]bool{}
+	inUse := c.allVpnAddresses()
+	for i := range inUse {
+		assigned[inUse[i].String()] = true
+	}
+	leaked := []string{}
+	for addr, used := range c.Service.VpnAddresses {
+		if used && !assigned[addr] {
+			leaked = append(leaked, addr)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
 type VpnAddressSpaceError struct {
 	Msg string
 }
@@ -471,10 +892,61 @@ type ServerNotFound struct{}
 
 func (s *ServerNotFound) Error() string { return "Server with the priority passed was not found." }
 
+// Ways that a new server can be configured after it is provisioned
+const (
+	BootstrapAnsible   = "ansible"    // run the rotation playbook through the ansible backend
+	BootstrapCloudInit = "cloud-init" // pass a rendered cloud-init user-data document to the cloud provider
+)
+
 type cloudConfig struct {
-	Image      string `json:"image"`
-	Region     string `json:"region"`
-	LinodeType string `json:"linode_type"`
+	Image         string        `json:"image"`
+	Region        string        `json:"region"`
+	LinodeType    string        `json:"linode_type"`
+	Bootstrap     string        `json:"bootstrap"`      // either BootstrapAnsible or BootstrapCloudInit, defaults to BootstrapAnsible even with a golden image
+	MonthlyBudget float64       `json:"monthly_budget"` // refuse to create servers that would put the months spend over this, 0 disables the check
+	Usage         []ServerUsage `json:"usage"`          // creation and deletion records for every server the daemon has created
+	ManagementIps []string      `json:"management_ips"` // addresses or CIDRs that are allowed to SSH to the VPN servers through the cloud firewall
+	GoldenImage   string        `json:"golden_image"`   // a private image with the VPN packages baked in, new servers boot from it when set
+}
+
+/*
+Check if new servers are configured with cloud-init rather than through ansible. This only follows the
+bootstrap setting, servers booted from a golden image are still configured by ansible unless it is set
+to BootstrapCloudInit.
+*/
+func (c *Configuration) UsesCloudInit() bool {
+	return c.Cloud.Bootstrap == BootstrapCloudInit
+}
+
+/*
+Get the image that new servers should boot from, preferring the golden image when one has been built
+*/
+func (c *Configuration) BootImage() string {
+	if image := c.GoldenImage(); image != "" {
+		return image
+	}
+	return c.Cloud.Image
+}
+
+/*
+Get the golden image that new servers boot from, empty when none has been built
+*/
+func (c *Configuration) GoldenImage() string {
+	defer c.rlock()()
+	return c.Cloud.GoldenImage
+}
+
+/*
+Replace the golden image that new servers boot from, returning the previous one. Image builds run in the
+background, so the image is set under the configuration lock.
+
+	:param image: the ID of the new golden image
+*/
+func (c *Configuration) SetGoldenImage(image string) string {
+	defer c.lock()()
+	previous := c.Cloud.GoldenImage
+	c.Cloud.GoldenImage = image
+	return previous
 }
 
 /*
@@ -489,6 +961,125 @@ func (c *Configuration) SetConfigIO(impl DaemonConfigIO) {
 	c.cfgIO = impl
 }
 
+/*
+Register a function to run after the configuration has been reloaded, so that anything built from the
+configuration can be brought back in line with it
+
+	:param hook: the function to call after every reload
+*/
+func (c *Configuration) OnReload(hook func()) {
+	c.reloadHooks = append(c.reloadHooks, hook)
+}
+
+/*
+Set how keypairs are made for clients that are added without a public key
+
+	:param keygen: makes and stores a keypair for the named client, returning its public key
+*/
+func (c *Configuration) SetKeyGenerator(keygen func(string) (string, error)) {
+	c.keygen = keygen
+}
+
+/*
+Get the servers that a client is authorized for, ordered by priority and then by name
+
+	:param client: the client to get the servers for
+*/
+func (c *Configuration) ClientServers(client VpnClient) []VpnServer {
+	defer c.rlock()()
+	servers := []VpnServer{}
+	for _, server := range c.Service.Servers {
+		if len(client.Servers) == 0 || slices.Contains(client.Servers, server.Name) {
+			servers = append(servers, server)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Priority != servers[j].Priority {
+			return servers[i].Priority < servers[j].Priority
+		}
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+/*
+Get the names of every client and server, which are also the names that their keypairs are kept under
+*/
+func (c *Configuration) KeyHolders() []string {
+	defer c.rlock()()
+	names := []string{}
+	for name := range c.Service.Clients {
+		names = append(names, name)
+	}
+	for name := range c.Service.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Get the keypair lifecycle of a client or server
+
+	:param name: the name of the client or server
+*/
+func (c *Configuration) KeyLifecycleOf(name string) (KeyLifecycle, error) {
+	defer c.rlock()()
+	if client, ok := c.Service.Clients[name]; ok {
+		return client.Key, nil
+	}
+	if server, ok := c.Service.Servers[name]; ok {
+		return server.Key, nil
+	}
+	return KeyLifecycle{}, &ConfigError{Msg: "no client or server named: " + name}
+}
+
+/*
+Record a new keypair lifecycle for a client or server. Only clients keep their public key in the
+configuration, servers public keys are only kept on the keyring
+
+	    :param name: the name of the client or server
+		:param lifecycle: the new lifecycle of its keypair
+		:param pubkey: the public key of a clients new keypair, left as is when empty
+*/
+func (c *Configuration) SetKeyLifecycle(name string, lifecycle KeyLifecycle, pubkey string) error {
+	defer c.lock()()
+	if client, ok := c.Service.Clients[name]; ok {
+		client.Key = lifecycle
+		if pubkey != "" {
+			client.Pubkey = pubkey
+		}
+		c.Service.Clients[name] = client
+		return nil
+	}
+	if server, ok := c.Service.Servers[name]; ok {
+		server.Key = lifecycle
+		c.Service.Servers[name] = server
+		return nil
+	}
+	return &ConfigError{Msg: "no client or server named: " + name}
+}
+
+/*
+Move a client onto a new VPN address, returning the address it had. Wireguard only routes an address to one
+peer, so a client that is given a new keypair is moved to a new address, and its previous keypair keeps the old one
+
+	    :param name: the name of the client
+		:param addr: a net.IP gotten from GetAvailableVpnIpv4()
+*/
+func (c *Configuration) ReaddressClient(name string, addr net.IP) (net.IP, error) {
+	defer c.lock()()
+	client, ok := c.Service.Clients[name]
+	if !ok {
+		return nil, &ConfigError{Msg: "no client named: " + name}
+	}
+	previous := client.VpnIpv4
+	client.VpnIpv4 = addr
+	client.VpnIpv6 = c.VpnIpv6For(addr)
+	c.Service.Clients[name] = client
+	return previous, nil
+}
+
 func (c *Configuration) SetStreamIO(impl io.Writer) {
 	c.stream = impl
 }
@@ -497,6 +1088,7 @@ func (c *Configuration) SetStreamIO(impl io.Writer) {
 Calculate the VPN space details
 */
 func (c *Configuration) CalculateVpnSpace() error {
+	defer c.lock()()
 
 	mask, _ := c.Service.VpnAddressSpace.Mask.Size()
 	vpnNetwork := fmt.Sprintf("%s/%v", c.Service.VpnAddressSpace.IP.String(), mask)
@@ -509,14 +1101,18 @@ func (c *Configuration) CalculateVpnSpace() error {
 	for i := range addresses.Ipv4s {
 		addrSpace[addresses.Ipv4s[i].String()] = false
 	}
-	usedAddresses := c.AllVpnAddresses()
+	c.Service.VpnAddresses = addrSpace
+	usedAddresses := c.allVpnAddresses()
 	for i := range usedAddresses {
 		c.Log("Checking: ", usedAddresses[i].String())
 		c.Service.VpnAddresses[usedAddresses[i].String()] = true
 	}
-	c.Service.VpnAddresses = addrSpace
 	c.Service.VpnAddressSpace = *ntwrk
 	c.Service.VpnMask = addresses.Mask
+	if c.Service.VpnAddressSpaceV6.IP == nil {
+		c.Service.VpnAddressSpaceV6 = UlaPrefix(string(c.Username) + ntwrk.String())
+	}
+	c.assignVpnIpv6()
 	return nil
 }
 
@@ -536,6 +1132,34 @@ func (c ConfigurationBuilder) readFiles() {
 
 func (c ConfigurationBuilder) readServer() {}
 
+/*
+Load a configuration that a DaemonConfigIO read, building it up on its own and then swapping it in under the
+lock, so that the background jobs never see a configuration that is only partly loaded
+
+	:param b: the JSON encoded configuration
+*/
+func (c *Configuration) load(b []byte) error {
+	loaded := NewConfiguration(c.stream, c.Username)
+	if err := json.Unmarshal(b, loaded); err != nil {
+		return err
+	}
+	if err := loaded.CalculateVpnSpace(); err != nil {
+		return err
+	}
+	defer c.lock()()
+	c.Username = loaded.Username
+	c.Cloud = loaded.Cloud
+	c.Ansible = loaded.Ansible
+	c.Service = loaded.Service
+	c.HostInfo = loaded.HostInfo
+	c.Rotation = loaded.Rotation
+	c.Health = loaded.Health
+	c.KillSwitch = loaded.KillSwitch
+	c.Dns = loaded.Dns
+	c.KeyRotation = loaded.KeyRotation
+	return nil
+}
+
 type ConfigHostImpl struct {
 	path string
 }
@@ -550,11 +1174,7 @@ func (c ConfigHostImpl) Propogate(config *Configuration) {
 		log.Fatal(err)
 	}
 
-	err = json.Unmarshal(b, config)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = config.CalculateVpnSpace()
+	err = config.load(b)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -588,11 +1208,7 @@ func (s ConfigServerImpl) Propogate(config *Configuration) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err = json.Unmarshal(resp, &config); err != nil {
-		log.Fatal(err)
-	}
-	err = config.CalculateVpnSpace()
-	if err != nil {
+	if err = config.load(resp); err != nil {
 		log.Fatal(err)
 	}
 
@@ -669,7 +1285,7 @@ func (s ConfigServerImpl) post(body interface{}, path string) ([]byte, error) {
 Create a new Configuration struct with initialized maps
 */
 func NewConfiguration(stream io.Writer, username Username) *Configuration {
-	return &Configuration{Username: username, stream: stream, Service: serviceConfig{Servers: map[string]VpnServer{}, Clients: map[string]VpnClient{}, VpnAddresses: map[string]bool{}}}
+	return &Configuration{Username: username, stream: stream, mu: &sync.RWMutex{}, Service: serviceConfig{Servers: map[string]VpnServer{}, Clients: map[string]VpnClient{}, VpnAddresses: map[string]bool{}}}
 }
 
 func BlankConfig(path string) error {
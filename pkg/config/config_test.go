@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentServerAccess(t *testing.T) {
+	conf := NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	if err := conf.CalculateVpnSpace(); err != nil {
+		t.Fatal(err)
+	}
+	conf.Cloud.MonthlyBudget = 1000
+	now := time.Now()
+
+	// the routes change the servers and clients while the background jobs read them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("exit-%d-%d", i, j)
+				addr, err := conf.GetAvailableVpnIpv4()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conf.AddServer(addr, name, "5.5.5.5", "", 51820)
+				conf.SetKeyLifecycle(name, KeyLifecycle{}, "")
+				conf.RecordServerCreated(ServerUsage{Username: "test", Name: name, Id: i*100 + j, HourlyPrice: 0.01, Created: now})
+				conf.RecordServerDeleted(i*100+j, now)
+				if err := conf.RemoveServer(name); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for name := range conf.Servers() {
+					conf.KeyLifecycleOf(name)
+				}
+				conf.KeyHolders()
+				conf.LeakedVpnAddresses()
+				if err := conf.CheckBudget(0.01, 5, now); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(conf.Servers()) != 0 {
+		t.Errorf("expected every server to be removed, got: %v", conf.Servers())
+	}
+	if leaked := conf.LeakedVpnAddresses(); len(leaked) != 0 {
+		t.Errorf("expected every address to be freed, got: %v", leaked)
+	}
+	if len(conf.Cloud.Usage) != 200 {
+		t.Errorf("expected a usage record for every server, got: %v", len(conf.Cloud.Usage))
+	}
+}
+
+func TestUsesCloudInit(t *testing.T) {
+	c := NewConfiguration(io.Discard, "test")
+	c.Cloud.Image = "linode/debian12"
+	if c.UsesCloudInit() || c.BootImage() != "linode/debian12" {
+		t.Errorf("expected ansible and the stock image by default, got cloud-init: %v image: %s", c.UsesCloudInit(), c.BootImage())
+	}
+	// a golden image doesnt change how servers are configured
+	if previous := c.SetGoldenImage("private/1"); previous != "" {
+		t.Errorf("expected no previous golden image, got: %s", previous)
+	}
+	if c.UsesCloudInit() || c.BootImage() != "private/1" {
+		t.Errorf("expected ansible and the golden image, got cloud-init: %v image: %s", c.UsesCloudInit(), c.BootImage())
+	}
+	c.Cloud.Bootstrap = BootstrapCloudInit
+	if !c.UsesCloudInit() {
+		t.Error("expected cloud-init once it is set as the bootstrap")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	c := NewConfiguration(io.Discard, "test")
+	for _, probe := range c.HealthProbes() {
+		if probe == ProbeUdp || probe == ProbeSsh {
+			t.Errorf("expected the %s probe to be off by default", probe)
+		}
+	}
+	c.Health.Probes = []string{ProbeSsh}
+	if probes := c.HealthProbes(); len(probes) != 1 || probes[0] != ProbeSsh {
+		t.Errorf("expected the configured probes, got: %v", probes)
+	}
+}
+
+func TestValidateServerOptions(t *testing.T) {
+	c := NewConfiguration(io.Discard, "test")
+	c.AddServer(net.ParseIP("10.0.0.1"), "exit", "1.1.1.1", "", 51820)
+	if err := c.ValidateServerOptions(); err != nil {
+		t.Fatal(err)
+	}
+	server, _ := c.GetServer("exit")
+	server.Options.ListenPort = 51821
+	c.putServer("exit", server)
+	if err := c.ValidateServerOptions(); err == nil {
+		t.Error("expected a servers listen port to be rejected")
+	}
+	c.RemoveServer("exit")
+	c.Service.ServerOptions.ListenPort = 51821
+	if err := c.ValidateServerOptions(); err == nil {
+		t.Error("expected a listen port in the server options to be rejected")
+	}
+}
+
+func TestReloadWhileReading(t *testing.T) {
+	saved := NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	saved.Service.VpnAddressSpace = *space
+	saved.AddServer(net.ParseIP("10.8.0.1"), "exit", "5.5.5.5", "", 51820)
+	b, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := NewConfiguration(io.Discard, "test")
+	host := NewConfigHostImpl(file)
+	host.Propogate(conf)
+	// the background jobs keep reading the servers while the configuration is reloaded
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			host.Propogate(conf)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if _, ok := conf.Servers()["exit"]; !ok {
+				t.Error("expected the server to be there throughout the reloads")
+				return
+			}
+			conf.LeakedVpnAddresses()
+		}
+	}()
+	wg.Wait()
+	if !conf.Service.VpnAddresses["10.8.0.1"] {
+		t.Error("expected the address of the loaded server to be in use")
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+const VpnIpv6PrefixLen = 64
+
+/*
+Build a unique local IPv6 prefix (RFC 4193) for the VPN. The global ID is taken from a hash of the seed
+rather than being random, so that the same VPN always ends up with the same prefix even if it was never saved.
+
+	:param seed: a value unique to the VPN, the username and IPv4 network are used by the daemon
+*/
+func UlaPrefix(seed string) net.IPNet {
+	sum := sha1.Sum([]byte(seed))
+	prefix := make(net.IP, net.IPv6len)
+	prefix[0] = 0xfd
+	copy(prefix[1:6], sum[:5])
+	return net.IPNet{IP: prefix, Mask: net.CIDRMask(VpnIpv6PrefixLen, 128)}
+}
+
+/*
+Get the IPv6 VPN address that pairs with an IPv4 VPN address. The offset of the IPv4 address into the IPv4
+address space is used as the interface ID in the IPv6 prefix, so that the two are allocated together and
+freeing the IPv4 address frees the IPv6 one. Returns nil if there is no IPv6 address space, or if the
+address isnt in the IPv4 address space.
+
+	:param addr: the IPv4 VPN address
+*/
+func (c *Configuration) VpnIpv6For(addr net.IP) net.IP {
+	v4 := addr.To4()
+	network := c.Service.VpnAddressSpace.IP.To4()
+	prefix := c.Service.VpnAddressSpaceV6.IP.To16()
+	if v4 == nil || network == nil || prefix == nil || !c.Service.VpnAddressSpace.Contains(v4) {
+		return nil
+	}
+	offset := binary.BigEndian.Uint32(v4) - binary.BigEndian.Uint32(network)
+	v6 := make(net.IP, net.IPv6len)
+	copy(v6, prefix)
+	binary.BigEndian.PutUint32(v6[12:], offset)
+	return v6
+}
+
+/*
+Format an IP address, returning an empty string rather than '<nil>' for a missing address, like the IPv6
+address of a server or client when there is no IPv6 address space
+
+	:param addr: the address to format
+*/
+func IpString(addr net.IP) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+/*
+Give any servers or clients that were added before the IPv6 address space existed their IPv6 address
+*/
+func (c *Configuration) assignVpnIpv6() {
+	for name, server := range c.Service.Servers {
+		if server.VpnIpv6 == nil {
+			server.VpnIpv6 = c.VpnIpv6For(server.VpnIpv4)
+			c.Service.Servers[name] = server
+		}
+	}
+	for name, client := range c.Service.Clients {
+		if client.VpnIpv6 == nil {
+			client.VpnIpv6 = c.VpnIpv6For(client.VpnIpv4)
+			c.Service.Clients[name] = client
+		}
+	}
+}
+
+/*
+Return the VPN IPv6 network in CIDR notation, or an empty string if there isnt one
+*/
+func (c *Configuration) VpnNetworkV6() string {
+	if c.Service.VpnAddressSpaceV6.IP == nil {
+		return ""
+	}
+	return c.Service.VpnAddressSpaceV6.String()
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUlaPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		seed string
+		want string
+	}{
+		{"aeth10.8.0.0/24", "fdae:7a0:d5e::/64"},
+		{"", "fdda:39a3:ee5e::/64"},
+	} {
+		prefix := UlaPrefix(tc.seed)
+		if prefix.String() != tc.want {
+			t.Errorf("unexpected prefix for %q:\n got: %s\nwant: %s", tc.seed, prefix.String(), tc.want)
+		}
+		// the same seed always gives the same prefix
+		if again := UlaPrefix(tc.seed); again.String() != prefix.String() {
+			t.Errorf("expected the prefix for %q to be stable, got: %s and %s", tc.seed, prefix.String(), again.String())
+		}
+	}
+	alice, bob := UlaPrefix("alice"), UlaPrefix("bob")
+	if alice.String() == bob.String() {
+		t.Error("expected different seeds to give different prefixes")
+	}
+}
+
+func TestVpnIpv6For(t *testing.T) {
+	c := NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	c.Service.VpnAddressSpace = *space
+	_, spaceV6, _ := net.ParseCIDR("fd00:1234:5678::/64")
+	c.Service.VpnAddressSpaceV6 = *spaceV6
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"10.8.0.0", "fd00:1234:5678::"},
+		{"10.8.0.1", "fd00:1234:5678::1"},
+		{"10.8.0.255", "fd00:1234:5678::ff"},
+		{"10.9.0.1", ""},
+		{"fd00::1", ""},
+	} {
+		if got := IpString(c.VpnIpv6For(net.ParseIP(tc.addr))); got != tc.want {
+			t.Errorf("unexpected IPv6 address for %s:\n got: %q\nwant: %q", tc.addr, got, tc.want)
+		}
+	}
+	if got := c.VpnIpv6For(nil); got != nil {
+		t.Errorf("expected no IPv6 address for a missing address, got: %s", got)
+	}
+
+	// without an IPv6 address space nothing is paired
+	c.Service.VpnAddressSpaceV6 = net.IPNet{}
+	if got := c.VpnIpv6For(net.ParseIP("10.8.0.1")); got != nil {
+		t.Errorf("expected no IPv6 address without an IPv6 address space, got: %s", got)
+	}
+}
+
+func TestIpString(t *testing.T) {
+	for _, tc := range []struct {
+		addr net.IP
+		want string
+	}{
+		{nil, ""},
+		{net.ParseIP("10.8.0.1"), "10.8.0.1"},
+		{net.ParseIP("fd00::1"), "fd00::1"},
+	} {
+		if got := IpString(tc.addr); got != tc.want {
+			t.Errorf("unexpected string for %#v: got %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
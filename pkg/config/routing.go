@@ -0,0 +1,232 @@
+package config
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// How much of a clients traffic goes through the tunnel
+const (
+	RoutingFull    = "full"    // everything goes through the tunnel
+	RoutingInclude = "include" // only the clients routes go through the tunnel
+	RoutingExclude = "exclude" // everything apart from the clients routes goes through the tunnel
+)
+
+// looks up the domains in a clients routes, swapped out in the tests
+var lookupIP = net.LookupIP
+
+/*
+Get the routing policy of a client, defaulting to a full tunnel
+*/
+func (v VpnClient) RoutingPolicy() string {
+	if v.Routing == "" {
+		return RoutingFull
+	}
+	return v.Routing
+}
+
+/*
+Check that a clients routing policy is one that is supported, and that its routes are CIDRs, addresses or domains
+*/
+func (v VpnClient) ValidateRouting() error {
+	switch v.RoutingPolicy() {
+	case RoutingFull:
+		return nil
+	case RoutingInclude, RoutingExclude:
+	default:
+		return &RoutingError{Client: v.Name, Msg: "unknown routing policy: " + v.Routing}
+	}
+	if len(v.Routes) == 0 {
+		return &RoutingError{Client: v.Name, Msg: "the " + v.Routing + " policy needs at least one route"}
+	}
+	for _, route := range v.Routes {
+		if _, err := netip.ParsePrefix(route); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(route); err == nil {
+			continue
+		}
+		if route == "" || strings.ContainsAny(route, "/ ") {
+			return &RoutingError{Client: v.Name, Msg: "route isnt a CIDR, address or domain: " + route}
+		}
+	}
+	return nil
+}
+
+/*
+Compute the AllowedIPs for a clients tunnel to a server from the clients routing policy. Domains in the
+routes are resolved now, so the result only holds for as long as their addresses dont change. Split tunnels
+always reach the VPN address space and the clients DNS servers, even when an exclude list covers them, so
+that DNS queries never leak outside of the tunnel. They never include the servers endpoints, so that the
+tunnels own packets arent routed back into it.
+
+	    :param client: the client that the tunnel is for
+		:param servers: the servers that the tunnel can go to, more than one for a failover tunnel
+*/
+func (c *Configuration) AllowedIPs(client VpnClient, servers ...VpnServer) ([]string, error) {
+	full := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	if client.RoutingPolicy() == RoutingFull {
+		return prefixStrings(full), nil
+	}
+	if err := client.ValidateRouting(); err != nil {
+		return nil, err
+	}
+	routes, err := resolveRoutes(client.Routes)
+	if err != nil {
+		return nil, &RoutingError{Client: client.Name, Msg: err.Error()}
+	}
+	var allowed []netip.Prefix
+	if client.RoutingPolicy() == RoutingInclude {
+		allowed = routes
+	} else {
+		allowed = full
+		for _, route := range routes {
+			allowed = subtractPrefix(allowed, route)
+		}
+	}
+	// the clients resolvers are always reached through the tunnel, so that queries dont leak past it
+	for _, server := range servers {
+		for _, dns := range c.DnsServers(server) {
+			if addr, err := netip.ParseAddr(dns); err == nil {
+				allowed = append(allowed, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			}
+		}
+	}
+	for _, server := range servers {
+		for _, wan := range []string{server.WanIpv4, server.WanIpv6} {
+			if addr, err := netip.ParseAddr(wan); err == nil {
+				allowed = subtractPrefix(allowed, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	for _, space := range []net.IPNet{c.Service.VpnAddressSpace, c.Service.VpnAddressSpaceV6} {
+		if prefix, ok := netipPrefix(space); ok {
+			allowed = append(allowed, prefix)
+		}
+	}
+	return prefixStrings(collapsePrefixes(allowed)), nil
+}
+
+/*
+Turn a clients routes into prefixes, resolving any domains to all of their addresses
+
+	:param routes: the CIDRs, addresses and domains to resolve
+*/
+func resolveRoutes(routes []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, route := range routes {
+		if prefix, err := netip.ParsePrefix(route); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(route); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		ips, err := lookupIP(route)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addr = addr.Unmap()
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+/*
+Remove a prefix from a set of prefixes, splitting any prefix that contains it into the parts around it
+
+	    :param prefixes: the prefixes to remove from
+		:param remove: the prefix to remove
+*/
+func subtractPrefix(prefixes []netip.Prefix, remove netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, prefix := range prefixes {
+		switch {
+		case prefix.Addr().Is4() != remove.Addr().Is4():
+			result = append(result, prefix)
+		case remove.Bits() <= prefix.Bits() && remove.Contains(prefix.Addr()):
+			// removed entirely
+		case prefix.Bits() < remove.Bits() && prefix.Contains(remove.Addr()):
+			lower, upper := splitPrefix(prefix)
+			result = append(result, subtractPrefix([]netip.Prefix{lower, upper}, remove)...)
+		default:
+			result = append(result, prefix)
+		}
+	}
+	return result
+}
+
+/*
+Split a prefix into its two halves
+
+	:param prefix: the prefix to split, which cant be a single address
+*/
+func splitPrefix(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits() + 1
+	addr := prefix.Addr().AsSlice()
+	lower := netip.PrefixFrom(prefix.Addr(), bits)
+	addr[prefix.Bits()/8] |= 0x80 >> (prefix.Bits() % 8)
+	upperAddr, _ := netip.AddrFromSlice(addr)
+	return lower, netip.PrefixFrom(upperAddr, bits)
+}
+
+/*
+Sort the prefixes, dropping any that are already covered by another
+
+	:param prefixes: the prefixes to collapse
+*/
+func collapsePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Addr() == prefixes[j].Addr() {
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		}
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+	var result []netip.Prefix
+	for _, prefix := range prefixes {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if last.Bits() <= prefix.Bits() && last.Contains(prefix.Addr()) {
+				continue
+			}
+		}
+		result = append(result, prefix)
+	}
+	return result
+}
+
+func netipPrefix(ipnet net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipnet.IP)
+	if !ok || ipnet.Mask == nil {
+		return netip.Prefix{}, false
+	}
+	ones, bits := ipnet.Mask.Size()
+	if addr.Is4In6() && bits == 128 {
+		ones -= 96
+	}
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), true
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	strs := []string{}
+	for _, prefix := range prefixes {
+		strs = append(strs, prefix.String())
+	}
+	return strs
+}
+
+type RoutingError struct {
+	Client string
+	Msg    string
+}
+
+func (r *RoutingError) Error() string {
+	return "There was an error with the routing policy for client: " + r.Client + " " + r.Msg
+}
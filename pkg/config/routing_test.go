@@ -0,0 +1,90 @@
+package config
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedIPs(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "corp.example.com" {
+			t.Fatalf("unexpected lookup: %s", host)
+		}
+		return []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+	conf := NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	server := VpnServer{Name: "exit", WanIpv4: "5.5.5.5"}
+
+	allowed, err := conf.AllowedIPs(VpnClient{Name: "full"}, server)
+	if err != nil || !reflect.DeepEqual(allowed, []string{"0.0.0.0/0", "::/0"}) {
+		t.Errorf("unexpected full tunnel: %v, %v", allowed, err)
+	}
+
+	allowed, err = conf.AllowedIPs(VpnClient{Name: "split", Routing: RoutingInclude, Routes: []string{"192.0.2.0/24", "corp.example.com"}}, server)
+	want := []string{"10.8.0.0/24", "192.0.2.0/24", "203.0.113.7/32", "2001:db8::7/128"}
+	if err != nil || !reflect.DeepEqual(allowed, want) {
+		t.Errorf("unexpected include list:\n got: %v\nwant: %v, %v", allowed, want, err)
+	}
+
+	allowed, err = conf.AllowedIPs(VpnClient{Name: "lan", Routing: RoutingExclude, Routes: []string{"10.0.0.0/8", "128.0.0.0/1"}}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lower half of the address space without 10/8 or the endpoint, the VPN space is kept out of the excluded range
+	want = []string{
+		"0.0.0.0/6", "4.0.0.0/8", "5.0.0.0/14", "5.4.0.0/16", "5.5.0.0/22", "5.5.4.0/24",
+		"5.5.5.0/30", "5.5.5.4/32", "5.5.5.6/31", "5.5.5.8/29", "5.5.5.16/28", "5.5.5.32/27",
+		"5.5.5.64/26", "5.5.5.128/25", "5.5.6.0/23", "5.5.8.0/21", "5.5.16.0/20", "5.5.32.0/19",
+		"5.5.64.0/18", "5.5.128.0/17", "5.6.0.0/15", "5.8.0.0/13", "5.16.0.0/12", "5.32.0.0/11",
+		"5.64.0.0/10", "5.128.0.0/9", "6.0.0.0/7", "8.0.0.0/7", "10.8.0.0/24", "11.0.0.0/8",
+		"12.0.0.0/6", "16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2", "::/0",
+	}
+	if !reflect.DeepEqual(allowed, want) {
+		t.Errorf("unexpected exclude list:\n got: %v\nwant: %v", allowed, want)
+	}
+
+	for _, client := range []VpnClient{
+		{Name: "bad", Routing: "sometimes"},
+		{Name: "empty", Routing: RoutingExclude},
+		{Name: "typo", Routing: RoutingInclude, Routes: []string{"10.0.0.0/33"}},
+	} {
+		if err := client.ValidateRouting(); err == nil {
+			t.Errorf("expected %s to be rejected", client.Name)
+		}
+	}
+}
+
+func TestAllowedIPsDns(t *testing.T) {
+	conf := NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	conf.Dns = dnsConfig{Enabled: true, Servers: []string{"9.9.9.9", "2620:fe::fe"}}
+	server := VpnServer{Name: "exit", WanIpv4: "5.5.5.5"}
+
+	allowed, err := conf.AllowedIPs(VpnClient{Name: "split", Routing: RoutingInclude, Routes: []string{"192.0.2.0/24"}}, server)
+	want := []string{"9.9.9.9/32", "10.8.0.0/24", "192.0.2.0/24", "2620:fe::fe/128"}
+	if err != nil || !reflect.DeepEqual(allowed, want) {
+		t.Errorf("expected the DNS servers in the include list:\n got: %v\nwant: %v, %v", allowed, want, err)
+	}
+
+	// excluding everything but the VPN space still leaves the resolvers in the tunnel
+	allowed, err = conf.AllowedIPs(VpnClient{Name: "lan", Routing: RoutingExclude, Routes: []string{"0.0.0.0/0", "::/0"}}, server)
+	want = []string{"9.9.9.9/32", "10.8.0.0/24", "2620:fe::fe/128"}
+	if err != nil || !reflect.DeepEqual(allowed, want) {
+		t.Errorf("expected the DNS servers to never be excluded:\n got: %v\nwant: %v, %v", allowed, want, err)
+	}
+
+	// the exit nodes own resolver is inside of the VPN space
+	conf.Dns.Servers = nil
+	server.VpnIpv4 = net.ParseIP("10.8.0.1")
+	allowed, err = conf.AllowedIPs(VpnClient{Name: "split", Routing: RoutingInclude, Routes: []string{"192.0.2.0/24"}}, server)
+	want = []string{"10.8.0.0/24", "192.0.2.0/24"}
+	if err != nil || !reflect.DeepEqual(allowed, want) {
+		t.Errorf("unexpected include list with the exit nodes resolver:\n got: %v\nwant: %v, %v", allowed, want, err)
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+A record of a server that the daemon created, used to work out what the cloud provider will bill for it
+*/
+type ServerUsage struct {
+	Username     Username   `json:"username"`
+	Name         string     `json:"name"`
+	Id           int        `json:"id"`
+	Type         string     `json:"type"`
+	HourlyPrice  float64    `json:"hourly_price"`
+	MonthlyPrice float64    `json:"monthly_price"` // the most a server can be billed for in a month
+	Created      time.Time  `json:"created"`
+	Deleted      *time.Time `json:"deleted,omitempty"`
+}
+
+type ServerCost struct {
+	Username Username `json:"username"`
+	Name     string   `json:"name"`
+	Id       int      `json:"id"`
+	Hours    int      `json:"hours"`
+	Cost     float64  `json:"cost"`
+}
+
+type CostReport struct {
+	Month   string               `json:"month"`
+	Budget  float64              `json:"budget"`
+	Total   float64              `json:"total"`
+	Users   map[Username]float64 `json:"users"`
+	Servers []ServerCost         `json:"servers"`
+}
+
+/*
+Record that a server was created
+
+	:param usage: the ServerUsage record for the new server
+*/
+func (c *Configuration) RecordServerCreated(usage ServerUsage) {
+	defer c.lock()()
+	c.Cloud.Usage = append(c.Cloud.Usage, usage)
+}
+
+/*
+Record that a server was deleted. Returns an error if the server was never recorded as created
+
+	:param id: the cloud providers ID for the server
+	:param at: the time the server was deleted
+*/
+func (c *Configuration) RecordServerDeleted(id int, at time.Time) error {
+	defer c.lock()()
+	for i := range c.Cloud.Usage {
+		if c.Cloud.Usage[i].Id == id && c.Cloud.Usage[i].Deleted == nil {
+			c.Cloud.Usage[i].Deleted = &at
+			return nil
+		}
+	}
+	return &ConfigError{Msg: fmt.Sprintf("No usage record for server with ID: %v", id)}
+}
+
+/*
+Return the first instant of the month that 't' falls in
+*/
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+/*
+Work out the cost of a server between two points in time. Partial hours are billed as a full hour,
+and a server is never billed for more than its monthly price
+
+	:param usage: the server to calculate the cost for
+	:param from: the start of the billing window
+	:param to: the end of the billing window
+*/
+func (u ServerUsage) costBetween(from time.Time, to time.Time) (int, float64) {
+	start := u.Created
+	if start.Before(from) {
+		start = from
+	}
+	end := to
+	if u.Deleted != nil && u.Deleted.Before(end) {
+		end = *u.Deleted
+	}
+	if !end.After(start) {
+		return 0, 0
+	}
+	hours := int(math.Ceil(end.Sub(start).Hours()))
+	cost := float64(hours) * u.HourlyPrice
+	if u.MonthlyPrice > 0 && cost > u.MonthlyPrice {
+		cost = u.MonthlyPrice
+	}
+	return hours, cost
+}
+
+/*
+Calculate the month to date spend for every server the daemon has recorded
+
+	:param now: the point in time to calculate the spend up until
+*/
+func (c *Configuration) MonthToDateCost(now time.Time) CostReport {
+	defer c.rlock()()
+	return c.monthToDateCost(now)
+}
+
+func (c *Configuration) monthToDateCost(now time.Time) CostReport {
+	report := CostReport{
+		Month:   now.Format("2006-01"),
+		Budget:  c.Cloud.MonthlyBudget,
+		Users:   map[Username]float64{},
+		Servers: []ServerCost{},
+	}
+	from := monthStart(now)
+	for i := range c.Cloud.Usage {
+		usage := c.Cloud.Usage[i]
+		hours, cost := usage.costBetween(from, now)
+		if hours == 0 {
+			continue
+		}
+		report.Servers = append(report.Servers, ServerCost{Username: usage.Username, Name: usage.Name, Id: usage.Id, Hours: hours, Cost: cost})
+		report.Users[usage.Username] += cost
+		report.Total += cost
+	}
+	return report
+}
+
+/*
+Check that running another server for the rest of the month would keep the users spend within the
+configured monthly budget. A budget of 0 means that no budget is enforced.
+
+	:param hourly: the hourly price of the server that is going to be created
+	:param monthly: the monthly price cap of the server that is going to be created
+	:param now: the time that the server would be created
+*/
+func (c *Configuration) CheckBudget(hourly float64, monthly float64, now time.Time) error {
+	defer c.rlock()()
+	if c.Cloud.MonthlyBudget <= 0 {
+		return nil
+	}
+	report := c.monthToDateCost(now)
+	next := ServerUsage{HourlyPrice: hourly, MonthlyPrice: monthly, Created: now}
+	_, projected := next.costBetween(now, monthStart(now).AddDate(0, 1, 0))
+	spend := report.Users[c.Username]
+	if spend+projected > c.Cloud.MonthlyBudget {
+		return &BudgetExceeded{Budget: c.Cloud.MonthlyBudget, Spent: spend, Projected: projected}
+	}
+	return nil
+}
+
+type BudgetExceeded struct {
+	Budget    float64
+	Spent     float64
+	Projected float64
+}
+
+func (b *BudgetExceeded) Error() string {
+	return fmt.Sprintf("Monthly budget of: %.2f would be exceeded. Spent this month: %.2f, new server would cost up to: %.2f",
+		b.Budget, b.Spent, b.Projected)
+}
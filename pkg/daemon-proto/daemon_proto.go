@@ -3,6 +3,8 @@ package daemonproto
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
 )
 
@@ -29,6 +31,9 @@ const TargetInfoIdx = 11
 const MethodInfoIdx = 19
 const MsgHeaderEnd = 27
 
+// the largest message that will be read off of the socket
+const MaxMessageSize = 1 << 20
+
 const MsgRequest = "REQUEST"
 const MsgResponse = "RESPONSE"
 
@@ -71,6 +76,28 @@ func MethodCheck(m string) (Method, error) {
 		return RUN, nil
 	case "save":
 		return SAVE, nil
+	case "cost":
+		return COST, nil
+	case "build":
+		return BUILD, nil
+	case "resume":
+		return RESUME, nil
+	case "up":
+		return UP, nil
+	case "down":
+		return DOWN, nil
+	case "status":
+		return STATUS, nil
+	case "lock":
+		return LOCK, nil
+	case "unlock":
+		return UNLOCK, nil
+	case "rotate":
+		return ROTATE, nil
+	case "import":
+		return IMPORT, nil
+	case "export":
+		return EXPORT, nil
 	}
 	return SHOW, &InvalidMethod{Method: m}
 
@@ -93,6 +120,17 @@ const (
 	POLL      Method = "poll"
 	RUN       Method = "run"
 	SAVE      Method = "save"
+	COST      Method = "cost"
+	BUILD     Method = "build"
+	RESUME    Method = "resume"
+	UP        Method = "up"
+	DOWN      Method = "down"
+	STATUS    Method = "status"
+	LOCK      Method = "lock"
+	UNLOCK    Method = "unlock"
+	ROTATE    Method = "rotate"
+	IMPORT    Method = "import"
+	EXPORT    Method = "export"
 )
 
 type SockMessage struct {
@@ -164,23 +202,78 @@ func Marshal(v SockMessage) []byte { // TODO: Need to clean up the error handlin
 	return msgHeaderBuf.Bytes()
 }
 
+/*
+Read a single framed message off of a stream, using the lengths in the header to know when the whole message
+has arrived, rather than trusting a single read to return all of it
+
+	    :param r: the stream to read the message from
+		:param max: the largest message that will be accepted
+*/
+func ReadMessage(r io.Reader, max int) ([]byte, error) {
+	header := make([]byte, MsgHeaderEnd)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, &MessageError{Msg: "couldnt read the message header: " + err.Error()}
+	}
+	size, err := payloadSize(header)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(max-MsgHeaderEnd) {
+		return nil, &MessageError{Msg: fmt.Sprintf("message is %d bytes, which is over the limit of %d", size+MsgHeaderEnd, max)}
+	}
+	msg := make([]byte, MsgHeaderEnd+int(size))
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[MsgHeaderEnd:]); err != nil {
+		return nil, &MessageError{Msg: "couldnt read the message payload: " + err.Error()}
+	}
+	return msg, nil
+}
+
+/*
+Work out the length of the payload that follows a message header
+
+	:param header: the header of a message
+*/
+func payloadSize(header []byte) (uint64, error) {
+	if len(header) < MsgHeaderEnd {
+		return 0, &MessageError{Msg: fmt.Sprintf("message is %d bytes, which is shorter than the header", len(header))}
+	}
+	size := uint64(header[TypeInfoIdx])
+	for _, idx := range []int{BodyInfoIdx, TargetInfoIdx, MethodInfoIdx} {
+		field := binary.LittleEndian.Uint64(header[idx : idx+8])
+		if field > MaxMessageSize {
+			return 0, &MessageError{Msg: fmt.Sprintf("header has a field length of %d, which is over the limit of %d", field, MaxMessageSize)}
+		}
+		size += field
+	}
+	return size, nil
+}
+
 /*
 Unmarshalls a sock message byte array into a SockMessage struct, undoing what was done when Marshal() was called on the SockMessage
 
 	:param msg: a byte array that can be unmarshalled into a SockMessage
 */
-func Unmarshal(msg []byte) SockMessage {
+func Unmarshal(msg []byte) (SockMessage, error) {
+	size, err := payloadSize(msg)
+	if err != nil {
+		return SockMessage{}, err
+	}
+	if uint64(len(msg)-MsgHeaderEnd) < size {
+		return SockMessage{}, &MessageError{Msg: fmt.Sprintf("message is truncated, the header describes %d bytes but only %d arrived", size+MsgHeaderEnd, len(msg))}
+	}
 	vers := int8(msg[VersionIdx])
 	statusCode := int8(msg[StatusCodeIdx])
 	typeInfo := int(msg[TypeInfoIdx])
 	bodyInfo := int(binary.LittleEndian.Uint64(msg[BodyInfoIdx:TargetInfoIdx]))
 	targetInfo := int(binary.LittleEndian.Uint64(msg[TargetInfoIdx:MethodInfoIdx]))
+	methodInfo := int(binary.LittleEndian.Uint64(msg[MethodInfoIdx:MsgHeaderEnd]))
 	msgPayload := msg[MsgHeaderEnd:]
 	body := msgPayload[typeInfo : typeInfo+bodyInfo]
 	var msgInfo = []string{
 		string(msgPayload[0:typeInfo]),
 		string(msgPayload[(typeInfo + bodyInfo):(typeInfo + bodyInfo + targetInfo)]),
-		string(msgPayload[(typeInfo + bodyInfo + targetInfo):]),
+		string(msgPayload[(typeInfo + bodyInfo + targetInfo):(typeInfo + bodyInfo + targetInfo + methodInfo)]),
 	}
 	return SockMessage{
 		Type:       msgInfo[0],
@@ -190,5 +283,13 @@ func Unmarshal(msg []byte) SockMessage {
 		Body:       body,
 		Target:     msgInfo[1],
 		Method:     msgInfo[2],
-	}
+	}, nil
+}
+
+type MessageError struct {
+	Msg string
+}
+
+func (m *MessageError) Error() string {
+	return "There was an error reading the message: " + m.Msg
 }
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
+)
+
+/*
+Get the name of the tunnel that a render request is for, which is also the name of its interface
+
+	:param req: the render request
+*/
+func confName(req ConfigRenderRequest) string {
+	if req.Failover {
+		return FailoverConfName
+	}
+	return req.Server
+}
+
+/*
+Get the name that a clients configuration is saved under. The wg-quick config of the default client is the
+hosts own tunnel, which is brought up from the file named after its server, see rotation.TunnelConf, so it
+keeps that name. Every other config is named after the client as well.
+
+	:param req: the render request
+*/
+func (c *Context) exportName(req ConfigRenderRequest) string {
+	if req.Format == "" || req.Format == wg.FormatWgQuick {
+		if client, err := c.Config.DefaultClient(); err == nil && client.Name == req.Client {
+			return confName(req)
+		}
+	}
+	return req.Client + "-" + confName(req)
+}
+
+/*
+Render a clients configuration in the format that the request asks for
+
+	    :param req: the render request
+		:param name: the name that the files are named after
+*/
+func (c *Context) exportFiles(req ConfigRenderRequest, name string) ([]wg.ExportFile, error) {
+	seed, err := c.configSeed(req)
+	if err != nil {
+		return nil, err
+	}
+	return wg.ExportClientConfiguration(seed, req.Format, name, confName(req))
+}
+
+/*
+Render the wg-quick config for a QR code, which is the only format that the mobile apps can scan
+
+	:param req: the render request
+*/
+func (c *Context) qrConfig(req ConfigRenderRequest) ([]byte, error) {
+	if req.Format != "" && req.Format != wg.FormatWgQuick {
+		return nil, &wg.ExportError{Format: req.Format, Msg: "QR codes can only hold wg-quick configs"}
+	}
+	seed, err := c.configSeed(req)
+	if err != nil {
+		return nil, err
+	}
+	return wg.RenderClientConfiguration(seed)
+}
+
+/*
+Save the configs of every client to a single zip. Clients that hold their own keypair are skipped, since the
+daemon cant render their private key. The names of the skipped clients are returned.
+
+	:param req: the render request, the client is ignored
+*/
+func (c *Context) saveBundle(req ConfigRenderRequest) (string, []string, error) {
+	if req.Server == "" && !req.Failover {
+		return "", nil, &ExportError{Msg: "a bundle needs either a server or a failover config"}
+	}
+	names := []string{}
+	for name := range c.Config.Clients() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buff := bytes.NewBuffer([]byte{})
+	archive := zip.NewWriter(buff)
+	skipped := []string{}
+	for _, name := range names {
+		clientReq := req
+		clientReq.Client = name
+		files, err := c.exportFiles(clientReq, name+"-"+confName(req))
+		if errors.Is(err, keyring.KeyNotFound) {
+			skipped = append(skipped, name)
+			continue
+		}
+		if err != nil {
+			return "", nil, &ExportError{Msg: "couldnt render the config for: " + name + " " + err.Error()}
+		}
+		for _, file := range files {
+			header := &zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: time.Now()}
+			header.SetMode(0600)
+			w, err := archive.CreateHeader(header)
+			if err != nil {
+				return "", nil, &ExportError{Msg: err.Error()}
+			}
+			if _, err := w.Write(file.Contents); err != nil {
+				return "", nil, &ExportError{Msg: err.Error()}
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", nil, &ExportError{Msg: err.Error()}
+	}
+	fpath := path.Join(c.Config.HostInfo.WireguardSavePath, string(c.Config.Username)+"-"+confName(req)+"-configs.zip")
+	if err := writePrivate(fpath, buff.Bytes()); err != nil {
+		return "", nil, err
+	}
+	return fpath, skipped, nil
+}
+
+/*
+Write a file that only the daemon can read, replacing the file if it exists. The file is written next to
+its destination and moved into place, so an existing file never keeps looser permissions and a reader
+never sees a partial file.
+
+	    :param fpath: the path to write to
+		:param b: the contents of the file
+*/
+func writePrivate(fpath string, b []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(fpath), "."+path.Base(fpath)+".*")
+	if err != nil {
+		return &ExportError{Msg: err.Error()}
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return &ExportError{Msg: err.Error()}
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return &ExportError{Msg: err.Error()}
+	}
+	if err := tmp.Close(); err != nil {
+		return &ExportError{Msg: err.Error()}
+	}
+	if err := os.Rename(tmp.Name(), fpath); err != nil {
+		return &ExportError{Msg: err.Error()}
+	}
+	return nil
+}
+
+type ExportError struct {
+	Msg string
+}
+
+func (e *ExportError) Error() string {
+	return "There was an error saving the configurations: " + e.Msg
+}
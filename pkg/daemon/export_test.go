@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
+)
+
+func TestVpnSaveExport(t *testing.T) {
+	ctx, _ := newFailoverContext(t)
+	dir := t.TempDir()
+	ctx.Config.HostInfo.WireguardSavePath = dir
+	// a stale config from before saves were private
+	stale := path.Join(dir, "phone-primary.netdev")
+	if err := os.WriteFile(stale, []byte("stale"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(ConfigRenderRequest{Client: "phone", Server: "primary", Format: wg.FormatNetworkd})
+	resp := ctx.VpnSaveHandler(*daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, b))
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		t.Fatal(string(resp.Body))
+	}
+	for _, name := range []string{"phone-primary.netdev", "phone-primary.network"} {
+		info, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected %s to only be readable by the daemon, got: %s", name, info.Mode().Perm())
+		}
+	}
+
+	// the default clients wg-quick config is the hosts own tunnel, so it keeps the servers name
+	phone := ctx.Config.Service.Clients["phone"]
+	phone.Default = true
+	ctx.Config.Service.Clients["phone"] = phone
+	if name := ctx.exportName(ConfigRenderRequest{Client: "phone", Server: "primary"}); name != "primary" {
+		t.Errorf("expected the hosts tunnel to be named after its server, got: %s", name)
+	}
+}
+
+func TestSaveBundle(t *testing.T) {
+	ctx, _ := newFailoverContext(t)
+	ctx.Config.HostInfo.WireguardSavePath = t.TempDir()
+	ctx.Config.AddClient(net.ParseIP("10.0.0.11"), "byopub", "laptop")
+	fpath, skipped, err := ctx.saveBundle(ConfigRenderRequest{Server: "primary", Format: wg.FormatJson})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, []string{"laptop"}) {
+		t.Errorf("expected the client with its own keypair to be skipped, got: %v", skipped)
+	}
+	archive, err := zip.OpenReader(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	names := []string{}
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"phone-primary.json"}) {
+		t.Errorf("unexpected files in the bundle: %v", names)
+	}
+}
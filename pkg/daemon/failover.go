@@ -0,0 +1,223 @@
+package daemon
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+	"git.aetherial.dev/aeth/yosai/pkg/wireguard/iface"
+)
+
+// how often the handshakes on the failover interfaces are checked
+const FailoverCheckEvery = time.Second * 10
+
+// the oldest a peers latest handshake can be before it is taken to be down, when the health config doesnt set it
+const DefaultFailoverHandshakeMaxAge = time.Minute * 5
+
+/*
+The local wireguard interfaces that failover configs are brought up on. This is satisfied by the iface.Manager
+*/
+type PeerDevices interface {
+	StatusAll() ([]iface.InterfaceStatus, error)
+	SetAllowedIPs(name string, allowed map[string][]string) error
+}
+
+/*
+Owns the moves of the local tunnels, so a peer failover isnt made while something else is moving a tunnel.
+This is satisfied by the rotation.Rotator
+*/
+type TunnelMover interface {
+	Move(move func() error) error
+}
+
+/*
+Watches the local interfaces brought up from failover configs, and moves the clients traffic from the active
+peer to the next standby peer in priority order once the active peer stops handshaking. A peer is active when
+its AllowedIPs are more than its servers own VPN addresses, see Context.failoverSeed.
+*/
+type PeerFailover struct {
+	Config    *config.Configuration
+	Keyring   keyring.DaemonKeyRing
+	KeyTagger keytags.Keytagger
+	Devices   PeerDevices
+	Mover     TunnelMover
+	mu        sync.Mutex
+	now       func() time.Time
+	seen      map[string]time.Time // when each interface was first seen, so new interfaces get time to handshake
+}
+
+/*
+Create a new PeerFailover
+
+	    :param conf: the daemon configuration, with the servers that the peers belong to
+		:param kr: the keyring that the servers keypairs are stored on
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param devices: the local wireguard interfaces
+		:param mover: makes the moves, under the same lock as every other move of a tunnel
+*/
+func NewPeerFailover(conf *config.Configuration, kr keyring.DaemonKeyRing, keytagger keytags.Keytagger, devices PeerDevices, mover TunnelMover) *PeerFailover {
+	return &PeerFailover{
+		Config:    conf,
+		Keyring:   kr,
+		KeyTagger: keytagger,
+		Devices:   devices,
+		Mover:     mover,
+		now:       time.Now,
+		seen:      map[string]time.Time{},
+	}
+}
+
+// Logging wrapper
+func (p *PeerFailover) Log(msg ...string) {
+	pMsg := []string{"PeerFailover:"}
+	pMsg = append(pMsg, msg...)
+	p.Config.Log(pMsg...)
+}
+
+/*
+Check the handshakes on every interface with more than one peer, failing over the ones whose active peer is down
+*/
+func (p *PeerFailover) Tick() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	statuses, err := p.Devices.StatusAll()
+	if err != nil {
+		p.Log("Couldnt get the status of the interfaces:", err.Error())
+		return
+	}
+	now := p.now()
+	maxAge := DefaultFailoverHandshakeMaxAge
+	if d, err := time.ParseDuration(p.Config.Health.HandshakeMaxAge); err == nil && d > 0 {
+		maxAge = d
+	}
+	servers := p.serversByKey()
+	seen := map[string]time.Time{}
+	for _, status := range statuses {
+		if len(status.Peers) < 2 {
+			continue
+		}
+		first, ok := p.seen[status.Name]
+		if !ok {
+			first = now
+		}
+		seen[status.Name] = first
+		if now.Sub(first) < maxAge {
+			continue
+		}
+		if err := p.failover(status, servers, now, maxAge); err != nil {
+			p.Log(err.Error())
+		}
+	}
+	p.seen = seen
+}
+
+/*
+Move the clients traffic on an interface off of its active peer, if the active peer has stopped handshaking
+
+	    :param status: the live status of the interface
+		:param servers: the servers in the configuration, keyed by their public key
+		:param now: the time of the check
+		:param maxAge: the oldest a handshake can be for its peer to be up
+*/
+func (p *PeerFailover) failover(status iface.InterfaceStatus, servers map[string]config.VpnServer, now time.Time, maxAge time.Duration) error {
+	var active *iface.PeerStatus
+	standby := []iface.PeerStatus{}
+	for i := range status.Peers {
+		peer := status.Peers[i]
+		server, ok := servers[peer.PublicKey]
+		if !ok {
+			// not an interface from a failover config
+			return nil
+		}
+		if sameAddresses(peer.AllowedIPs, server.VpnAddresses()) {
+			standby = append(standby, peer)
+			continue
+		}
+		if active != nil {
+			return nil
+		}
+		active = &peer
+	}
+	if active == nil || now.Sub(active.LastHandshake) <= maxAge {
+		return nil
+	}
+	sort.Slice(standby, func(i, j int) bool {
+		a, b := servers[standby[i].PublicKey], servers[standby[j].PublicKey]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return a.Name < b.Name
+	})
+	from := servers[active.PublicKey]
+	for _, peer := range standby {
+		if now.Sub(peer.LastHandshake) > maxAge {
+			continue
+		}
+		err := p.Mover.Move(func() error {
+			return p.Devices.SetAllowedIPs(status.Name, map[string][]string{
+				active.PublicKey: from.VpnAddresses(),
+				peer.PublicKey:   active.AllowedIPs,
+			})
+		})
+		if err != nil {
+			return &FailoverError{Msg: err.Error()}
+		}
+		p.Log("Moved the tunnel on:", status.Name, "from:", from.Name, "to:", servers[peer.PublicKey].Name)
+		return nil
+	}
+	return &FailoverError{Msg: "server: " + from.Name + " on: " + status.Name + " stopped handshaking, and none of the standby servers have handshaked recently"}
+}
+
+/*
+Get the servers whose keypairs are on the keyring, keyed by their public key
+*/
+func (p *PeerFailover) serversByKey() map[string]config.VpnServer {
+	servers := map[string]config.VpnServer{}
+	for _, server := range p.Config.Servers() {
+		key, err := p.Keyring.GetKey(keyring.WireguardKeyname(p.KeyTagger, server.Name))
+		if err != nil {
+			continue
+		}
+		servers[key.GetPublic()] = server
+	}
+	return servers
+}
+
+/*
+Check if two lists of prefixes hold the same prefixes, in any order
+
+	    :param a: the first list
+		:param b: the second list
+*/
+func sameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+/*
+Check the interfaces periodically
+*/
+func (p *PeerFailover) Run() {
+	for {
+		time.Sleep(FailoverCheckEvery)
+		p.Tick()
+	}
+}
+
+type FailoverError struct {
+	Msg string
+}
+
+func (f *FailoverError) Error() string {
+	return "There was an error failing over the tunnel: " + f.Msg
+}
@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+	"git.aetherial.dev/aeth/yosai/pkg/wireguard/iface"
+)
+
+type fakeDevices struct {
+	statuses []iface.InterfaceStatus
+	set      map[string][]string
+}
+
+func (f *fakeDevices) StatusAll() ([]iface.InterfaceStatus, error) {
+	return f.statuses, nil
+}
+
+func (f *fakeDevices) SetAllowedIPs(name string, allowed map[string][]string) error {
+	f.set = allowed
+	return nil
+}
+
+type fakeMover struct {
+	busy bool
+}
+
+func (f *fakeMover) Move(move func() error) error {
+	if f.busy {
+		return &FailoverError{Msg: "busy"}
+	}
+	return move()
+}
+
+func newFailoverContext(t *testing.T) (*Context, map[string]string) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	conf.AddServer(net.ParseIP("10.0.0.1"), "backup", "5.5.5.5", "", 51820)
+	conf.AddServer(net.ParseIP("10.0.0.2"), "primary", "6.6.6.6", "", 51820)
+	conf.AddServer(net.ParseIP("10.0.0.3"), "down", "7.7.7.7", "", 51820)
+	conf.AddServer(net.ParseIP("10.0.0.4"), "other", "8.8.8.8", "", 51820)
+	backup := conf.Service.Servers["backup"]
+	backup.Priority = 2
+	conf.Service.Servers["backup"] = backup
+	conf.AddClient(net.ParseIP("10.0.0.10"), "", "phone")
+	phone := conf.Service.Clients["phone"]
+	phone.Servers = []string{"backup", "primary", "down"}
+	conf.Service.Clients["phone"] = phone
+	keys := map[string]string{}
+	for _, name := range []string{"phone", "backup", "primary", "down", "other"} {
+		key, err := keyring.WireguardKey(kr, keytags.ConstKeytag{}, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key.GetPublic()
+	}
+	ctx := &Context{keyring: kr, Keytags: keytags.ConstKeytag{}, Config: conf}
+	ctx.Healthy = func(server string) bool { return server != "down" }
+	return ctx, keys
+}
+
+func TestFailoverSeed(t *testing.T) {
+	ctx, keys := newFailoverContext(t)
+	seed, err := ctx.configSeed(ConfigRenderRequest{Client: "phone", Failover: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, peer := range seed.Peers {
+		got = append(got, peer.Pubkey+" "+peer.AllowedIPs)
+		if peer.PersistentKeepalive != FailoverKeepalive {
+			t.Errorf("expected every peer to keep handshaking, got: %+v", peer)
+		}
+	}
+	want := []string{keys["primary"] + " 0.0.0.0/0, ::/0", keys["backup"] + " 10.0.0.1/32"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the healthy authorized servers in priority order\ngot:  %v\nwant: %v", got, want)
+	}
+
+	ctx.Healthy = func(server string) bool { return false }
+	if _, err := ctx.configSeed(ConfigRenderRequest{Client: "phone", Failover: true}); err == nil {
+		t.Error("expected an error when no server is healthy")
+	}
+}
+
+func TestPeerFailover(t *testing.T) {
+	ctx, keys := newFailoverContext(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	devices := &fakeDevices{statuses: []iface.InterfaceStatus{{
+		Name: "failover",
+		Peers: []iface.PeerStatus{
+			{PublicKey: keys["primary"], AllowedIPs: []string{"0.0.0.0/0"}, LastHandshake: start},
+			{PublicKey: keys["backup"], AllowedIPs: []string{"10.0.0.1/32"}, LastHandshake: start},
+		},
+	}}}
+	mover := &fakeMover{busy: true}
+	failover := NewPeerFailover(ctx.Config, ctx.keyring, keytags.ConstKeytag{}, devices, mover)
+	failover.now = func() time.Time { return start }
+	failover.Tick()
+
+	// the backup keeps handshaking after the primary stops
+	devices.statuses[0].Peers[1].LastHandshake = start.Add(10 * time.Minute)
+	failover.now = func() time.Time { return start.Add(11 * time.Minute) }
+	failover.Tick()
+	if devices.set != nil {
+		t.Errorf("expected the tunnel to stay put while another move is being made, got: %v", devices.set)
+	}
+	mover.busy = false
+	failover.Tick()
+	want := map[string][]string{keys["primary"]: {"10.0.0.2/32"}, keys["backup"]: {"0.0.0.0/0"}}
+	if !reflect.DeepEqual(devices.set, want) {
+		t.Errorf("expected the tunnel to move to the backup\ngot:  %v\nwant: %v", devices.set, want)
+	}
+
+	devices.set = nil
+	devices.statuses[0].Peers[1].LastHandshake = start
+	failover.Tick()
+	if devices.set != nil {
+		t.Errorf("expected the tunnel to stay put when no standby is up, got: %v", devices.set)
+	}
+}
@@ -2,10 +2,13 @@ package daemon
 
 import (
 	"encoding/json"
-	"os"
 	"path"
+	"slices"
+	"strings"
 
+	"git.aetherial.dev/aeth/yosai/pkg/config"
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
 	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
 )
 
@@ -34,11 +37,25 @@ type AddHostRequest struct {
 }
 
 type ConfigRenderRequest struct {
-	Client       string `json:"client"`
+	Client       string `json:"client"` // the servers own configuration is rendered when no client is given
 	Server       string `json:"server"`
 	OutputToFile bool   `json:"output_to_file"`
+	Probe        bool   `json:"probe"`    // render a config that only reaches the server itself, for checking it before cutting over to it
+	Qr           bool   `json:"qr"`       // render the config as a QR code, printed for the terminal when shown and as a PNG when saved
+	Failover     bool   `json:"failover"` // render a peer for every healthy server the client is authorized for, the server is ignored
+	Format       string `json:"format"`   // one of the wg.Format constants, wg-quick when empty
+	Bundle       bool   `json:"bundle"`   // save the configs of every client into a single zip, the client is ignored
 }
 
+// how often a probe config sends keepalives, which also makes it handshake as soon as it comes up
+const ProbeKeepalive = 5
+
+// how often the peers of a failover config send keepalives when the client doesnt set it, so the standby peers keep handshaking
+const FailoverKeepalive = 25
+
+// the name that failover configs are saved under, which is also the name of their interface
+const FailoverConfName = "failover"
+
 // Client for building internal Daemon route requests
 
 func (c *Context) CreateServer(msg daemonproto.SockMessage) daemonproto.SockMessage {
@@ -53,11 +70,14 @@ Render the wireguard configuration seed to be used when templating into the conf
 */
 func (c *Context) configSeed(req ConfigRenderRequest) (wg.WireguardTemplateSeed, error) {
 	var seed wg.WireguardTemplateSeed
-	serverKeypair, err := c.keyring.GetKey(req.Server + "_" + c.Keytags.WgKeypairKeyname())
+	if req.Failover {
+		return c.failoverSeed(req)
+	}
+	serverKeypair, err := keyring.WireguardKey(c.keyring, c.Keytags, req.Server)
 	if err != nil {
 		return seed, err
 	}
-	clientKeypair, err := c.keyring.GetKey(req.Client + "_" + c.Keytags.WgKeypairKeyname())
+	clientKeypair, err := c.keyring.GetKey(keyring.WireguardKeyname(c.Keytags, req.Client))
 	if err != nil {
 		return seed, err
 	}
@@ -69,19 +89,162 @@ func (c *Context) configSeed(req ConfigRenderRequest) (wg.WireguardTemplateSeed,
 	if err != nil {
 		return seed, err
 	}
+	allowed, err := c.Config.AllowedIPs(client, server)
+	if err != nil {
+		return seed, err
+	}
+	allowedIps := strings.Join(allowed, ", ")
+	dns := strings.Join(c.Config.DnsServers(server), ", ")
+	opts := config.ClientTunnelOptions(client, server)
+	psk, err := c.presharedKey(opts, client, server)
+	if err != nil {
+		return seed, err
+	}
+	keepalive := opts.PersistentKeepalive
+	if req.Probe {
+		// only the servers own VPN address goes through a probe, so that it can come up
+		// alongside the tunnel that is currently in use
+		allowedIps = strings.Join(server.VpnAddresses(), ", ")
+		keepalive = ProbeKeepalive
+		// the probe comes up alongside the tunnel in use, so it cant take over the hosts resolver,
+		// or the port, mark and routing table of the tunnel in use
+		dns = ""
+		opts.ListenPort = 0
+		opts.FwMark = 0
+		opts.Table = ""
+	}
 	seed = wg.WireguardTemplateSeed{
 		VpnClientPrivateKey: clientKeypair.GetSecret(),
-		VpnClientAddress:    client.VpnIpv4.String() + "/32",
+		VpnClientAddress:    clientAddress(client),
+		Dns:                 dns,
+		MTU:                 opts.MTU,
+		ListenPort:          opts.ListenPort,
+		FwMark:              opts.FwMark,
+		Table:               opts.Table,
 		Peers: []wg.WireguardTemplatePeer{
 			{
-				Pubkey:  serverKeypair.GetPublic(),
-				Address: server.WanIpv4,
-				Port:    c.Config.Service.VpnServerPort,
+				Name:                server.Name,
+				Pubkey:              serverKeypair.GetPublic(),
+				PresharedKey:        psk,
+				Address:             server.WanIpv4,
+				Port:                c.Config.Service.VpnServerPort,
+				AllowedIPs:          allowedIps,
+				PersistentKeepalive: keepalive,
 			},
 		}}
 	return seed, nil
 }
 
+/*
+Render the seed for a failover configuration, with a peer for every healthy server that the client is
+authorized for in priority order. Peers on one interface cant share AllowedIPs, so the first peer routes
+the clients traffic and the rest only route their own VPN addresses, keeping them handshaking on standby
+until the failover helper moves the routed AllowedIPs over to one of them.
+
+	:param req: the struct containing the client for the configuration
+*/
+func (c *Context) failoverSeed(req ConfigRenderRequest) (wg.WireguardTemplateSeed, error) {
+	var seed wg.WireguardTemplateSeed
+	client, err := c.Config.GetClient(req.Client)
+	if err != nil {
+		return seed, err
+	}
+	clientKeypair, err := c.keyring.GetKey(keyring.WireguardKeyname(c.Keytags, req.Client))
+	if err != nil {
+		return seed, err
+	}
+	servers := []config.VpnServer{}
+	for _, server := range c.Config.ClientServers(client) {
+		if c.Healthy == nil || c.Healthy(server.Name) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return seed, &FailoverError{Msg: "there are no healthy servers that client: " + client.Name + " is authorized for"}
+	}
+	allowed, err := c.Config.AllowedIPs(client, servers...)
+	if err != nil {
+		return seed, err
+	}
+	// the interface takes its options from the preferred server
+	opts := config.ClientTunnelOptions(client, servers[0])
+	seed = wg.WireguardTemplateSeed{
+		VpnClientPrivateKey: clientKeypair.GetSecret(),
+		VpnClientAddress:    clientAddress(client),
+		MTU:                 opts.MTU,
+		ListenPort:          opts.ListenPort,
+		FwMark:              opts.FwMark,
+		Table:               opts.Table,
+	}
+	dns := []string{}
+	for i, server := range servers {
+		serverKeypair, err := keyring.WireguardKey(c.keyring, c.Keytags, server.Name)
+		if err != nil {
+			return seed, err
+		}
+		peerOpts := config.ClientTunnelOptions(client, server)
+		psk, err := c.presharedKey(peerOpts, client, server)
+		if err != nil {
+			return seed, err
+		}
+		keepalive := peerOpts.PersistentKeepalive
+		if keepalive == 0 {
+			keepalive = FailoverKeepalive
+		}
+		allowedIps := strings.Join(server.VpnAddresses(), ", ")
+		if i == 0 {
+			allowedIps = strings.Join(allowed, ", ")
+		}
+		for _, resolver := range c.Config.DnsServers(server) {
+			if !slices.Contains(dns, resolver) {
+				dns = append(dns, resolver)
+			}
+		}
+		seed.Peers = append(seed.Peers, wg.WireguardTemplatePeer{
+			Name:                server.Name,
+			Pubkey:              serverKeypair.GetPublic(),
+			PresharedKey:        psk,
+			Address:             server.WanIpv4,
+			Port:                c.Config.Service.VpnServerPort,
+			AllowedIPs:          allowedIps,
+			PersistentKeepalive: keepalive,
+		})
+	}
+	seed.Dns = strings.Join(dns, ", ")
+	return seed, nil
+}
+
+/*
+Get the preshared key for a client and server pair, or an empty string when the tunnel doesnt use one
+
+	    :param opts: the options for the clients tunnel to the server
+		:param client: the client that the tunnel is for
+		:param server: the server that the tunnel goes to
+*/
+func (c *Context) presharedKey(opts config.TunnelOptions, client config.VpnClient, server config.VpnServer) (string, error) {
+	if !opts.PresharedKey {
+		return "", nil
+	}
+	key, err := keyring.PresharedKey(c.keyring, keyring.PresharedKeyname(c.Keytags, client.Name, server.Name))
+	if err != nil {
+		return "", err
+	}
+	return key.GetSecret(), nil
+}
+
+/*
+Format the addresses of a client for the Address line of its configuration
+
+	:param client: the client to format the addresses of
+*/
+func clientAddress(client config.VpnClient) string {
+	addr := client.VpnIpv4.String() + "/32"
+	if client.VpnIpv6 != nil {
+		addr = addr + ", " + client.VpnIpv6.String() + "/128"
+	}
+	return addr
+}
+
 /*
 wrapping the VPN show configuration function in a route friendly interface
 
@@ -93,17 +256,58 @@ func (c *Context) VpnShowHandler(msg daemonproto.SockMessage) daemonproto.SockMe
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	seed, err := c.configSeed(req)
-	if err != nil {
-		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	if req.Client == "" {
+		cfg, err := c.serverConfig(req.Server)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, cfg)
+	}
+	if req.Qr {
+		cfg, err := c.qrConfig(req)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		qr, err := wg.RenderQrCode(cfg)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte(qr))
 	}
-	cfg, err := wg.RenderClientConfiguration(seed)
+	files, err := c.exportFiles(req, c.exportName(req))
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
+	if len(files) == 1 {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, files[0].Contents)
+	}
+	var cfg []byte
+	for _, file := range files {
+		cfg = append(cfg, []byte("# "+file.Name+"\n")...)
+		cfg = append(cfg, file.Contents...)
+		cfg = append(cfg, '\n')
+	}
 	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, cfg)
 }
 
+/*
+Render the wireguard configuration that a server should be running, with a peer for each client. No keys
+are made on the keyring, so a server without a keypair is an error
+
+	:param name: the name of the server
+*/
+func (c *Context) serverConfig(name string) ([]byte, error) {
+	server, err := c.Config.GetServer(name)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := wg.ReadServerTemplateSeed(c.Config, c.keyring, c.Keytags, server)
+	if err != nil {
+		return nil, err
+	}
+	return wg.RenderServerConfiguration(seed)
+}
+
 /*
 wrapping the VPN save configuration function in a route friendly interface
 
@@ -115,20 +319,45 @@ func (c *Context) VpnSaveHandler(msg daemonproto.SockMessage) daemonproto.SockMe
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	seed, err := c.configSeed(req)
-	if err != nil {
-		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	if req.Bundle {
+		fpath, skipped, err := c.saveBundle(req)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		resp := "Configurations saved to: " + fpath
+		if len(skipped) != 0 {
+			resp = resp + "\nSkipped the clients that hold their own keypair: " + strings.Join(skipped, ", ")
+		}
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte(resp))
 	}
-	cfg, err := wg.RenderClientConfiguration(seed)
-	if err != nil {
-		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	if req.Qr {
+		cfg, err := c.qrConfig(req)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		png, err := wg.RenderQrPng(cfg, wg.QrPngSize)
+		if err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		fpath := path.Join(c.Config.HostInfo.WireguardSavePath, req.Client+"-"+confName(req)+".png")
+		if err := writePrivate(fpath, png); err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("QR code saved to: "+fpath))
 	}
-	fpath := path.Join(c.Config.HostInfo.WireguardSavePath, req.Server+".conf")
-	err = os.WriteFile(fpath, cfg, 0666)
+	files, err := c.exportFiles(req, c.exportName(req))
 	if err != nil {
 		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
 	}
-	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Configuration saved to: "+fpath))
+	saved := []string{}
+	for _, file := range files {
+		fpath := path.Join(c.Config.HostInfo.WireguardSavePath, file.Name)
+		if err := writePrivate(fpath, file.Contents); err != nil {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+		}
+		saved = append(saved, fpath)
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Configuration saved to: "+strings.Join(saved, ", ")))
 }
 
 type VpnRouter struct {
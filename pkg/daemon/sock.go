@@ -27,6 +27,7 @@ type Context struct {
 	servers  []config.VpnServer
 	rwBuffer bytes.Buffer
 	stream   io.Writer
+	Healthy  func(server string) bool // reports if a server is healthy, every server is when nil
 }
 
 /*
@@ -93,14 +94,20 @@ func (c *Context) Log(msg ...string) {
 
 func (c *Context) Handle(conn net.Conn) {
 	defer conn.Close()
-	b := make([]byte, 2048)
-	nr, err := conn.Read(b)
+	b, err := daemonproto.ReadMessage(conn, daemonproto.MaxMessageSize)
 	if err != nil {
 		c.Log(err.Error())
+		conn.Write(daemonproto.Marshal(*daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))))
 		return
 	}
-	req := c.parseRequest(b[0:nr])
-	out := c.resolveRoute(req)
+	var out daemonproto.SockMessage
+	req, err := c.parseRequest(b)
+	if err != nil {
+		c.Log(err.Error())
+		out = *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	} else {
+		out = c.resolveRoute(req)
+	}
 	_, err = conn.Write(daemonproto.Marshal(out))
 	if err != nil {
 		c.Log(err.Error())
@@ -150,6 +157,25 @@ func (c *Context) Register(name string, router Router) {
 	c.routes[name] = router
 }
 
+/*
+Call one of the registered routes from inside of the daemon, resolving it the same way as a request
+from the socket would be, so that background jobs can reuse the route handlers
+
+	    :param payload: the body of the request
+		:param target: the name of the router to call
+		:param method: the method on the router to call
+*/
+func (c *Context) Call(payload []byte, target string, method string) daemonproto.SockMessage {
+	return c.resolveRoute(daemonproto.SockMessage{
+		Type:    daemonproto.MsgRequest,
+		TypeLen: int8(len(daemonproto.MsgRequest)),
+		Version: daemonproto.SockMsgVers,
+		Body:    payload,
+		Target:  target,
+		Method:  method,
+	})
+}
+
 /*
 Hold the execution context open and listen for input
 */
@@ -171,10 +197,14 @@ Validate and parse a stream from the unix socket and return an Action
 
 	:param msg: a byte array with the action and arguments
 */
-func (c *Context) parseRequest(msg []byte) daemonproto.SockMessage {
-	c.Log("Recieved request to parse action. ", string(msg))
-
-	return daemonproto.Unmarshal(msg)
+func (c *Context) parseRequest(msg []byte) (daemonproto.SockMessage, error) {
+	req, err := daemonproto.Unmarshal(msg)
+	if err != nil {
+		return req, err
+	}
+	// only the route is logged, request bodies can hold keys and passphrases
+	c.Log("Recieved request to parse action. target:", req.Target, "method:", req.Method, "body length:", fmt.Sprint(len(req.Body)))
+	return req, nil
 
 }
 
@@ -191,7 +221,7 @@ func (c *Context) resolveRoute(req daemonproto.SockMessage) daemonproto.SockMess
 	}
 	method, err := daemonproto.MethodCheck(req.Method)
 	if err != nil {
-		c.Log("Error parsing request: ", string(daemonproto.Marshal(req)), err.Error())
+		c.Log("Error parsing request for the target: ", req.Target, err.Error())
 	}
 	handlerFunc, ok := router.Routes()[method]
 	if !ok {
@@ -1 +1,137 @@
 package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+/*
+Send a raw message to a context over a real socket, returning the response
+*/
+func sendRaw(t *testing.T, ctx *Context, raw []byte) daemonproto.SockMessage {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ctx.conn.Accept()
+		if err != nil {
+			return
+		}
+		ctx.Handle(conn)
+	}()
+	conn, err := net.Dial("unix", ctx.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// written in pieces, so that the daemon has to put the message back together
+	for len(raw) > 0 {
+		n := min(len(raw), 1000)
+		if _, err := conn.Write(raw[:n]); err != nil {
+			t.Fatal(err)
+		}
+		raw = raw[n:]
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	out, err := daemonproto.Unmarshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestHandleLargeMessage(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext(path.Join(t.TempDir(), "yosaid.sock"), &buf, nil, config.NewConfiguration(&buf, "test"))
+	defer ctx.conn.Close()
+	router := NewContextRouter()
+	router.Register(daemonproto.ADD, func(msg daemonproto.SockMessage) daemonproto.SockMessage {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte(fmt.Sprint(len(msg.Body))))
+	})
+	ctx.Register("keyring", router)
+
+	// about the size of a PEM encoded RSA key
+	secret := strings.Repeat("A", 3400)
+	req := daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, []byte(secret))
+	req.Target = "keyring"
+	req.Method = string(daemonproto.ADD)
+	resp := sendRaw(t, ctx, daemonproto.Marshal(*req))
+	if resp.StatusCode != daemonproto.REQUEST_OK || string(resp.Body) != "3400" {
+		t.Errorf("expected the whole body to reach the route, got: %d %s", resp.StatusCode, resp.Body)
+	}
+	if strings.Contains(buf.String(), secret) {
+		t.Error("expected the request body to be left out of the logs")
+	}
+
+	// a message that ends before the header says it should
+	truncated := daemonproto.Marshal(*req)[:2048]
+	resp = sendRaw(t, ctx, truncated)
+	if resp.StatusCode != daemonproto.REQUEST_FAILED {
+		t.Errorf("expected a truncated message to fail, got: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// a header claiming a body larger than the limit
+	oversized := daemonproto.Marshal(*req)
+	binary.LittleEndian.PutUint64(oversized[daemonproto.BodyInfoIdx:daemonproto.TargetInfoIdx], daemonproto.MaxMessageSize+1)
+	resp = sendRaw(t, ctx, oversized[:daemonproto.MsgHeaderEnd])
+	if resp.StatusCode != daemonproto.REQUEST_FAILED || !strings.Contains(string(resp.Body), "over the limit") {
+		t.Errorf("expected an oversized message to fail, got: %d %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestHandleRedactsPassphrase(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext(path.Join(t.TempDir(), "yosaid.sock"), &buf, nil, config.NewConfiguration(&buf, "test"))
+	defer ctx.conn.Close()
+	router := NewContextRouter()
+	router.Register(daemonproto.EXPORT, func(msg daemonproto.SockMessage) daemonproto.SockMessage {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("exported"))
+	})
+	ctx.Register("keyring", router)
+
+	b, _ := json.Marshal(keyring.KeyringTransferRequest{Path: "/tmp/backup.keyring", Passphrase: "correct horse battery staple"})
+	req := daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, b)
+	req.Target = "keyring"
+	req.Method = string(daemonproto.EXPORT)
+	resp := sendRaw(t, ctx, daemonproto.Marshal(*req))
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		t.Fatal(string(resp.Body))
+	}
+	if strings.Contains(buf.String(), "correct horse") {
+		t.Error("expected the keyring passphrase to be left out of the logs")
+	}
+}
+
+func TestUnmarshalShortInput(t *testing.T) {
+	req := daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, []byte("body"))
+	req.Target = "keyring"
+	req.Method = "add"
+	raw := daemonproto.Marshal(*req)
+	for _, n := range []int{0, 10, daemonproto.MsgHeaderEnd, len(raw) - 1} {
+		if _, err := daemonproto.Unmarshal(raw[:n]); err == nil {
+			t.Errorf("expected %d of %d bytes to fail", n, len(raw))
+		}
+	}
+	msg, err := daemonproto.Unmarshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Target != "keyring" || msg.Method != "add" || string(msg.Body) != "body" {
+		t.Errorf("expected the message to round trip, got: %#v", msg)
+	}
+}
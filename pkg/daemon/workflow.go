@@ -0,0 +1,790 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+// The states that a workflow run can be in
+const (
+	WorkflowRunning        = "running"
+	WorkflowSucceeded      = "succeeded"
+	WorkflowFailed         = "failed"          // a step failed with nothing to roll back, resuming retries the step
+	WorkflowRolledBack     = "rolled-back"     // a step failed and the steps before it were undone
+	WorkflowRollbackFailed = "rollback-failed" // undoing a step failed, resuming carries on with the rollback
+	WorkflowInterrupted    = "interrupted"     // the daemon stopped while the run was in progress
+)
+
+// the number of finished runs that are kept around for the show route
+const maxFinishedRuns = 50
+
+/*
+How many times a step is attempted before the workflow gives up on it, and how long to wait in between
+*/
+type RetryPolicy struct {
+	Attempts int           `json:"attempts"` // the total number of attempts, 0 and 1 both mean the step isnt retried
+	Delay    time.Duration `json:"delay"`    // the wait before the first retry
+	Backoff  float64       `json:"backoff"`  // what the delay is multiplied by after each retry, ignored unless its above 1
+}
+
+/*
+Get the wait before the next attempt
+
+	:param attempt: the number of attempts that have been made so far
+*/
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	d := r.Delay
+	for i := 1; i < attempt && r.Backoff > 1; i++ {
+		d = time.Duration(float64(d) * r.Backoff)
+	}
+	return d
+}
+
+/*
+A call to one of the daemons registered routes. The body and the condition are templates, rendered with
+the runs .Params, the .Outputs of the steps before it keyed by step name, and the daemons .Config. The
+'json' function quotes a value for the body, and 'addr' strips the prefix length from a CIDR.
+*/
+type WorkflowCall struct {
+	Target string `json:"target"`
+	Method string `json:"method"`
+	Body   string `json:"body"`
+	When   string `json:"when,omitempty"` // the call is only made if this renders to 'true', it is always made when empty
+}
+
+/*
+A step that runs inside of the daemon rather than calling a route, for steps that do more than a route
+can, like bringing up a tunnel. It is given a copy of the run, and what it returns is kept as the steps
+output.
+*/
+type WorkflowFunc func(run WorkflowRun) (interface{}, error)
+
+type WorkflowStep struct {
+	Name string `json:"name"`
+	WorkflowCall
+	Func       WorkflowFunc            `json:"-"` // run in place of the call when set
+	Retry      RetryPolicy             `json:"retry"`
+	Undo       []WorkflowCall          `json:"undo,omitempty"` // the calls that reverse the step if the workflow is rolled back
+	UndoFunc   func(WorkflowRun) error `json:"-"`              // run before the undo calls, for steps that are reversed inside of the daemon
+	UndoFailed bool                    `json:"undo_failed"`    // the step is undone when it fails as well, since it may have been partly applied
+	Final      bool                    `json:"final"`          // once the step has run, the steps before it are never undone
+}
+
+type Workflow struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Params      []string       `json:"params"`   // the parameters that have to be passed to run the workflow
+	Internal    bool           `json:"internal"` // the daemon runs the workflow itself, so it cant be run or resumed through the routes
+	Steps       []WorkflowStep `json:"steps"`
+}
+
+/*
+A single run of a workflow, persisted after every call so that it can be resumed
+*/
+type WorkflowRun struct {
+	Id            string                 `json:"id"`
+	Workflow      string                 `json:"workflow"`
+	Params        map[string]string      `json:"params"`
+	Outputs       map[string]interface{} `json:"outputs"`
+	Status        string                 `json:"status"`
+	Step          int                    `json:"step"`         // the index of the step being run
+	Attempts      int                    `json:"attempts"`     // the attempts made at the current step
+	Completed     []int                  `json:"completed"`    // the indexes of the steps that have run, undone newest first
+	RollingBack   bool                   `json:"rolling_back"` // the run is undoing its completed steps
+	UndoCalls     int                    `json:"undo_calls"`   // the undo calls already made for the step being rolled back
+	Error         string                 `json:"error"`
+	RollbackError string                 `json:"rollback_error"`
+	Started       time.Time              `json:"started"`
+	Updated       time.Time              `json:"updated"`
+}
+
+/*
+Copy a run, so that the engines record of it isnt changed out from under it
+*/
+func (r WorkflowRun) clone() WorkflowRun {
+	outputs := make(map[string]interface{}, len(r.Outputs))
+	for k, v := range r.Outputs {
+		outputs[k] = v
+	}
+	r.Outputs = outputs
+	r.Completed = append([]int{}, r.Completed...)
+	return r
+}
+
+type WorkflowRequest struct {
+	Name   string            `json:"name"`
+	Id     string            `json:"id"`
+	Params map[string]string `json:"params"`
+	Wait   bool              `json:"wait"` // block until the run is finished, rather than running it in the background
+}
+
+type WorkflowSummary struct {
+	Workflows []Workflow    `json:"workflows"`
+	Runs      []WorkflowRun `json:"runs"`
+}
+
+type workflowState struct {
+	Runs []WorkflowRun `json:"runs"`
+}
+
+type workflowData struct {
+	Params  map[string]string
+	Outputs map[string]interface{}
+	Config  *config.Configuration
+}
+
+var workflowFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"addr": func(cidr string) string {
+		addr, _, _ := strings.Cut(cidr, "/")
+		return addr
+	},
+}
+
+/*
+Something that can call the daemons routes, this is satisfied by the Context
+*/
+type RouteCaller interface {
+	Call(payload []byte, target string, method string) daemonproto.SockMessage
+}
+
+type WorkflowEngine struct {
+	caller    RouteCaller
+	Config    *config.Configuration
+	workflows map[string]Workflow
+	runs      map[string]WorkflowRun
+	active    map[string]bool
+	mu        sync.Mutex
+	sleep     func(time.Duration)
+}
+
+/*
+Create a workflow engine, loading the runs from the last time the daemon ran. Any run that was still
+going when the daemon stopped is marked as interrupted, so that it can be resumed.
+
+	    :param caller: used to call the routes that the workflow steps are declared against
+		:param conf: the daemons configuration
+*/
+func NewWorkflowEngine(caller RouteCaller, conf *config.Configuration) (*WorkflowEngine, error) {
+	w := &WorkflowEngine{
+		caller:    caller,
+		Config:    conf,
+		workflows: map[string]Workflow{},
+		runs:      map[string]WorkflowRun{},
+		active:    map[string]bool{},
+		sleep:     time.Sleep,
+	}
+	b, err := os.ReadFile(conf.WorkflowStatePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return w, nil
+		}
+		return nil, &WorkflowError{Msg: "couldnt read the workflow state: " + err.Error()}
+	}
+	var state workflowState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, &WorkflowError{Msg: "couldnt parse the workflow state: " + err.Error()}
+	}
+	for i := range state.Runs {
+		if state.Runs[i].Status == WorkflowRunning {
+			state.Runs[i].Status = WorkflowInterrupted
+		}
+		w.runs[state.Runs[i].Id] = state.Runs[i]
+	}
+	return w, nil
+}
+
+// Logging wrapper
+func (w *WorkflowEngine) Log(msg ...string) {
+	wMsg := []string{"WorkflowEngine:"}
+	wMsg = append(wMsg, msg...)
+	w.Config.Log(wMsg...)
+}
+
+/*
+Declare a workflow so that it can be run. The templates in the steps are checked here, so that a
+mistake in one shows up when the daemon starts rather than part way through a run.
+
+	:param wf: the workflow to declare
+*/
+func (w *WorkflowEngine) Declare(wf Workflow) error {
+	if wf.Name == "" || len(wf.Steps) == 0 {
+		return &WorkflowError{Msg: "workflows need a name and at least one step"}
+	}
+	seen := map[string]bool{}
+	for i := range wf.Steps {
+		step := wf.Steps[i]
+		if step.Name == "" || seen[step.Name] {
+			return &WorkflowError{Msg: fmt.Sprintf("the steps in workflow: %s need unique names, got: '%s'", wf.Name, step.Name)}
+		}
+		seen[step.Name] = true
+		if _, err := parseWorkflowTemplate(step.When); err != nil {
+			return &WorkflowError{Msg: fmt.Sprintf("step: %s in workflow: %s: %s", step.Name, wf.Name, err)}
+		}
+		calls := step.Undo
+		if step.Func == nil {
+			calls = append([]WorkflowCall{step.WorkflowCall}, calls...)
+		}
+		for j := range calls {
+			if _, err := daemonproto.MethodCheck(calls[j].Method); err != nil {
+				return &WorkflowError{Msg: fmt.Sprintf("step: %s in workflow: %s: %s", step.Name, wf.Name, err)}
+			}
+			for _, tmpl := range []string{calls[j].Body, calls[j].When} {
+				if _, err := parseWorkflowTemplate(tmpl); err != nil {
+					return &WorkflowError{Msg: fmt.Sprintf("step: %s in workflow: %s: %s", step.Name, wf.Name, err)}
+				}
+			}
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.workflows[wf.Name] = wf
+	return nil
+}
+
+func parseWorkflowTemplate(tmpl string) (*template.Template, error) {
+	return template.New("workflow").Funcs(workflowFuncs).Option("missingkey=error").Parse(tmpl)
+}
+
+/*
+Render one of a steps templates
+
+	    :param tmpl: the template to render
+		:param run: the run to render it with
+*/
+func (w *WorkflowEngine) render(tmpl string, run WorkflowRun) (string, error) {
+	t, err := parseWorkflowTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer([]byte{})
+	err = t.Execute(buf, workflowData{Params: run.Params, Outputs: run.Outputs, Config: w.Config})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+/*
+Make a call for a workflow run, returning the response body. Calls whose condition doesnt hold are
+skipped, which is reported back with the bool.
+
+	    :param call: the call to make
+		:param run: the run that the call is for
+*/
+func (w *WorkflowEngine) call(call WorkflowCall, run WorkflowRun) ([]byte, bool, error) {
+	if ok, err := w.holds(call.When, run); !ok {
+		return nil, false, err
+	}
+	body, err := w.render(call.Body, run)
+	if err != nil {
+		return nil, false, err
+	}
+	resp := w.caller.Call([]byte(body), call.Target, call.Method)
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		return resp.Body, true, &WorkflowError{Msg: fmt.Sprintf("%s %s: %s %s", call.Target, call.Method, resp.StatusMsg, string(resp.Body))}
+	}
+	return resp.Body, true, nil
+}
+
+/*
+Check the condition of a call, which holds when it is empty
+
+	    :param when: the condition to check
+		:param run: the run that the condition is for
+*/
+func (w *WorkflowEngine) holds(when string, run WorkflowRun) (bool, error) {
+	if when == "" {
+		return true, nil
+	}
+	rendered, err := w.render(when, run)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(rendered) == "true", nil
+}
+
+/*
+Run a step of a workflow, either by calling its route or its function, returning the steps output. Steps
+whose condition doesnt hold are skipped, which is reported back with the bool.
+
+	    :param step: the step to run
+		:param run: the run that the step is for
+*/
+func (w *WorkflowEngine) runStep(step WorkflowStep, run WorkflowRun) (interface{}, bool, error) {
+	if step.Func == nil {
+		out, called, err := w.call(step.WorkflowCall, run)
+		if err != nil || !called {
+			return nil, called, err
+		}
+		return decodeOutput(out), true, nil
+	}
+	if ok, err := w.holds(step.When, run); !ok {
+		return nil, false, err
+	}
+	out, err := step.Func(run)
+	if err != nil {
+		return nil, true, err
+	}
+	// kept the same way that it is read back from disk, so that resumed runs see the same output
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil, true, err
+	}
+	return decodeOutput(b), true, nil
+}
+
+/*
+Make one of the calls that undo a step, the steps function counting as the first one
+
+	    :param step: the step to undo
+		:param i: the index of the undo call to make
+		:param run: the run that the step is being undone for
+*/
+func (w *WorkflowEngine) undo(step WorkflowStep, i int, run WorkflowRun) error {
+	if step.UndoFunc != nil {
+		if i == 0 {
+			return step.UndoFunc(run)
+		}
+		i--
+	}
+	_, _, err := w.call(step.Undo[i], run)
+	return err
+}
+
+/*
+Get the number of calls that undo a step
+
+	:param step: the step to undo
+*/
+func undoCalls(step WorkflowStep) int {
+	if step.UndoFunc != nil {
+		return len(step.Undo) + 1
+	}
+	return len(step.Undo)
+}
+
+/*
+Persist every run to disk, dropping the oldest finished runs once there are too many. The caller has
+to hold the lock.
+*/
+func (w *WorkflowEngine) save() {
+	runs := make([]WorkflowRun, 0, len(w.runs))
+	for _, run := range w.runs {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.After(runs[j].Started) })
+	var kept []WorkflowRun
+	var finished int
+	for i := range runs {
+		if runs[i].Status == WorkflowSucceeded || runs[i].Status == WorkflowRolledBack {
+			finished++
+			if finished > maxFinishedRuns {
+				delete(w.runs, runs[i].Id)
+				continue
+			}
+		}
+		kept = append(kept, runs[i])
+	}
+	b, err := json.MarshalIndent(workflowState{Runs: kept}, " ", "    ")
+	if err != nil {
+		w.Log(err.Error())
+		return
+	}
+	fpath := w.Config.WorkflowStatePath()
+	err = os.WriteFile(fpath+".tmp", b, 0600)
+	if err == nil {
+		err = os.Rename(fpath+".tmp", fpath)
+	}
+	if err != nil {
+		w.Log("Couldnt save the workflow state: ", err.Error())
+	}
+}
+
+/*
+Record the progress of a run
+
+	:param run: the run to record
+*/
+func (w *WorkflowEngine) update(run *WorkflowRun) {
+	run.Updated = time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.runs[run.Id] = run.clone()
+	w.save()
+}
+
+/*
+Get a run by its ID
+
+	:param id: the ID of the run
+*/
+func (w *WorkflowEngine) Run(id string) (WorkflowRun, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	run, ok := w.runs[id]
+	if !ok {
+		return run, &WorkflowError{Msg: "no run with the ID: " + id}
+	}
+	return run.clone(), nil
+}
+
+/*
+Get the parameters of every run that hasnt finished, i.e. the names of the servers that are still being
+brought up or torn down. Runs that were interrupted or failed to roll back are included, since resuming
+them carries on with what they started.
+*/
+func (w *WorkflowEngine) UnfinishedParams() map[string]bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	params := map[string]bool{}
+	for _, run := range w.runs {
+		switch run.Status {
+		case WorkflowRunning, WorkflowInterrupted, WorkflowRollbackFailed:
+		default:
+			continue
+		}
+		for _, val := range run.Params {
+			params[val] = true
+		}
+	}
+	return params
+}
+
+/*
+Create a new run of a workflow. The run doesnt do anything until it is executed.
+
+	    :param name: the name of the workflow to run
+		:param params: the parameters to run it with
+*/
+func (w *WorkflowEngine) Start(name string, params map[string]string) (WorkflowRun, error) {
+	w.mu.Lock()
+	wf, ok := w.workflows[name]
+	w.mu.Unlock()
+	if !ok {
+		return WorkflowRun{}, &WorkflowError{Msg: "no workflow named: " + name}
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	for i := range wf.Params {
+		if _, ok := params[wf.Params[i]]; !ok {
+			return WorkflowRun{}, &WorkflowError{Msg: fmt.Sprintf("the workflow: %s needs the parameters: %v", name, wf.Params)}
+		}
+	}
+	now := time.Now()
+	run := WorkflowRun{
+		Id:       name + "-" + strconv.FormatInt(now.UnixNano(), 36),
+		Workflow: name,
+		Params:   params,
+		Outputs:  map[string]interface{}{},
+		Status:   WorkflowRunning,
+		Started:  now,
+	}
+	w.update(&run)
+	return run, nil
+}
+
+/*
+Pick a run back up from where it stopped. Failed runs retry the step that failed, and runs that
+failed to roll back carry on with the rollback.
+
+	:param id: the ID of the run to resume
+*/
+func (w *WorkflowEngine) Resume(id string) (WorkflowRun, error) {
+	run, err := w.Run(id)
+	if err != nil {
+		return run, err
+	}
+	switch run.Status {
+	case WorkflowFailed, WorkflowRollbackFailed, WorkflowInterrupted:
+	default:
+		return run, &WorkflowError{Msg: fmt.Sprintf("the run: %s is %s, and cant be resumed", id, run.Status)}
+	}
+	run.Attempts = 0
+	run.Status = WorkflowRunning
+	w.update(&run)
+	return run, nil
+}
+
+/*
+Execute a run until it succeeds, or until it fails and has been rolled back. Only one caller can
+execute a run at a time.
+
+	:param id: the ID of the run to execute
+*/
+func (w *WorkflowEngine) Execute(id string) (WorkflowRun, error) {
+	w.mu.Lock()
+	run, ok := w.runs[id]
+	wf, declared := w.workflows[run.Workflow]
+	if !ok || !declared || w.active[id] {
+		w.mu.Unlock()
+		return run, &WorkflowError{Msg: "the run: " + id + " doesnt exist, or is already executing"}
+	}
+	w.active[id] = true
+	run = run.clone()
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.active, id)
+		w.mu.Unlock()
+	}()
+
+	for !run.RollingBack && run.Step < len(wf.Steps) {
+		step := wf.Steps[run.Step]
+		out, called, err := w.runStep(step, run)
+		if err == nil {
+			if called {
+				run.Outputs[step.Name] = out
+				run.Completed = append(run.Completed, run.Step)
+			}
+			if called && step.Final {
+				run.Completed = nil
+			}
+			run.Step++
+			run.Attempts = 0
+			w.update(&run)
+			continue
+		}
+		run.Attempts++
+		run.Error = step.Name + ": " + err.Error()
+		w.Log("Workflow:", run.Id, "step:", step.Name, "failed on attempt:", fmt.Sprint(run.Attempts), err.Error())
+		if run.Attempts < step.Retry.Attempts {
+			w.update(&run)
+			w.sleep(step.Retry.delay(run.Attempts))
+			continue
+		}
+		if step.UndoFailed {
+			run.Completed = append(run.Completed, run.Step)
+		}
+		if !w.undoable(wf, run) {
+			run.Status = WorkflowFailed
+			w.update(&run)
+			return run, err
+		}
+		run.RollingBack = true
+		w.update(&run)
+	}
+	if run.RollingBack {
+		return w.rollback(wf, run)
+	}
+	run.Status = WorkflowSucceeded
+	run.Error = ""
+	w.update(&run)
+	return run, nil
+}
+
+/*
+Check if any of the completed steps of a run can be undone
+
+	    :param wf: the workflow of the run
+		:param run: the run to check
+*/
+func (w *WorkflowEngine) undoable(wf Workflow, run WorkflowRun) bool {
+	for i := range run.Completed {
+		if undoCalls(wf.Steps[run.Completed[i]]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Undo the completed steps of a run, newest first
+
+	    :param wf: the workflow of the run
+		:param run: the run to roll back
+*/
+func (w *WorkflowEngine) rollback(wf Workflow, run WorkflowRun) (WorkflowRun, error) {
+	for len(run.Completed) > 0 {
+		step := wf.Steps[run.Completed[len(run.Completed)-1]]
+		for run.UndoCalls < undoCalls(step) {
+			err := w.undo(step, run.UndoCalls, run)
+			if err != nil {
+				w.Log("Workflow:", run.Id, "failed to undo step:", step.Name, err.Error())
+				run.Status = WorkflowRollbackFailed
+				run.RollbackError = step.Name + ": " + err.Error()
+				w.update(&run)
+				return run, err
+			}
+			run.UndoCalls++
+			w.update(&run)
+		}
+		run.Completed = run.Completed[:len(run.Completed)-1]
+		run.UndoCalls = 0
+		w.update(&run)
+	}
+	run.Status = WorkflowRolledBack
+	run.RollbackError = ""
+	w.update(&run)
+	return run, &WorkflowError{Msg: run.Error}
+}
+
+/*
+Keep the response of a step so that later steps can use it, decoded if it is JSON
+
+	:param body: the body of the response
+*/
+func decodeOutput(body []byte) interface{} {
+	var out interface{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return string(body)
+	}
+	return out
+}
+
+/*
+Execute a run, either in the background or waiting for it, and wrap the result as a response
+
+	    :param run: the run to execute
+		:param wait: block until the run is finished
+*/
+func (w *WorkflowEngine) executeResponse(run WorkflowRun, wait bool) daemonproto.SockMessage {
+	if !wait {
+		go w.Execute(run.Id)
+		b, _ := json.Marshal(run)
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_ACCEPTED, b)
+	}
+	run, err := w.Execute(run.Id)
+	b, _ := json.Marshal(run)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, b)
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Check if a workflow is only run by the daemon itself
+
+	:param name: the name of the workflow
+*/
+func (w *WorkflowEngine) internal(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.workflows[name].Internal
+}
+
+/*
+Wrapping the start of a workflow run in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (w *WorkflowEngine) RunWorkflowHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req WorkflowRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if w.internal(req.Name) {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("the workflow: "+req.Name+" is run by the daemon itself"))
+	}
+	run, err := w.Start(req.Name, req.Params)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return w.executeResponse(run, req.Wait)
+}
+
+/*
+Wrapping the resumption of a workflow run in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (w *WorkflowEngine) ResumeWorkflowHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req WorkflowRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if current, err := w.Run(req.Id); err == nil && w.internal(current.Workflow) {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("the run: "+req.Id+" is resumed by the daemon itself"))
+	}
+	run, err := w.Resume(req.Id)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return w.executeResponse(run, req.Wait)
+}
+
+/*
+Wrapping the workflow listing in a route friendly interface. A run is shown when its ID is passed, a
+workflow declaration when its name is passed, and a summary of everything otherwise. When both are
+passed the run is preferred.
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (w *WorkflowEngine) ShowWorkflowHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req WorkflowRequest
+	json.Unmarshal(msg.Body, &req)
+	var out interface{}
+	run, runErr := w.Run(req.Id)
+	switch {
+	case req.Id != "" && runErr == nil:
+		out = run
+	case req.Id != "" && req.Name == "":
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(runErr.Error()))
+	case req.Name != "":
+		w.mu.Lock()
+		wf, ok := w.workflows[req.Name]
+		w.mu.Unlock()
+		if !ok {
+			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("no workflow named: "+req.Name))
+		}
+		out = wf
+	default:
+		summary := WorkflowSummary{Workflows: []Workflow{}, Runs: []WorkflowRun{}}
+		w.mu.Lock()
+		for _, wf := range w.workflows {
+			summary.Workflows = append(summary.Workflows, wf)
+		}
+		for _, run := range w.runs {
+			summary.Runs = append(summary.Runs, run.clone())
+		}
+		w.mu.Unlock()
+		sort.Slice(summary.Workflows, func(i, j int) bool { return summary.Workflows[i].Name < summary.Workflows[j].Name })
+		sort.Slice(summary.Runs, func(i, j int) bool { return summary.Runs[i].Started.Before(summary.Runs[j].Started) })
+		out = summary
+	}
+	b, _ := json.Marshal(out)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+type WorkflowRouter struct {
+	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
+}
+
+func (w *WorkflowRouter) Register(method daemonproto.Method, callable func(daemonproto.SockMessage) daemonproto.SockMessage) {
+	w.routes[method] = callable
+}
+
+func (w *WorkflowRouter) Routes() map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage {
+	return w.routes
+}
+
+func NewWorkflowRouter() *WorkflowRouter {
+	return &WorkflowRouter{routes: map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage{}}
+}
+
+type WorkflowError struct {
+	Msg string
+}
+
+func (w *WorkflowError) Error() string {
+	return "There was an error running the workflow: " + w.Msg
+}
@@ -0,0 +1,252 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+type fakeRoutes struct {
+	calls []string
+	fail  map[string]int // the number of times a route should fail before it succeeds
+}
+
+func (f *fakeRoutes) Call(payload []byte, target string, method string) daemonproto.SockMessage {
+	route := target + " " + method
+	f.calls = append(f.calls, route+" "+string(payload))
+	if f.fail[route] > 0 {
+		f.fail[route]--
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("failed"))
+	}
+	if route == "cloud add" {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte(`{"ipv4": ["5.5.5.5"]}`))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte{})
+}
+
+var testWorkflow = Workflow{
+	Name:   "test",
+	Params: []string{"name"},
+	Steps: []WorkflowStep{
+		{
+			Name:         "create",
+			WorkflowCall: WorkflowCall{Target: "cloud", Method: "add", Body: `{"name": {{ json .Params.name }}}`},
+			Undo:         []WorkflowCall{{Target: "cloud", Method: "delete", Body: `{"name": {{ json .Params.name }}}`}},
+		},
+		{
+			Name:         "skipped",
+			WorkflowCall: WorkflowCall{Target: "ansible-hosts", Method: "add", Body: `{}`, When: "{{ .Config.UsesCloudInit }}"},
+		},
+		{
+			Name:         "register",
+			WorkflowCall: WorkflowCall{Target: "config-server", Method: "add", Body: `{"wan_ipv4": {{ json (index .Outputs.create.ipv4 0) }}}`},
+			Retry:        RetryPolicy{Attempts: 3, Delay: time.Second, Backoff: 2},
+		},
+	},
+}
+
+func newTestEngine(t *testing.T, fail map[string]int) (*WorkflowEngine, *fakeRoutes, *[]time.Duration) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.HostInfo.WorkflowStatePath = path.Join(t.TempDir(), "workflows.json")
+	routes := &fakeRoutes{fail: fail}
+	engine, err := NewWorkflowEngine(routes, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slept := []time.Duration{}
+	engine.sleep = func(d time.Duration) { slept = append(slept, d) }
+	if err := engine.Declare(testWorkflow); err != nil {
+		t.Fatal(err)
+	}
+	return engine, routes, &slept
+}
+
+func TestWorkflowRetries(t *testing.T) {
+	engine, routes, slept := newTestEngine(t, map[string]int{"config-server add": 2})
+	run, err := engine.Start("test", map[string]string{"name": "vpn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err = engine.Execute(run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != WorkflowSucceeded || !reflect.DeepEqual(run.Completed, []int{0, 2}) {
+		t.Errorf("unexpected run: %+v", run)
+	}
+	want := []string{
+		`cloud add {"name": "vpn"}`,
+		`config-server add {"wan_ipv4": "5.5.5.5"}`,
+		`config-server add {"wan_ipv4": "5.5.5.5"}`,
+		`config-server add {"wan_ipv4": "5.5.5.5"}`,
+	}
+	if !reflect.DeepEqual(routes.calls, want) {
+		t.Errorf("unexpected calls:\n got: %v\nwant: %v", routes.calls, want)
+	}
+	if !reflect.DeepEqual(*slept, []time.Duration{time.Second, time.Second * 2}) {
+		t.Errorf("unexpected retry delays: %v", *slept)
+	}
+}
+
+func TestWorkflowRollsBack(t *testing.T) {
+	engine, routes, _ := newTestEngine(t, map[string]int{"config-server add": 3, "cloud delete": 1})
+	run, _ := engine.Start("test", map[string]string{"name": "vpn"})
+	run, err := engine.Execute(run.Id)
+	if err == nil || run.Status != WorkflowRollbackFailed || run.RollbackError == "" {
+		t.Fatalf("expected the rollback to fail, got: %+v", run)
+	}
+
+	// a new engine stands in for the daemon restarting
+	routes.calls = nil
+	engine, err = NewWorkflowEngine(routes, engine.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Declare(testWorkflow)
+	if _, err := engine.Resume(run.Id); err != nil {
+		t.Fatal(err)
+	}
+	run, err = engine.Execute(run.Id)
+	if err == nil || run.Status != WorkflowRolledBack || len(run.Completed) != 0 {
+		t.Fatalf("expected the run to be rolled back, got: %+v", run)
+	}
+	if want := []string{`cloud delete {"name": "vpn"}`}; !reflect.DeepEqual(routes.calls, want) {
+		t.Errorf("unexpected calls:\n got: %v\nwant: %v", routes.calls, want)
+	}
+	if _, err := engine.Resume(run.Id); err == nil {
+		t.Error("a rolled back run shouldnt be resumable")
+	}
+}
+
+func TestWorkflowResumesInterruptedRun(t *testing.T) {
+	engine, routes, _ := newTestEngine(t, map[string]int{})
+	run, _ := engine.Start("test", map[string]string{"name": "vpn"})
+	// pretend that the daemon stopped after the first step
+	run.Step = 1
+	run.Completed = []int{0}
+	run.Outputs["create"] = map[string]interface{}{"ipv4": []interface{}{"5.5.5.5"}}
+	engine.update(&run)
+
+	engine, err := NewWorkflowEngine(routes, engine.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Declare(testWorkflow)
+	stored, _ := engine.Run(run.Id)
+	if stored.Status != WorkflowInterrupted {
+		t.Fatalf("expected the run to be interrupted, got: %s", stored.Status)
+	}
+	if !engine.UnfinishedParams()["vpn"] {
+		t.Error("expected the server of an interrupted run to be unfinished")
+	}
+	if _, err := engine.Resume(run.Id); err != nil {
+		t.Fatal(err)
+	}
+	run, err = engine.Execute(run.Id)
+	if err != nil || run.Status != WorkflowSucceeded {
+		t.Fatalf("expected the run to succeed, got: %+v, %v", run, err)
+	}
+	if want := []string{`config-server add {"wan_ipv4": "5.5.5.5"}`}; !reflect.DeepEqual(routes.calls, want) {
+		t.Errorf("unexpected calls:\n got: %v\nwant: %v", routes.calls, want)
+	}
+	if engine.UnfinishedParams()["vpn"] {
+		t.Error("expected a finished run not to be unfinished")
+	}
+}
+
+func TestDeclareServerWorkflows(t *testing.T) {
+	engine, _, _ := newTestEngine(t, map[string]int{})
+	for _, wf := range ServerWorkflows() {
+		if err := engine.Declare(wf); err != nil {
+			t.Error(err)
+		}
+	}
+	bad := Workflow{Name: "bad", Steps: []WorkflowStep{{Name: "a", WorkflowCall: WorkflowCall{Target: "cloud", Method: "frobnicate"}}}}
+	if err := engine.Declare(bad); err == nil {
+		t.Error("expected a workflow with an unknown method to be rejected")
+	}
+}
+
+func TestWorkflowFuncSteps(t *testing.T) {
+	engine, routes, _ := newTestEngine(t, map[string]int{})
+	var events []string
+	fails := 1
+	wf := Workflow{
+		Name:     "local",
+		Params:   []string{"name"},
+		Internal: true,
+		Steps: []WorkflowStep{
+			{
+				Name: "create",
+				Func: func(run WorkflowRun) (interface{}, error) {
+					events = append(events, "create")
+					return struct {
+						Address string `json:"address"`
+					}{"5.5.5.5"}, nil
+				},
+				UndoFunc: func(run WorkflowRun) error {
+					events = append(events, "destroy")
+					return nil
+				},
+			},
+			{
+				Name: "cut-over",
+				Func: func(run WorkflowRun) (interface{}, error) {
+					events = append(events, "cut-over "+run.Outputs["create"].(map[string]interface{})["address"].(string))
+					return nil, nil
+				},
+				Final: true,
+			},
+			{
+				Name: "partial",
+				Func: func(run WorkflowRun) (interface{}, error) {
+					events = append(events, "partial")
+					if fails > 0 {
+						fails--
+						return nil, errors.New("half done")
+					}
+					return nil, nil
+				},
+				UndoFunc: func(run WorkflowRun) error {
+					events = append(events, "undo partial")
+					return nil
+				},
+				UndoFailed: true,
+			},
+		},
+	}
+	if err := engine.Declare(wf); err != nil {
+		t.Fatal(err)
+	}
+	run, _ := engine.Start("local", map[string]string{"name": "vpn"})
+	run, err := engine.Execute(run.Id)
+	// the failed step is undone, but nothing from before the final step is
+	if err == nil || run.Status != WorkflowRolledBack {
+		t.Fatalf("expected the failed step to be rolled back, got: %+v", run)
+	}
+	want := []string{"create", "cut-over 5.5.5.5", "partial", "undo partial"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unexpected steps:\n got: %v\nwant: %v", events, want)
+	}
+	if len(routes.calls) != 0 {
+		t.Errorf("expected no routes to be called, got: %v", routes.calls)
+	}
+
+	// internal workflows are only run by the daemon
+	b, _ := json.Marshal(WorkflowRequest{Name: "local", Params: map[string]string{"name": "vpn"}})
+	if resp := engine.RunWorkflowHandler(*daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, b)); resp.StatusCode != daemonproto.REQUEST_FAILED {
+		t.Errorf("expected an internal workflow to be refused, got: %s", resp.Body)
+	}
+	b, _ = json.Marshal(WorkflowRequest{Id: run.Id})
+	if resp := engine.ResumeWorkflowHandler(*daemonproto.NewSockMessage(daemonproto.MsgRequest, daemonproto.REQUEST_OK, b)); resp.StatusCode != daemonproto.REQUEST_FAILED || !strings.Contains(string(resp.Body), "daemon itself") {
+		t.Errorf("expected an internal run to be refused, got: %s", resp.Body)
+	}
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/semaphore"
+)
+
+// Names of the workflows that the daemon declares for itself
+const (
+	ServerCreateWorkflow  = "server-create"
+	ServerDestroyWorkflow = "server-destroy"
+)
+
+const whenAnsible = "{{ not .Config.UsesCloudInit }}"
+const whenCloudInit = "{{ .Config.UsesCloudInit }}"
+
+/*
+The workflows for creating and destroying VPN servers. Creating a server is rolled back if any of its
+steps fail, so a half built server isnt left behind.
+*/
+func ServerWorkflows() []Workflow {
+	return []Workflow{
+		{
+			Name:        ServerCreateWorkflow,
+			Description: "Create a VPN server, add it to the configuration and the inventory, and configure it",
+			Params:      []string{"name"},
+			Steps: []WorkflowStep{
+				{
+					Name: "create",
+					WorkflowCall: WorkflowCall{
+						Target: "cloud",
+						Method: "add",
+						Body:   `{"name": {{ json .Params.name }}, "image": {{ json .Config.BootImage }}, "region": {{ json .Config.Cloud.Region }}, "type": {{ json .Config.Cloud.LinodeType }}}`,
+					},
+					Undo: []WorkflowCall{
+						{Target: "cloud", Method: "delete", Body: `{"name": {{ json .Params.name }}}`},
+						// servers bootstrapped with cloud-init are added to the configuration when theyre created
+						{Target: "config-server", Method: "delete", Body: `{"name": {{ json .Params.name }}}`, When: whenCloudInit},
+					},
+				},
+				{
+					Name: "config-add",
+					WorkflowCall: WorkflowCall{
+						Target: "config-server",
+						Method: "add",
+						Body:   `{"name": {{ json .Params.name }}, "wan_ipv4": {{ json (index .Outputs.create.ipv4 0) }}, "wan_ipv6": {{ json (addr .Outputs.create.ipv6) }}, "Port": {{ .Config.Service.VpnServerPort }}}`,
+						When:   whenAnsible,
+					},
+					Undo: []WorkflowCall{
+						{Target: "config-server", Method: "delete", Body: `{"name": {{ json .Params.name }}}`},
+					},
+				},
+				{
+					Name: "inventory-add",
+					WorkflowCall: WorkflowCall{
+						Target: "ansible-hosts",
+						Method: "add",
+						Body:   `{"target": {{ json .Params.name }}}`,
+						When:   whenAnsible,
+					},
+					Retry: RetryPolicy{Attempts: 3, Delay: time.Second * 5, Backoff: 2},
+					Undo: []WorkflowCall{
+						{Target: "ansible-hosts", Method: "delete", Body: `{"target": {{ json (index .Outputs.create.ipv4 0) }}}`},
+					},
+				},
+				{
+					Name: "poll",
+					WorkflowCall: WorkflowCall{
+						Target: "cloud",
+						Method: "poll",
+						Body:   `{"address": {{ json .Params.name }}}`,
+					},
+					Retry: RetryPolicy{Attempts: 3, Delay: time.Second * 10},
+				},
+				{
+					Name: "playbook",
+					WorkflowCall: WorkflowCall{
+						Target: "ansible-task",
+						Method: "run",
+						Body:   `{"target": "` + semaphore.YosaiVpnRotationJob + `"}`,
+						When:   whenAnsible,
+					},
+					Retry: RetryPolicy{Attempts: 3, Delay: time.Second * 10, Backoff: 2},
+				},
+				{
+					Name: "playbook-poll",
+					WorkflowCall: WorkflowCall{
+						Target: "ansible-task",
+						Method: "poll",
+						Body:   `{"target": "{{ .Outputs.playbook.id }}"}`,
+						When:   whenAnsible,
+					},
+				},
+			},
+		},
+		{
+			Name:        ServerDestroyWorkflow,
+			Description: "Delete a VPN server from the cloud provider, the inventory and the configuration",
+			Params:      []string{"name"},
+			Steps: []WorkflowStep{
+				{
+					Name: "cloud-delete",
+					WorkflowCall: WorkflowCall{
+						Target: "cloud",
+						Method: "delete",
+						Body:   `{"name": {{ json .Params.name }}, "force": {{ eq (index .Params "force") "true" }}}`,
+					},
+					Retry: RetryPolicy{Attempts: 3, Delay: time.Second * 5, Backoff: 2},
+				},
+				{
+					Name: "inventory-delete",
+					WorkflowCall: WorkflowCall{
+						Target: "ansible-hosts",
+						Method: "delete",
+						Body:   `{"target": {{ json (index .Config.Servers .Params.name).WanIpv4 }}}`,
+						When:   whenAnsible,
+					},
+					Retry: RetryPolicy{Attempts: 3, Delay: time.Second * 5, Backoff: 2},
+				},
+				{
+					Name: "config-delete",
+					WorkflowCall: WorkflowCall{
+						Target: "config-server",
+						Method: "delete",
+						Body:   `{"name": {{ json .Params.name }}}`,
+					},
+				},
+			},
+		},
+	}
+}
@@ -15,7 +15,8 @@ import (
 	"git.aetherial.dev/aeth/yosai/pkg/config"
 	"git.aetherial.dev/aeth/yosai/pkg/daemon"
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
-	"git.aetherial.dev/aeth/yosai/pkg/secrets/hashicorp"
+	"git.aetherial.dev/aeth/yosai/pkg/rotation"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
 	"git.aetherial.dev/aeth/yosai/pkg/semaphore"
 )
 
@@ -50,7 +51,8 @@ func makeArgMap(arg string) map[string]string {
 	argSplit := strings.Split(arg, ",")
 	argMap := map[string]string{}
 	for i := range argSplit {
-		a := strings.Split(strings.TrimSpace(argSplit[i]), "=")
+		// values can hold an '=', i.e. the padding on a base64 key
+		a := strings.SplitN(strings.TrimSpace(argSplit[i]), "=", 2)
 		if len(a) != 2 {
 			log.Fatal("Key values must be passed comma delimmited, seperated with an '='. i.e. 'public=12345abcdef,secret=qwerty69420'")
 		}
@@ -74,7 +76,15 @@ func serverAddRequestBuilder(argMap map[string]string) []byte {
 		log.Fatal("Port passed: ", port, " Was not in the valid range of between 1-65535.")
 	}
 
-	b, _ := json.Marshal(config.VpnServer{WanIpv4: argMap["wan"], Port: port, Name: argMap["name"]})
+	var priority int
+	if argMap["priority"] != "" {
+		priority, err = strconv.Atoi(argMap["priority"])
+		if err != nil {
+			log.Fatal("Priority passed: ", argMap["priority"], " is not a valid integer.")
+		}
+	}
+
+	b, _ := json.Marshal(config.VpnServer{WanIpv4: argMap["wan"], Port: port, Name: argMap["name"], Priority: priority})
 
 	return b
 }
@@ -85,19 +95,45 @@ Wraps the creation of a request to add/delete a peer from the config
 	:param argMap: a map with named elements that correspond to the subsequent struct's fields
 */
 func peerAddRequestBuilder(argMap map[string]string) []byte {
-	b, _ := json.Marshal(config.VpnClient{Name: argMap["name"], Pubkey: argMap["pubkey"]})
+	var routes []string
+	if argMap["routes"] != "" {
+		// commas already seperate the arguments, so the routes are seperated with semicolons
+		routes = strings.Split(argMap["routes"], ";")
+	}
+	var servers []string
+	if argMap["servers"] != "" {
+		servers = strings.Split(argMap["servers"], ";")
+	}
+	b, _ := json.Marshal(config.VpnClient{Name: argMap["name"], Pubkey: argMap["pubkey"], Routing: argMap["routing"], Routes: routes, Servers: servers})
 	return b
 }
 
 /*
-Wraps the creation of a request to add to the keyring
+Wraps the creation of a request to add to the keyring. Everything other than the name, type and rung is a
+field of the key, and a field ending in '_file' is read from that file, i.e. 'private_key_file=~/.ssh/id_ed25519'
 	:param argMap: a map with named elements that correspond to the subsequent struct's fields
 */
 
-func keyringRequstBuilder(argMap map[string]string) []byte {
-	b, _ := json.Marshal(hashicorp.VaultItem{Public: argMap["public"], Secret: argMap["secret"], Type: argMap["type"], Name: argMap["name"]})
-	return b
-
+func keyringRequstBuilder(argMap map[string]string) ([]byte, error) {
+	fields := map[string]string{}
+	for field, val := range argMap {
+		switch field {
+		case "name", "type", "rung":
+			continue
+		}
+		if strings.HasSuffix(field, "_file") {
+			b, err := os.ReadFile(val)
+			if err != nil {
+				return nil, err
+			}
+			fields[strings.TrimSuffix(field, "_file")] = string(b)
+			continue
+		}
+		fields[field] = val
+	}
+	key, _ := json.Marshal(fields)
+	b, _ := json.Marshal(keyring.KeyAddRequest{Name: argMap["name"], Type: argMap["type"], Rung: argMap["rung"], Key: key})
+	return b, nil
 }
 
 /*
@@ -106,7 +142,13 @@ Wraps the creation of a request to render a configuration
 */
 
 func configRenderRequestBuilder(argMap map[string]string) []byte {
-	b, _ := json.Marshal(daemon.ConfigRenderRequest{Server: argMap["server"], Client: argMap["client"]})
+	b, _ := json.Marshal(daemon.ConfigRenderRequest{
+		Server:   argMap["server"],
+		Client:   argMap["client"],
+		Failover: argMap["failover"] == "true",
+		Format:   argMap["format"],
+		Bundle:   argMap["bundle"] == "true",
+	})
 	return b
 }
 
@@ -114,7 +156,7 @@ func (d DaemonClient) addLinodeRequestBuilder(arg string) []byte {
 	cfg := d.GetConfig()
 	addLn := linode.AddLinodeRequest{
 		Name:   arg,
-		Image:  cfg.Cloud.Image,
+		Image:  cfg.BootImage(),
 		Type:   cfg.Cloud.LinodeType,
 		Region: cfg.Cloud.Region,
 	}
@@ -154,7 +196,11 @@ func (d DaemonClient) Call(payload []byte, target string, method string) daemonp
 		}
 		log.Fatal(err)
 	}
-	return daemonproto.Unmarshal(resp.Bytes())
+	out, err := daemonproto.Unmarshal(resp.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return out
 
 }
 
@@ -202,13 +248,18 @@ Create a server, and propogate it across the daemonproto's system
 */
 func (d DaemonClient) NewServer(name string) error {
 	// create new server in cloud environment
-	ipv4, err := d.addLinode(name)
+	server, err := d.addLinode(name)
 	if err != nil {
 		return err
 	}
-	// add server data to daemonproto configuration
 	conf := d.GetConfig()
-	b, _ := json.Marshal(config.VpnServer{WanIpv4: ipv4, Name: name, Port: conf.Service.VpnServerPort})
+	if conf.UsesCloudInit() {
+		// the daemon adds the server to its configuration when it renders the user-data,
+		// and the server configures itself so it doesnt belong in the ansible inventory
+		return nil
+	}
+	// add server data to daemonproto configuration
+	b, _ := json.Marshal(config.VpnServer{WanIpv4: server.Ipv4[0], WanIpv6: server.WanIpv6(), Name: name, Port: conf.Service.VpnServerPort})
 	resp := d.Call(b, "config-server", "add")
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return &DaemonClientError{SockMsg: resp}
@@ -230,8 +281,8 @@ Helper function to get servers from the daemonproto config
 func (d DaemonClient) GetServer(val string) (config.VpnServer, error) {
 	cfg := d.GetConfig()
 	for name := range cfg.Service.Servers {
-		if cfg.Service.Servers[name].WanIpv4 == val {
-			return cfg.Service.Servers[val], nil
+		if cfg.Service.Servers[name].WanIpv4 == val || cfg.Service.Servers[name].WanIpv6 == val {
+			return cfg.Service.Servers[name], nil
 		}
 		server, ok := cfg.Service.Servers[val]
 		if ok {
@@ -245,6 +296,20 @@ func (d DaemonClient) GetServer(val string) (config.VpnServer, error) {
 /*
 Add a server to the configuration
 */
+/*
+Add a client to the configuration, along with its routing policy
+
+	:param val: the clients arguments, i.e. 'name=laptop,pubkey=abc123,routing=exclude,routes=192.168.0.0/16;corp.example.com'
+*/
+func (d DaemonClient) AddClientToConfig(val string) error {
+	argMap := makeArgMap(val)
+	resp := d.Call(peerAddRequestBuilder(argMap), "config-peer", "add")
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		return &DaemonClientError{SockMsg: resp}
+	}
+	return nil
+}
+
 func (d DaemonClient) AddServeToConfig(val string) error {
 	argMap := makeArgMap(val)
 	resp := d.Call(serverAddRequestBuilder(argMap), "config-server", "add")
@@ -258,7 +323,7 @@ func (d DaemonClient) AddServeToConfig(val string) error {
 Trigger the daemonproto to execute the vpn rotation playbook on all of the servers in the ansible inventory
 */
 func (d DaemonClient) ConfigureServers() (daemonproto.SockMessage, error) {
-	resp := d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, semaphore.YosaiVpnRotationJob), "ansible-job", "run")
+	resp := d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, semaphore.YosaiVpnRotationJob), "ansible-task", "run")
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return resp, &DaemonClientError{SockMsg: resp}
 	}
@@ -267,7 +332,7 @@ func (d DaemonClient) ConfigureServers() (daemonproto.SockMessage, error) {
 	if err != nil {
 		return resp, &DaemonClientError{SockMsg: resp}
 	}
-	resp = d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, fmt.Sprint(taskInfo.ID)), "ansible-job", "poll")
+	resp = d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, fmt.Sprint(taskInfo.ID)), "ansible-task", "poll")
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return resp, &DaemonClientError{SockMsg: resp}
 	}
@@ -325,51 +390,153 @@ func (d DaemonClient) RemoveServerFromAnsible(name string) error {
 Destroy a server by its logical name in the configuration, ansible inventory, and cloud provider
 
 	:param name: the name of the server in the system
+	:param force: delete the server from the cloud provider even if it isnt tagged as owned by yosai
 */
-func (d DaemonClient) DestroyServer(name string) error {
-	cfg := d.GetConfig()
-	resp := d.Call(jsonBuilder(linode.DeleteLinodeRequest{}, name), "cloud", "delete")
+func (d DaemonClient) DestroyServer(name string, force bool) error {
+	resp := d.RunWorkflow(daemon.ServerDestroyWorkflow, fmt.Sprintf("name=%s,force=%v", name, force), true)
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return &DaemonClientError{SockMsg: resp}
 	}
-	resp = d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, cfg.Service.Servers[name].WanIpv4), "ansible-hosts", "delete")
+	return nil
+}
+
+/*
+Tag an existing server in the cloud provider so that yosai will manage it
+
+	:param name: the name/label of the server
+*/
+func (d DaemonClient) TagServer(name string) daemonproto.SockMessage {
+	b, _ := json.Marshal(linode.TagLinodeRequest{Name: name})
+	return d.Call(b, "cloud-tag", "add")
+}
+
+/*
+Get the health of every server, as seen by the daemons last checks
+*/
+func (d DaemonClient) HealthCheck() (daemonproto.SockMessage, error) {
+	resp := d.Call([]byte(BLANK_JSON), "health", "show")
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		return resp, &DaemonClientError{SockMsg: resp}
+	}
+	return resp, nil
+}
+
+/*
+Bring the local tunnel up, moving it over to another server if one is passed
+
+	:param server: the server to bring the tunnel up to, the one in use when empty
+*/
+func (d DaemonClient) TunnelUp(server string) daemonproto.SockMessage {
+	b, _ := json.Marshal(rotation.TunnelRequest{Server: server})
+	return d.Call(b, "vpn", "up")
+}
+
+/*
+Lock the kill switch, blocking traffic outside of the tunnel
+*/
+func (d DaemonClient) LockFirewall() error {
+	resp := d.Call([]byte(BLANK_JSON), "vpn", "lock")
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return &DaemonClientError{SockMsg: resp}
 	}
-	b, _ := json.Marshal(config.VpnServer{Name: name})
-	resp = d.Call(b, "config-server", "delete")
+	return nil
+}
+
+/*
+Unlock the kill switch, letting traffic out in the clear again
+*/
+func (d DaemonClient) UnlockFirewall() error {
+	resp := d.Call([]byte(BLANK_JSON), "vpn", "unlock")
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return &DaemonClientError{SockMsg: resp}
 	}
 	return nil
+}
 
+/*
+Rotate the wireguard keypair of a client or server
+
+	:param name: the client or server to rotate the keypair of, every keypair that is due is rotated when empty
+*/
+func (d DaemonClient) RotateKey(name string) daemonproto.SockMessage {
+	b, _ := json.Marshal(keyring.KeyRotationRequest{Name: name})
+	return d.Call(b, "keys", "rotate")
 }
 
-func (d DaemonClient) HealthCheck() (daemonproto.SockMessage, error) {
-	return daemonproto.SockMessage{}, nil
+/*
+Add a key to the keyring, or rotate a key that is already on it
+
+	    :param method: either 'add' or 'rotate'
+		:param arg: the key, i.e. 'name=LINODE,type=bearer_auth,secret=abc123' with 'rung=' to pick the rung it is written to
+*/
+func (d DaemonClient) WriteKey(method string, arg string) (daemonproto.SockMessage, error) {
+	b, err := keyringRequstBuilder(makeArgMap(arg))
+	if err != nil {
+		return daemonproto.SockMessage{}, err
+	}
+	return d.Call(b, "keyring", method), nil
 }
-func (d DaemonClient) LockFirewall() error {
-	return nil
+
+/*
+Delete a key from the keyring
+
+	    :param name: the name of the key
+		:param rung: the rung to delete the key from, the first rung when empty
+*/
+func (d DaemonClient) DeleteKey(name string, rung string) daemonproto.SockMessage {
+	b, _ := json.Marshal(keyring.KeyDeleteRequest{Name: name, Rung: rung})
+	return d.Call(b, "keyring", "delete")
+}
+
+/*
+Import keys into the daemons local keyring from a keyring file, or export the local keyring to one. The
+passphrase is taken from YOSAI_KEYRING_PASSPHRASE when neither a passphrase or key file is given, so that
+it doesnt have to be passed on the command line.
+
+	    :param method: either 'import' or 'export'
+		:param arg: the keyring file and its secret, i.e. 'path=/mnt/usb/yosai.keyring,key_file=/mnt/usb/yosai.key'
+*/
+func (d DaemonClient) TransferKeyring(method string, arg string) daemonproto.SockMessage {
+	argMap := makeArgMap(arg)
+	req := keyring.KeyringTransferRequest{Path: argMap["path"], Passphrase: argMap["passphrase"], KeyFile: argMap["key_file"]}
+	if req.Passphrase == "" && req.KeyFile == "" {
+		req.Passphrase = os.Getenv(keyring.KeyringPassphraseEnv)
+	}
+	b, _ := json.Marshal(req)
+	return d.Call(b, "keyring", method)
 }
 
 /*
 Render the a wireguard configuration file
+
+	:param arg: the client and server of the configuration, i.e. 'client=phone,server=primary-vpn', with 'format=networkd' for other VPN clients
 */
 func (d DaemonClient) RenderWgConfig(arg string) daemonproto.SockMessage {
+	return d.Call(configRenderRequestBuilder(makeArgMap(arg)), "vpn-config", "show")
+}
+
+/*
+Render a wireguard configuration file as a QR code, for adding a phone to the VPN
+
+	:param arg: the client and server of the configuration, i.e. 'client=phone,server=primary-vpn', with 'png=true' to save it as an image
+*/
+func (d DaemonClient) RenderWgQrCode(arg string) daemonproto.SockMessage {
 	argMap := makeArgMap(arg)
 
-	b, _ := json.Marshal(daemon.ConfigRenderRequest{Server: argMap["server"], Client: argMap["client"]})
+	b, _ := json.Marshal(daemon.ConfigRenderRequest{Server: argMap["server"], Client: argMap["client"], Qr: true, Failover: argMap["failover"] == "true"})
+	if argMap["png"] == "true" {
+		return d.Call(b, "vpn-config", "save")
+	}
 	return d.Call(b, "vpn-config", "show")
 }
 
 /*
-Render the a wireguard configuration file
+Save a wireguard configuration file
+
+	:param arg: the client and server of the configuration, with 'format=' to pick the format and 'bundle=true' to zip up every clients configuration
 */
 func (d DaemonClient) SaveWgConfig(arg string) daemonproto.SockMessage {
-	argMap := makeArgMap(arg)
-
-	b, _ := json.Marshal(daemon.ConfigRenderRequest{Server: argMap["server"], Client: argMap["client"]})
-	return d.Call(b, "vpn-config", "save")
+	return d.Call(configRenderRequestBuilder(makeArgMap(arg)), "vpn-config", "save")
 }
 
 /*
@@ -377,10 +544,10 @@ This is function creates a linode, and then returns the IPv4 as a string
 
 	:param name: the name to assign the linode
 */
-func (d DaemonClient) addLinode(name string) (string, error) {
+func (d DaemonClient) addLinode(name string) (linode.GetLinodeResponse, error) {
 	cfg := d.GetConfig()
 	b, _ := json.Marshal(linode.AddLinodeRequest{
-		Image:  cfg.Cloud.Image,
+		Image:  cfg.BootImage(),
 		Region: cfg.Cloud.Region,
 		Type:   cfg.Cloud.LinodeType,
 		Name:   name,
@@ -388,10 +555,10 @@ func (d DaemonClient) addLinode(name string) (string, error) {
 	resp := d.Call(b, "cloud", "add")
 	linodeResp := linode.GetLinodeResponse{}
 	err := json.Unmarshal(resp.Body, &linodeResp)
-	if err != nil {
-		return "", &DaemonClientError{SockMsg: resp}
+	if err != nil || len(linodeResp.Ipv4) == 0 {
+		return linodeResp, &DaemonClientError{SockMsg: resp}
 	}
-	return linodeResp.Ipv4[0], nil
+	return linodeResp, nil
 }
 
 func (d DaemonClient) BootstrapAll() error {
@@ -431,32 +598,56 @@ func (d DaemonClient) ShowAllRoutes() daemonproto.SockMessage {
 }
 
 /*
-This creates a new server, wrapping the DaemonClient.NewServer() function, and then configures it
+This creates a new server and configures it, through the daemons server-create workflow. If any part
+of it fails then the daemon destroys the server again, rather than leaving it half built.
 
 	:param name: the name to give the server
 */
 func (d DaemonClient) ServiceInit(name string) error {
-	d.NewServer(name)
-	resp := d.Call(jsonBuilder(linode.PollLinodeRequest{}, name), "cloud", "poll")
-	if resp.StatusCode != daemonproto.REQUEST_OK {
-		return &DaemonClientError{SockMsg: resp}
-	}
-	resp = d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, "VPN Rotation playbook"), "ansible-job", "run")
-	if resp.StatusCode != daemonproto.REQUEST_OK {
-		return &DaemonClientError{SockMsg: resp}
-	}
-	semaphoreResp := semaphore.TaskInfo{}
-	err := json.Unmarshal(resp.Body, &semaphoreResp)
-	if err != nil {
-		return &DaemonClientError{SockMsg: resp}
-	}
-	resp = d.Call(jsonBuilder(semaphore.SemaphoreRequest{}, fmt.Sprint(semaphoreResp.ID)), "ansible-job", "poll")
+	resp := d.RunWorkflow(daemon.ServerCreateWorkflow, "name="+name, true)
 	if resp.StatusCode != daemonproto.REQUEST_OK {
 		return &DaemonClientError{SockMsg: resp}
 	}
 	return nil
 }
 
+/*
+Start a run of one of the daemons workflows
+
+	    :param name: the name of the workflow to run
+		:param params: the parameters for the workflow, i.e. 'name=primary-vpn,force=true'
+		:param wait: block until the run is finished, rather than running it in the background
+*/
+func (d DaemonClient) RunWorkflow(name string, params string, wait bool) daemonproto.SockMessage {
+	req := daemon.WorkflowRequest{Name: name, Params: map[string]string{}, Wait: wait}
+	if params != "" {
+		req.Params = makeArgMap(params)
+	}
+	b, _ := json.Marshal(req)
+	return d.Call(b, "workflow", "run")
+}
+
+/*
+Show a workflow run, a workflow declaration, or a summary of both
+
+	:param target: the ID of a run or the name of a workflow, shows the summary when empty
+*/
+func (d DaemonClient) ShowWorkflow(target string) daemonproto.SockMessage {
+	// the daemon looks for a run with the ID first, then a workflow with the name
+	b, _ := json.Marshal(daemon.WorkflowRequest{Id: target, Name: target})
+	return d.Call(b, "workflow", "show")
+}
+
+/*
+Resume a workflow run that failed or was interrupted, running it in the background
+
+	:param id: the ID of the run to resume
+*/
+func (d DaemonClient) ResumeWorkflow(id string) daemonproto.SockMessage {
+	b, _ := json.Marshal(daemon.WorkflowRequest{Id: id})
+	return d.Call(b, "workflow", "resume")
+}
+
 type DaemonClientError struct {
 	SockMsg daemonproto.SockMessage
 }
@@ -0,0 +1,538 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/linode"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/rotation"
+)
+
+const DefaultInterval = time.Second * 30
+const DefaultFailureThreshold = 3
+const DefaultHandshakeMaxAge = time.Minute * 5
+const DefaultHistory = 20
+
+// how long a single probe waits for the server to answer
+const ProbeTimeout = time.Second * 5
+
+type ProbeResult struct {
+	Probe  string `json:"probe"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+/*
+The results of checking a server once. A server is healthy if every probe that ran passed.
+*/
+type Check struct {
+	Time    time.Time     `json:"time"`
+	Healthy bool          `json:"healthy"`
+	Results []ProbeResult `json:"results"`
+}
+
+type ServerHealth struct {
+	Name     string  `json:"name"`
+	Active   bool    `json:"active"`
+	Failures int     `json:"failures"` // the checks failed in a row
+	History  []Check `json:"history"`  // oldest first
+}
+
+/*
+Check if the latest check of the server passed
+*/
+func (s ServerHealth) Healthy() bool {
+	return len(s.History) > 0 && s.History[len(s.History)-1].Healthy
+}
+
+type HealthStatus struct {
+	Enabled           bool           `json:"enabled"`
+	Active            string         `json:"active"`
+	LastCheck         time.Time      `json:"last_check"`
+	LastFailover      time.Time      `json:"last_failover"`
+	LastFailoverError string         `json:"last_failover_error"`
+	Servers           []ServerHealth `json:"servers"`
+}
+
+/*
+Owns the local tunnel, and moves it between servers. This is satisfied by the rotation.Rotator
+*/
+type Switcher interface {
+	Active() string
+	FailoverFrom(from string, name string) error
+}
+
+/*
+A probe of a single server. The cloud statuses are keyed by server name, and are nil if they
+couldnt be listed.
+*/
+type probe func(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool)
+
+/*
+Periodically probes every server in the configuration, and fails the local tunnel over to the next
+healthy server when the one in use keeps failing. The history of the checks is kept in memory.
+*/
+type Monitor struct {
+	Caller   rotation.Caller
+	Config   *config.Configuration
+	Switcher Switcher
+	Tunnel   rotation.Tunnel
+	now      func() time.Time
+	probes   map[string]probe
+	sshPort  string
+	mu       sync.Mutex
+	status   HealthStatus
+	servers  map[string]*ServerHealth
+	trigger  chan struct{}
+}
+
+/*
+Create a health monitor
+
+	    :param caller: used to list the servers with the cloud provider
+		:param conf: the daemons configuration
+		:param switcher: moves the local tunnel over when the server in use is unhealthy
+		:param tunnel: used to read the handshakes of the local tunnel
+*/
+func NewMonitor(caller rotation.Caller, conf *config.Configuration, switcher Switcher, tunnel rotation.Tunnel) *Monitor {
+	m := &Monitor{
+		Caller:   caller,
+		Config:   conf,
+		Switcher: switcher,
+		Tunnel:   tunnel,
+		now:      time.Now,
+		sshPort:  "22",
+		servers:  map[string]*ServerHealth{},
+		trigger:  make(chan struct{}, 1),
+	}
+	m.probes = map[string]probe{
+		config.ProbeHandshake: m.probeHandshake,
+		config.ProbeUdp:       m.probeUdp,
+		config.ProbeSsh:       m.probeSsh,
+		config.ProbeProvider:  m.probeProvider,
+	}
+	return m
+}
+
+// Logging wrapper
+func (m *Monitor) Log(msg ...string) {
+	hMsg := []string{"HealthMonitor:"}
+	hMsg = append(hMsg, msg...)
+	m.Config.Log(hMsg...)
+}
+
+/*
+Parse a duration from the configuration, falling back to a default when it isnt set or is invalid
+
+	    :param val: the duration from the configuration
+		:param fallback: the default duration
+*/
+func (m *Monitor) duration(val string, fallback time.Duration) time.Duration {
+	if strings.TrimSpace(val) == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		m.Log("Invalid duration:", val, "using:", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+/*
+Run a check on the next loop, whether health checking is enabled or not
+*/
+func (m *Monitor) Trigger() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Check the servers on the configured interval. The interval is read again after every check, so
+that changes to it are picked up when the configuration is reloaded.
+*/
+func (m *Monitor) Run() {
+	for {
+		forced := false
+		select {
+		case <-time.After(m.duration(m.Config.Health.Interval, DefaultInterval)):
+		case <-m.trigger:
+			forced = true
+		}
+		if forced || m.Config.Health.Enabled {
+			m.Tick()
+		}
+	}
+}
+
+/*
+Check every server once, and fail over if the server in use has failed too many checks in a row
+*/
+func (m *Monitor) Tick() {
+	active := m.Switcher.Active()
+	var cloud map[string]string
+	if m.enabled(config.ProbeProvider) {
+		var err error
+		cloud, err = m.cloudStatuses()
+		if err != nil {
+			m.Log("Couldnt list the servers with the cloud provider, skipping the provider probe:", err.Error())
+		}
+	}
+	servers := m.Config.Servers()
+	checks := make(map[string]Check, len(servers))
+	var wg sync.WaitGroup
+	var checksMu sync.Mutex
+	for name := range servers {
+		wg.Add(1)
+		go func(server config.VpnServer) {
+			defer wg.Done()
+			check := m.check(server, server.Name == active, cloud)
+			checksMu.Lock()
+			checks[server.Name] = check
+			checksMu.Unlock()
+		}(servers[name])
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	history := m.Config.Health.History
+	if history <= 0 {
+		history = DefaultHistory
+	}
+	for name := range m.servers {
+		if _, ok := checks[name]; !ok {
+			delete(m.servers, name)
+		}
+	}
+	for name, check := range checks {
+		health, ok := m.servers[name]
+		if !ok {
+			health = &ServerHealth{Name: name}
+			m.servers[name] = health
+		}
+		health.History = append(health.History, check)
+		if len(health.History) > history {
+			health.History = health.History[len(health.History)-history:]
+		}
+		if check.Healthy {
+			health.Failures = 0
+		} else {
+			health.Failures++
+		}
+	}
+	m.status.LastCheck = m.now()
+	var failures int
+	if health, ok := m.servers[active]; ok {
+		failures = health.Failures
+	}
+	m.mu.Unlock()
+
+	threshold := m.Config.Health.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if active == "" || failures < threshold {
+		return
+	}
+	m.failover(active, failures)
+}
+
+/*
+Move the local tunnel off of an unhealthy server, to the most preferred healthy one
+
+	    :param active: the server that the tunnel is using
+		:param failures: the checks that it has failed in a row
+*/
+func (m *Monitor) failover(active string, failures int) {
+	next := m.nextHealthy(active)
+	if next == "" {
+		m.setFailover(time.Time{}, fmt.Sprintf("%s failed %v checks in a row, but there isnt a healthy server to fail over to", active, failures))
+		return
+	}
+	m.Log("The server:", active, "failed", fmt.Sprint(failures), "checks in a row, failing over to:", next)
+	err := m.Switcher.FailoverFrom(active, next)
+	if err != nil {
+		m.setFailover(time.Time{}, "failing over to: "+next+" failed: "+err.Error())
+		return
+	}
+	m.setFailover(m.now(), "")
+}
+
+/*
+Record the outcome of a failover
+
+	    :param at: when the failover happened, or the zero time if it didnt
+		:param failure: why the failover didnt happen
+*/
+func (m *Monitor) setFailover(at time.Time, failure string) {
+	if failure != "" {
+		m.Log(failure)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !at.IsZero() {
+		m.status.LastFailover = at
+	}
+	m.status.LastFailoverError = failure
+}
+
+/*
+Get the most preferred server other than the passed one whose latest check passed. Servers are
+preferred by their priority and then by name, the same order that failover tunnels use them in.
+
+	:param except: the name of the server to leave out
+*/
+func (m *Monitor) nextHealthy(except string) string {
+	// a client that isnt limited to any servers gets every server, in the order it prefers them
+	servers := m.Config.ClientServers(config.VpnClient{})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, server := range servers {
+		if health, ok := m.servers[server.Name]; ok && server.Name != except && health.Healthy() {
+			return server.Name
+		}
+	}
+	return ""
+}
+
+/*
+Check if a server is healthy. Servers that havent been checked yet are taken to be healthy, so that
+they can be used before the first check runs or when health checks are turned off.
+
+	:param name: the name of the server
+*/
+func (m *Monitor) Healthy(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	server, ok := m.servers[name]
+	if !ok || len(server.History) == 0 {
+		return true
+	}
+	return server.Healthy()
+}
+
+/*
+Check if a probe is turned on in the configuration
+
+	:param name: the name of the probe
+*/
+func (m *Monitor) enabled(name string) bool {
+	for _, p := range m.Config.HealthProbes() {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Run every enabled probe against a server
+
+	    :param server: the server to check
+		:param active: the local tunnel is using the server
+		:param cloud: the status of each server with the cloud provider
+*/
+func (m *Monitor) check(server config.VpnServer, active bool, cloud map[string]string) Check {
+	check := Check{Time: m.now(), Healthy: true}
+	for _, name := range m.Config.HealthProbes() {
+		p, ok := m.probes[name]
+		if !ok {
+			continue
+		}
+		result, ran := p(server, active, cloud)
+		if !ran {
+			continue
+		}
+		result.Probe = name
+		check.Results = append(check.Results, result)
+		if !result.Ok {
+			check.Healthy = false
+		}
+	}
+	return check
+}
+
+/*
+List the status of every server with the cloud provider, keyed by name
+*/
+func (m *Monitor) cloudStatuses() (map[string]string, error) {
+	resp := m.Caller.Call([]byte("{}"), "cloud", "show")
+	if resp.StatusCode != daemonproto.REQUEST_OK {
+		return nil, &HealthError{Msg: fmt.Sprintf("%s %s", resp.StatusMsg, string(resp.Body))}
+	}
+	var owned linode.GetAllLinodes
+	if err := json.Unmarshal(resp.Body, &owned); err != nil {
+		return nil, &HealthError{Msg: "unexpected response listing the servers: " + string(resp.Body)}
+	}
+	statuses := make(map[string]string, len(owned.Data))
+	for i := range owned.Data {
+		statuses[owned.Data[i].Label] = owned.Data[i].Status
+	}
+	return statuses, nil
+}
+
+/*
+Check that the local tunnel to the server has handshaked recently. Only the server in use has a
+tunnel, so the probe is skipped for the others.
+*/
+func (m *Monitor) probeHandshake(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+	if !active {
+		return ProbeResult{}, false
+	}
+	handshake, err := m.Tunnel.Handshake(rotation.TunnelConf(m.Config, server.Name))
+	if err != nil {
+		return ProbeResult{Detail: err.Error()}, true
+	}
+	if handshake.IsZero() {
+		return ProbeResult{Detail: "the tunnel hasnt completed a handshake"}, true
+	}
+	age := m.now().Sub(handshake)
+	maxAge := m.duration(m.Config.Health.HandshakeMaxAge, DefaultHandshakeMaxAge)
+	if age > maxAge {
+		return ProbeResult{Detail: fmt.Sprintf("the latest handshake was %s ago", age.Round(time.Second))}, true
+	}
+	return ProbeResult{Ok: true, Detail: fmt.Sprintf("the latest handshake was %s ago", age.Round(time.Second))}, true
+}
+
+/*
+Check that the wireguard port isnt closed. Wireguard drops anything it cant authenticate, so the
+probe can only tell that the port is closed from an ICMP port unreachable, and silence is a pass.
+*/
+func (m *Monitor) probeUdp(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+	port := server.Port
+	if port == 0 {
+		port = m.Config.Service.VpnServerPort
+	}
+	addr := net.JoinHostPort(server.WanIpv4, strconv.Itoa(port))
+	conn, err := net.DialTimeout("udp", addr, ProbeTimeout)
+	if err != nil {
+		return ProbeResult{Detail: err.Error()}, true
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ProbeTimeout))
+	if _, err = conn.Write([]byte{0}); err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ProbeResult{Detail: addr + " is refusing datagrams"}, true
+	}
+	return ProbeResult{Ok: true, Detail: addr + " isnt refusing datagrams"}, true
+}
+
+/*
+Check that the server answers on the SSH port with an SSH banner
+*/
+func (m *Monitor) probeSsh(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+	addr := net.JoinHostPort(server.WanIpv4, m.sshPort)
+	conn, err := net.DialTimeout("tcp", addr, ProbeTimeout)
+	if err != nil {
+		return ProbeResult{Detail: err.Error()}, true
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ProbeTimeout))
+	banner := make([]byte, 4)
+	_, err = conn.Read(banner)
+	if err != nil {
+		return ProbeResult{Detail: "no banner from " + addr + ": " + err.Error()}, true
+	}
+	if string(banner) != "SSH-" {
+		return ProbeResult{Detail: addr + " didnt answer with an SSH banner"}, true
+	}
+	return ProbeResult{Ok: true, Detail: addr + " answered with an SSH banner"}, true
+}
+
+/*
+Check that the cloud provider has the server, and reports it as running. The probe is skipped if the
+servers couldnt be listed, as an outage of the providers API says nothing about the server.
+*/
+func (m *Monitor) probeProvider(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+	if cloud == nil {
+		return ProbeResult{}, false
+	}
+	status, ok := cloud[server.Name]
+	if !ok {
+		return ProbeResult{Detail: "the cloud provider doesnt have the server"}, true
+	}
+	if status != "running" {
+		return ProbeResult{Detail: "the cloud provider reports the server as: " + status}, true
+	}
+	return ProbeResult{Ok: true, Detail: "running"}, true
+}
+
+/*
+Get a copy of the health of every server
+*/
+func (m *Monitor) Status() HealthStatus {
+	active := m.Switcher.Active()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	status.Enabled = m.Config.Health.Enabled
+	status.Active = active
+	status.Servers = []ServerHealth{}
+	for _, health := range m.servers {
+		server := *health
+		server.History = append([]Check{}, health.History...)
+		server.Active = server.Name == active
+		status.Servers = append(status.Servers, server)
+	}
+	sort.Slice(status.Servers, func(i, j int) bool { return status.Servers[i].Name < status.Servers[j].Name })
+	return status
+}
+
+/*
+Wrapping the health of the servers in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (m *Monitor) ShowHealthHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	b, _ := json.Marshal(m.Status())
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Wrapping a manual health check in a route friendly interface. The check runs in the background, and
+its results can be seen with the show route.
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (m *Monitor) RunHealthHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	m.Trigger()
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Health check started."))
+}
+
+type HealthRouter struct {
+	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
+}
+
+func (h *HealthRouter) Register(method daemonproto.Method, callable func(daemonproto.SockMessage) daemonproto.SockMessage) {
+	h.routes[method] = callable
+}
+
+func (h *HealthRouter) Routes() map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage {
+	return h.routes
+}
+
+func NewHealthRouter() *HealthRouter {
+	return &HealthRouter{routes: map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage{}}
+}
+
+type HealthError struct {
+	Msg string
+}
+
+func (h *HealthError) Error() string {
+	return "There was an error checking the health of the servers: " + h.Msg
+}
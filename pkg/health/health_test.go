@@ -0,0 +1,152 @@
+package health
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+type fakeSwitcher struct {
+	active    string
+	failovers []string
+}
+
+func (f *fakeSwitcher) Active() string {
+	return f.active
+}
+
+func (f *fakeSwitcher) FailoverFrom(from string, name string) error {
+	if from != f.active {
+		return errors.New("the tunnel has moved to: " + f.active)
+	}
+	f.failovers = append(f.failovers, name)
+	f.active = name
+	return nil
+}
+
+type noCaller struct{}
+
+func (n noCaller) Call(payload []byte, target string, method string) daemonproto.SockMessage {
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("unreachable"))
+}
+
+func TestFailover(t *testing.T) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.Health.FailureThreshold = 2
+	conf.Health.Probes = []string{config.ProbeUdp}
+	for _, name := range []string{"a", "b", "c"} {
+		conf.Service.Servers[name] = config.VpnServer{Name: name}
+	}
+	switcher := &fakeSwitcher{active: "b"}
+	monitor := NewMonitor(noCaller{}, conf, switcher, nil)
+	down := map[string]bool{"b": true, "c": true}
+	monitor.probes = map[string]probe{
+		config.ProbeUdp: func(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+			return ProbeResult{Ok: !down[server.Name]}, true
+		},
+	}
+
+	monitor.Tick()
+	if len(switcher.failovers) != 0 {
+		t.Fatalf("failed over before the threshold: %v", switcher.failovers)
+	}
+	monitor.Tick()
+	// a is the only other healthy server, so the failover goes to it
+	if len(switcher.failovers) != 1 || switcher.active != "a" {
+		t.Fatalf("expected a failover to a, got: %v", switcher.failovers)
+	}
+	status := monitor.Status()
+	if status.Active != "a" || status.LastFailover.IsZero() || len(status.Servers) != 3 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if !status.Servers[0].Active || status.Servers[1].Failures != 2 || len(status.Servers[1].History) != 2 {
+		t.Errorf("unexpected server health: %+v", status.Servers)
+	}
+
+	down["a"] = true
+	monitor.Tick()
+	monitor.Tick()
+	if len(switcher.failovers) != 1 || monitor.Status().LastFailoverError == "" {
+		t.Errorf("expected no failover without a healthy server, got: %v", switcher.failovers)
+	}
+}
+
+func TestFailoverPriority(t *testing.T) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.Health.FailureThreshold = 1
+	conf.Health.Probes = []string{config.ProbeUdp}
+	conf.Service.Servers["a"] = config.VpnServer{Name: "a", Priority: 2}
+	conf.Service.Servers["b"] = config.VpnServer{Name: "b", Priority: 0}
+	conf.Service.Servers["c"] = config.VpnServer{Name: "c", Priority: 1}
+	switcher := &fakeSwitcher{active: "b"}
+	monitor := NewMonitor(noCaller{}, conf, switcher, nil)
+	down := map[string]bool{"b": true}
+	monitor.probes = map[string]probe{
+		config.ProbeUdp: func(server config.VpnServer, active bool, cloud map[string]string) (ProbeResult, bool) {
+			return ProbeResult{Ok: !down[server.Name]}, true
+		},
+	}
+	// a comes first by name, but c is preferred by its priority
+	monitor.Tick()
+	if switcher.active != "c" {
+		t.Fatalf("expected a failover to c, got: %v", switcher.failovers)
+	}
+}
+
+func TestNetworkProbes(t *testing.T) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	monitor := NewMonitor(noCaller{}, conf, &fakeSwitcher{}, nil)
+
+	// grab a free port and close it again, so that datagrams to it are refused
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+	if result, _ := monitor.probeUdp(config.VpnServer{WanIpv4: "127.0.0.1", Port: port}, false, nil); result.Ok {
+		t.Errorf("expected the closed port to fail: %+v", result)
+	}
+	open, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	port = open.LocalAddr().(*net.UDPAddr).Port
+	go func() {
+		// answer like a server that isnt wireguard would, so the probe doesnt wait out its timeout
+		buf := make([]byte, 1)
+		_, addr, err := open.ReadFrom(buf)
+		if err == nil {
+			open.WriteTo(buf, addr)
+		}
+	}()
+	if result, _ := monitor.probeUdp(config.VpnServer{WanIpv4: "127.0.0.1", Port: port}, false, nil); !result.Ok {
+		t.Errorf("expected the open port to pass: %+v", result)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			conn.Close()
+		}
+	}()
+	_, monitor.sshPort, _ = net.SplitHostPort(ln.Addr().String())
+	if result, _ := monitor.probeSsh(config.VpnServer{WanIpv4: "127.0.0.1"}, false, nil); !result.Ok {
+		t.Errorf("expected the SSH banner to pass: %+v", result)
+	}
+	ln.Close()
+	if result, _ := monitor.probeSsh(config.VpnServer{WanIpv4: "127.0.0.1"}, false, nil); result.Ok {
+		t.Errorf("expected the closed SSH port to fail: %+v", result)
+	}
+}
@@ -10,6 +10,7 @@ type Keytagger interface {
 	SemaphoreApiKeyname() string      // Returns the Semaphore API key name
 	GitSshKeyname() string            // Returns the name of the SSH key used to pull from the git server
 	WgKeypairKeyname() string         // returns the keyname of the Wireguard server keypair
+	WgPresharedKeyname() string       // returns the suffix of the keynames of the Wireguard preshared keys, one per client and server pair
 	AllKeys() []string                // Returns all of the key names
 	GetAnsibleKeys() []string         // Returns all the keynames that need to be added to Semaphore
 	ProtectedKeys() map[string]string // Get protected keys that shall not be deleted and reloaded when the keyring is synced with the backend
@@ -27,6 +28,7 @@ func (c ConstKeytag) SemaphoreApiKeyname() string    { return SEMAPHORE_API_KEYN
 func (c ConstKeytag) GitSshKeyname() string          { return GIT_SSH_KEYNAME }
 func (c ConstKeytag) VpsSvcAccSshPubkeySeed() string { return VPS_PUBKEY_SEED_KEYNAME }
 func (c ConstKeytag) WgKeypairKeyname() string       { return WG_KEYPAIR_KEYNAME }
+func (c ConstKeytag) WgPresharedKeyname() string     { return WG_PRESHARED_KEYNAME }
 func (c ConstKeytag) GetAnsibleKeys() []string {
 	return []string{
 		GIT_SSH_KEYNAME,
@@ -100,3 +102,4 @@ const SEMAPHORE_API_KEYNAME = "SEMAPHORE_API_KEY"
 const GIT_SSH_KEYNAME = "GIT_SSH_KEY"
 const VPS_PUBKEY_SEED_KEYNAME = "VPS_PUBKEY_SEED"
 const WG_KEYPAIR_KEYNAME = "WG_KEYPAIR"
+const WG_PRESHARED_KEYNAME = "WG_PSK"
@@ -0,0 +1,252 @@
+package killswitch
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/rotation"
+	"git.aetherial.dev/aeth/yosai/pkg/wireguard/iface"
+)
+
+/*
+A wireguard endpoint that traffic is let out to while the kill switch is locked
+*/
+type Endpoint struct {
+	IP   net.IP `json:"ip"`
+	Port int    `json:"port"`
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+/*
+Everything that is allowed out while the kill switch is locked, all other outbound traffic is dropped
+*/
+type Ruleset struct {
+	Interfaces []string    `json:"interfaces"` // the tunnel interfaces
+	Endpoints  []Endpoint  `json:"endpoints"`  // the wireguard endpoints of the tunnels
+	LanRanges  []net.IPNet `json:"lan_ranges"`
+}
+
+/*
+Something that can enforce a Ruleset on the host
+*/
+type Firewall interface {
+	Apply(rules Ruleset) error
+	Remove() error
+}
+
+type KillSwitchStatus struct {
+	Locked  bool    `json:"locked"`
+	Ruleset Ruleset `json:"ruleset"`
+}
+
+/*
+Blocks traffic outside of the tunnel. The endpoints of each tunnel are tracked as it comes up and goes down,
+so the rules follow the tunnel across rotations and failovers, and are enforced whenever the switch is locked.
+While locked, the daemon can only reach the cloud provider and the other backends through the tunnel or over the LAN.
+*/
+type KillSwitch struct {
+	Config   *config.Configuration
+	Firewall Firewall
+	mu       sync.Mutex
+	locked   bool
+	tunnels  map[string][]Endpoint // the endpoints of each tunnel, keyed by the interface name
+}
+
+/*
+Create a kill switch, it is unlocked until Lock is called
+
+	    :param conf: the daemons configuration, which has the LAN ranges to allow
+		:param firewall: the firewall to enforce the rules with
+*/
+func NewKillSwitch(conf *config.Configuration, firewall Firewall) *KillSwitch {
+	return &KillSwitch{Config: conf, Firewall: firewall, tunnels: map[string][]Endpoint{}}
+}
+
+// Logging wrapper
+func (k *KillSwitch) Log(msg ...string) {
+	kMsg := []string{"KillSwitch:"}
+	kMsg = append(kMsg, msg...)
+	k.Config.Log(kMsg...)
+}
+
+/*
+Block all traffic outside of the tunnel
+*/
+func (k *KillSwitch) Lock() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rules, err := k.ruleset()
+	if err != nil {
+		return err
+	}
+	if err := k.Firewall.Apply(rules); err != nil {
+		return &KillSwitchError{Msg: err.Error()}
+	}
+	k.locked = true
+	k.Log("locked, allowing", strconv.Itoa(len(rules.Endpoints)), "endpoints")
+	return nil
+}
+
+/*
+Remove the kill switch rules, letting traffic out in the clear again
+*/
+func (k *KillSwitch) Unlock() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.Firewall.Remove(); err != nil {
+		return &KillSwitchError{Msg: err.Error()}
+	}
+	k.locked = false
+	k.Log("unlocked")
+	return nil
+}
+
+/*
+Get whether the kill switch is locked, and the rules it is enforcing
+*/
+func (k *KillSwitch) Status() (KillSwitchStatus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rules, err := k.ruleset()
+	return KillSwitchStatus{Locked: k.locked, Ruleset: rules}, err
+}
+
+/*
+Let traffic out to the endpoints of a tunnel, and through its interface
+
+	:param conf: the path of the tunnels wireguard configuration file
+*/
+func (k *KillSwitch) Allow(conf string) error {
+	cfg, err := iface.ReadConfig(conf)
+	if err != nil {
+		return err
+	}
+	var endpoints []Endpoint
+	for _, peer := range cfg.Peers {
+		if peer.Endpoint == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", peer.Endpoint)
+		if err != nil {
+			return &KillSwitchError{Msg: "couldnt resolve the endpoint " + peer.Endpoint + ": " + err.Error()}
+		}
+		endpoints = append(endpoints, Endpoint{IP: addr.IP, Port: addr.Port})
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.tunnels[cfg.Name] = endpoints
+	return k.apply()
+}
+
+/*
+Stop letting traffic out to the endpoints of a tunnel
+
+	:param conf: the path of the tunnels wireguard configuration file
+*/
+func (k *KillSwitch) Revoke(conf string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.tunnels, iface.InterfaceName(conf))
+	return k.apply()
+}
+
+// reapply the rules if the switch is locked, k.mu must be held
+func (k *KillSwitch) apply() error {
+	if !k.locked {
+		return nil
+	}
+	rules, err := k.ruleset()
+	if err != nil {
+		return err
+	}
+	if err := k.Firewall.Apply(rules); err != nil {
+		return &KillSwitchError{Msg: err.Error()}
+	}
+	return nil
+}
+
+// build the rules from the tracked tunnels and the configured LAN ranges, k.mu must be held
+func (k *KillSwitch) ruleset() (Ruleset, error) {
+	rules := Ruleset{}
+	for name, endpoints := range k.tunnels {
+		rules.Interfaces = append(rules.Interfaces, name)
+		rules.Endpoints = append(rules.Endpoints, endpoints...)
+	}
+	sort.Strings(rules.Interfaces)
+	sort.Slice(rules.Endpoints, func(i, j int) bool { return rules.Endpoints[i].String() < rules.Endpoints[j].String() })
+	for _, lan := range k.Config.KillSwitch.LanRanges {
+		_, prefix, err := net.ParseCIDR(lan)
+		if err != nil {
+			return rules, &KillSwitchError{Msg: "invalid LAN range " + lan + ": " + err.Error()}
+		}
+		rules.LanRanges = append(rules.LanRanges, *prefix)
+	}
+	return rules, nil
+}
+
+func (k *KillSwitch) LockHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	if err := k.Lock(); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return k.StatusHandler(msg)
+}
+
+func (k *KillSwitch) UnlockHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	if err := k.Unlock(); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return k.StatusHandler(msg)
+}
+
+func (k *KillSwitch) StatusHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	status, err := k.Status()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	b, _ := json.Marshal(status)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Wraps the local tunnel so that the kill switch follows it, letting the endpoint out before the
+tunnel comes up, and closing it again once the tunnel is down
+*/
+type Tunnel struct {
+	rotation.Tunnel
+	KillSwitch *KillSwitch
+}
+
+func (t Tunnel) Up(conf string) error {
+	if err := t.KillSwitch.Allow(conf); err != nil {
+		return err
+	}
+	if err := t.Tunnel.Up(conf); err != nil {
+		t.KillSwitch.Revoke(conf)
+		return err
+	}
+	return nil
+}
+
+func (t Tunnel) Down(conf string) error {
+	err := t.Tunnel.Down(conf)
+	if revokeErr := t.KillSwitch.Revoke(conf); err == nil {
+		err = revokeErr
+	}
+	return err
+}
+
+type KillSwitchError struct {
+	Msg string
+}
+
+func (k *KillSwitchError) Error() string {
+	return "There was an error with the kill switch: " + k.Msg
+}
@@ -0,0 +1,139 @@
+package killswitch
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+)
+
+type fakeFirewall struct {
+	applied []Ruleset
+	removed int
+}
+
+func (f *fakeFirewall) Apply(rules Ruleset) error {
+	f.applied = append(f.applied, rules)
+	return nil
+}
+
+func (f *fakeFirewall) Remove() error {
+	f.removed++
+	return nil
+}
+
+func (f *fakeFirewall) last() Ruleset {
+	return f.applied[len(f.applied)-1]
+}
+
+type fakeTunnel struct {
+	failUp bool
+}
+
+func (f fakeTunnel) Up(conf string) error {
+	if f.failUp {
+		return errors.New("no handshake")
+	}
+	return nil
+}
+
+func (f fakeTunnel) Down(conf string) error {
+	return nil
+}
+
+func (f fakeTunnel) Handshake(conf string) (time.Time, error) {
+	return time.Now(), nil
+}
+
+func writeConf(t *testing.T, dir string, name string, endpoint string) string {
+	conf := path.Join(dir, name+".conf")
+	body := "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.0.0.2/24\n\n" +
+		"[Peer]\nPublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nEndpoint = " + endpoint + "\nAllowedIPs = 0.0.0.0/0\n"
+	if err := os.WriteFile(conf, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestKillSwitchFollowsTunnel(t *testing.T) {
+	dir := t.TempDir()
+	current := writeConf(t, dir, "current", "5.5.5.5:51820")
+	replacement := writeConf(t, dir, "replacement", "6.6.6.6:51820")
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.KillSwitch.LanRanges = []string{"192.168.1.0/24"}
+	firewall := &fakeFirewall{}
+	ks := NewKillSwitch(conf, firewall)
+	tunnel := Tunnel{Tunnel: fakeTunnel{}, KillSwitch: ks}
+
+	// the rules are only enforced once the switch is locked
+	if err := tunnel.Up(current); err != nil {
+		t.Fatal(err)
+	}
+	if len(firewall.applied) != 0 {
+		t.Fatalf("applied rules before locking: %+v", firewall.applied)
+	}
+	if err := ks.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	rules := firewall.last()
+	if len(rules.Interfaces) != 1 || len(rules.Endpoints) != 1 || rules.Endpoints[0].String() != "5.5.5.5:51820" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if len(rules.LanRanges) != 1 || rules.LanRanges[0].String() != "192.168.1.0/24" {
+		t.Errorf("unexpected LAN ranges: %v", rules.LanRanges)
+	}
+	// 1 for loopback, then the interface, the LAN range and the endpoint
+	if n := len(rules.expressions()); n != 4 {
+		t.Errorf("expected 4 rules, got %v", n)
+	}
+
+	// a rotation brings the replacement up before taking the current server down
+	if err := tunnel.Up(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if rules := firewall.last(); len(rules.Endpoints) != 2 {
+		t.Errorf("expected both endpoints during the rotation, got: %+v", rules.Endpoints)
+	}
+	if err := tunnel.Down(current); err != nil {
+		t.Fatal(err)
+	}
+	rules = firewall.last()
+	if len(rules.Endpoints) != 1 || rules.Endpoints[0].String() != "6.6.6.6:51820" || rules.Interfaces[0] != "replacement" {
+		t.Errorf("expected only the replacement, got: %+v", rules)
+	}
+
+	// a tunnel that fails to come up is closed off again
+	failing := Tunnel{Tunnel: fakeTunnel{failUp: true}, KillSwitch: ks}
+	if err := failing.Up(current); err == nil {
+		t.Fatal("expected the tunnel to fail")
+	}
+	if rules := firewall.last(); len(rules.Endpoints) != 1 {
+		t.Errorf("the failed tunnel was left open: %+v", rules.Endpoints)
+	}
+
+	if err := ks.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	applied := len(firewall.applied)
+	tunnel.Down(replacement)
+	if firewall.removed != 1 || len(firewall.applied) != applied {
+		t.Errorf("expected the rules to be removed and left alone, removed %v times", firewall.removed)
+	}
+}
+
+func TestInvalidLanRange(t *testing.T) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.KillSwitch.LanRanges = []string{"192.168.1.0"}
+	firewall := &fakeFirewall{}
+	ks := NewKillSwitch(conf, firewall)
+	if err := ks.Lock(); err == nil {
+		t.Fatal("expected the invalid LAN range to be rejected")
+	}
+	if len(firewall.applied) != 0 {
+		t.Errorf("applied rules with an invalid LAN range: %+v", firewall.applied)
+	}
+}
@@ -0,0 +1,135 @@
+package killswitch
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const TableName = "yosai_killswitch"
+
+/*
+Enforces the kill switch with an nftables table of its own, holding an output chain that drops
+everything the Ruleset doesnt allow. The table is replaced in a single transaction so that there
+is no window where traffic can get out while the rules change.
+*/
+type NftFirewall struct{}
+
+var killSwitchTable = &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+
+func (n NftFirewall) Apply(rules Ruleset) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	// adding the table first means the delete wont fail when it doesnt exist yet
+	conn.AddTable(killSwitchTable)
+	conn.DelTable(killSwitchTable)
+	table := conn.AddTable(killSwitchTable)
+	policy := nftables.ChainPolicyDrop
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	for _, exprs := range rules.expressions() {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+	return conn.Flush()
+}
+
+func (n NftFirewall) Remove() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	conn.AddTable(killSwitchTable)
+	conn.DelTable(killSwitchTable)
+	return conn.Flush()
+}
+
+/*
+Get the expressions for each rule in the output chain, all of which accept the packet
+*/
+func (r Ruleset) expressions() [][]expr.Any {
+	rules := [][]expr.Any{acceptInterface("lo")}
+	for _, name := range r.Interfaces {
+		rules = append(rules, acceptInterface(name))
+	}
+	for _, lan := range r.LanRanges {
+		rules = append(rules, acceptPrefix(lan))
+	}
+	for _, endpoint := range r.Endpoints {
+		rules = append(rules, acceptEndpoint(endpoint))
+	}
+	return rules
+}
+
+// oifname <name> accept
+func acceptInterface(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+// ip(6) daddr <prefix> accept
+func acceptPrefix(prefix net.IPNet) []expr.Any {
+	exprs := matchDaddr(prefix.IP)
+	addr := exprs[len(exprs)-1].(*expr.Cmp)
+	mask := net.IP(prefix.Mask)
+	addr.Data = []byte(prefix.IP.Mask(prefix.Mask))
+	// mask the address off before comparing it, the bitwise expression goes between the load and the comparison
+	bitwise := &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(mask)), Mask: mask, Xor: make([]byte, len(mask))}
+	exprs = append(exprs[:len(exprs)-1], bitwise, addr)
+	return append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+// ip(6) daddr <ip> udp dport <port> accept
+func acceptEndpoint(endpoint Endpoint) []expr.Any {
+	exprs := matchDaddr(endpoint.IP)
+	return append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(endpoint.Port))},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+}
+
+/*
+Match the destination address of a packet, the table is inet so the address family is checked first
+
+	:param ip: the address to match, ending with the comparison against it
+*/
+func matchDaddr(ip net.IP) []expr.Any {
+	proto := byte(unix.NFPROTO_IPV6)
+	var offset uint32 = 24
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		proto = unix.NFPROTO_IPV4
+		offset = 16
+	} else {
+		ip = ip.To16()
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip)},
+	}
+}
+
+// interface names are compared as the full IFNAMSIZ buffer, null padded
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
@@ -0,0 +1,332 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/linode"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/semaphore"
+)
+
+type Reconciler struct {
+	Cloud     linode.LinodeConnection
+	Inventory Inventory // nil when there is no ansible backend
+	Workflows Workflows // nil when nothing creates servers in the background
+	Config    *config.Configuration
+}
+
+/*
+The ansible inventory that the servers are kept in, this is satisfied by the semaphore.SemaphoreConnection
+*/
+type Inventory interface {
+	GetInventoryHosts(name string) (map[string]string, error)
+	AddHostToInv(name string, host ...config.VpnServer) error
+	RemoveHostFromInv(name string, host ...string) error
+}
+
+/*
+The workflow runs that may still be bringing servers up or tearing them down, this is satisfied by the daemon.WorkflowEngine
+*/
+type Workflows interface {
+	UnfinishedParams() map[string]bool
+}
+
+type CloudServer struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	WanIpv4 string `json:"wan_ipv4"`
+}
+
+type InventoryHost struct {
+	Name    string `json:"name"`
+	WanIpv4 string `json:"wan_ipv4"`
+}
+
+/*
+The drift between the cloud provider, the daemon configuration and the ansible inventory
+*/
+type DriftReport struct {
+	CloudOnly          []CloudServer   `json:"cloud_only"`           // servers that exist in the cloud, but not in the configuration
+	ConfigOnly         []string        `json:"config_only"`          // servers in the configuration that have no cloud instance
+	Untagged           []CloudServer   `json:"untagged"`             // servers in the configuration whose cloud instance isnt tagged as owned, like servers made before the tags
+	StaleImageBuilds   []CloudServer   `json:"stale_image_builds"`   // golden image build servers that were left behind by their build
+	MissingInventory   []string        `json:"missing_inventory"`    // servers in the cloud and the configuration that arent in the inventory
+	InventoryOnly      []InventoryHost `json:"inventory_only"`       // inventory hosts that arent backed by a configured cloud instance
+	LeakedVpnAddresses []string        `json:"leaked_vpn_addresses"` // VPN addresses marked as in use that arent assigned to anything
+	InventoryError     string          `json:"inventory_error"`      // why the inventory couldnt be checked, its drift is left out when set
+}
+
+type RepairReport struct {
+	Drift   DriftReport `json:"drift"`
+	Actions []string    `json:"actions"`
+	Errors  []string    `json:"errors"`
+}
+
+/*
+Check if the report contains any drift at all
+*/
+func (d DriftReport) Drifted() bool {
+	return len(d.CloudOnly)+len(d.ConfigOnly)+len(d.Untagged)+len(d.StaleImageBuilds)+len(d.MissingInventory)+len(d.InventoryOnly)+len(d.LeakedVpnAddresses) > 0
+}
+
+// Logging wrapper
+func (r Reconciler) Log(msg ...string) {
+	rMsg := []string{"Reconciler:"}
+	rMsg = append(rMsg, msg...)
+	r.Config.Log(rMsg...)
+}
+
+/*
+Work out the drift between the three sources of truth for the servers. A server is matched between the
+cloud and the configuration by its name, and between the configuration and the inventory by its WAN address.
+Golden image build servers arent VPN servers, so they are left out.
+
+	:param cloud: every server on the cloud providers account
+	:param tag: the tag that marks the servers that are owned by this user
+	:param servers: the servers from the daemon configuration
+	:param hosts: the inventory hosts, keyed by WAN address with the server name as the value, nil when the inventory couldnt be checked
+	:param leaked: the VPN addresses that are in use but not assigned
+	:param inventoried: if the servers belong in the inventory, they dont when theyre bootstrapped with cloud-init
+*/
+func Diff(cloud []linode.GetLinodeResponse, tag string, servers map[string]config.VpnServer, hosts map[string]string, leaked []string, inventoried bool) DriftReport {
+	report := DriftReport{
+		CloudOnly:          []CloudServer{},
+		ConfigOnly:         []string{},
+		Untagged:           []CloudServer{},
+		StaleImageBuilds:   []CloudServer{},
+		MissingInventory:   []string{},
+		InventoryOnly:      []InventoryHost{},
+		LeakedVpnAddresses: leaked,
+	}
+	inCloud := map[string]bool{}
+	for i := range cloud {
+		if cloud[i].HasTag(linode.ImageBuildTag) {
+			continue
+		}
+		var wan string
+		if len(cloud[i].Ipv4) > 0 {
+			wan = cloud[i].Ipv4[0]
+		}
+		_, configured := servers[cloud[i].Label]
+		if !cloud[i].HasTag(tag) {
+			// a configured server that isnt tagged is still ours, anything else on the account is left alone
+			if configured {
+				inCloud[cloud[i].Label] = true
+				report.Untagged = append(report.Untagged, CloudServer{Id: cloud[i].Id, Name: cloud[i].Label, WanIpv4: wan})
+			}
+			continue
+		}
+		inCloud[cloud[i].Label] = true
+		if !configured {
+			report.CloudOnly = append(report.CloudOnly, CloudServer{Id: cloud[i].Id, Name: cloud[i].Label, WanIpv4: wan})
+		}
+	}
+	backed := map[string]bool{}
+	for name, server := range servers {
+		if !inCloud[name] {
+			report.ConfigOnly = append(report.ConfigOnly, name)
+			continue
+		}
+		backed[server.WanIpv4] = true
+		if _, ok := hosts[server.WanIpv4]; inventoried && hosts != nil && !ok {
+			report.MissingInventory = append(report.MissingInventory, name)
+		}
+	}
+	for addr, name := range hosts {
+		if !backed[addr] {
+			report.InventoryOnly = append(report.InventoryOnly, InventoryHost{Name: name, WanIpv4: addr})
+		}
+	}
+	sort.Slice(report.CloudOnly, func(i, j int) bool { return report.CloudOnly[i].Name < report.CloudOnly[j].Name })
+	sort.Strings(report.ConfigOnly)
+	sort.Slice(report.Untagged, func(i, j int) bool { return report.Untagged[i].Name < report.Untagged[j].Name })
+	sort.Strings(report.MissingInventory)
+	sort.Slice(report.InventoryOnly, func(i, j int) bool { return report.InventoryOnly[i].WanIpv4 < report.InventoryOnly[j].WanIpv4 })
+	return report
+}
+
+/*
+Gather the current state from the cloud provider, the configuration and the inventory, and report the drift.
+The inventory is optional, when it cant be reached the rest of the drift is still reported.
+*/
+func (r Reconciler) Drift() (DriftReport, error) {
+	var report DriftReport
+	// every server is listed, so that configured servers from before the ownership tags arent taken as missing
+	all, err := r.Cloud.ListLinodes()
+	if err != nil {
+		return report, &ReconcileError{Msg: "Couldnt list the cloud servers: " + err.Error()}
+	}
+	var hosts map[string]string
+	inventoryErr := "there is no ansible backend"
+	if r.Inventory != nil {
+		hosts, err = r.Inventory.GetInventoryHosts(semaphore.YosaiServerInventory)
+		if err != nil {
+			r.Log("Couldnt get the inventory hosts, leaving them out of the drift:", err.Error())
+			inventoryErr = err.Error()
+			hosts = nil
+		} else {
+			inventoryErr = ""
+		}
+	}
+	report = Diff(all.Data, r.Cloud.OwnerTag(), r.Config.Servers(), hosts, r.Config.LeakedVpnAddresses(), !r.Config.UsesCloudInit())
+	report.InventoryError = inventoryErr
+	now := time.Now().UTC()
+	for i := range all.Data {
+		if all.Data[i].HasTag(r.Cloud.OwnerTag()) && all.Data[i].StaleImageBuild(now) {
+			report.StaleImageBuilds = append(report.StaleImageBuilds, CloudServer{Id: all.Data[i].Id, Name: all.Data[i].Label})
+		}
+	}
+	return report, nil
+}
+
+/*
+Repair the drift in a report. Every repair is attempted, and the failures are collected rather than
+stopping at the first one, so that a single bad server doesnt block the rest from being cleaned up.
+Servers that a workflow run is still bringing up or tearing down are left for the run to finish.
+
+	:param drift: the DriftReport to repair
+*/
+func (r Reconciler) Repair(drift DriftReport) RepairReport {
+	report := RepairReport{Drift: drift, Actions: []string{}, Errors: []string{}}
+	busy := map[string]bool{}
+	if r.Workflows != nil {
+		busy = r.Workflows.UnfinishedParams()
+	}
+	record := func(action string, err error) {
+		if err != nil {
+			r.Log("Failed to", action, err.Error())
+			report.Errors = append(report.Errors, action+": "+err.Error())
+			return
+		}
+		r.Log(action)
+		report.Actions = append(report.Actions, action)
+	}
+	for i := range drift.CloudOnly {
+		server := drift.CloudOnly[i]
+		if busy[server.Name] {
+			r.Log("Leaving the cloud server:", server.Name, "to the workflow run that it belongs to")
+			continue
+		}
+		record(fmt.Sprintf("delete orphaned cloud server: %s (%v)", server.Name, server.Id), r.deleteCloudServer(server))
+	}
+	for i := range drift.StaleImageBuilds {
+		server := drift.StaleImageBuilds[i]
+		record(fmt.Sprintf("delete stale image build server: %s (%v)", server.Name, server.Id), r.deleteCloudServer(server))
+	}
+	staleHosts := []string{}
+	for i := range drift.InventoryOnly {
+		staleHosts = append(staleHosts, drift.InventoryOnly[i].WanIpv4)
+	}
+	for i := range drift.ConfigOnly {
+		if busy[drift.ConfigOnly[i]] {
+			r.Log("Leaving the server:", drift.ConfigOnly[i], "to the workflow run that it belongs to")
+			continue
+		}
+		server, err := r.Config.GetServer(drift.ConfigOnly[i])
+		if err != nil {
+			record("remove server from the config: "+drift.ConfigOnly[i], err)
+			continue
+		}
+		record("remove server from the config: "+server.Name, r.Config.RemoveServer(server.Name))
+	}
+	for i := range drift.Untagged {
+		server := drift.Untagged[i]
+		_, err := r.Cloud.TagLinode(fmt.Sprint(server.Id))
+		record(fmt.Sprintf("tag untagged cloud server: %s (%v)", server.Name, server.Id), err)
+	}
+	if len(staleHosts) > 0 && r.Inventory != nil {
+		record(fmt.Sprintf("remove hosts from the inventory: %v", staleHosts),
+			r.Inventory.RemoveHostFromInv(semaphore.YosaiServerInventory, staleHosts...))
+	}
+	// servers bootstrapped with cloud-init dont belong in the inventory
+	if len(drift.MissingInventory) > 0 && r.Inventory != nil && !r.Config.UsesCloudInit() {
+		missing := []config.VpnServer{}
+		for i := range drift.MissingInventory {
+			server, _ := r.Config.GetServer(drift.MissingInventory[i])
+			missing = append(missing, server)
+		}
+		record(fmt.Sprintf("add hosts to the inventory: %v", drift.MissingInventory),
+			r.Inventory.AddHostToInv(semaphore.YosaiServerInventory, missing...))
+	}
+	for i := range drift.LeakedVpnAddresses {
+		record("free leaked VPN address: "+drift.LeakedVpnAddresses[i], r.Config.FreeAddress(drift.LeakedVpnAddresses[i]))
+	}
+	return report
+}
+
+/*
+Delete a cloud server along with the firewalls that were made for it, and record that it stopped being billed
+
+	:param server: the cloud server to delete
+*/
+func (r Reconciler) deleteCloudServer(server CloudServer) error {
+	fws, err := r.Cloud.GetLinodeFirewalls(server.Id)
+	if err != nil {
+		return err
+	}
+	if err = r.Cloud.DeleteLinode(fmt.Sprint(server.Id)); err != nil {
+		return err
+	}
+	r.Config.RecordServerDeleted(server.Id, time.Now().UTC())
+	return r.Cloud.DeleteOwnedFirewalls(fws)
+}
+
+/*
+Wrapping the drift report in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r Reconciler) ShowDriftHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	drift, err := r.Drift()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	b, _ := json.Marshal(drift)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Wrapping the drift repair in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r Reconciler) RepairDriftHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	drift, err := r.Drift()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	report := r.Repair(drift)
+	b, _ := json.Marshal(report)
+	if len(report.Errors) > 0 {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, b)
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+type ReconcileRouter struct {
+	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
+}
+
+func (r *ReconcileRouter) Register(method daemonproto.Method, callable func(daemonproto.SockMessage) daemonproto.SockMessage) {
+	r.routes[method] = callable
+}
+
+func (r *ReconcileRouter) Routes() map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage {
+	return r.routes
+}
+
+func NewReconcileRouter() *ReconcileRouter {
+	return &ReconcileRouter{routes: map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage{}}
+}
+
+type ReconcileError struct {
+	Msg string
+}
+
+func (r *ReconcileError) Error() string {
+	return "There was an error reconciling the servers: " + r.Msg
+}
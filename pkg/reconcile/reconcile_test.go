@@ -0,0 +1,158 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/linode"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+func TestDiff(t *testing.T) {
+	owned := []string{"yosai-test"}
+	cloud := []linode.GetLinodeResponse{
+		{Id: 1, Label: "primary-vpn", Ipv4: []string{"1.1.1.1"}, Tags: owned},
+		{Id: 2, Label: "secondary-vpn", Ipv4: []string{"2.2.2.2"}, Tags: owned},
+		{Id: 3, Label: "orphan", Ipv4: []string{"3.3.3.3"}, Tags: owned},
+		{Id: 5, Label: "legacy", Ipv4: []string{"6.6.6.6"}},
+		{Id: 6, Label: "someone-elses", Ipv4: []string{"7.7.7.7"}},
+		{Id: 7, Label: "yosai-image-build-1", Ipv4: []string{"8.8.8.8"}, Tags: []string{"yosai-test", linode.ImageBuildTag}},
+	}
+	servers := map[string]config.VpnServer{
+		"primary-vpn":   {Name: "primary-vpn", WanIpv4: "1.1.1.1", VpnIpv4: net.ParseIP("10.0.0.1")},
+		"secondary-vpn": {Name: "secondary-vpn", WanIpv4: "2.2.2.2", VpnIpv4: net.ParseIP("10.0.0.2")},
+		"gone":          {Name: "gone", WanIpv4: "4.4.4.4", VpnIpv4: net.ParseIP("10.0.0.4")},
+		"legacy":        {Name: "legacy", WanIpv4: "6.6.6.6", VpnIpv4: net.ParseIP("10.0.0.6")},
+	}
+	hosts := map[string]string{
+		"1.1.1.1": "primary-vpn",
+		"4.4.4.4": "gone",
+		"5.5.5.5": "stale",
+		"6.6.6.6": "legacy",
+	}
+	drift := Diff(cloud, "yosai-test", servers, hosts, []string{"10.0.0.9"}, true)
+	want := DriftReport{
+		CloudOnly:          []CloudServer{{Id: 3, Name: "orphan", WanIpv4: "3.3.3.3"}},
+		ConfigOnly:         []string{"gone"},
+		Untagged:           []CloudServer{{Id: 5, Name: "legacy", WanIpv4: "6.6.6.6"}},
+		StaleImageBuilds:   []CloudServer{},
+		MissingInventory:   []string{"secondary-vpn"},
+		InventoryOnly:      []InventoryHost{{Name: "gone", WanIpv4: "4.4.4.4"}, {Name: "stale", WanIpv4: "5.5.5.5"}},
+		LeakedVpnAddresses: []string{"10.0.0.9"},
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("unexpected drift:\n got: %+v\nwant: %+v", drift, want)
+	}
+	if !drift.Drifted() {
+		t.Error("expected the report to show drift")
+	}
+	if Diff(cloud[:2], "yosai-test", map[string]config.VpnServer{"primary-vpn": servers["primary-vpn"], "secondary-vpn": servers["secondary-vpn"]},
+		map[string]string{"1.1.1.1": "primary-vpn", "2.2.2.2": "secondary-vpn"}, []string{}, true).Drifted() {
+		t.Error("expected no drift when all three sources agree")
+	}
+
+	// servers bootstrapped with cloud-init arent expected in the inventory
+	if drift := Diff(cloud, "yosai-test", servers, hosts, []string{}, false); len(drift.MissingInventory) != 0 {
+		t.Errorf("expected no missing inventory without ansible, got: %v", drift.MissingInventory)
+	}
+	// nothing is known about the inventory when it couldnt be checked
+	drift = Diff(cloud, "yosai-test", servers, nil, []string{}, true)
+	if len(drift.MissingInventory) != 0 || len(drift.InventoryOnly) != 0 {
+		t.Errorf("expected no inventory drift without the inventory, got: %+v", drift)
+	}
+}
+
+type fakeInventory struct {
+	hosts map[string]string
+	err   error
+	added []config.VpnServer
+}
+
+func (f *fakeInventory) GetInventoryHosts(name string) (map[string]string, error) {
+	return f.hosts, f.err
+}
+func (f *fakeInventory) AddHostToInv(name string, host ...config.VpnServer) error {
+	f.added = append(f.added, host...)
+	return nil
+}
+func (f *fakeInventory) RemoveHostFromInv(name string, host ...string) error { return nil }
+
+func newTestReconciler(t *testing.T, inventory Inventory) Reconciler {
+	conf := config.NewConfiguration(io.Discard, "test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":    []linode.GetLinodeResponse{{Id: 1, Label: "vpn", Ipv4: []string{"1.1.1.1"}, Tags: []string{linode.YosaiTagPrefix + "test"}}},
+			"page":    1,
+			"pages":   1,
+			"results": 1,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	kr.AddKey(keytags.LINODE_API_KEYNAME, keyring.BearerAuth{Secret: "linode-token"})
+	conf.Service.Servers["vpn"] = config.VpnServer{Name: "vpn", WanIpv4: "1.1.1.1"}
+	return Reconciler{
+		Cloud:     linode.LinodeConnection{Client: srv.Client(), Keyring: kr, KeyTagger: keytags.ConstKeytag{}, Config: conf, BaseUrl: srv.URL},
+		Inventory: inventory,
+		Config:    conf,
+	}
+}
+
+func TestDriftWithoutInventory(t *testing.T) {
+	r := newTestReconciler(t, &fakeInventory{err: errors.New("connection refused")})
+	drift, err := r.Drift()
+	if err != nil {
+		t.Fatalf("expected the drift without the inventory, got: %v", err)
+	}
+	if !strings.Contains(drift.InventoryError, "connection refused") || drift.Drifted() {
+		t.Errorf("expected the inventory to be reported as unavailable, got: %+v", drift)
+	}
+	r.Inventory = nil
+	if drift, err := r.Drift(); err != nil || drift.InventoryError == "" {
+		t.Errorf("expected the missing ansible backend to be reported, got: %+v %v", drift, err)
+	}
+
+	// with cloud-init the servers are never added to the inventory
+	inventory := &fakeInventory{hosts: map[string]string{}}
+	r = newTestReconciler(t, inventory)
+	r.Config.Cloud.Bootstrap = config.BootstrapCloudInit
+	drift, err = r.Drift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.Drifted() || drift.InventoryError != "" {
+		t.Errorf("expected no drift for a cloud-init server, got: %+v", drift)
+	}
+	r.Repair(DriftReport{MissingInventory: []string{"vpn"}})
+	if len(inventory.added) != 0 {
+		t.Errorf("expected a cloud-init server not to be added to the inventory, got: %v", inventory.added)
+	}
+}
+
+type fakeWorkflows map[string]bool
+
+func (f fakeWorkflows) UnfinishedParams() map[string]bool { return f }
+
+func TestRepairSkipsWorkflowRuns(t *testing.T) {
+	r := newTestReconciler(t, nil)
+	r.Workflows = fakeWorkflows{"vpn": true, "replacement": true}
+	report := r.Repair(DriftReport{
+		CloudOnly:  []CloudServer{{Id: 2, Name: "replacement", WanIpv4: "2.2.2.2"}},
+		ConfigOnly: []string{"vpn"},
+	})
+	if len(report.Actions) != 0 || len(report.Errors) != 0 {
+		t.Errorf("expected the servers of a workflow run to be left alone, got: %+v", report)
+	}
+	if _, err := r.Config.GetServer("vpn"); err != nil {
+		t.Errorf("expected the server to stay in the config, got: %v", err)
+	}
+}
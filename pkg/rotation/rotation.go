@@ -0,0 +1,1023 @@
+package rotation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/linode"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/daemon"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/semaphore"
+	wg "git.aetherial.dev/aeth/yosai/pkg/wireguard/centos"
+)
+
+// the name of the workflow that rotations run as
+const RotationWorkflow = "rotation"
+
+/*
+The steps of a rotation, in the order that they run. Every step up to and including the cut over is
+rolled back if one of them fails, so the old server keeps serving until the replacement has proven
+that it works. Once the tunnel is on the replacement, destroying the old server is retried instead.
+*/
+const (
+	StepIdle         = "idle"          // no rotation is in progress
+	StepCreate       = "create"        // create the replacement server with the cloud provider
+	StepPoll         = "poll"          // wait for the replacement to boot
+	StepConfigAdd    = "config-add"    // add the replacement to the configuration
+	StepInventoryAdd = "inventory-add" // add the replacement to the ansible inventory
+	StepPlaybook     = "playbook"      // run the rotation playbook against the inventory
+	StepHandshake    = "handshake"     // bring up a probe tunnel to the replacement and wait for a handshake
+	StepCutOver      = "cut-over"      // move the local tunnel over to the replacement
+	StepDestroyOld   = "destroy-old"   // remove the old server from the cloud, the inventory and the configuration
+	StepRollback     = "rollback"      // undoing the steps of a rotation that failed
+)
+
+// replacement servers are named with this prefix, and kept short enough to be a wireguard interface name
+const ServerNamePrefix = "exit-"
+const DefaultCheckInterval = time.Minute
+const DefaultRetryDelay = time.Minute * 5
+const DefaultHandshakeTimeout = time.Minute * 2
+const DefaultHandshakeInterval = time.Second * 5
+
+// the longest that failed rotations back off for before trying again
+const MaxFailureBackoff = time.Hour * 24
+
+/*
+The schedule of the rotations and the server in use. The steps of a rotation are run as a workflow, which
+keeps the progress of the rotation so that it can pick up where it left off.
+*/
+type RotationState struct {
+	Run           string    `json:"run"`     // the workflow run of the rotation in progress, empty when there isnt one
+	Current       string    `json:"current"` // the server that the tunnel is using
+	StartedAt     time.Time `json:"started_at"`
+	LastRotation  time.Time `json:"last_rotation"`
+	NextRun       time.Time `json:"next_run"`
+	RetryAt       time.Time `json:"retry_at"`
+	Failures      int       `json:"failures"` // rotations that have failed in a row
+	LastError     string    `json:"last_error"`
+	RollbackError string    `json:"rollback_error"`
+}
+
+/*
+The servers that a rotation is between, kept as the parameters of its workflow run, and the addresses of
+the replacement once it has been created
+*/
+type rotation struct {
+	Current            string `json:"-"`
+	Replacement        string `json:"-"`
+	ReplacementWanIpv4 string `json:"wan_ipv4"`
+	ReplacementWanIpv6 string `json:"wan_ipv6"`
+}
+
+/*
+Get the servers of a rotation from its workflow run
+
+	:param run: the workflow run of the rotation
+*/
+func rotationOf(run daemon.WorkflowRun) rotation {
+	var rot rotation
+	// the output of the create step is a rotation with only the addresses set
+	if b, err := json.Marshal(run.Outputs[StepCreate]); err == nil {
+		json.Unmarshal(b, &rot)
+	}
+	rot.Current = run.Params["current"]
+	rot.Replacement = run.Params["replacement"]
+	return rot
+}
+
+type TunnelRequest struct {
+	Server string `json:"server"` // the server to bring the tunnel up to, the one in use when empty
+}
+
+type RotationStatus struct {
+	Enabled bool                `json:"enabled"`
+	Step    string              `json:"step"`
+	State   RotationState       `json:"state"`
+	Run     *daemon.WorkflowRun `json:"run,omitempty"` // the workflow run of the rotation in progress
+}
+
+/*
+Load the rotation state from disk, returning an empty state if nothing has been saved yet
+
+	:param fpath: the path of the state file
+*/
+func LoadState(fpath string) (RotationState, error) {
+	var state RotationState
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return state, &RotationError{Msg: "couldnt read the rotation state: " + err.Error()}
+	}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return state, &RotationError{Msg: "couldnt parse the rotation state: " + err.Error()}
+	}
+	return state, nil
+}
+
+/*
+Save the rotation state to disk. The state is written to a temporary file first, so that a crash
+part way through the write doesnt leave a corrupted state behind
+
+	    :param fpath: the path of the state file
+		:param state: the state to save
+*/
+func SaveState(fpath string, state RotationState) error {
+	b, err := json.MarshalIndent(state, " ", "    ")
+	if err != nil {
+		return &RotationError{Msg: err.Error()}
+	}
+	tmp := fpath + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return &RotationError{Msg: "couldnt write the rotation state: " + err.Error()}
+	}
+	err = os.Rename(tmp, fpath)
+	if err != nil {
+		return &RotationError{Msg: "couldnt write the rotation state: " + err.Error()}
+	}
+	return nil
+}
+
+/*
+Something that can call the daemons routes, this is satisfied by the daemon.Context
+*/
+type Caller interface {
+	Call(payload []byte, target string, method string) daemonproto.SockMessage
+}
+
+/*
+The local wireguard tunnels, addressed by the path of their configuration file
+*/
+type Tunnel interface {
+	Up(conf string) error
+	Down(conf string) error
+	Handshake(conf string) (time.Time, error) // the latest handshake, or the zero time if there hasnt been one
+}
+
+type WgQuickTunnel struct{}
+
+func (w WgQuickTunnel) Up(conf string) error {
+	out, err := wg.ChangeWgInterfaceState(conf, "up")
+	if err != nil {
+		return &RotationError{Msg: fmt.Sprintf("wg-quick up %s failed: %s %s", conf, err, out)}
+	}
+	return nil
+}
+
+func (w WgQuickTunnel) Down(conf string) error {
+	out, err := wg.ChangeWgInterfaceState(conf, "down")
+	if err != nil {
+		return &RotationError{Msg: fmt.Sprintf("wg-quick down %s failed: %s %s", conf, err, out)}
+	}
+	return nil
+}
+
+func (w WgQuickTunnel) Handshake(conf string) (time.Time, error) {
+	// wg-quick names the interface after the configuration file
+	return wg.LatestHandshake(strings.TrimSuffix(path.Base(conf), ".conf"))
+}
+
+type Rotator struct {
+	Caller            Caller
+	Workflows         *daemon.WorkflowEngine
+	Config            *config.Configuration
+	Tunnel            Tunnel
+	CheckInterval     time.Duration
+	RetryDelay        time.Duration
+	HandshakeTimeout  time.Duration
+	HandshakeInterval time.Duration
+	now               func() time.Time
+	mu                sync.Mutex
+	busy              sync.Mutex // held by whatever is changing the tunnel, a rotation or a failover
+	state             RotationState
+	forced            bool
+	trigger           chan struct{}
+}
+
+/*
+Create a rotator, loading any rotation that was in progress when the daemon last stopped, and declare the
+rotation workflow on the workflow engine
+
+	    :param caller: used to call the daemons routes for each step of the rotation
+		:param workflows: the workflow engine that the rotations are run on
+		:param conf: the daemons configuration
+		:param tunnel: the local tunnel to switch over to the new server
+*/
+func NewRotator(caller Caller, workflows *daemon.WorkflowEngine, conf *config.Configuration, tunnel Tunnel) (*Rotator, error) {
+	state, err := LoadState(conf.RotationStatePath())
+	if err != nil {
+		return nil, err
+	}
+	r := &Rotator{
+		Caller:            caller,
+		Workflows:         workflows,
+		Config:            conf,
+		Tunnel:            tunnel,
+		CheckInterval:     DefaultCheckInterval,
+		RetryDelay:        DefaultRetryDelay,
+		HandshakeTimeout:  DefaultHandshakeTimeout,
+		HandshakeInterval: DefaultHandshakeInterval,
+		now:               time.Now,
+		state:             state,
+		trigger:           make(chan struct{}, 1),
+	}
+	if err := workflows.Declare(r.workflow()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Logging wrapper
+func (r *Rotator) Log(msg ...string) {
+	rMsg := []string{"Rotator:"}
+	rMsg = append(rMsg, msg...)
+	r.Config.Log(rMsg...)
+}
+
+/*
+Get a copy of the current rotation state
+*/
+func (r *Rotator) State() RotationState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+/*
+Replace the rotation state and persist it
+
+	:param state: the new state
+*/
+func (r *Rotator) setState(state RotationState) {
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+	err := SaveState(r.Config.RotationStatePath(), state)
+	if err != nil {
+		r.Log(err.Error())
+	}
+}
+
+/*
+Build the schedule from the current configuration
+*/
+func (r *Rotator) schedule() (Schedule, error) {
+	return ParseSchedule(r.Config.Rotation.Interval, r.Config.Rotation.Cron, r.Config.Rotation.Jitter, r.Config.Rotation.MaintenanceWindows)
+}
+
+/*
+Start a rotation on the next check, whether one is due or not. A rotation that is waiting to retry
+a failed step is resumed straight away.
+*/
+func (r *Rotator) Trigger() {
+	r.mu.Lock()
+	r.forced = true
+	r.mu.Unlock()
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Throw away the scheduled time of the next rotation so that it is worked out again from the current
+configuration. This is meant to be registered as a configuration reload hook.
+*/
+func (r *Rotator) Reschedule() {
+	state := r.State()
+	if state.Run != "" {
+		return
+	}
+	state.NextRun = time.Time{}
+	r.setState(state)
+}
+
+/*
+Check the schedule on an interval and run the rotations as they come due. Any rotation that was
+interrupted is resumed on the first check.
+*/
+func (r *Rotator) Run() {
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+	for {
+		r.Tick()
+		select {
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
+
+/*
+Do a single check of the schedule, starting or resuming a rotation if one is due
+*/
+func (r *Rotator) Tick() {
+	r.busy.Lock()
+	defer r.busy.Unlock()
+	r.mu.Lock()
+	state := r.state
+	forced := r.forced
+	r.forced = false
+	r.mu.Unlock()
+	now := r.now()
+	if state.Run != "" {
+		r.resume(state, forced)
+		return
+	}
+	if !forced {
+		if !r.Config.Rotation.Enabled {
+			return
+		}
+		if state.NextRun.IsZero() {
+			sched, err := r.schedule()
+			if err != nil {
+				r.Log(err.Error())
+				state.LastError = err.Error()
+				r.setState(state)
+				return
+			}
+			from := state.LastRotation
+			if from.IsZero() {
+				from = now
+			}
+			state.NextRun = sched.Next(from)
+			r.setState(state)
+			r.Log("Next rotation scheduled for:", state.NextRun.String())
+		}
+		if state.NextRun.IsZero() || now.Before(state.NextRun) {
+			return
+		}
+	}
+	if _, err := r.Config.GetServer(state.Current); state.Current == "" || err != nil {
+		state.Current = r.soleServer()
+	}
+	run, err := r.Workflows.Start(RotationWorkflow, map[string]string{
+		"current":     state.Current,
+		"replacement": ServerNamePrefix + strconv.FormatInt(now.Unix(), 36),
+	})
+	if err != nil {
+		r.Log(err.Error())
+		state.LastError = err.Error()
+		r.setState(state)
+		return
+	}
+	state.Run = run.Id
+	state.StartedAt = now
+	state.RetryAt = time.Time{}
+	state.LastError = ""
+	state.RollbackError = ""
+	r.setState(state)
+	r.Log("Starting a rotation away from:", state.Current)
+	run, _ = r.Workflows.Execute(run.Id)
+	r.settle(state, run)
+}
+
+/*
+Pick the rotation in progress back up. Runs that were interrupted by the daemon stopping are resumed
+straight away, and runs that failed are resumed once the retry delay is up.
+
+	    :param state: the rotation state
+		:param forced: resume the run without waiting for the retry delay
+*/
+func (r *Rotator) resume(state RotationState, forced bool) {
+	run, err := r.Workflows.Run(state.Run)
+	if err != nil {
+		r.Log("The rotation run is gone, starting over:", err.Error())
+		state.Run = ""
+		r.setState(state)
+		return
+	}
+	switch run.Status {
+	case daemon.WorkflowSucceeded, daemon.WorkflowRolledBack:
+		// the run finished before the daemon could record it
+		r.settle(state, run)
+		return
+	case daemon.WorkflowInterrupted:
+	default:
+		if !forced && r.now().Before(state.RetryAt) {
+			return
+		}
+	}
+	r.Log("Resuming the rotation to:", run.Params["replacement"], "at step:", r.runStep(run))
+	run, err = r.Workflows.Resume(run.Id)
+	if err != nil {
+		r.Log(err.Error())
+		return
+	}
+	run, _ = r.Workflows.Execute(run.Id)
+	r.settle(state, run)
+}
+
+/*
+Record where a rotation got to once its run stops. Finished and rolled back rotations leave the rotator
+idle, and failed ones are retried after the retry delay.
+
+	    :param state: the rotation state
+		:param run: the workflow run of the rotation
+*/
+func (r *Rotator) settle(state RotationState, run daemon.WorkflowRun) {
+	state.LastError = run.Error
+	state.RollbackError = run.RollbackError
+	switch run.Status {
+	case daemon.WorkflowSucceeded:
+		state.Current = run.Params["replacement"]
+		state.Run = ""
+		state.LastRotation = r.now()
+		state.NextRun = time.Time{}
+		state.RetryAt = time.Time{}
+		state.Failures = 0
+		state.LastError = ""
+		r.setState(state)
+		r.Log("Rotation finished, now using:", state.Current)
+	case daemon.WorkflowRolledBack:
+		state.Failures++
+		backoff := r.RetryDelay << (state.Failures - 1)
+		if backoff <= 0 || backoff > MaxFailureBackoff {
+			backoff = MaxFailureBackoff
+		}
+		state.Run = ""
+		state.NextRun = r.now().Add(backoff)
+		state.RetryAt = time.Time{}
+		r.setState(state)
+		r.Log("Rotation rolled back, still using:", state.Current, "trying again at:", state.NextRun.String())
+	default:
+		state.RetryAt = r.now().Add(r.RetryDelay)
+		r.setState(state)
+		r.Log("Rotation stopped at step:", r.runStep(run), "retrying at:", state.RetryAt.String())
+	}
+}
+
+/*
+Get the step that a rotation run is at
+
+	:param run: the workflow run of the rotation
+*/
+func (r *Rotator) runStep(run daemon.WorkflowRun) string {
+	steps := r.workflow().Steps
+	switch {
+	case run.Status == daemon.WorkflowSucceeded || run.Status == daemon.WorkflowRolledBack:
+		return StepIdle
+	case run.RollingBack:
+		return StepRollback
+	case run.Step < len(steps):
+		return steps[run.Step].Name
+	}
+	return StepIdle
+}
+
+/*
+Get the step that the rotation in progress is at, StepIdle when there isnt one
+*/
+func (r *Rotator) Step() string {
+	state := r.State()
+	if state.Run == "" {
+		return StepIdle
+	}
+	run, err := r.Workflows.Run(state.Run)
+	if err != nil {
+		return StepIdle
+	}
+	return r.runStep(run)
+}
+
+/*
+Get the name of the only server in the configuration, which is taken to be the one in use before
+the first rotation. An empty string is returned when there isnt exactly one.
+*/
+func (r *Rotator) soleServer() string {
+	servers := r.Config.Servers()
+	if len(servers) != 1 {
+		return ""
+	}
+	for name := range servers {
+		return name
+	}
+	return ""
+}
+
+/*
+Get the server that the local tunnel is using
+*/
+func (r *Rotator) Active() string {
+	state := r.State()
+	if _, err := r.Config.GetServer(state.Current); state.Current == "" || err != nil {
+		return r.soleServer()
+	}
+	return state.Current
+}
+
+/*
+Move the local tunnel over to another server straight away, without replacing the one in use. The
+tunnel is moved back if the new one wont come up. This is refused while a rotation is in progress,
+as the rotation is already moving the tunnel.
+
+	:param name: the name of the server to move to
+*/
+func (r *Rotator) Failover(name string) error {
+	if !r.busy.TryLock() {
+		return &RotationError{Msg: "cant fail over to: " + name + " while a rotation is running"}
+	}
+	defer r.busy.Unlock()
+	return r.failover(name)
+}
+
+/*
+Move the local tunnel over to another server, but only if it is still using the server that the move was
+decided on. The check and the move are made under the same lock, so a rotation or another failover that
+moved the tunnel in the meantime isnt undone.
+
+	    :param from: the server that the tunnel has to be using
+		:param name: the name of the server to move to
+*/
+func (r *Rotator) FailoverFrom(from string, name string) error {
+	if !r.busy.TryLock() {
+		return &RotationError{Msg: "cant fail over to: " + name + " while a rotation is running"}
+	}
+	defer r.busy.Unlock()
+	if active := r.Active(); active != from {
+		return &RotationError{Msg: "cant fail over from: " + from + " as the tunnel has moved to: " + active}
+	}
+	return r.failover(name)
+}
+
+/*
+Run a move of a tunnel that is made outside of the rotator, like the failover of a peer on a failover
+interface, under the lock that every other move is made under. The move is refused while a rotation is
+running, or while another move is being made.
+
+	:param move: makes the move
+*/
+func (r *Rotator) Move(move func() error) error {
+	if !r.busy.TryLock() {
+		return &RotationError{Msg: "cant move the tunnel while a rotation is running"}
+	}
+	defer r.busy.Unlock()
+	if state := r.State(); state.Run != "" {
+		return &RotationError{Msg: "cant move the tunnel while a rotation is at step: " + r.Step()}
+	}
+	return move()
+}
+
+/*
+Move the local tunnel over to another server. The caller has to hold the busy lock.
+
+	:param name: the name of the server to move to
+*/
+func (r *Rotator) failover(name string) error {
+	state := r.State()
+	if state.Run != "" {
+		return &RotationError{Msg: "cant fail over to: " + name + " while a rotation is at step: " + r.Step()}
+	}
+	if _, err := r.Config.GetServer(name); err != nil {
+		return err
+	}
+	err := r.saveTunnelConf(name, false)
+	if err != nil {
+		return err
+	}
+	current := r.Active()
+	if current != "" {
+		if err := r.Tunnel.Down(r.tunnelConf(current)); err != nil {
+			r.Log(err.Error())
+		}
+	}
+	err = r.Tunnel.Up(r.tunnelConf(name))
+	if err != nil {
+		r.Tunnel.Down(r.tunnelConf(name))
+		if current != "" {
+			if upErr := r.Tunnel.Up(r.tunnelConf(current)); upErr != nil {
+				r.Log("Couldnt bring the tunnel back up to:", current, upErr.Error())
+			}
+		}
+		return err
+	}
+	state.Current = name
+	r.setState(state)
+	r.Log("Failed over from:", current, "to:", name)
+	return nil
+}
+
+/*
+Take the local tunnel down. The server stays the one in use, so bringing the tunnel back up goes to
+the same server.
+*/
+func (r *Rotator) Down() error {
+	if !r.busy.TryLock() {
+		return &RotationError{Msg: "cant take the tunnel down while a rotation is running"}
+	}
+	defer r.busy.Unlock()
+	active := r.Active()
+	if active == "" {
+		return &RotationError{Msg: "there isnt a server in use"}
+	}
+	return r.Tunnel.Down(r.tunnelConf(active))
+}
+
+/*
+The workflow that rotations run as. The steps that might have been partly applied when they fail are
+undone along with the steps before them, and once the tunnel is cut over to the replacement there is no
+going back, so destroying the old server is retried rather than rolled back.
+*/
+func (r *Rotator) workflow() daemon.Workflow {
+	return daemon.Workflow{
+		Name:        RotationWorkflow,
+		Description: "Replace the server in use with a new one, and move the local tunnel over to it",
+		Params:      []string{"current", "replacement"},
+		Internal:    true,
+		Steps: []daemon.WorkflowStep{
+			{Name: StepCreate, Func: r.createReplacement, UndoFunc: r.destroyReplacement, UndoFailed: true},
+			{Name: StepPoll, Func: r.pollReplacement},
+			{Name: StepConfigAdd, Func: r.addReplacementToConfig, UndoFunc: r.removeReplacementFromConfig, UndoFailed: true},
+			{Name: StepInventoryAdd, Func: r.addReplacementToInventory, UndoFunc: r.removeReplacementFromInventory, UndoFailed: true},
+			{Name: StepPlaybook, Func: r.runPlaybook},
+			{Name: StepHandshake, Func: r.checkHandshake, UndoFunc: r.removeProbe, UndoFailed: true},
+			{Name: StepCutOver, Func: r.cutOver, UndoFunc: r.cutBack, UndoFailed: true, Final: true},
+			{Name: StepDestroyOld, Func: r.destroyOld},
+		},
+	}
+}
+
+func (r *Rotator) createReplacement(run daemon.WorkflowRun) (interface{}, error) {
+	rot := rotationOf(run)
+	exists, err := r.cloudHas(rot.Replacement)
+	if err != nil {
+		return nil, err
+	}
+	created := rotation{}
+	if exists {
+		// the server was created before the daemon was interrupted
+		if server, err := r.Config.GetServer(rot.Replacement); err == nil {
+			created.ReplacementWanIpv4 = server.WanIpv4
+			created.ReplacementWanIpv6 = server.WanIpv6
+		}
+		if created.ReplacementWanIpv4 == "" {
+			return nil, &RotationError{Msg: "the server: " + rot.Replacement + " exists, but its address wasnt recorded"}
+		}
+		return created, nil
+	}
+	b, _ := json.Marshal(linode.AddLinodeRequest{
+		Name:   rot.Replacement,
+		Image:  r.Config.BootImage(),
+		Region: r.Config.Cloud.Region,
+		Type:   r.Config.Cloud.LinodeType,
+	})
+	resp := r.Caller.Call(b, "cloud", "add")
+	if err := callError(resp); err != nil {
+		return nil, err
+	}
+	var server linode.GetLinodeResponse
+	if err := json.Unmarshal(resp.Body, &server); err != nil || len(server.Ipv4) == 0 {
+		return nil, &RotationError{Msg: "unexpected response creating the server: " + string(resp.Body)}
+	}
+	created.ReplacementWanIpv4 = server.Ipv4[0]
+	created.ReplacementWanIpv6 = server.WanIpv6()
+	return created, nil
+}
+
+func (r *Rotator) destroyReplacement(run daemon.WorkflowRun) error {
+	rot := rotationOf(run)
+	exists, err := r.cloudHas(rot.Replacement)
+	if err != nil {
+		return err
+	}
+	if exists {
+		b, _ := json.Marshal(linode.DeleteLinodeRequest{Name: rot.Replacement})
+		if err := callError(r.Caller.Call(b, "cloud", "delete")); err != nil {
+			return err
+		}
+	}
+	// servers bootstrapped with cloud-init are added to the configuration when theyre created, removing
+	// them again also frees up their VPN address
+	return r.removeReplacementFromConfig(run)
+}
+
+func (r *Rotator) pollReplacement(run daemon.WorkflowRun) (interface{}, error) {
+	b, _ := json.Marshal(linode.PollLinodeRequest{Address: rotationOf(run).Replacement})
+	return nil, callError(r.Caller.Call(b, "cloud", "poll"))
+}
+
+func (r *Rotator) addReplacementToConfig(run daemon.WorkflowRun) (interface{}, error) {
+	rot := rotationOf(run)
+	if _, err := r.Config.GetServer(rot.Replacement); err == nil {
+		// servers bootstrapped with cloud-init are added when their user-data is rendered
+		return nil, nil
+	}
+	b, _ := json.Marshal(config.VpnServer{
+		Name:    rot.Replacement,
+		WanIpv4: rot.ReplacementWanIpv4,
+		WanIpv6: rot.ReplacementWanIpv6,
+		Port:    r.Config.Service.VpnServerPort,
+	})
+	return nil, callError(r.Caller.Call(b, "config-server", "add"))
+}
+
+func (r *Rotator) removeReplacementFromConfig(run daemon.WorkflowRun) error {
+	rot := rotationOf(run)
+	if _, err := r.Config.GetServer(rot.Replacement); err != nil {
+		return nil
+	}
+	b, _ := json.Marshal(config.VpnServer{Name: rot.Replacement})
+	return callError(r.Caller.Call(b, "config-server", "delete"))
+}
+
+func (r *Rotator) addReplacementToInventory(run daemon.WorkflowRun) (interface{}, error) {
+	if r.Config.UsesCloudInit() {
+		return nil, nil
+	}
+	b, _ := json.Marshal(semaphore.SemaphoreRequest{Target: rotationOf(run).Replacement})
+	return nil, callError(r.Caller.Call(b, "ansible-hosts", "add"))
+}
+
+func (r *Rotator) removeReplacementFromInventory(run daemon.WorkflowRun) error {
+	rot := rotationOf(run)
+	if r.Config.UsesCloudInit() || rot.ReplacementWanIpv4 == "" {
+		return nil
+	}
+	b, _ := json.Marshal(semaphore.SemaphoreRequest{Target: rot.ReplacementWanIpv4})
+	return callError(r.Caller.Call(b, "ansible-hosts", "delete"))
+}
+
+func (r *Rotator) runPlaybook(run daemon.WorkflowRun) (interface{}, error) {
+	if r.Config.UsesCloudInit() {
+		return nil, nil
+	}
+	b, _ := json.Marshal(semaphore.SemaphoreRequest{Target: semaphore.YosaiVpnRotationJob})
+	resp := r.Caller.Call(b, "ansible-task", "run")
+	if err := callError(resp); err != nil {
+		return nil, err
+	}
+	var task semaphore.TaskInfo
+	if err := json.Unmarshal(resp.Body, &task); err != nil {
+		return nil, &RotationError{Msg: "unexpected response starting the playbook: " + string(resp.Body)}
+	}
+	b, _ = json.Marshal(semaphore.SemaphoreRequest{Target: fmt.Sprint(task.ID)})
+	return task, callError(r.Caller.Call(b, "ansible-task", "poll"))
+}
+
+/*
+Prove that the replacement works before cutting over to it, by bringing up a probe tunnel that only
+routes to the servers VPN address and waiting for it to handshake. The probe runs alongside the
+tunnel that is in use, and is taken down again either way.
+*/
+func (r *Rotator) checkHandshake(run daemon.WorkflowRun) (interface{}, error) {
+	replacement := rotationOf(run).Replacement
+	err := r.saveTunnelConf(replacement, true)
+	if err != nil {
+		return nil, err
+	}
+	conf := r.tunnelConf(replacement)
+	err = r.Tunnel.Up(conf)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := r.Tunnel.Down(conf); err != nil {
+			r.Log(err.Error())
+		}
+	}()
+	deadline := r.now().Add(r.HandshakeTimeout)
+	for {
+		handshake, err := r.Tunnel.Handshake(conf)
+		if err == nil && !handshake.IsZero() {
+			r.Log("The replacement:", replacement, "completed a handshake at:", handshake.String())
+			return handshake, nil
+		}
+		if !r.now().Before(deadline) {
+			return nil, &RotationError{Msg: "no handshake from: " + replacement + " within " + r.HandshakeTimeout.String()}
+		}
+		time.Sleep(r.HandshakeInterval)
+	}
+}
+
+func (r *Rotator) removeProbe(run daemon.WorkflowRun) error {
+	// the probe is normally already down, this is for when the daemon stopped part way through the check
+	replacement := rotationOf(run).Replacement
+	r.Tunnel.Down(r.tunnelConf(replacement))
+	os.Remove(r.tunnelConf(replacement))
+	return nil
+}
+
+func (r *Rotator) cutOver(run daemon.WorkflowRun) (interface{}, error) {
+	rot := rotationOf(run)
+	err := r.saveTunnelConf(rot.Replacement, false)
+	if err != nil {
+		return nil, err
+	}
+	if rot.Current != "" {
+		// the old tunnel might already be down if the cut over is being resumed
+		if err := r.Tunnel.Down(r.tunnelConf(rot.Current)); err != nil {
+			r.Log(err.Error())
+		}
+	}
+	return nil, r.Tunnel.Up(r.tunnelConf(rot.Replacement))
+}
+
+func (r *Rotator) cutBack(run daemon.WorkflowRun) error {
+	rot := rotationOf(run)
+	r.Tunnel.Down(r.tunnelConf(rot.Replacement))
+	if rot.Current == "" {
+		return nil
+	}
+	// the old tunnel may or may not have been taken down before the cut over failed, so make
+	// sure its down before bringing it back up
+	r.Tunnel.Down(r.tunnelConf(rot.Current))
+	return r.Tunnel.Up(r.tunnelConf(rot.Current))
+}
+
+func (r *Rotator) destroyOld(run daemon.WorkflowRun) (interface{}, error) {
+	current := rotationOf(run).Current
+	if current == "" {
+		return nil, nil
+	}
+	exists, err := r.cloudHas(current)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		b, _ := json.Marshal(linode.DeleteLinodeRequest{Name: current})
+		if err := callError(r.Caller.Call(b, "cloud", "delete")); err != nil {
+			return nil, err
+		}
+	}
+	old, err := r.Config.GetServer(current)
+	if err != nil {
+		return nil, nil
+	}
+	if !r.Config.UsesCloudInit() {
+		b, _ := json.Marshal(semaphore.SemaphoreRequest{Target: old.WanIpv4})
+		if err := callError(r.Caller.Call(b, "ansible-hosts", "delete")); err != nil {
+			return nil, err
+		}
+	}
+	b, _ := json.Marshal(config.VpnServer{Name: old.Name})
+	if err := callError(r.Caller.Call(b, "config-server", "delete")); err != nil {
+		return nil, err
+	}
+	os.Remove(r.tunnelConf(old.Name))
+	return nil, nil
+}
+
+/*
+Save the tunnel configuration for a server with the default client
+
+	    :param server: the name of the server
+		:param probe: save a probe configuration that only routes to the server itself
+*/
+func (r *Rotator) saveTunnelConf(server string, probe bool) error {
+	client, err := r.Config.DefaultClient()
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(daemon.ConfigRenderRequest{Server: server, Client: client.Name, Probe: probe})
+	return callError(r.Caller.Call(b, "vpn-config", "save"))
+}
+
+/*
+Get the path of the tunnel configuration for a server, as saved by the vpn-config route
+
+	:param name: the name of the server
+*/
+func (r *Rotator) tunnelConf(name string) string {
+	return TunnelConf(r.Config, name)
+}
+
+/*
+Get the path of the tunnel configuration for a server, as saved by the vpn-config route
+
+	    :param conf: the daemons configuration
+		:param name: the name of the server
+*/
+func TunnelConf(conf *config.Configuration, name string) string {
+	return path.Join(conf.HostInfo.WireguardSavePath, name+".conf")
+}
+
+/*
+Check if the cloud provider still has a server
+
+	:param name: the name of the server
+*/
+func (r *Rotator) cloudHas(name string) (bool, error) {
+	resp := r.Caller.Call([]byte("{}"), "cloud", "show")
+	if err := callError(resp); err != nil {
+		return false, err
+	}
+	var owned linode.GetAllLinodes
+	if err := json.Unmarshal(resp.Body, &owned); err != nil {
+		return false, &RotationError{Msg: "unexpected response listing the servers: " + string(resp.Body)}
+	}
+	for i := range owned.Data {
+		if owned.Data[i].Label == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/*
+Turn a failed response from a route into an error
+
+	:param resp: the response from the route
+*/
+func callError(resp daemonproto.SockMessage) error {
+	if resp.StatusCode == daemonproto.REQUEST_OK {
+		return nil
+	}
+	return &RotationError{Msg: fmt.Sprintf("%s %s", resp.StatusMsg, string(resp.Body))}
+}
+
+/*
+Wrapping the rotation status in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r *Rotator) ShowRotationHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	status := RotationStatus{Enabled: r.Config.Rotation.Enabled, Step: StepIdle, State: r.State()}
+	if run, err := r.Workflows.Run(status.State.Run); err == nil {
+		status.Step = r.runStep(run)
+		status.Run = &run
+	}
+	b, _ := json.Marshal(status)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+/*
+Wrapping a manual rotation in a route friendly interface. The rotation runs in the background, and
+its progress can be followed with the show route.
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r *Rotator) RunRotationHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	r.Trigger()
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Rotation started."))
+}
+
+/*
+Wrapping bringing the local tunnel up in a route friendly interface. Bringing it up to a server other
+than the one in use moves the tunnel over to it.
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r *Rotator) TunnelUpHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req TunnelRequest
+	json.Unmarshal(msg.Body, &req)
+	server := req.Server
+	if server == "" {
+		server = r.Active()
+	}
+	if server == "" {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("there isnt a server in use, pass one to bring the tunnel up to"))
+	}
+	err := r.Failover(server)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Tunnel up to: "+server))
+}
+
+/*
+Wrapping taking the local tunnel down in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (r *Rotator) TunnelDownHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	err := r.Down()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Tunnel down."))
+}
+
+type RotationRouter struct {
+	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
+}
+
+func (r *RotationRouter) Register(method daemonproto.Method, callable func(daemonproto.SockMessage) daemonproto.SockMessage) {
+	r.routes[method] = callable
+}
+
+func (r *RotationRouter) Routes() map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage {
+	return r.routes
+}
+
+func NewRotationRouter() *RotationRouter {
+	return &RotationRouter{routes: map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage{}}
+}
+
+type RotationError struct {
+	Msg string
+}
+
+func (r *RotationError) Error() string {
+	return "There was an error rotating the exit node: " + r.Msg
+}
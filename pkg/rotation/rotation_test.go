@@ -0,0 +1,318 @@
+package rotation
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/cloud/linode"
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/daemon"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+)
+
+func TestCronNext(t *testing.T) {
+	loc := time.UTC
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"30 3 * * *", time.Date(2024, 5, 1, 4, 0, 0, 0, loc), time.Date(2024, 5, 2, 3, 30, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 4, 7, 12, 0, loc), time.Date(2024, 5, 1, 4, 15, 0, 0, loc)},
+		{"0 2 * * 1-5", time.Date(2024, 5, 3, 3, 0, 0, 0, loc), time.Date(2024, 5, 6, 2, 0, 0, 0, loc)},
+		{"0 0 1,15 * 7", time.Date(2024, 5, 2, 0, 0, 0, 0, loc), time.Date(2024, 5, 5, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2023, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+		{"0 0 30 2 *", time.Date(2023, 3, 1, 0, 0, 0, 0, loc), time.Time{}},
+	}
+	for _, tc := range tests {
+		cron, err := ParseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.expr, err)
+		}
+		if got := cron.Next(tc.after); !got.Equal(tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "* * * * mon", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := ParseCron(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	sched, err := ParseSchedule("24h", "", "", []string{"mon-fri 02:00-04:00", "sat,sun 22:00-06:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := time.UTC
+	// Friday 10:00 + 24h lands on Saturday 10:00, which waits for the weekend window that evening
+	if got, want := sched.Next(time.Date(2024, 5, 3, 10, 0, 0, 0, loc)), time.Date(2024, 5, 4, 22, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// the sunday night window runs over into monday morning
+	if !sched.Allowed(time.Date(2024, 5, 6, 5, 0, 0, 0, loc)) {
+		t.Error("expected monday 05:00 to be inside of sundays window")
+	}
+	if sched.Allowed(time.Date(2024, 5, 7, 5, 0, 0, 0, loc)) {
+		t.Error("expected tuesday 05:00 to be outside of every window")
+	}
+	sched, err = ParseSchedule("1h", "", "30m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 5, 3, 10, 0, 0, 0, loc)
+	for i := 0; i < 20; i++ {
+		next := sched.Next(from)
+		if next.Before(from.Add(time.Hour)) || next.After(from.Add(time.Hour+time.Minute*30)) {
+			t.Fatalf("jittered time %s is out of range", next)
+		}
+	}
+	for _, bad := range []string{"02:00", "someday 02:00-04:00", "02:00-02:00", "mon 25:00-26:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+type fakeCaller struct {
+	conf  *config.Configuration
+	calls []string
+	fail  map[string]int // the number of times a route should fail before it succeeds
+	cloud []string
+}
+
+func (f *fakeCaller) Call(payload []byte, target string, method string) daemonproto.SockMessage {
+	route := target + " " + method
+	f.calls = append(f.calls, route)
+	if f.fail[route] > 0 {
+		f.fail[route]--
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte("failed"))
+	}
+	var body []byte
+	switch route {
+	case "cloud add":
+		var req linode.AddLinodeRequest
+		json.Unmarshal(payload, &req)
+		f.cloud = append(f.cloud, req.Name)
+		// like the real handler does when the server is bootstrapped with cloud-init
+		addr, _ := f.conf.GetAvailableVpnIpv4()
+		f.conf.Service.Servers[req.Name] = config.VpnServer{Name: req.Name, WanIpv4: "5.5.5.5", VpnIpv4: addr}
+		body, _ = json.Marshal(linode.GetLinodeResponse{Label: req.Name, Ipv4: []string{"5.5.5.5"}})
+	case "cloud show":
+		owned := linode.GetAllLinodes{}
+		for i := range f.cloud {
+			owned.Data = append(owned.Data, linode.GetLinodeResponse{Label: f.cloud[i]})
+		}
+		body, _ = json.Marshal(owned)
+	case "cloud delete":
+		var req linode.DeleteLinodeRequest
+		json.Unmarshal(payload, &req)
+		for i := range f.cloud {
+			if f.cloud[i] == req.Name {
+				f.cloud = append(f.cloud[:i], f.cloud[i+1:]...)
+				break
+			}
+		}
+	case "config-server delete":
+		var req config.VpnServer
+		json.Unmarshal(payload, &req)
+		if server, ok := f.conf.Service.Servers[req.Name]; ok && server.VpnIpv4 != nil {
+			f.conf.FreeAddress(server.VpnIpv4.String())
+		}
+		delete(f.conf.Service.Servers, req.Name)
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, body)
+}
+
+type fakeTunnel struct {
+	events    []string
+	handshake time.Time
+}
+
+func (f *fakeTunnel) Up(conf string) error {
+	f.events = append(f.events, "up "+path.Base(conf))
+	return nil
+}
+
+func (f *fakeTunnel) Down(conf string) error {
+	f.events = append(f.events, "down "+path.Base(conf))
+	return nil
+}
+
+func (f *fakeTunnel) Handshake(conf string) (time.Time, error) {
+	return f.handshake, nil
+}
+
+func newTestRotator(t *testing.T, fail map[string]int, handshake time.Time) (*Rotator, *fakeCaller, *fakeTunnel) {
+	conf := config.NewConfiguration(bytes.NewBuffer([]byte{}), "test")
+	conf.Cloud.Bootstrap = config.BootstrapCloudInit
+	dir := t.TempDir()
+	conf.Rotation.StatePath = path.Join(dir, "rotation.json")
+	conf.HostInfo.WorkflowStatePath = path.Join(dir, "workflows.json")
+	conf.Service.VpnAddresses = map[string]bool{"10.8.0.1": true, "10.8.0.2": false}
+	conf.Service.Servers["old"] = config.VpnServer{Name: "old", WanIpv4: "1.1.1.1", VpnIpv4: net.ParseIP("10.8.0.1")}
+	conf.Service.Clients["laptop"] = config.VpnClient{Name: "laptop", Default: true}
+	caller := &fakeCaller{conf: conf, fail: fail, cloud: []string{"old"}}
+	tunnel := &fakeTunnel{handshake: handshake}
+	rotator, err := newRotator(caller, conf, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.HandshakeTimeout = 0
+	return rotator, caller, tunnel
+}
+
+// a rotator with a workflow engine of its own, loaded from the state files like the daemon does when it starts
+func newRotator(caller *fakeCaller, conf *config.Configuration, tunnel *fakeTunnel) (*Rotator, error) {
+	workflows, err := daemon.NewWorkflowEngine(caller, conf)
+	if err != nil {
+		return nil, err
+	}
+	return NewRotator(caller, workflows, conf, tunnel)
+}
+
+func TestRotationRollsBackWithoutHandshake(t *testing.T) {
+	rotator, caller, tunnel := newTestRotator(t, map[string]int{}, time.Time{})
+	now := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+	rotator.now = func() time.Time { return now }
+	rotator.Trigger()
+	rotator.Tick()
+
+	state := rotator.State()
+	if rotator.Step() != StepIdle || state.Run != "" || state.Current != "old" || state.Failures != 1 || state.LastError == "" {
+		t.Fatalf("expected the rotation to be rolled back, got: %+v", state)
+	}
+	if !state.NextRun.Equal(now.Add(DefaultRetryDelay)) {
+		t.Errorf("expected the next attempt to back off, got: %s", state.NextRun)
+	}
+	if !reflect.DeepEqual(caller.cloud, []string{"old"}) {
+		t.Errorf("expected the replacement to be deleted, got: %v", caller.cloud)
+	}
+	if _, ok := rotator.Config.Service.Servers["old"]; !ok || len(rotator.Config.Service.Servers) != 1 {
+		t.Errorf("expected only the old server to be left in the config, got: %v", rotator.Config.Service.Servers)
+	}
+	for i := range tunnel.events {
+		if tunnel.events[i] == "down old.conf" {
+			t.Errorf("the old tunnel was taken down: %v", tunnel.events)
+		}
+	}
+}
+
+func TestRotationRollbackCleansConfig(t *testing.T) {
+	// the replacement is added to the configuration when its created, and then fails to boot
+	rotator, caller, _ := newTestRotator(t, map[string]int{"cloud poll": 1}, time.Now())
+	rotator.now = func() time.Time { return time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC) }
+	rotator.Trigger()
+	rotator.Tick()
+
+	state := rotator.State()
+	if rotator.Step() != StepIdle || state.Current != "old" || state.Failures != 1 {
+		t.Fatalf("expected the rotation to be rolled back, got: %+v", state)
+	}
+	if !reflect.DeepEqual(caller.cloud, []string{"old"}) {
+		t.Errorf("expected the replacement to be deleted, got: %v", caller.cloud)
+	}
+	if _, ok := rotator.Config.Service.Servers["old"]; !ok || len(rotator.Config.Service.Servers) != 1 {
+		t.Errorf("expected only the old server to be left in the config, got: %v", rotator.Config.Service.Servers)
+	}
+	if used := rotator.Config.Service.VpnAddresses["10.8.0.2"]; used {
+		t.Error("expected the replacements VPN address to be freed")
+	}
+	if leaked := rotator.Config.LeakedVpnAddresses(); len(leaked) != 0 {
+		t.Errorf("expected no leaked VPN addresses, got: %v", leaked)
+	}
+
+	// the next attempt can create a server with the same address again
+	rotator.Trigger()
+	rotator.Tick()
+	if final := rotator.State(); rotator.Step() != StepIdle || final.Current == "old" || final.LastError != "" {
+		t.Errorf("expected the retried rotation to finish, got: %+v", final)
+	}
+}
+
+func TestRotationResumesAfterRestart(t *testing.T) {
+	rotator, caller, tunnel := newTestRotator(t, map[string]int{"config-server delete": 1}, time.Now())
+	now := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+	rotator.now = func() time.Time { return now }
+	rotator.Trigger()
+	rotator.Tick()
+	state := rotator.State()
+	run, err := rotator.Workflows.Run(state.Run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := run.Params["replacement"]
+	if rotator.Step() != StepDestroyOld || state.Current != "old" || replacement == "" || state.LastError == "" {
+		t.Fatalf("expected the rotation to stop at destroying the old server, got: %+v", state)
+	}
+	wantTunnel := []string{"up " + replacement + ".conf", "down " + replacement + ".conf", "down old.conf", "up " + replacement + ".conf"}
+	if !reflect.DeepEqual(tunnel.events, wantTunnel) {
+		t.Errorf("unexpected tunnel changes:\n got: %v\nwant: %v", tunnel.events, wantTunnel)
+	}
+
+	// a new rotator stands in for the daemon restarting, it shouldnt resume until the retry delay is up
+	caller.calls = nil
+	rotator, err = newRotator(caller, rotator.Config, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.now = func() time.Time { return now }
+	rotator.Tick()
+	if len(caller.calls) != 0 {
+		t.Fatalf("expected no calls before the retry delay, got: %v", caller.calls)
+	}
+	rotator.now = func() time.Time { return now.Add(DefaultRetryDelay) }
+	rotator.Tick()
+	want := []string{"cloud show", "config-server delete"}
+	if !reflect.DeepEqual(caller.calls, want) {
+		t.Errorf("unexpected calls after resuming:\n got: %v\nwant: %v", caller.calls, want)
+	}
+	final := rotator.State()
+	if rotator.Step() != StepIdle || final.Run != "" || final.Current != replacement || final.LastError != "" {
+		t.Errorf("unexpected final state: %+v", final)
+	}
+	if !reflect.DeepEqual(caller.cloud, []string{replacement}) {
+		t.Errorf("expected only the replacement to be left in the cloud, got: %v", caller.cloud)
+	}
+}
+
+func TestTunnelMovesShareLock(t *testing.T) {
+	rotator, caller, tunnel := newTestRotator(t, map[string]int{}, time.Now())
+	caller.conf.Service.Servers["new"] = config.VpnServer{Name: "new", WanIpv4: "2.2.2.2", VpnIpv4: net.ParseIP("10.8.0.2")}
+	rotator.setState(RotationState{Current: "old"})
+
+	err := rotator.Move(func() error {
+		if err := rotator.Failover("new"); err == nil {
+			t.Error("expected a failover to be refused while another move is being made")
+		}
+		if err := rotator.FailoverFrom("old", "new"); err == nil {
+			t.Error("expected a failover from the health monitor to be refused while another move is being made")
+		}
+		if err := rotator.Move(func() error { return nil }); err == nil {
+			t.Error("expected a move to be refused while another move is being made")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnel.events) != 0 {
+		t.Errorf("expected the tunnel to stay put, got: %v", tunnel.events)
+	}
+
+	if err := rotator.FailoverFrom("new", "old"); err == nil {
+		t.Error("expected a failover decided on a server the tunnel isnt using to be refused")
+	}
+	if err := rotator.FailoverFrom("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rotator.Active(); got != "new" {
+		t.Errorf("expected the tunnel to move to: new, got: %s", got)
+	}
+}
@@ -0,0 +1,412 @@
+package rotation
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the furthest ahead a cron expression is searched before it is treated as never matching
+const cronSearchYears = 5
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+/*
+When rotations happen. A rotation is due either a fixed interval after the last one, or at the next time
+that matches a cron expression, then delayed by a random amount of jitter and held back until a
+maintenance window opens.
+*/
+type Schedule struct {
+	Interval time.Duration
+	Cron     *CronExpr
+	Jitter   time.Duration
+	Windows  []Window
+	rnd      func(int64) int64
+}
+
+/*
+Build a schedule from the rotation settings in the configuration
+
+	    :param interval: a duration between rotations, i.e. '24h'. Ignored if a cron expression is passed
+		:param cron: a five field cron expression
+		:param jitter: the most that a rotation can be randomly delayed by, i.e. '30m'
+		:param windows: the maintenance windows that rotations can start in, i.e. 'mon-fri 02:00-04:00'
+*/
+func ParseSchedule(interval string, cron string, jitter string, windows []string) (Schedule, error) {
+	sched := Schedule{rnd: rand.Int63n}
+	var err error
+	switch {
+	case strings.TrimSpace(cron) != "":
+		expr, err := ParseCron(cron)
+		if err != nil {
+			return sched, err
+		}
+		sched.Cron = &expr
+	case strings.TrimSpace(interval) != "":
+		sched.Interval, err = time.ParseDuration(interval)
+		if err != nil {
+			return sched, &ScheduleError{Msg: "invalid interval: " + err.Error()}
+		}
+		if sched.Interval <= 0 {
+			return sched, &ScheduleError{Msg: "the interval must be positive, got: " + interval}
+		}
+	default:
+		return sched, &ScheduleError{Msg: "either an interval or a cron expression has to be set"}
+	}
+	if strings.TrimSpace(jitter) != "" {
+		sched.Jitter, err = time.ParseDuration(jitter)
+		if err != nil {
+			return sched, &ScheduleError{Msg: "invalid jitter: " + err.Error()}
+		}
+		if sched.Jitter < 0 {
+			return sched, &ScheduleError{Msg: "the jitter cant be negative, got: " + jitter}
+		}
+	}
+	for i := range windows {
+		window, err := ParseWindow(windows[i])
+		if err != nil {
+			return sched, err
+		}
+		sched.Windows = append(sched.Windows, window)
+	}
+	return sched, nil
+}
+
+/*
+Work out when the next rotation should start. Jitter is only kept if the delayed time still lands inside
+of a maintenance window, otherwise the rotation starts when the window opens.
+
+	:param from: the time of the last rotation, or the current time if there hasnt been one
+*/
+func (s Schedule) Next(from time.Time) time.Time {
+	var next time.Time
+	if s.Cron != nil {
+		next = s.Cron.Next(from)
+		if next.IsZero() {
+			return next
+		}
+	} else {
+		next = from.Add(s.Interval)
+	}
+	next = s.Defer(next)
+	if s.Jitter > 0 && s.rnd != nil {
+		jittered := next.Add(time.Duration(s.rnd(int64(s.Jitter))))
+		if s.Allowed(jittered) {
+			next = jittered
+		}
+	}
+	return next
+}
+
+/*
+Check if a rotation is allowed to start at the passed time
+
+	:param t: the time to check
+*/
+func (s Schedule) Allowed(t time.Time) bool {
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for i := range s.Windows {
+		if s.Windows[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Hold back a time until the next maintenance window opens, if it isnt already inside of one
+
+	:param t: the time to defer
+*/
+func (s Schedule) Defer(t time.Time) time.Time {
+	if s.Allowed(t) {
+		return t
+	}
+	var earliest time.Time
+	for i := range s.Windows {
+		start := s.Windows[i].NextStart(t)
+		if earliest.IsZero() || start.Before(earliest) {
+			earliest = start
+		}
+	}
+	return earliest
+}
+
+/*
+A recurring period of time that rotations are allowed to start in. A window that ends before it
+starts runs over midnight, and belongs to the day that it starts on.
+*/
+type Window struct {
+	Days  [7]bool // indexed by time.Weekday
+	Start int     // minutes after midnight
+	End   int     // minutes after midnight
+}
+
+/*
+Parse a maintenance window in the form '[days ]HH:MM-HH:MM', where the days are a comma separated list of
+three letter day names or ranges of them, i.e. 'mon-fri 02:00-04:00' or 'sat,sun 22:00-06:00'. A window
+without days applies every day.
+
+	:param spec: the window to parse
+*/
+func ParseWindow(spec string) (Window, error) {
+	var window Window
+	fields := strings.Fields(strings.ToLower(spec))
+	var clock string
+	switch len(fields) {
+	case 1:
+		clock = fields[0]
+		for i := range window.Days {
+			window.Days[i] = true
+		}
+	case 2:
+		clock = fields[1]
+		for _, part := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := weekdays[bounds[0]]
+			if !ok {
+				return window, &ScheduleError{Msg: "invalid day: " + bounds[0] + " in window: " + spec}
+			}
+			last := first
+			if len(bounds) == 2 {
+				last, ok = weekdays[bounds[1]]
+				if !ok {
+					return window, &ScheduleError{Msg: "invalid day: " + bounds[1] + " in window: " + spec}
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				window.Days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return window, &ScheduleError{Msg: "windows must look like '[days ]HH:MM-HH:MM', got: " + spec}
+	}
+	times := strings.SplitN(clock, "-", 2)
+	if len(times) != 2 {
+		return window, &ScheduleError{Msg: "windows must have a start and an end, got: " + spec}
+	}
+	var err error
+	window.Start, err = parseClock(times[0])
+	if err != nil {
+		return window, err
+	}
+	window.End, err = parseClock(times[1])
+	if err != nil {
+		return window, err
+	}
+	if window.Start == window.End {
+		return window, &ScheduleError{Msg: "the window is empty: " + spec}
+	}
+	return window, nil
+}
+
+/*
+Parse a time of day into the minutes after midnight
+
+	:param clock: a time in the form HH:MM
+*/
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, &ScheduleError{Msg: "invalid time of day: " + clock}
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+/*
+Check if a time falls inside of the window
+
+	:param t: the time to check
+*/
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+	}
+	if minute >= w.Start {
+		return w.Days[t.Weekday()]
+	}
+	return minute < w.End && w.Days[t.AddDate(0, 0, -1).Weekday()]
+}
+
+/*
+Get the next time that the window opens after the passed time
+
+	:param t: the time to start looking from
+*/
+func (w Window) NextStart(t time.Time) time.Time {
+	for d := 0; d <= 7; d++ {
+		day := t.AddDate(0, 0, d)
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.Start/60, w.Start%60, 0, 0, t.Location())
+		if start.After(t) && w.Days[start.Weekday()] {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+type cronField struct {
+	values map[int]bool
+	any    bool // the field started with a '*', which matters for how the day fields are combined
+}
+
+/*
+A standard five field cron expression: minute, hour, day of the month, month and day of the week
+*/
+type CronExpr struct {
+	expr    string
+	minute  cronField
+	hour    cronField
+	dom     cronField
+	month   cronField
+	weekday cronField
+}
+
+/*
+Parse a five field cron expression. Each field can be a '*', a value, a range, a comma separated list
+of those, and any of them can have a '/step'. Sunday is both 0 and 7 in the day of the week field.
+
+	:param expr: the cron expression to parse
+*/
+func ParseCron(expr string) (CronExpr, error) {
+	cron := CronExpr{expr: expr}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cron, &ScheduleError{Msg: fmt.Sprintf("cron expressions need 5 fields, got %v in: %s", len(fields), expr)}
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([]cronField, 5)
+	for i := range fields {
+		field, err := parseCronField(fields[i], bounds[i][0], bounds[i][1])
+		if err != nil {
+			return cron, &ScheduleError{Msg: err.Error() + " in: " + expr}
+		}
+		parsed[i] = field
+	}
+	if parsed[4].values[7] {
+		parsed[4].values[0] = true
+	}
+	cron.minute, cron.hour, cron.dom, cron.month, cron.weekday = parsed[0], parsed[1], parsed[2], parsed[3], parsed[4]
+	return cron, nil
+}
+
+/*
+Parse a single field of a cron expression
+
+	    :param field: the field to parse
+		:param min: the smallest value the field allows
+		:param max: the largest value the field allows
+*/
+func parseCronField(field string, min int, max int) (cronField, error) {
+	parsed := cronField{values: map[int]bool{}, any: strings.HasPrefix(field, "*")}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rng, stepStr, ok := strings.Cut(part, "/"); ok {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return parsed, &ScheduleError{Msg: "invalid step: " + stepStr}
+			}
+			part = rng
+		}
+		lo, hi := min, max
+		if part != "*" {
+			first, last, isRange := strings.Cut(part, "-")
+			var err error
+			lo, err = strconv.Atoi(first)
+			if err != nil {
+				return parsed, &ScheduleError{Msg: "invalid value: " + first}
+			}
+			hi = lo
+			if isRange {
+				hi, err = strconv.Atoi(last)
+				if err != nil {
+					return parsed, &ScheduleError{Msg: "invalid value: " + last}
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return parsed, &ScheduleError{Msg: fmt.Sprintf("%s is outside of the range %v-%v", part, min, max)}
+		}
+		for v := lo; v <= hi; v += step {
+			parsed.values[v] = true
+		}
+	}
+	return parsed, nil
+}
+
+/*
+Check if the day of a time matches the expression. Like every other cron, if both of the day fields
+are restricted then a day only has to match one of them.
+
+	:param t: the time to check
+*/
+func (c CronExpr) dayMatches(t time.Time) bool {
+	dom := c.dom.values[t.Day()]
+	weekday := c.weekday.values[int(t.Weekday())]
+	if c.dom.any || c.weekday.any {
+		return dom && weekday
+	}
+	return dom || weekday
+}
+
+/*
+Get the first time after the passed one that matches the expression, or the zero time if nothing
+matches within the next few years
+
+	:param after: the time to start searching from
+*/
+func (c CronExpr) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := after.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		if !c.month.values[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.hour.values[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !c.minute.values[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c CronExpr) String() string {
+	return c.expr
+}
+
+type ScheduleError struct {
+	Msg string
+}
+
+func (s *ScheduleError) Error() string {
+	return "There was an error with the rotation schedule: " + s.Msg
+}
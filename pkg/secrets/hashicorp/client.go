@@ -8,7 +8,6 @@ import (
 	"io"
 	"net/http"
 
-	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
 	"git.aetherial.dev/aeth/yosai/pkg/keytags"
 	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
 )
@@ -62,10 +61,11 @@ func (v VaultResponse) GetSecret() string {
 
 // this is an extra implementation so VaultResponse can implement the daemon.Key interface
 func (v VaultResponse) Prepare() string {
-	if v.Data.Data.Type == "bearer" {
+	// keys added through the daemon carry the keyring types, older items carry 'bearer' and 'basic'
+	if v.Data.Data.Type == "bearer" || v.Data.Data.Type == keyring.BEARER_AUTH {
 		return fmt.Sprintf("Bearer %s", v.GetSecret())
 	}
-	if v.Data.Data.Type == "basic" {
+	if v.Data.Data.Type == "basic" || v.Data.Data.Type == keyring.BASIC_AUTH {
 
 		encodedcreds := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", v.GetPublic(), v.GetSecret())))
 		return fmt.Sprintf("Basic %s", encodedcreds)
@@ -102,12 +102,16 @@ func (v VaultConnection) GetKey(name string) (keyring.Key, error) {
 	req.Header.Add("Authorization", vaultApiKey.Prepare())
 	resp, err := v.Client.Do(req)
 	if err != nil {
-		return vaultResp, err
+		return vaultResp, &HashicorpClientError{Msg: err.Error()}
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	// only a 404 means that the key is gone, anything else is vault being unavailable or refusing the request
+	if resp.StatusCode == http.StatusNotFound {
 		return vaultResp, keyring.KeyNotFound
 	}
+	if resp.StatusCode != http.StatusOK {
+		return vaultResp, &HashicorpClientError{Msg: resp.Status}
+	}
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -150,7 +154,7 @@ func (v VaultConnection) AddKey(name string, key keyring.Key) error {
 
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return &HashicorpClientError{Msg: resp.Status}
 	}
 	return nil
@@ -180,7 +184,7 @@ func (v VaultConnection) RemoveKey(name string) error {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return &HashicorpClientError{Msg: resp.Status}
 	}
 	return nil
@@ -191,30 +195,6 @@ func (v VaultConnection) Source() string {
 	return "Hashicorp Vault"
 }
 
-/*
-Handles the routing for the hashicorp keyring routes
-
-	:param msg: a daemon.SockMessage that contains request data
-*/
-func (v VaultConnection) VaultRouter(msg daemonproto.SockMessage) daemonproto.SockMessage {
-	switch msg.Method {
-	case "add":
-		var req VaultItem
-		err := json.Unmarshal(msg.Body, &req)
-		if err != nil {
-			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
-		}
-		err = v.AddKey(req.Name, req)
-		if err != nil {
-			return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
-		}
-		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Key successfully added."))
-	default:
-		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_UNRESOLVED, []byte("Unresolvable method"))
-
-	}
-}
-
 /*
 #####################
 ###### ERRORS #######
@@ -227,3 +207,8 @@ type HashicorpClientError struct {
 func (h *HashicorpClientError) Error() string {
 	return fmt.Sprintf("There was an error with the client call: %s", h.Msg)
 }
+
+// Errors from vault are handled like the errors of any other rung
+func (h *HashicorpClientError) Unwrap() error {
+	return keyring.KeyRingError
+}
@@ -1 +1,48 @@
 package hashicorp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+func TestGetKeyStatus(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data": {"data": {"public": "", "secret": "linode-token", "type": "bearer_auth"}}}`))
+	}))
+	defer srv.Close()
+	kr := keyring.NewKeyRing(config.NewConfiguration(os.Stdout, "test"), keytags.ConstKeytag{})
+	kr.Keys[keytags.HASHICORP_VAULT_KEYNAME] = keyring.BearerAuth{Secret: "vault-token"}
+	vault := VaultConnection{VaultUrl: strings.TrimPrefix(srv.URL, "http://"), HttpProto: "http", KeyRing: kr, Client: srv.Client()}
+
+	key, err := vault.GetKey("LINODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.GetSecret() != "linode-token" {
+		t.Errorf("unexpected key: %#v", key)
+	}
+	status = http.StatusNotFound
+	if _, err := vault.GetKey("LINODE"); !errors.Is(err, keyring.KeyNotFound) {
+		t.Errorf("expected a 404 to be not found, got: %v", err)
+	}
+	for _, status = range []int{http.StatusForbidden, http.StatusServiceUnavailable} {
+		_, err := vault.GetKey("LINODE")
+		if errors.Is(err, keyring.KeyNotFound) || !errors.Is(err, keyring.KeyRingError) {
+			t.Errorf("expected a %d to be a keyring error, got: %v", status, err)
+		}
+	}
+	srv.Close()
+	if _, err := vault.GetKey("LINODE"); !errors.Is(err, keyring.KeyRingError) {
+		t.Errorf("expected vault going away to be a keyring error, got: %v", err)
+	}
+}
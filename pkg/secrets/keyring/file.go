@@ -0,0 +1,512 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// the environment variable holding the passphrase for the local keyring, when no key file is configured
+const KeyringPassphraseEnv = "YOSAI_KEYRING_PASSPHRASE"
+
+// the version of the local keyring file format
+const fileKeyringVersion = 1
+
+// the scrypt cost parameters used to derive the keyring key from its secret
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// the shortest secret that a key file can hold
+const minKeyFileLen = 32
+
+/*
+The encrypted form of the local keyring, as it is written to disk
+*/
+type fileKeyringEnvelope struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Box     []byte `json:"box"` // the keys, sealed with NaCl secretbox under a key derived from the secret with scrypt
+}
+
+/*
+A key as it is kept inside of the local keyring
+*/
+type storedKey struct {
+	Type   string `json:"type"`
+	Public string `json:"public"`
+	Secret string `json:"secret"`
+}
+
+func (s storedKey) GetPublic() string { return s.Public }
+func (s storedKey) GetSecret() string { return s.Secret }
+func (s storedKey) GetType() string   { return s.Type }
+func (s storedKey) Prepare() string   { return s.Secret }
+
+/*
+Turn a key into the form that it is kept in
+
+	:param key: the key to store
+*/
+func toStoredKey(key Key) storedKey {
+	return storedKey{Type: key.GetType(), Public: key.GetPublic(), Secret: key.GetSecret()}
+}
+
+/*
+Turn a stored key back into the type that it was stored from, so that it prepares the same way
+
+	:param stored: the stored key
+*/
+func fromStoredKey(stored storedKey) Key {
+	switch stored.Type {
+	case WIREGUARD:
+		return WireguardKeypair{PublicKey: stored.Public, PrivateKey: stored.Secret}
+	case WIREGUARD_PSK:
+		return WireguardPresharedKey{Pair: stored.Public, Key: stored.Secret}
+	case BEARER_AUTH, "bearer":
+		return BearerAuth{Secret: stored.Secret}
+	case BASIC_AUTH, "basic":
+		return BasicAuth{Username: stored.Public, Password: stored.Secret}
+	case CLIENT_CREDENTIALS:
+		return ClientCredentials{ClientId: stored.Public, ClientSecret: stored.Secret}
+	case SSH_KEY:
+		return SshKey{User: stored.Public, PrivateKey: stored.Secret}
+	}
+	return stored
+}
+
+/*
+A keyring kept in a file on the host, encrypted with NaCl secretbox. It is unlocked with a passphrase or
+the contents of a key file, and can either cache the keys of the secrets backend or be the backend itself.
+*/
+type FileKeyRing struct {
+	Path string
+	mu   sync.Mutex
+	salt []byte
+	key  [32]byte
+	keys map[string]storedKey
+}
+
+/*
+Open the local keyring, creating it when the file doesnt exist yet
+
+	    :param fpath: the path of the keyring file
+		:param secret: the passphrase or key file contents that unlock the keyring
+*/
+func NewFileKeyRing(fpath string, secret []byte) (*FileKeyRing, error) {
+	return openFileKeyRing(fpath, secret, true)
+}
+
+/*
+Open a keyring file
+
+	    :param fpath: the path of the keyring file
+		:param secret: the passphrase or key file contents that unlock the keyring
+		:param create: create the keyring when the file doesnt exist, rather than failing
+*/
+func openFileKeyRing(fpath string, secret []byte, create bool) (*FileKeyRing, error) {
+	if len(secret) == 0 {
+		return nil, &FileKeyRingError{Path: fpath, Msg: "no passphrase or key file was given to unlock it"}
+	}
+	f := &FileKeyRing{Path: fpath, keys: map[string]storedKey{}}
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, os.ErrNotExist) && create {
+		f.salt = make([]byte, 32)
+		if _, err := rand.Read(f.salt); err != nil {
+			return nil, &FileKeyRingError{Path: fpath, Msg: err.Error()}
+		}
+		if err := f.derive(secret); err != nil {
+			return nil, err
+		}
+		return f, f.save()
+	}
+	if err != nil {
+		return nil, &FileKeyRingError{Path: fpath, Msg: err.Error()}
+	}
+	var envelope fileKeyringEnvelope
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil, &FileKeyRingError{Path: fpath, Msg: "the file isnt a keyring: " + err.Error()}
+	}
+	if envelope.Version != fileKeyringVersion || len(envelope.Nonce) != 24 {
+		return nil, &FileKeyRingError{Path: fpath, Msg: "unsupported keyring file"}
+	}
+	f.salt = envelope.Salt
+	if err := f.derive(secret); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], envelope.Nonce)
+	plain, ok := secretbox.Open(nil, envelope.Box, &nonce, &f.key)
+	if !ok {
+		return nil, &FileKeyRingError{Path: fpath, Msg: "couldnt unlock the keyring, the passphrase or key file is wrong"}
+	}
+	if err := json.Unmarshal(plain, &f.keys); err != nil {
+		return nil, &FileKeyRingError{Path: fpath, Msg: err.Error()}
+	}
+	return f, nil
+}
+
+/*
+Derive the key that the keyring is sealed with from its secret
+
+	:param secret: the passphrase or key file contents
+*/
+func (f *FileKeyRing) derive(secret []byte) error {
+	key, err := scrypt.Key(secret, f.salt, scryptN, scryptR, scryptP, len(f.key))
+	if err != nil {
+		return &FileKeyRingError{Path: f.Path, Msg: err.Error()}
+	}
+	copy(f.key[:], key)
+	return nil
+}
+
+/*
+Seal the keys and write them out. The file is written next to the keyring and moved over it, so that a
+failed write never loses the keyring.
+*/
+func (f *FileKeyRing) save() error {
+	plain, err := json.Marshal(f.keys)
+	if err != nil {
+		return &FileKeyRingError{Path: f.Path, Msg: err.Error()}
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return &FileKeyRingError{Path: f.Path, Msg: err.Error()}
+	}
+	b, _ := json.Marshal(fileKeyringEnvelope{
+		Version: fileKeyringVersion,
+		Salt:    f.salt,
+		Nonce:   nonce[:],
+		Box:     secretbox.Seal(nil, plain, &nonce, &f.key),
+	})
+	tmp, err := os.CreateTemp(path.Dir(f.Path), "."+path.Base(f.Path)+".*")
+	if err != nil {
+		return &FileKeyRingError{Path: f.Path, Msg: err.Error()}
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.Path)
+	}
+	if err != nil {
+		return &FileKeyRingError{Path: f.Path, Msg: err.Error()}
+	}
+	return nil
+}
+
+/*
+Get a key from the local keyring
+
+	:param name: the name of the key
+*/
+func (f *FileKeyRing) GetKey(name string) (Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored, ok := f.keys[name]
+	if !ok {
+		return stored, KeyNotFound
+	}
+	return fromStoredKey(stored), nil
+}
+
+/*
+Add a key to the local keyring, replacing the key if it is already there
+
+	    :param name: the name of the key
+		:param key: the key to add
+*/
+func (f *FileKeyRing) AddKey(name string, key Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := toStoredKey(key)
+	// nothing to write when the key hasnt changed, so that caching a key doesnt rewrite the file each time it is read
+	if current, ok := f.keys[name]; ok && current == stored {
+		return nil
+	}
+	f.keys[name] = stored
+	return f.save()
+}
+
+/*
+Remove a key from the local keyring. Removing a key that isnt there isnt an error.
+
+	:param name: the name of the key
+*/
+func (f *FileKeyRing) RemoveKey(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.keys[name]; !ok {
+		return nil
+	}
+	delete(f.keys, name)
+	return f.save()
+}
+
+// Return the resource name for logging purposes
+func (f *FileKeyRing) Source() string {
+	return "Local keyring: " + f.Path
+}
+
+/*
+Get the names of every key on the local keyring
+*/
+func (f *FileKeyRing) Names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.keys))
+	for name := range f.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Write every key on the local keyring to a new keyring file, sealed with its own secret, i.e. to move
+the keys onto another host
+
+	    :param fpath: the path to write the keyring to
+		:param secret: the passphrase or key file contents that the new keyring is unlocked with
+*/
+func (f *FileKeyRing) Export(fpath string, secret []byte) error {
+	if _, err := os.Stat(fpath); err == nil {
+		return &FileKeyRingError{Path: fpath, Msg: "the file already exists"}
+	}
+	out, err := NewFileKeyRing(fpath, secret)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	for name, key := range f.keys {
+		out.keys[name] = key
+	}
+	f.mu.Unlock()
+	return out.save()
+}
+
+/*
+Add every key from another keyring file to the local keyring, replacing the keys that are already on it.
+The number of keys imported is returned.
+
+	    :param fpath: the path of the keyring to import
+		:param secret: the passphrase or key file contents that unlock the keyring being imported
+*/
+func (f *FileKeyRing) Import(fpath string, secret []byte) (int, error) {
+	in, err := openFileKeyRing(fpath, secret, false)
+	if err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, key := range in.keys {
+		f.keys[name] = key
+	}
+	return len(in.keys), f.save()
+}
+
+/*
+Read the secret out of a key file
+
+	:param fpath: the path of the key file
+*/
+func ReadKeyFile(fpath string) ([]byte, error) {
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, &FileKeyRingError{Path: fpath, Msg: err.Error()}
+	}
+	secret := []byte(strings.TrimSpace(string(b)))
+	if len(secret) < minKeyFileLen {
+		return nil, &FileKeyRingError{Path: fpath, Msg: "key files have to hold at least 32 bytes"}
+	}
+	return secret, nil
+}
+
+/*
+Get the secret that unlocks a keyring, from the key file when there is one and from the passphrase
+environment variable otherwise
+
+	:param keyFile: the path of the key file, if there is one
+*/
+func KeyringSecret(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return ReadKeyFile(keyFile)
+	}
+	passphrase := os.Getenv(KeyringPassphraseEnv)
+	if passphrase == "" {
+		return nil, &FileKeyRingError{Msg: "there is no key file, and " + KeyringPassphraseEnv + " isnt set"}
+	}
+	return []byte(passphrase), nil
+}
+
+/*
+Keeps a local copy of the keys from a secrets backend, so that the daemon can start and keep running
+when the backend cant be reached. The backend is always asked first, and a key that the backend no
+longer has is dropped from the copy.
+*/
+type CachedKeyRing struct {
+	Backend DaemonKeyRing
+	Cache   *FileKeyRing
+	Config  *config.Configuration
+}
+
+/*
+Put a local copy in front of a secrets backend
+
+	    :param backend: the secrets backend
+		:param cache: the local keyring that the keys are copied to
+		:param cfg: the daemon configuration, used for logging
+*/
+func NewCachedKeyRing(backend DaemonKeyRing, cache *FileKeyRing, cfg *config.Configuration) CachedKeyRing {
+	return CachedKeyRing{Backend: backend, Cache: cache, Config: cfg}
+}
+
+func (c CachedKeyRing) Log(msg ...string) {
+	cacheMsg := []string{
+		"CachedKeyRing:",
+	}
+	cacheMsg = append(cacheMsg, msg...)
+	c.Config.Log(cacheMsg...)
+}
+
+/*
+Get a key from the backend, falling back to the local copy when the backend cant be reached
+
+	:param name: the name of the key
+*/
+func (c CachedKeyRing) GetKey(name string) (Key, error) {
+	key, err := c.Backend.GetKey(name)
+	if err == nil {
+		if cacheErr := c.Cache.AddKey(name, key); cacheErr != nil {
+			c.Log("Couldnt cache key:", name, cacheErr.Error())
+		}
+		return key, nil
+	}
+	if errors.Is(err, KeyNotFound) {
+		c.Cache.RemoveKey(name)
+		return key, err
+	}
+	cached, cacheErr := c.Cache.GetKey(name)
+	if cacheErr != nil {
+		return cached, KeyNotFound
+	}
+	c.Log(c.Backend.Source(), "couldnt be reached, using the local copy of:", name, err.Error())
+	return cached, nil
+}
+
+/*
+Add a key to the backend and to the local copy
+
+	    :param name: the name of the key
+		:param key: the key to add
+*/
+func (c CachedKeyRing) AddKey(name string, key Key) error {
+	if err := c.Backend.AddKey(name, key); err != nil {
+		return err
+	}
+	return c.Cache.AddKey(name, key)
+}
+
+/*
+Remove a key from the backend and from the local copy
+
+	:param name: the name of the key
+*/
+func (c CachedKeyRing) RemoveKey(name string) error {
+	if err := c.Backend.RemoveKey(name); err != nil {
+		return err
+	}
+	return c.Cache.RemoveKey(name)
+}
+
+// Return the resource name for logging purposes
+func (c CachedKeyRing) Source() string {
+	return c.Backend.Source() + ", cached in: " + c.Cache.Path
+}
+
+type KeyringTransferRequest struct {
+	Path       string `json:"path"`       // the keyring file to import from or export to
+	Passphrase string `json:"passphrase"` // the passphrase of that keyring file
+	KeyFile    string `json:"key_file"`   // a key file for that keyring file, used instead of the passphrase
+}
+
+/*
+Get the secret for the keyring file being imported or exported
+*/
+func (k KeyringTransferRequest) secret() ([]byte, error) {
+	if k.KeyFile != "" {
+		return ReadKeyFile(k.KeyFile)
+	}
+	if k.Passphrase == "" {
+		return nil, &FileKeyRingError{Path: k.Path, Msg: "either a passphrase or a key file is needed"}
+	}
+	return []byte(k.Passphrase), nil
+}
+
+/*
+Wrapping the export keyring function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (f *FileKeyRing) ExportKeyringHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyringTransferRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	secret, err := req.secret()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if err := f.Export(req.Path, secret); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Keyring exported to: "+req.Path))
+}
+
+/*
+Wrapping the import keyring function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (f *FileKeyRing) ImportKeyringHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyringTransferRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	secret, err := req.secret()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	n, err := f.Import(req.Path, secret)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte(strconv.Itoa(n)+" keys imported from: "+req.Path))
+}
+
+type FileKeyRingError struct {
+	Path string
+	Msg  string
+}
+
+func (f *FileKeyRingError) Error() string {
+	return "There was an error with the local keyring: " + f.Path + " " + f.Msg
+}
@@ -0,0 +1,171 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+)
+
+/*
+A secrets backend that can be taken offline
+*/
+type fakeBackend struct {
+	keys    map[string]Key
+	offline bool
+	failure error // returned in place of the key when set
+}
+
+func (f *fakeBackend) GetKey(name string) (Key, error) {
+	if f.offline {
+		return nil, errors.New("connection refused")
+	}
+	if f.failure != nil {
+		return nil, f.failure
+	}
+	key, ok := f.keys[name]
+	if !ok {
+		return nil, KeyNotFound
+	}
+	return key, nil
+}
+func (f *fakeBackend) AddKey(name string, key Key) error { f.keys[name] = key; return nil }
+func (f *fakeBackend) RemoveKey(name string) error       { delete(f.keys, name); return nil }
+func (f *fakeBackend) Source() string                    { return "fake backend" }
+
+func TestFileKeyRing(t *testing.T) {
+	fpath := path.Join(t.TempDir(), "yosai.keyring")
+	kr, err := NewFileKeyRing(fpath, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.AddKey("LINODE", BearerAuth{Secret: "linode-token"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.AddKey("SEMAPHORE", BasicAuth{Username: "admin", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the keyring to only be readable by the daemon, got: %s", info.Mode().Perm())
+	}
+	b, _ := os.ReadFile(fpath)
+	if strings.Contains(string(b), "linode-token") || strings.Contains(string(b), "hunter2") {
+		t.Fatal("expected the keys to be encrypted on disk")
+	}
+
+	if _, err := NewFileKeyRing(fpath, []byte("wrong horse")); err == nil {
+		t.Fatal("expected the wrong passphrase to fail")
+	}
+	reopened, err := NewFileKeyRing(fpath, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := reopened.GetKey("SEMAPHORE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basic, ok := key.(BasicAuth); !ok || basic.Username != "admin" || basic.Password != "hunter2" {
+		t.Errorf("expected basic auth to come back as it was stored, got: %#v", key)
+	}
+	if key, _ := reopened.GetKey("LINODE"); key.Prepare() != "Bearer linode-token" {
+		t.Errorf("expected the bearer token to prepare the same way, got: %s", key.Prepare())
+	}
+	if err := reopened.RemoveKey("LINODE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.GetKey("LINODE"); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected a removed key to be not found, got: %v", err)
+	}
+}
+
+func TestFileKeyRingTransfer(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := NewFileKeyRing(path.Join(dir, "yosai.keyring"), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr.AddKey("wg-phone", WireguardKeypair{PublicKey: "pub", PrivateKey: "priv"})
+	exported := path.Join(dir, "export.keyring")
+	if err := kr.Export(exported, []byte("usb stick")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Export(exported, []byte("usb stick")); err == nil {
+		t.Error("expected exporting over an existing file to fail")
+	}
+
+	other, err := NewFileKeyRing(path.Join(dir, "other.keyring"), []byte("other host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Import(exported, []byte("correct horse")); err == nil {
+		t.Error("expected importing with the wrong passphrase to fail")
+	}
+	n, err := other.Import(exported, []byte("usb stick"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 key to be imported, got: %d", n)
+	}
+	if key, err := other.GetKey("wg-phone"); err != nil || key.GetSecret() != "priv" {
+		t.Errorf("expected the imported keypair, got: %v %v", key, err)
+	}
+}
+
+func TestCachedKeyRing(t *testing.T) {
+	cache, err := NewFileKeyRing(path.Join(t.TempDir(), "yosai.keyring"), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &fakeBackend{keys: map[string]Key{"LINODE": BearerAuth{Secret: "linode-token"}}}
+	cached := NewCachedKeyRing(backend, cache, config.NewConfiguration(os.Stdout, "test"))
+	if _, err := cached.GetKey("LINODE"); err != nil {
+		t.Fatal(err)
+	}
+	// reading a key that hasnt changed leaves the file alone
+	before, _ := os.ReadFile(cache.Path)
+	if _, err := cached.GetKey("LINODE"); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(cache.Path); !bytes.Equal(before, after) {
+		t.Error("expected the local copy not to be rewritten when the key is unchanged")
+	}
+
+	// the backend refusing the request isnt the key being gone
+	backend.failure = fmt.Errorf("%w: 503 Service Unavailable", KeyRingError)
+	if key, err := cached.GetKey("LINODE"); err != nil || key.GetSecret() != "linode-token" {
+		t.Fatalf("expected the local copy while the backend is failing, got: %v", err)
+	}
+	backend.failure = nil
+
+	backend.offline = true
+	key, err := cached.GetKey("LINODE")
+	if err != nil {
+		t.Fatalf("expected the local copy while the backend is offline, got: %v", err)
+	}
+	if key.GetSecret() != "linode-token" {
+		t.Errorf("unexpected local copy: %#v", key)
+	}
+	if _, err := cached.GetKey("OPENWRT"); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected a key that was never cached to be not found, got: %v", err)
+	}
+
+	// a key that the backend dropped shouldnt outlive it on the host
+	backend.offline = false
+	delete(backend.keys, "LINODE")
+	if _, err := cached.GetKey("LINODE"); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected the dropped key to be not found, got: %v", err)
+	}
+	if _, err := cache.GetKey("LINODE"); !errors.Is(err, KeyNotFound) {
+		t.Error("expected the dropped key to be removed from the local copy")
+	}
+}
@@ -0,0 +1,170 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The kernel keyrings that keys can be kept on
+const (
+	KernelScopeSession = "session" // the keyring of the login session, which goes away when the session ends
+	KernelScopeUser    = "user"    // the keyring of the user, which outlives sessions until the user has none left
+)
+
+// the prefix on the description of every key the daemon keeps on a kernel keyring
+const KernelKeyPrefix = "yosai:"
+
+// the type of kernel key that keys are kept as
+const kernelKeyType = "user"
+
+/*
+Keeps keys on a Linux kernel keyring, where they never touch the disk and can expire on their own. Keys are
+kept as 'user' keys described as 'yosai:<name>', so they can also be added by hand, i.e.
+
+	keyctl padd user yosai:LINODE @u < token
+
+and a key added by hand is read as a bearer token.
+*/
+type KernelKeyRing struct {
+	Scope   string
+	Timeout time.Duration // how long a key lives after it is added, keys dont expire when zero
+	ring    int
+}
+
+/*
+Use one of the kernel keyrings
+
+	    :param scope: either KernelScopeSession or KernelScopeUser
+		:param timeout: how long a key lives after it is added, keys dont expire when zero
+*/
+func NewKernelKeyRing(scope string, timeout time.Duration) (*KernelKeyRing, error) {
+	k := &KernelKeyRing{Scope: scope, Timeout: timeout}
+	switch scope {
+	case KernelScopeSession:
+		k.ring = unix.KEY_SPEC_SESSION_KEYRING
+	case KernelScopeUser:
+		k.ring = unix.KEY_SPEC_USER_KEYRING
+	default:
+		return nil, &KernelKeyRingError{Msg: "unknown keyring: " + scope + ", use either 'session' or 'user'"}
+	}
+	// make sure that the keyring can be reached, rather than failing on the first key
+	if _, err := unix.KeyctlGetKeyringID(k.ring, true); err != nil {
+		return nil, &KernelKeyRingError{Msg: "couldnt get the " + scope + " keyring: " + err.Error()}
+	}
+	return k, nil
+}
+
+/*
+Find a key on the keyring
+
+	:param name: the name of the key
+*/
+func (k *KernelKeyRing) find(name string) (int, error) {
+	id, err := unix.KeyctlSearch(k.ring, kernelKeyType, KernelKeyPrefix+name, 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, KeyNotFound
+	}
+	if err != nil {
+		return 0, &KernelKeyRingError{Msg: "couldnt search for: " + name + " " + err.Error()}
+	}
+	return id, nil
+}
+
+/*
+Get a key from the kernel keyring
+
+	:param name: the name of the key
+*/
+func (k *KernelKeyRing) GetKey(name string) (Key, error) {
+	id, err := k.find(name)
+	if err != nil {
+		return storedKey{}, err
+	}
+	// a read without a buffer gets the size of the payload
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return storedKey{}, &KernelKeyRingError{Msg: "couldnt read: " + name + " " + err.Error()}
+	}
+	payload := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0)
+	if errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return storedKey{}, KeyNotFound
+	}
+	if err != nil {
+		return storedKey{}, &KernelKeyRingError{Msg: "couldnt read: " + name + " " + err.Error()}
+	}
+	var stored storedKey
+	if json.Unmarshal(payload[:n], &stored) != nil || stored.Type == "" {
+		return BearerAuth{Secret: string(payload[:n])}, nil
+	}
+	return fromStoredKey(stored), nil
+}
+
+/*
+Add a key to the kernel keyring, replacing the key if it is already there. The timeout starts over
+whenever a key is added.
+
+	    :param name: the name of the key
+		:param key: the key to add
+*/
+func (k *KernelKeyRing) AddKey(name string, key Key) error {
+	payload, err := json.Marshal(toStoredKey(key))
+	if err != nil {
+		return &KernelKeyRingError{Msg: err.Error()}
+	}
+	id, err := unix.AddKey(kernelKeyType, KernelKeyPrefix+name, payload, k.ring)
+	if err != nil {
+		return &KernelKeyRingError{Msg: "couldnt add: " + name + " " + err.Error()}
+	}
+	if k.Timeout > 0 {
+		seconds := int(k.Timeout.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, seconds, 0, 0); err != nil {
+			return &KernelKeyRingError{Msg: "couldnt set the timeout on: " + name + " " + err.Error()}
+		}
+	}
+	return nil
+}
+
+/*
+Remove a key from the kernel keyring. The key is invalidated rather than unlinked, so that it is gone from
+every keyring that it was linked to. Removing a key that isnt there isnt an error.
+
+	:param name: the name of the key
+*/
+func (k *KernelKeyRing) RemoveKey(name string) error {
+	id, err := k.find(name)
+	if errors.Is(err, KeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+		return &KernelKeyRingError{Msg: "couldnt remove: " + name + " " + err.Error()}
+	}
+	return nil
+}
+
+// Return the resource name for logging purposes
+func (k *KernelKeyRing) Source() string {
+	return "Kernel keyring: " + k.Scope
+}
+
+type KernelKeyRingError struct {
+	Msg string
+}
+
+func (k *KernelKeyRingError) Error() string {
+	return "There was an error with the kernel keyring: " + k.Msg
+}
+
+// Errors from the kernel keyring are handled like the errors of any other rung
+func (k *KernelKeyRingError) Unwrap() error {
+	return KeyRingError
+}
@@ -0,0 +1,81 @@
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestKernelKeyRing(t *testing.T, timeout time.Duration) *KernelKeyRing {
+	kr, err := NewKernelKeyRing(KernelScopeSession, timeout)
+	if err != nil {
+		t.Skip("the kernel keyring isnt available: ", err)
+	}
+	return kr
+}
+
+func TestKernelKeyRing(t *testing.T) {
+	kr := newTestKernelKeyRing(t, 0)
+	name := fmt.Sprintf("test-%d-basic", os.Getpid())
+	t.Cleanup(func() { kr.RemoveKey(name) })
+	if err := kr.AddKey(name, BasicAuth{Username: "admin", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.AddKey(name, BasicAuth{Username: "admin", Password: "rotated"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := kr.GetKey(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basic, ok := key.(BasicAuth); !ok || basic.Username != "admin" || basic.Password != "rotated" {
+		t.Errorf("expected the replaced basic auth, got: %#v", key)
+	}
+	if err := kr.RemoveKey(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.GetKey(name); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected a removed key to be not found, got: %v", err)
+	}
+	if err := kr.RemoveKey(name); err != nil {
+		t.Errorf("expected removing a missing key to be fine, got: %v", err)
+	}
+
+	// keys added with keyctl are read as bearer tokens
+	handAdded := fmt.Sprintf("test-%d-keyctl", os.Getpid())
+	if _, err := unix.AddKey("user", KernelKeyPrefix+handAdded, []byte("linode-token"), unix.KEY_SPEC_SESSION_KEYRING); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kr.RemoveKey(handAdded) })
+	key, err = kr.GetKey(handAdded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Prepare() != "Bearer linode-token" {
+		t.Errorf("expected a bearer token, got: %#v", key)
+	}
+}
+
+func TestKernelKeyRingTimeout(t *testing.T) {
+	kr := newTestKernelKeyRing(t, time.Second)
+	name := fmt.Sprintf("test-%d-timeout", os.Getpid())
+	t.Cleanup(func() { kr.RemoveKey(name) })
+	if err := kr.AddKey(name, BearerAuth{Secret: "short lived"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.GetKey(name); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := kr.GetKey(name); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected the key to have expired, got: %v", err)
+	}
+
+	if _, err := NewKernelKeyRing("thread", 0); err == nil {
+		t.Error("expected an unknown keyring to fail")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"time"
 
 	"git.aetherial.dev/aeth/yosai/pkg/config"
 	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
@@ -21,6 +22,7 @@ const (
 	BASIC_AUTH         = "basic_auth"
 	LOGIN_CRED         = "login_password"
 	WIREGUARD          = "wireguard"
+	WIREGUARD_PSK      = "wireguard_psk"
 )
 
 type WireguardKeypair struct {
@@ -41,6 +43,28 @@ func (w WireguardKeypair) GetType() string {
 	return WIREGUARD
 }
 
+/*
+A preshared key shared between a client and a server. The public part is the name of the pair,
+as the keyring rungs treat a key without a public part as missing
+*/
+type WireguardPresharedKey struct {
+	Pair string
+	Key  string
+}
+
+func (w WireguardPresharedKey) GetPublic() string {
+	return w.Pair
+}
+func (w WireguardPresharedKey) GetSecret() string {
+	return w.Key
+}
+func (w WireguardPresharedKey) Prepare() string {
+	return ""
+}
+func (w WireguardPresharedKey) GetType() string {
+	return WIREGUARD_PSK
+}
+
 type VpsRootUser struct {
 	Password string
 	Pubkey   string
@@ -92,7 +116,7 @@ func (b BasicAuth) Prepare() string {
 Return the 'public' identifier, which for basic auth it will return the username
 */
 func (b BasicAuth) GetPublic() string {
-	return b.Password
+	return b.Username
 }
 
 /*
@@ -159,6 +183,7 @@ type ApiKeyRing struct {
 	Keys      map[string]Key // hashmap with the keys in the keyring. Protected with getters and setters
 	Config    *config.Configuration
 	KeyTagger keytags.Keytagger
+	rungNames map[string]DaemonKeyRing // the rungs that were added with a name, see AddRung
 }
 
 /*
@@ -217,6 +242,38 @@ func (a *ApiKeyRing) AddKey(name string, key Key) error {
 	return nil
 }
 
+/*
+Add a key to the daemon keyring, and save it into the first rung so that it outlives the daemon.
+The first rung is the secrets backend. A key that is already on the keyring is replaced.
+
+	:param name: name to give the key, used when indexing
+	:param key: the Key struct to add to the keyring
+*/
+func (a *ApiKeyRing) StoreKey(name string, key Key) error {
+	if len(a.Rungs) > 0 {
+		if err := a.Rungs[0].AddKey(name, key); err != nil {
+			return err
+		}
+	}
+	a.Keys[name] = key
+	return nil
+}
+
+/*
+Remove a key from the daemon keyring and from the first rung, so that it is gone for good
+
+	:param name: the name that the key was given when storing it
+*/
+func (a *ApiKeyRing) DestroyKey(name string) error {
+	if len(a.Rungs) > 0 {
+		if err := a.Rungs[0].RemoveKey(name); err != nil {
+			return err
+		}
+	}
+	delete(a.Keys, name)
+	return nil
+}
+
 /*
 Remove a key from the daemon keyring
 
@@ -236,6 +293,32 @@ func (a *ApiKeyRing) Source() string {
 	return "Base API Keyring"
 }
 
+/*
+Open the system keyring that the host is configured with
+
+	    :param kind: one of the config.SystemKeyring constants
+		:param ttl: how long keys live on a kernel keyring, i.e. '8h', keys dont expire when empty
+*/
+func NewSystemKeyRing(kind string, ttl string) (DaemonKeyRing, error) {
+	var timeout time.Duration
+	if ttl != "" {
+		var err error
+		timeout, err = time.ParseDuration(ttl)
+		if err != nil {
+			return nil, &KernelKeyRingError{Msg: "invalid ttl: " + ttl + " " + err.Error()}
+		}
+	}
+	switch kind {
+	case config.SystemKeyringKernelSession:
+		return NewKernelKeyRing(KernelScopeSession, timeout)
+	case config.SystemKeyringKernelUser:
+		return NewKernelKeyRing(KernelScopeUser, timeout)
+	case config.SystemKeyringSecretService:
+		return NewSecretServiceKeyRing("", DefaultSecretCollection)
+	}
+	return nil, &KeyringBootstrapError{Msg: "unknown system keyring: " + kind}
+}
+
 /*
 Create a new daemon keyring. Passing additional implementers of the DaemonKeyRing will
 allow the GetKey() method on the toplevel keyring to search all subsequent keyrings for a match.
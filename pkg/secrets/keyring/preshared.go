@@ -0,0 +1,64 @@
+package keyring
+
+import (
+	"errors"
+
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+/*
+A keyring that can save keys beyond the life of the daemon, rather than only holding them in memory
+*/
+type KeyStore interface {
+	StoreKey(string, Key) error
+}
+
+/*
+Get the name of the preshared key for a client and server pair
+
+	    :param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param client: the name of the client
+		:param server: the name of the server
+*/
+func PresharedKeyname(keytagger keytags.Keytagger, client string, server string) string {
+	return client + "_" + server + "_" + keytagger.WgPresharedKeyname()
+}
+
+/*
+Get the preshared key for a client and server pair, generating it the first time that it is asked for.
+New keys are stored into the secrets backend when the keyring supports it, so that the servers can
+retrieve the same key.
+
+	    :param kr: the keyring to get the key from
+		:param name: the name of the key, see PresharedKeyname
+*/
+func PresharedKey(kr DaemonKeyRing, name string) (Key, error) {
+	key, err := kr.GetKey(name)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, KeyNotFound) {
+		return key, err
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return key, err
+	}
+	key = WireguardPresharedKey{Pair: name, Key: psk.String()}
+	return key, saveKey(kr, name, key)
+}
+
+/*
+Save a newly made key, into the secrets backend when the keyring supports it
+
+	    :param kr: the keyring to save the key to
+		:param name: the name of the key
+		:param key: the key to save
+*/
+func saveKey(kr DaemonKeyRing, name string, key Key) error {
+	if store, ok := kr.(KeyStore); ok {
+		return store.StoreKey(name, key)
+	}
+	return kr.AddKey(name, key)
+}
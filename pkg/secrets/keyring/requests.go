@@ -0,0 +1,411 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The names that rungs are registered under, so that keys can be written to a specific rung
+const (
+	RungVault     = "vault"
+	RungSemaphore = "semaphore"
+	RungLocal     = "local"
+	RungSystem    = "system"
+)
+
+/*
+A request for a key of one type, which checks that it has what the key needs
+*/
+type KeyRequest interface {
+	Validate() error // check that every field the key needs is set
+	Key() Key        // make the key that was asked for
+}
+
+type BearerAuthRequest struct {
+	Secret string `json:"secret"`
+}
+
+func (b BearerAuthRequest) Validate() error { return requireFields(BEARER_AUTH, "secret", b.Secret) }
+func (b BearerAuthRequest) Key() Key        { return BearerAuth{Secret: b.Secret} }
+
+type BasicAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (b BasicAuthRequest) Validate() error {
+	return requireFields(BASIC_AUTH, "username", b.Username, "password", b.Password)
+}
+func (b BasicAuthRequest) Key() Key { return BasicAuth{Username: b.Username, Password: b.Password} }
+
+type ClientCredentialsRequest struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+func (c ClientCredentialsRequest) Validate() error {
+	return requireFields(CLIENT_CREDENTIALS, "client_id", c.ClientId, "client_secret", c.ClientSecret)
+}
+func (c ClientCredentialsRequest) Key() Key {
+	return ClientCredentials{ClientId: c.ClientId, ClientSecret: c.ClientSecret}
+}
+
+type SshKeyRequest struct {
+	User       string `json:"user"`
+	PrivateKey string `json:"private_key"`
+}
+
+func (s SshKeyRequest) Validate() error {
+	if err := requireFields(SSH_KEY, "user", s.User, "private_key", s.PrivateKey); err != nil {
+		return err
+	}
+	if !strings.Contains(s.PrivateKey, "PRIVATE KEY") {
+		return &KeyRequestError{Type: SSH_KEY, Msg: "the private key isnt in PEM or OpenSSH format"}
+	}
+	return nil
+}
+func (s SshKeyRequest) Key() Key { return SshKey{User: s.User, PrivateKey: s.PrivateKey} }
+
+/*
+A wireguard keypair. The public key is worked out from the private key when it is left out.
+*/
+type WireguardKeypairRequest struct {
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+func (w WireguardKeypairRequest) Validate() error {
+	if err := requireFields(WIREGUARD, "private_key", w.PrivateKey); err != nil {
+		return err
+	}
+	private, err := wgtypes.ParseKey(w.PrivateKey)
+	if err != nil {
+		return &KeyRequestError{Type: WIREGUARD, Msg: "invalid private key: " + err.Error()}
+	}
+	if w.PublicKey != "" && w.PublicKey != private.PublicKey().String() {
+		return &KeyRequestError{Type: WIREGUARD, Msg: "the public key doesnt belong to the private key"}
+	}
+	return nil
+}
+func (w WireguardKeypairRequest) Key() Key {
+	private, _ := wgtypes.ParseKey(w.PrivateKey)
+	return WireguardKeypair{PrivateKey: w.PrivateKey, PublicKey: private.PublicKey().String()}
+}
+
+type WireguardPresharedKeyRequest struct {
+	Pair         string `json:"pair"`
+	PresharedKey string `json:"key"`
+}
+
+func (w WireguardPresharedKeyRequest) Validate() error {
+	if err := requireFields(WIREGUARD_PSK, "pair", w.Pair, "key", w.PresharedKey); err != nil {
+		return err
+	}
+	if _, err := wgtypes.ParseKey(w.PresharedKey); err != nil {
+		return &KeyRequestError{Type: WIREGUARD_PSK, Msg: "invalid preshared key: " + err.Error()}
+	}
+	return nil
+}
+func (w WireguardPresharedKeyRequest) Key() Key {
+	return WireguardPresharedKey{Pair: w.Pair, Key: w.PresharedKey}
+}
+
+/*
+The requests for each type of key, see canonicalKeyType for the other names that types go by
+*/
+var keyRequestTypes = map[string]func() KeyRequest{
+	BEARER_AUTH:        func() KeyRequest { return &BearerAuthRequest{} },
+	BASIC_AUTH:         func() KeyRequest { return &BasicAuthRequest{} },
+	CLIENT_CREDENTIALS: func() KeyRequest { return &ClientCredentialsRequest{} },
+	SSH_KEY:            func() KeyRequest { return &SshKeyRequest{} },
+	WIREGUARD:          func() KeyRequest { return &WireguardKeypairRequest{} },
+	WIREGUARD_PSK:      func() KeyRequest { return &WireguardPresharedKeyRequest{} },
+}
+
+/*
+Get the type that a key type is known as. Vault items may carry the legacy 'bearer' and 'basic' types, and
+Semaphore calls a username and password a 'login_password'
+
+	:param keyType: the type of a key
+*/
+func canonicalKeyType(keyType string) string {
+	switch keyType {
+	case "bearer":
+		return BEARER_AUTH
+	case "basic", LOGIN_CRED:
+		return BASIC_AUTH
+	}
+	return keyType
+}
+
+/*
+Check that every required field of a key request is set
+
+	    :param keyType: the type of key being requested, for the error message
+		:param fields: pairs of field names and their values
+*/
+func requireFields(keyType string, fields ...string) error {
+	missing := []string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if strings.TrimSpace(fields[i+1]) == "" {
+			missing = append(missing, fields[i])
+		}
+	}
+	if len(missing) > 0 {
+		return &KeyRequestError{Type: keyType, Msg: "missing required fields: " + strings.Join(missing, ", ")}
+	}
+	return nil
+}
+
+type KeyAddRequest struct {
+	Name string          `json:"name"`
+	Type string          `json:"type"` // the type of the key, which decides the shape of Key
+	Rung string          `json:"rung"` // the rung to write the key to, the first rung when empty
+	Key  json.RawMessage `json:"key"`  // the key, shaped like the KeyRequest for its type
+}
+
+/*
+Decode and validate the key that a request carries
+*/
+func (k KeyAddRequest) key() (Key, error) {
+	if strings.TrimSpace(k.Name) == "" {
+		return nil, &KeyRequestError{Type: k.Type, Msg: "keys need a name"}
+	}
+	newRequest, ok := keyRequestTypes[canonicalKeyType(k.Type)]
+	if !ok {
+		types := []string{}
+		for keyType := range keyRequestTypes {
+			types = append(types, keyType)
+		}
+		sort.Strings(types)
+		return nil, &KeyRequestError{Type: k.Type, Msg: "unknown key type, use one of: " + strings.Join(types, ", ")}
+	}
+	req := newRequest()
+	if len(k.Key) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(string(k.Key)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(req); err != nil {
+			return nil, &KeyRequestError{Type: k.Type, Msg: err.Error()}
+		}
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return req.Key(), nil
+}
+
+type KeyDeleteRequest struct {
+	Name string `json:"name"`
+	Rung string `json:"rung"` // the rung to remove the key from, the first rung when empty
+}
+
+/*
+Add a rung to the keyring under a name, so that keys can be written to it
+
+	    :param name: the name of the rung, one of the Rung constants
+		:param rung: the rung to add
+*/
+func (a *ApiKeyRing) AddRung(name string, rung DaemonKeyRing) {
+	if a.rungNames == nil {
+		a.rungNames = map[string]DaemonKeyRing{}
+	}
+	a.rungNames[name] = rung
+	a.Rungs = append(a.Rungs, rung)
+}
+
+/*
+Get the rung that keys are written to
+
+	:param name: the name the rung was added under, the first rung when empty
+*/
+func (a *ApiKeyRing) Rung(name string) (DaemonKeyRing, error) {
+	if name == "" {
+		if len(a.Rungs) == 0 {
+			return nil, &KeyRequestError{Msg: "the keyring doesnt have any rungs to write to"}
+		}
+		return a.Rungs[0], nil
+	}
+	rung, ok := a.rungNames[name]
+	if !ok {
+		names := []string{}
+		for rungName := range a.rungNames {
+			names = append(names, rungName)
+		}
+		sort.Strings(names)
+		return nil, &KeyRequestError{Msg: "unknown rung: " + name + ", the keyring has: " + strings.Join(names, ", ")}
+	}
+	return rung, nil
+}
+
+/*
+Check that a key can be changed through the daemon. Protected keys, like the vault token, only ever live in
+the daemons memory.
+
+	:param name: the name of the key
+*/
+func (a *ApiKeyRing) writable(name string) error {
+	if a.KeyTagger == nil {
+		return nil
+	}
+	if _, ok := a.KeyTagger.ProtectedKeys()[name]; ok {
+		return &KeyRequestError{Msg: "the key: " + name + " is protected, and cant be changed through the daemon"}
+	}
+	return nil
+}
+
+/*
+Add a new key to a rung, and to the daemon keyring
+
+	:param req: the request with the key and the rung to add it to
+*/
+func (a *ApiKeyRing) AddToRung(req KeyAddRequest) error {
+	key, err := req.key()
+	if err != nil {
+		return err
+	}
+	if err := a.writable(req.Name); err != nil {
+		return err
+	}
+	rung, err := a.Rung(req.Rung)
+	if err != nil {
+		return err
+	}
+	_, err = rung.GetKey(req.Name)
+	if err == nil {
+		return KeyExists
+	}
+	if !errors.Is(err, KeyNotFound) {
+		return err
+	}
+	if err := rung.AddKey(req.Name, key); err != nil {
+		return err
+	}
+	a.Keys[req.Name] = key
+	a.Log("Key:", req.Name, "added to:", rung.Source())
+	return nil
+}
+
+/*
+Replace a key on a rung with a new value, and replace it on the daemon keyring. The key has to already be
+on the rung, and keep its type.
+
+	:param req: the request with the new key and the rung that holds it
+*/
+func (a *ApiKeyRing) RotateOnRung(req KeyAddRequest) error {
+	key, err := req.key()
+	if err != nil {
+		return err
+	}
+	if err := a.writable(req.Name); err != nil {
+		return err
+	}
+	rung, err := a.Rung(req.Rung)
+	if err != nil {
+		return err
+	}
+	current, err := rung.GetKey(req.Name)
+	if err != nil {
+		return err
+	}
+	if canonicalKeyType(current.GetType()) != key.GetType() {
+		return &KeyRequestError{Type: key.GetType(), Msg: "the key: " + req.Name + " is a " + current.GetType() + " key, and has to be rotated with one"}
+	}
+	if err := rung.AddKey(req.Name, key); err != nil {
+		return err
+	}
+	a.Keys[req.Name] = key
+	a.Log("Key:", req.Name, "rotated on:", rung.Source())
+	return nil
+}
+
+/*
+Remove a key from a rung, and from the daemon keyring
+
+	:param req: the request with the key and the rung to remove it from
+*/
+func (a *ApiKeyRing) DeleteFromRung(req KeyDeleteRequest) error {
+	if strings.TrimSpace(req.Name) == "" {
+		return &KeyRequestError{Msg: "the name of the key to delete is needed"}
+	}
+	if err := a.writable(req.Name); err != nil {
+		return err
+	}
+	rung, err := a.Rung(req.Rung)
+	if err != nil {
+		return err
+	}
+	if err := rung.RemoveKey(req.Name); err != nil {
+		return err
+	}
+	delete(a.Keys, req.Name)
+	a.Log("Key:", req.Name, "removed from:", rung.Source())
+	return nil
+}
+
+/*
+Wrapping the add key function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (a *ApiKeyRing) AddKeyHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyAddRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if err := a.AddToRung(req); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Key: "+req.Name+" successfully added."))
+}
+
+/*
+Wrapping the rotate key function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (a *ApiKeyRing) RotateKeyHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyAddRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if err := a.RotateOnRung(req); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Key: "+req.Name+" successfully rotated."))
+}
+
+/*
+Wrapping the delete key function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (a *ApiKeyRing) DeleteKeyHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyDeleteRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if err := a.DeleteFromRung(req); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Key: "+req.Name+" successfully deleted."))
+}
+
+type KeyRequestError struct {
+	Type string
+	Msg  string
+}
+
+func (k *KeyRequestError) Error() string {
+	if k.Type == "" {
+		return "There was an error with the key request: " + k.Msg
+	}
+	return "There was an error with the " + k.Type + " key request: " + k.Msg
+}
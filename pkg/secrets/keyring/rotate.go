@@ -0,0 +1,287 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+)
+
+const (
+	DefaultKeyInterval   = 90 * 24 * time.Hour // the age that keypairs are due for rotation at when no interval is configured
+	DefaultKeyOverlap    = 24 * time.Hour      // how long previous keypairs are kept when no overlap is configured
+	DefaultKeyCheckEvery = time.Hour           // how often the ages of the keypairs are checked
+)
+
+type KeyRotationRequest struct {
+	Name string `json:"name"` // the client or server to rotate the keypair of
+}
+
+/*
+Makes the wireguard keypairs for clients and servers, and rotates them on request. After a rotation the
+previous keypair is kept on the keyring for the overlap, so that nodes still running with it can be moved
+over, and then it is destroyed.
+*/
+type KeyRotator struct {
+	Config    *config.Configuration
+	Keyring   *ApiKeyRing
+	KeyTagger keytags.Keytagger
+	mu        sync.Mutex
+	now       func() time.Time
+	trigger   chan struct{}
+}
+
+/*
+Create a new KeyRotator
+
+	    :param conf: the daemon configuration, with the clients, servers and the rotation settings
+		:param kr: the keyring that the keypairs are stored on
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+*/
+func NewKeyRotator(conf *config.Configuration, kr *ApiKeyRing, keytagger keytags.Keytagger) *KeyRotator {
+	return &KeyRotator{
+		Config:    conf,
+		Keyring:   kr,
+		KeyTagger: keytagger,
+		now:       time.Now,
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+// Logging wrapper
+func (k *KeyRotator) Log(msg ...string) {
+	kMsg := []string{"KeyRotator:"}
+	kMsg = append(kMsg, msg...)
+	k.Config.Log(kMsg...)
+}
+
+/*
+Make and store a keypair for a new client, returning its public key. This is what the configuration
+uses to make keypairs for clients that are added without one.
+
+	:param name: the name of the client
+*/
+func (k *KeyRotator) Generate(name string) (string, error) {
+	keypair, err := NewWireguardKeypair()
+	if err != nil {
+		return "", err
+	}
+	if err := k.Keyring.StoreKey(WireguardKeyname(k.KeyTagger, name), keypair); err != nil {
+		return "", &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	return keypair.PublicKey, nil
+}
+
+/*
+Replace the keypair of a client or server, keeping the previous keypair for the overlap
+
+	:param name: the name of the client or server
+*/
+func (k *KeyRotator) Rotate(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rotate(name, k.now())
+}
+
+func (k *KeyRotator) rotate(name string, now time.Time) error {
+	lifecycle, err := k.Config.KeyLifecycleOf(name)
+	if err != nil {
+		return &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	_, err = k.Config.GetClient(name)
+	isClient := err == nil
+	previous, err := k.Keyring.GetKey(WireguardKeyname(k.KeyTagger, name))
+	if errors.Is(err, KeyNotFound) {
+		if isClient {
+			// the client was added with its own public key, so only the client can replace it
+			return &KeyRotationError{Name: name, Msg: "the daemon doesnt hold the keypair, it has to be rotated on the client"}
+		}
+		previous = nil
+	} else if err != nil {
+		return &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	keypair, err := NewWireguardKeypair()
+	if err != nil {
+		return &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	lifecycle.Created = now
+	if previous != nil {
+		if err := k.Keyring.StoreKey(PreviousWireguardKeyname(k.KeyTagger, name), previous); err != nil {
+			return &KeyRotationError{Name: name, Msg: "couldnt keep the previous keypair: " + err.Error()}
+		}
+		lifecycle.PreviousExpires = now.Add(k.duration(k.Config.KeyRotation.Overlap, DefaultKeyOverlap))
+	}
+	if err := k.Keyring.StoreKey(WireguardKeyname(k.KeyTagger, name), keypair); err != nil {
+		return &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	var pubkey string
+	if isClient {
+		pubkey = keypair.PublicKey
+		if err := k.readdress(name, &lifecycle); err != nil {
+			return &KeyRotationError{Name: name, Msg: err.Error()}
+		}
+	}
+	if err := k.Config.SetKeyLifecycle(name, lifecycle, pubkey); err != nil {
+		return &KeyRotationError{Name: name, Msg: err.Error()}
+	}
+	k.Log("Rotated the keypair for:", name)
+	return nil
+}
+
+/*
+Move a rotated client onto a new VPN address, keeping the address it had for its previous keypair. Wireguard
+only routes an address to one peer, so both keypairs couldnt be let in during the overlap on the same address.
+The address of a keypair that was replaced before its overlap passed is given back.
+
+	    :param name: the name of the client
+		:param lifecycle: the lifecycle of the clients new keypair, its previous address is recorded on it
+*/
+func (k *KeyRotator) readdress(name string, lifecycle *config.KeyLifecycle) error {
+	addr, err := k.Config.GetAvailableVpnIpv4()
+	if err != nil {
+		return err
+	}
+	previous, err := k.Config.ReaddressClient(name, addr)
+	if err != nil {
+		k.Config.FreeAddress(addr.String())
+		return err
+	}
+	if lifecycle.PreviousVpnIpv4 != nil {
+		k.Config.FreeAddress(lifecycle.PreviousVpnIpv4.String())
+	}
+	lifecycle.PreviousVpnIpv4 = previous
+	return nil
+}
+
+/*
+Log every keypair that has reached the rotation interval, and destroy the previous keypairs whose overlap has
+passed. Keypairs that the daemon didnt make start aging from the first time they are seen. Keypairs that are due
+are only logged, since the servers have to be reconfigured for a rotation to take effect.
+*/
+func (k *KeyRotator) Tick() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	interval := k.duration(k.Config.KeyRotation.Interval, DefaultKeyInterval)
+	for _, name := range k.Config.KeyHolders() {
+		lifecycle, err := k.Config.KeyLifecycleOf(name)
+		if err != nil {
+			continue
+		}
+		if !lifecycle.PreviousExpires.IsZero() && !now.Before(lifecycle.PreviousExpires) {
+			if err := k.Keyring.DestroyKey(PreviousWireguardKeyname(k.KeyTagger, name)); err != nil {
+				k.Log("Couldnt destroy the previous keypair for:", name, err.Error())
+			} else {
+				lifecycle.PreviousExpires = time.Time{}
+				if lifecycle.PreviousVpnIpv4 != nil {
+					k.Config.FreeAddress(lifecycle.PreviousVpnIpv4.String())
+					lifecycle.PreviousVpnIpv4 = nil
+				}
+				k.Config.SetKeyLifecycle(name, lifecycle, "")
+			}
+		}
+		if _, err := k.Keyring.GetKey(WireguardKeyname(k.KeyTagger, name)); err != nil {
+			continue
+		}
+		if lifecycle.Created.IsZero() {
+			lifecycle.Created = now
+			k.Config.SetKeyLifecycle(name, lifecycle, "")
+			continue
+		}
+		if now.Sub(lifecycle.Created) < interval {
+			continue
+		}
+		// nothing redeploys the servers with a new keypair or a moved client, so keypairs are only rotated on request
+		if _, err := k.Config.GetServer(name); err == nil {
+			k.Log("The keypair for the server:", name, "is due for rotation, rotate it with 'keys rotate' and then reconfigure the server")
+			continue
+		}
+		k.Log("The keypair for the client:", name, "is due for rotation, rotate it with 'keys rotate' and then reconfigure the client and its servers")
+	}
+}
+
+/*
+Check the keypairs on the next loop, whether key rotation is enabled or not
+*/
+func (k *KeyRotator) Trigger() {
+	select {
+	case k.trigger <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Check the ages of the keypairs periodically while key rotation is enabled
+*/
+func (k *KeyRotator) Run() {
+	for {
+		forced := false
+		select {
+		case <-time.After(DefaultKeyCheckEvery):
+		case <-k.trigger:
+			forced = true
+		}
+		if forced || k.Config.KeyRotation.Enabled {
+			k.Tick()
+		}
+	}
+}
+
+/*
+Parse a duration from the configuration, falling back to a default when it is unset or invalid
+
+	    :param val: the duration to parse, i.e. '24h'
+		:param fallback: the duration to use when val cant be used
+*/
+func (k *KeyRotator) duration(val string, fallback time.Duration) time.Duration {
+	if strings.TrimSpace(val) == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		k.Log("Invalid duration:", val, "using:", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+/*
+Wrapping the rotate keypair function in a route friendly interface
+
+	:param msg: a message to be decoded from the daemon socket
+*/
+func (k *KeyRotator) RotateKeyHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	var req KeyRotationRequest
+	err := json.Unmarshal(msg.Body, &req)
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if req.Name == "" {
+		k.Trigger()
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, []byte("Keypair check started."))
+	}
+	if err := k.Rotate(req.Name); err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	if _, err := k.Config.GetServer(req.Name); err == nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK,
+			[]byte("Keypair for: "+req.Name+" rotated. The server has to be reconfigured with its new configuration, and its clients need their configurations rendered again."))
+	}
+	client, _ := k.Config.GetClient(req.Name)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK,
+		[]byte("Keypair for: "+req.Name+" rotated and moved to the address: "+client.VpnIpv4.String()+". The client and its servers need their configurations rendered again to pick up the new key."))
+}
+
+type KeyRotationError struct {
+	Name string
+	Msg  string
+}
+
+func (k *KeyRotationError) Error() string {
+	return "There was an error rotating the keypair for: " + k.Name + " " + k.Msg
+}
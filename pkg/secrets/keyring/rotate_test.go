@@ -0,0 +1,101 @@
+package keyring
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+)
+
+func TestKeyRotation(t *testing.T) {
+	conf := config.NewConfiguration(io.Discard, "test")
+	conf.KeyRotation.Interval = "48h"
+	conf.KeyRotation.Overlap = "1h"
+	kr := NewKeyRing(conf, keytags.ConstKeytag{})
+	rotator := NewKeyRotator(conf, kr, keytags.ConstKeytag{})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rotator.now = func() time.Time { return start }
+
+	pubkey, err := rotator.Generate("phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.AddClient(net.ParseIP("10.0.0.2"), pubkey, "phone")
+	conf.AddClient(net.ParseIP("10.0.0.3"), "byo", "laptop")
+	conf.AddServer(net.ParseIP("10.0.0.1"), "exit", "5.5.5.5", "", 51820)
+	_, space, _ := net.ParseCIDR("10.0.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	if err := conf.CalculateVpnSpace(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := WireguardKey(kr, keytags.ConstKeytag{}, "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first check starts the clock on the keypairs the daemon holds
+	rotator.Tick()
+	if lc, _ := conf.KeyLifecycleOf("exit"); !lc.Created.Equal(start) {
+		t.Errorf("expected the servers keypair to start aging, got: %+v", lc)
+	}
+
+	// keypairs that are due are only logged, since nothing reconfigures the servers with them
+	rotator.now = func() time.Time { return start.Add(49 * time.Hour) }
+	rotator.Tick()
+	if conf.Service.Clients["phone"].Pubkey != pubkey {
+		t.Error("expected the clients keypair to only be rotated on request")
+	}
+	if err := rotator.Rotate("phone"); err != nil {
+		t.Fatal(err)
+	}
+	client := conf.Service.Clients["phone"]
+	if client.Pubkey == pubkey {
+		t.Error("expected the clients keypair to be rotated")
+	}
+	current, _ := kr.GetKey(WireguardKeyname(keytags.ConstKeytag{}, "phone"))
+	if current.GetPublic() != client.Pubkey {
+		t.Errorf("the configuration has: %s, the keyring has: %s", client.Pubkey, current.GetPublic())
+	}
+	if previous, err := kr.GetKey(PreviousWireguardKeyname(keytags.ConstKeytag{}, "phone")); err != nil || previous.GetPublic() != pubkey {
+		t.Errorf("expected the previous keypair to be kept: %v", err)
+	}
+	// the previous keypair keeps the clients old address, since wireguard only routes an address to one peer
+	if client.VpnIpv4.Equal(net.ParseIP("10.0.0.2")) || !client.Key.PreviousVpnIpv4.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected the client to be moved to a new address, got: %s previous: %s", client.VpnIpv4, client.Key.PreviousVpnIpv4)
+	}
+	if !conf.Service.VpnAddresses[client.VpnIpv4.String()] || !conf.Service.VpnAddresses["10.0.0.2"] {
+		t.Error("expected both of the clients addresses to be in use")
+	}
+	if rotated, _ := kr.GetKey(WireguardKeyname(keytags.ConstKeytag{}, "exit")); rotated.GetPublic() != server.GetPublic() {
+		t.Error("expected the servers keypair to only be rotated on request")
+	}
+	if err := rotator.Rotate("exit"); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := kr.GetKey(WireguardKeyname(keytags.ConstKeytag{}, "exit")); rotated.GetPublic() == server.GetPublic() {
+		t.Error("expected the servers keypair to be rotated")
+	}
+	if conf.Service.Clients["laptop"].Pubkey != "byo" {
+		t.Error("a client with its own keypair shouldnt be rotated")
+	}
+	if err := rotator.Rotate("laptop"); err == nil {
+		t.Error("expected rotating a keypair the daemon doesnt hold to fail")
+	}
+
+	// the previous keypair is destroyed once the overlap has passed
+	rotator.now = func() time.Time { return start.Add(50 * time.Hour) }
+	rotator.Tick()
+	if _, err := kr.GetKey(PreviousWireguardKeyname(keytags.ConstKeytag{}, "phone")); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected the previous keypair to be destroyed, got: %v", err)
+	}
+	if lc, _ := conf.KeyLifecycleOf("phone"); !lc.PreviousExpires.IsZero() || lc.PreviousVpnIpv4 != nil {
+		t.Errorf("expected the overlap to be cleared, got: %+v", lc)
+	}
+	if conf.Service.VpnAddresses["10.0.0.2"] {
+		t.Error("expected the address of the previous keypair to be freed")
+	}
+}
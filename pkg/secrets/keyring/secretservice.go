@@ -0,0 +1,323 @@
+package keyring
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// The names that the freedesktop Secret Service is reached at
+const (
+	secretServiceName      = "org.freedesktop.secrets"
+	secretServicePath      = "/org/freedesktop/secrets"
+	secretServiceIface     = "org.freedesktop.Secret.Service"
+	secretSessionIface     = "org.freedesktop.Secret.Session"
+	secretCollectionIface  = "org.freedesktop.Secret.Collection"
+	secretItemIface        = "org.freedesktop.Secret.Item"
+	secretPromptIface      = "org.freedesktop.Secret.Prompt"
+	secretServiceNoPrompt  = dbus.ObjectPath("/")
+	secretServiceAlgorithm = "plain" // the secrets only ever cross the local bus, so they arent encrypted for the trip
+)
+
+// the collection that keys are kept in, which is the users login keychain on most desktops
+const DefaultSecretCollection = "default"
+
+// the application attribute on every item the daemon keeps, so its keys stand out in the desktop keychain
+const SecretServiceApplication = "yosai"
+
+// how long to wait for the user to answer an unlock prompt
+const DefaultSecretPromptTimeout = 2 * time.Minute
+
+/*
+A secret as the Secret Service sends it over the bus
+*/
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+/*
+Keeps keys in the desktop keychain, i.e. GNOME Keyring or KWallet, through the freedesktop Secret Service
+D-Bus API. Every item carries the attributes 'application', 'name', 'type' and 'public', and holds the secret
+of the key, so keys can also be added from the desktop, i.e.
+
+	secret-tool store --label='yosai: LINODE' application yosai name LINODE
+
+and an item without a type is read as a bearer token.
+*/
+type SecretServiceKeyRing struct {
+	Collection    dbus.ObjectPath
+	PromptTimeout time.Duration
+	conn          *dbus.Conn
+}
+
+/*
+Connect to the Secret Service and find the collection that keys are kept in
+
+	    :param address: the address of the bus that the Secret Service is on, the users session bus when empty
+		:param alias: the alias of the collection, DefaultSecretCollection when empty
+*/
+func NewSecretServiceKeyRing(address string, alias string) (*SecretServiceKeyRing, error) {
+	var conn *dbus.Conn
+	var err error
+	if address == "" {
+		conn, err = dbus.ConnectSessionBus()
+	} else {
+		conn, err = dbus.Connect(address)
+	}
+	if err != nil {
+		return nil, &SecretServiceError{Msg: "couldnt connect to the bus: " + err.Error()}
+	}
+	if alias == "" {
+		alias = DefaultSecretCollection
+	}
+	s := &SecretServiceKeyRing{PromptTimeout: DefaultSecretPromptTimeout, conn: conn}
+	err = s.service().Call(secretServiceIface+".ReadAlias", 0, alias).Store(&s.Collection)
+	if err != nil {
+		conn.Close()
+		return nil, &SecretServiceError{Msg: "couldnt reach the Secret Service: " + err.Error()}
+	}
+	if s.Collection == secretServiceNoPrompt {
+		conn.Close()
+		return nil, &SecretServiceError{Msg: "there is no collection with the alias: " + alias}
+	}
+	return s, nil
+}
+
+// Close the connection to the bus
+func (s *SecretServiceKeyRing) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SecretServiceKeyRing) service() dbus.BusObject {
+	return s.conn.Object(secretServiceName, secretServicePath)
+}
+
+func (s *SecretServiceKeyRing) object(path dbus.ObjectPath) dbus.BusObject {
+	return s.conn.Object(secretServiceName, path)
+}
+
+/*
+Open a session to move secrets over. The session has to be closed once the secrets are moved.
+*/
+func (s *SecretServiceKeyRing) openSession() (dbus.ObjectPath, error) {
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err := s.service().Call(secretServiceIface+".OpenSession", 0, secretServiceAlgorithm, dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		return session, &SecretServiceError{Msg: "couldnt open a session: " + err.Error()}
+	}
+	return session, nil
+}
+
+func (s *SecretServiceKeyRing) closeSession(session dbus.ObjectPath) {
+	s.object(session).Call(secretSessionIface+".Close", 0)
+}
+
+/*
+Wait for the user to answer a prompt, i.e. for the password that unlocks the keychain
+
+	:param prompt: the prompt to show
+*/
+func (s *SecretServiceKeyRing) prompt(prompt dbus.ObjectPath) error {
+	if prompt == secretServiceNoPrompt || prompt == "" {
+		return nil
+	}
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretPromptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return &SecretServiceError{Msg: "couldnt wait for the prompt: " + err.Error()}
+	}
+	defer s.conn.RemoveMatchSignal(match...)
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.object(prompt).Call(secretPromptIface+".Prompt", 0, "").Err; err != nil {
+		return &SecretServiceError{Msg: "couldnt show the prompt: " + err.Error()}
+	}
+	timeout := time.After(s.PromptTimeout)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != prompt || signal.Name != secretPromptIface+".Completed" {
+				continue
+			}
+			if len(signal.Body) > 0 {
+				if dismissed, ok := signal.Body[0].(bool); ok && dismissed {
+					return &SecretServiceError{Msg: "the prompt was dismissed"}
+				}
+			}
+			return nil
+		case <-timeout:
+			return &SecretServiceError{Msg: "the prompt wasnt answered within: " + s.PromptTimeout.String()}
+		}
+	}
+}
+
+/*
+Unlock items or collections, prompting the user when the keychain asks for it
+
+	:param paths: the items or collections to unlock
+*/
+func (s *SecretServiceKeyRing) unlock(paths ...dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := s.service().Call(secretServiceIface+".Unlock", 0, paths).Store(&unlocked, &prompt)
+	if err != nil {
+		return &SecretServiceError{Msg: "couldnt unlock the keychain: " + err.Error()}
+	}
+	return s.prompt(prompt)
+}
+
+/*
+Find the items that hold a key
+
+	:param name: the name of the key
+*/
+func (s *SecretServiceKeyRing) search(name string) ([]dbus.ObjectPath, error) {
+	var items []dbus.ObjectPath
+	attrs := map[string]string{"application": SecretServiceApplication, "name": name}
+	err := s.object(s.Collection).Call(secretCollectionIface+".SearchItems", 0, attrs).Store(&items)
+	if err != nil {
+		return nil, &SecretServiceError{Msg: "couldnt search for: " + name + " " + err.Error()}
+	}
+	return items, nil
+}
+
+/*
+Get a key from the desktop keychain
+
+	:param name: the name of the key
+*/
+func (s *SecretServiceKeyRing) GetKey(name string) (Key, error) {
+	items, err := s.search(name)
+	if err != nil {
+		return storedKey{}, err
+	}
+	if len(items) == 0 {
+		return storedKey{}, KeyNotFound
+	}
+	item := s.object(items[0])
+	if err := s.unlock(items[0]); err != nil {
+		return storedKey{}, err
+	}
+	session, err := s.openSession()
+	if err != nil {
+		return storedKey{}, err
+	}
+	defer s.closeSession(session)
+	var secret secretServiceSecret
+	if err := item.Call(secretItemIface+".GetSecret", 0, session).Store(&secret); err != nil {
+		return storedKey{}, &SecretServiceError{Msg: "couldnt get the secret of: " + name + " " + err.Error()}
+	}
+	prop, err := item.GetProperty(secretItemIface + ".Attributes")
+	if err != nil {
+		return storedKey{}, &SecretServiceError{Msg: "couldnt get the attributes of: " + name + " " + err.Error()}
+	}
+	attrs, _ := prop.Value().(map[string]string)
+	stored := storedKey{Type: attrs["type"], Public: attrs["public"], Secret: string(secret.Value)}
+	if stored.Type == "" {
+		stored.Type = BEARER_AUTH
+	}
+	return fromStoredKey(stored), nil
+}
+
+/*
+Add a key to the desktop keychain, replacing the key if it is already there
+
+	    :param name: the name of the key
+		:param key: the key to add
+*/
+func (s *SecretServiceKeyRing) AddKey(name string, key Key) error {
+	old, err := s.search(name)
+	if err != nil {
+		return err
+	}
+	if err := s.unlock(s.Collection); err != nil {
+		return err
+	}
+	session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer s.closeSession(session)
+	stored := toStoredKey(key)
+	props := map[string]dbus.Variant{
+		secretItemIface + ".Label": dbus.MakeVariant(SecretServiceApplication + ": " + name),
+		secretItemIface + ".Attributes": dbus.MakeVariant(map[string]string{
+			"application": SecretServiceApplication,
+			"name":        name,
+			"type":        stored.Type,
+			"public":      stored.Public,
+		}),
+	}
+	secret := secretServiceSecret{Session: session, Parameters: []byte{}, Value: []byte(stored.Secret), ContentType: "text/plain"}
+	var item, prompt dbus.ObjectPath
+	err = s.object(s.Collection).Call(secretCollectionIface+".CreateItem", 0, props, secret, true).Store(&item, &prompt)
+	if err != nil {
+		return &SecretServiceError{Msg: "couldnt add: " + name + " " + err.Error()}
+	}
+	if err := s.prompt(prompt); err != nil {
+		return err
+	}
+	// the attributes change with the key, so the item isnt always replaced in place
+	for _, path := range old {
+		if path == item {
+			continue
+		}
+		if err := s.deleteItem(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Remove a key from the desktop keychain. Removing a key that isnt there isnt an error.
+
+	:param name: the name of the key
+*/
+func (s *SecretServiceKeyRing) RemoveKey(name string) error {
+	items, err := s.search(name)
+	if err != nil {
+		return err
+	}
+	for _, path := range items {
+		if err := s.deleteItem(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SecretServiceKeyRing) deleteItem(path dbus.ObjectPath) error {
+	var prompt dbus.ObjectPath
+	if err := s.object(path).Call(secretItemIface+".Delete", 0).Store(&prompt); err != nil {
+		return &SecretServiceError{Msg: "couldnt delete: " + string(path) + " " + err.Error()}
+	}
+	return s.prompt(prompt)
+}
+
+// Return the resource name for logging purposes
+func (s *SecretServiceKeyRing) Source() string {
+	return "Secret Service collection: " + string(s.Collection)
+}
+
+type SecretServiceError struct {
+	Msg string
+}
+
+func (s *SecretServiceError) Error() string {
+	return "There was an error with the Secret Service: " + s.Msg
+}
+
+// Errors from the Secret Service are handled like the errors of any other rung
+func (s *SecretServiceError) Unwrap() error {
+	return KeyRingError
+}
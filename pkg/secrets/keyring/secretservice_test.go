@@ -0,0 +1,289 @@
+package keyring
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const fakeCollectionPath = dbus.ObjectPath("/org/freedesktop/secrets/collection/login")
+
+// a minimal session bus, so that the tests dont depend on how the host's dbus is set up
+const privateBusConfig = `<busconfig>
+  <type>session</type>
+  <listen>unix:dir=/tmp</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`
+
+/*
+Start a private D-Bus session, returning its address
+*/
+func newPrivateBus(t *testing.T) string {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon isnt installed")
+	}
+	conf := path.Join(t.TempDir(), "session.conf")
+	if err := os.WriteFile(conf, []byte(privateBusConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("dbus-daemon", "--config-file="+conf, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address)
+}
+
+/*
+A Secret Service with a single collection, which starts out locked
+*/
+type fakeSecretService struct {
+	conn   *dbus.Conn
+	mu     sync.Mutex
+	locked bool
+	items  map[dbus.ObjectPath]*fakeItem
+	serial int
+	// the number of times that the user was prompted
+	prompts int
+}
+
+type fakeItem struct {
+	service *fakeSecretService
+	path    dbus.ObjectPath
+	attrs   map[string]string
+	value   []byte
+}
+
+type fakePrompt struct {
+	service *fakeSecretService
+	path    dbus.ObjectPath
+}
+
+func newFakeSecretService(t *testing.T, address string) *fakeSecretService {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	reply, err := conn.RequestName(secretServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatal("couldnt own the Secret Service name: ", err)
+	}
+	f := &fakeSecretService{conn: conn, locked: true, items: map[dbus.ObjectPath]*fakeItem{}}
+	conn.Export(f, secretServicePath, secretServiceIface)
+	conn.Export(f, fakeCollectionPath, secretCollectionIface)
+	return f
+}
+
+// the number of prompts shown and items kept, read under the lock since the bus calls the service from its own goroutines
+func (f *fakeSecretService) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.prompts, len(f.items)
+}
+
+func (f *fakeSecretService) nextPath(base string) dbus.ObjectPath {
+	f.serial++
+	return dbus.ObjectPath(fmt.Sprintf("%s/%d", base, f.serial))
+}
+
+func (f *fakeSecretService) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	if name != DefaultSecretCollection {
+		return secretServiceNoPrompt, nil
+	}
+	return fakeCollectionPath, nil
+}
+
+func (f *fakeSecretService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != secretServiceAlgorithm {
+		return dbus.MakeVariant(""), "", dbus.NewError("org.freedesktop.DBus.Error.NotSupported", nil)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session := f.nextPath(secretServicePath + "/session")
+	f.conn.Export(f, session, secretSessionIface)
+	return dbus.MakeVariant(""), session, nil
+}
+
+func (f *fakeSecretService) Close() *dbus.Error {
+	return nil
+}
+
+func (f *fakeSecretService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.locked {
+		return objects, secretServiceNoPrompt, nil
+	}
+	prompt := &fakePrompt{service: f, path: f.nextPath(secretServicePath + "/prompt")}
+	f.conn.Export(prompt, prompt.path, secretPromptIface)
+	return []dbus.ObjectPath{}, prompt.path, nil
+}
+
+func (p *fakePrompt) Prompt(windowId string) *dbus.Error {
+	p.service.mu.Lock()
+	p.service.locked = false
+	p.service.prompts++
+	p.service.mu.Unlock()
+	p.service.conn.Emit(p.path, secretPromptIface+".Completed", false, dbus.MakeVariant([]dbus.ObjectPath{fakeCollectionPath}))
+	return nil
+}
+
+func (f *fakeSecretService) SearchItems(attrs map[string]string) ([]dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := []dbus.ObjectPath{}
+	for itemPath, item := range f.items {
+		matches := true
+		for k, v := range attrs {
+			if item.attrs[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			found = append(found, itemPath)
+		}
+	}
+	return found, nil
+}
+
+func (f *fakeSecretService) CreateItem(props map[string]dbus.Variant, secret secretServiceSecret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locked {
+		return "", "", dbus.NewError("org.freedesktop.Secret.Error.IsLocked", nil)
+	}
+	attrs, _ := props[secretItemIface+".Attributes"].Value().(map[string]string)
+	if replace {
+		for _, item := range f.items {
+			if fmt.Sprint(item.attrs) == fmt.Sprint(attrs) {
+				item.value = secret.Value
+				return item.path, secretServiceNoPrompt, nil
+			}
+		}
+	}
+	item := &fakeItem{service: f, path: f.nextPath(string(fakeCollectionPath)), attrs: attrs, value: secret.Value}
+	f.items[item.path] = item
+	f.conn.Export(item, item.path, secretItemIface)
+	f.conn.Export(item, item.path, "org.freedesktop.DBus.Properties")
+	return item.path, secretServiceNoPrompt, nil
+}
+
+func (i *fakeItem) GetSecret(session dbus.ObjectPath) (secretServiceSecret, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	if i.service.locked {
+		return secretServiceSecret{}, dbus.NewError("org.freedesktop.Secret.Error.IsLocked", nil)
+	}
+	return secretServiceSecret{Session: session, Parameters: []byte{}, Value: i.value, ContentType: "text/plain"}, nil
+}
+
+func (i *fakeItem) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	delete(i.service.items, i.path)
+	i.service.conn.Export(nil, i.path, secretItemIface)
+	i.service.conn.Export(nil, i.path, "org.freedesktop.DBus.Properties")
+	return secretServiceNoPrompt, nil
+}
+
+func (i *fakeItem) Get(iface string, prop string) (dbus.Variant, *dbus.Error) {
+	if iface == secretItemIface && prop == "Attributes" {
+		return dbus.MakeVariant(i.attrs), nil
+	}
+	return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", nil)
+}
+
+func TestSecretServiceKeyRing(t *testing.T) {
+	address := newPrivateBus(t)
+	service := newFakeSecretService(t, address)
+	kr, err := NewSecretServiceKeyRing(address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr.Close()
+
+	if _, err := kr.GetKey("LINODE"); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected a missing key to be not found, got: %v", err)
+	}
+	if err := kr.AddKey("SEMAPHORE", BasicAuth{Username: "admin", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if prompts, _ := service.counts(); prompts != 1 {
+		t.Errorf("expected the user to be prompted to unlock the keychain once, got: %d", prompts)
+	}
+	if err := kr.AddKey("SEMAPHORE", BasicAuth{Username: "root", Password: "rotated"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, items := service.counts(); items != 1 {
+		t.Errorf("expected the key to be replaced, got %d items", items)
+	}
+	key, err := kr.GetKey("SEMAPHORE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basic, ok := key.(BasicAuth); !ok || basic.Username != "root" || basic.Password != "rotated" {
+		t.Errorf("expected the replaced basic auth, got: %#v", key)
+	}
+	if err := kr.RemoveKey("SEMAPHORE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.GetKey("SEMAPHORE"); !errors.Is(err, KeyNotFound) {
+		t.Errorf("expected a removed key to be not found, got: %v", err)
+	}
+}
+
+func TestSecretServiceKeyRingDesktopItems(t *testing.T) {
+	address := newPrivateBus(t)
+	service := newFakeSecretService(t, address)
+	service.locked = false
+	// an item added with secret-tool only has the attributes that it was given
+	service.CreateItem(map[string]dbus.Variant{
+		secretItemIface + ".Attributes": dbus.MakeVariant(map[string]string{"application": SecretServiceApplication, "name": "LINODE"}),
+	}, secretServiceSecret{Value: []byte("linode-token")}, false)
+
+	kr, err := NewSecretServiceKeyRing(address, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr.Close()
+	key, err := kr.GetKey("LINODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Prepare() != "Bearer linode-token" {
+		t.Errorf("expected a bearer token, got: %#v", key)
+	}
+
+	if _, err := NewSecretServiceKeyRing(address, "work"); err == nil {
+		t.Error("expected a missing collection to fail")
+	}
+	service.conn.Close()
+	if _, err := kr.GetKey("LINODE"); !errors.Is(err, KeyRingError) {
+		t.Errorf("expected the Secret Service going away to be a keyring error, got: %v", err)
+	}
+}
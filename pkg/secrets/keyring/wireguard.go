@@ -0,0 +1,63 @@
+package keyring
+
+import (
+	"errors"
+
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+/*
+Get the name of a client or servers wireguard keypair
+
+	    :param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param name: the name of the client or server
+*/
+func WireguardKeyname(keytagger keytags.Keytagger, name string) string {
+	return name + "_" + keytagger.WgKeypairKeyname()
+}
+
+/*
+Get the name that a client or servers previous wireguard keypair is kept under after a rotation
+
+	    :param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param name: the name of the client or server
+*/
+func PreviousWireguardKeyname(keytagger keytags.Keytagger, name string) string {
+	return name + "_PREVIOUS_" + keytagger.WgKeypairKeyname()
+}
+
+/*
+Make a new Curve25519 keypair for a wireguard interface
+*/
+func NewWireguardKeypair() (WireguardKeypair, error) {
+	private, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return WireguardKeypair{}, err
+	}
+	return WireguardKeypair{PrivateKey: private.String(), PublicKey: private.PublicKey().String()}, nil
+}
+
+/*
+Get a client or servers wireguard keypair, making it the first time that it is asked for. New keypairs
+are stored into the secrets backend when the keyring supports it, so that the servers can retrieve them.
+
+	    :param kr: the keyring to get the keypair from
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param name: the name of the client or server
+*/
+func WireguardKey(kr DaemonKeyRing, keytagger keytags.Keytagger, name string) (Key, error) {
+	keyname := WireguardKeyname(keytagger, name)
+	key, err := kr.GetKey(keyname)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, KeyNotFound) {
+		return key, err
+	}
+	keypair, err := NewWireguardKeypair()
+	if err != nil {
+		return key, err
+	}
+	return keypair, saveKey(kr, keyname, keypair)
+}
@@ -3,6 +3,7 @@ package semaphore
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -145,6 +146,7 @@ type NewRepoResponse struct {
 }
 
 type AddKeyRequest struct {
+	Id            int           `json:"id,omitempty"` // the ID of the key being replaced, only set when updating a key
 	Name          string        `json:"name"`
 	Type          string        `json:"type"`
 	ProjectId     int           `json:"project_id"`
@@ -260,30 +262,47 @@ func (s SemaphoreConnection) GetKey(name string) (keyring.Key, error) {
 }
 
 /*
-Add SSH Key to a project
+Add SSH Key to a project, replacing the key if the project already has one with the same name
 
 	:param name: the name to assign the key in the project
 	:param keyring: a keyring.DaemonKeyRing implementer that can return the API key for Semaphore
 	:param key: a keyring.Key implementer wrapping the SSH key
 */
 func (s SemaphoreConnection) AddKey(name string, key keyring.Key) error {
-	_, err := s.GetKeyId(name)
-	if err == nil { // return if the key exists
-		return nil
+	req, ok := key.(AddKeyRequest)
+	if !ok {
+		req = s.NewKeyRequestBuilder(name, key).(AddKeyRequest)
+	}
+	id, err := s.GetKeyId(name)
+	var notFound *KeyNotFound
+	if errors.As(err, &notFound) {
+		req.Id = 0
+		_, err = s.Post(fmt.Sprintf("%s/%v/keys", ProjectPath, s.ProjectId), bytes.NewReader([]byte(req.Prepare())))
+		return err
 	}
-	path := fmt.Sprintf("%s/%v/keys", ProjectPath, s.ProjectId)
-	_, err = s.Post(path, bytes.NewReader([]byte(key.Prepare())))
 	if err != nil {
 		return err
 	}
-	return nil
+	req.Id = id
+	_, err = s.Put(fmt.Sprintf("%s/%v/keys/%v", ProjectPath, s.ProjectId, id), bytes.NewReader([]byte(req.Prepare())))
+	return err
 }
 
 /*
-Drop a key from the Semaphore secret store
+Drop a key from the Semaphore secret store. Removing a key that isnt there isnt an error.
+
+	:param name: the name of the key in the project
 */
 func (s SemaphoreConnection) RemoveKey(name string) error {
-	_, err := s.Delete(name)
+	id, err := s.GetKeyId(name)
+	var notFound *KeyNotFound
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.Delete(fmt.Sprintf("%s/%v/keys/%v", ProjectPath, s.ProjectId, id))
 	return err
 }
 
@@ -540,9 +559,33 @@ func (s SemaphoreConnection) Get(path string) ([]byte, error) {
 
 /*
 Generic DELETE method for calling the Semaphore server
+
+	:param path: the path of the resource to delete, relative to the server url
 */
 func (s SemaphoreConnection) Delete(path string) ([]byte, error) {
-	return []byte{}, nil
+	var b []byte
+	apikey, err := s.Keyring.GetKey(s.KeyTagger.SemaphoreApiKeyname())
+	if err != nil {
+		return b, &SemaphoreClientError{Msg: err.Error()}
+	}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s://%s/%s", s.HttpProto, s.ServerUrl, strings.TrimPrefix(path, "/")), nil)
+	if err != nil {
+		return b, &SemaphoreClientError{Msg: err.Error()}
+	}
+	req.Header.Add("Authorization", apikey.Prepare())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return b, &SemaphoreClientError{Msg: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return b, &SemaphoreClientError{Msg: resp.Status}
+	}
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return b, &SemaphoreClientError{Msg: err.Error()}
+	}
+	return b, nil
 }
 
 /*
@@ -823,6 +866,28 @@ func (s SemaphoreConnection) RemoveHostFromInv(name string, host ...string) erro
 
 }
 
+/*
+Get the hosts in an inventory, keyed by their WAN address with the server name as the value
+
+	:param name: the name of the inventory
+*/
+func (s SemaphoreConnection) GetInventoryHosts(name string) (map[string]string, error) {
+	hosts := map[string]string{}
+	resp, err := s.GetInventoryByName(name)
+	if err != nil {
+		return hosts, err
+	}
+	var inv YamlInventory
+	err = yaml.Unmarshal([]byte(resp.Inventory), &inv)
+	if err != nil {
+		return hosts, &SemaphoreClientError{Msg: "Error unmarshalling inventory from server: " + resp.Inventory + err.Error()}
+	}
+	for addr, vars := range inv.All.Hosts {
+		hosts[addr] = vars.Name
+	}
+	return hosts, nil
+}
+
 /*
 Add hosts to inventory
 */
@@ -1346,17 +1411,29 @@ type yamlVars struct {
 	MachineType          string                   `yaml:"machine_type"`
 	MachineSubType       string                   `yaml:"machine_subtype"`
 	VpnNetworkAddress    string                   `yaml:"vpn_network_address"`
+	VpnNetworkAddressV6  string                   `yaml:"vpn_network_address_v6"`
+	WanIpv6              string                   `yaml:"wan_ipv6"`
 	VpnServerPort        int                      `yaml:"vpn_server_port"`
 	Clients              map[string]yamlVpnClient `yaml:"clients"`
 	SecretsProvider      string                   `yaml:"secrets_provider"`
 	VpnNetMask           int                      `yaml:"vpn_netmask"`
+	VpnNetworkV6         string                   `yaml:"vpn_network_v6"`
 	Name                 string                   `yaml:"name"`
+	DnsResolver          bool                     `yaml:"dns_resolver"` // run a resolver for the clients on the servers VPN addresses
+	DnsServers           []string                 `yaml:"dns_servers"`
+	DnsUpstream          string                   `yaml:"dns_upstream"`
+	DnsUpstreamServers   []string                 `yaml:"dns_upstream_servers"`
+	VpnMtu               int                      `yaml:"vpn_mtu"` // 0 leaves the MTU to wireguard
+	VpnFwMark            int                      `yaml:"vpn_fwmark"`
+	VpnTable             string                   `yaml:"vpn_table"`
 }
 
 type yamlVpnClient struct {
-	Name   string `yaml:"name"`
-	Ipv4   string `yaml:"ipv4"`
-	Pubkey string `yaml:"pubkey"`
+	Name             string `yaml:"name"`
+	Ipv4             string `yaml:"ipv4"`
+	Ipv6             string `yaml:"ipv6"`
+	Pubkey           string `yaml:"pubkey"`
+	PresharedKeyName string `yaml:"preshared_key_name"` // the name of the preshared key in the secrets provider, empty when there isnt one
 }
 
 /*
@@ -1367,24 +1444,46 @@ YAML inventory builder function
 func (s SemaphoreConnection) YamlInventoryBuilder(hosts []config.VpnServer) YamlInventory {
 
 	hostmap := map[string]yamlVars{}
-	clientmap := map[string]yamlVpnClient{}
 	clients := s.Config.VpnClients()
-	for i := range clients {
-		client := clients[i]
-		clientmap[client.Name] = yamlVpnClient{Name: client.Name, Ipv4: client.VpnIpv4.String(), Pubkey: client.Pubkey}
-	}
 	for i := range hosts {
 		server := hosts[i]
+		// make sure that the servers keypair is in the secrets provider before the playbook goes looking for it
+		if _, err := keyring.WireguardKey(s.Keyring, s.KeyTagger, server.Name); err != nil {
+			s.Log("Couldnt create the wireguard keypair for:", server.Name, err.Error())
+		}
+		clientmap := map[string]yamlVpnClient{}
+		for j := range clients {
+			client := clients[j]
+			var pskName string
+			if config.ClientTunnelOptions(client, server).PresharedKey {
+				pskName = keyring.PresharedKeyname(s.KeyTagger, client.Name, server.Name)
+				// make sure that the key is in the secrets provider before the playbook goes looking for it
+				if _, err := keyring.PresharedKey(s.Keyring, pskName); err != nil {
+					s.Log("Couldnt create the preshared key:", pskName, err.Error())
+				}
+			}
+			clientmap[client.Name] = yamlVpnClient{Name: client.Name, Ipv4: client.VpnIpv4.String(), Ipv6: config.IpString(client.VpnIpv6), Pubkey: client.Pubkey, PresharedKeyName: pskName}
+		}
 		hostmap[hosts[i].WanIpv4] = yamlVars{
 			AnsibleSshCommonArgs: "-o StrictHostKeyChecking=no",
 			MachineType:          "vpn",
 			MachineSubType:       "server",
 			VpnNetworkAddress:    server.VpnIpv4.String(),
+			VpnNetworkAddressV6:  config.IpString(server.VpnIpv6),
+			WanIpv6:              server.WanIpv6,
 			VpnServerPort:        server.Port,
 			Clients:              clientmap,
 			SecretsProvider:      s.Config.Service.SecretsBackend,
 			VpnNetMask:           s.Config.Service.VpnMask,
-			Name:                 server.Name}
+			VpnNetworkV6:         s.Config.VpnNetworkV6(),
+			Name:                 server.Name,
+			DnsResolver:          s.Config.ExitNodeResolver(),
+			DnsServers:           s.Config.DnsServers(server),
+			DnsUpstream:          s.Config.DnsUpstream(),
+			DnsUpstreamServers:   s.Config.Dns.UpstreamServers,
+			VpnMtu:               server.Options.MTU,
+			VpnFwMark:            server.Options.FwMark,
+			VpnTable:             server.Options.Table}
 	}
 	return YamlInventory{
 		All: yamlInvAll{
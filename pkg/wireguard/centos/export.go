@@ -0,0 +1,326 @@
+package wg
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"net/netip"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The formats that client configurations can be exported in
+const (
+	FormatWgQuick        = "wg-quick"
+	FormatNetworkManager = "networkmanager" // a NetworkManager keyfile, for /etc/NetworkManager/system-connections
+	FormatNetworkd       = "networkd"       // a systemd-networkd .netdev and .network pair, for /etc/systemd/network
+	FormatUci            = "uci"            // an OpenWrt UCI section, for /etc/config/network
+	FormatJson           = "json"
+)
+
+/*
+The firewall mark and routing table that a full tunnel uses when its configuration doesnt set them. This is
+the same scheme that wg-quick uses, so that exported configs route the same way the wg-quick ones do.
+*/
+const fullTunnelMark = 51820
+
+// the longest name that the kernel allows for an interface
+const maxInterfaceName = 15
+
+//go:embed networkmanager.nmconnection.templ
+var nmTmpl string
+
+//go:embed networkd.netdev.templ
+var netdevTmpl string
+
+//go:embed networkd.network.templ
+var networkTmpl string
+
+//go:embed openwrt.uci.templ
+var uciTmpl string
+
+/*
+A client configuration with its lists split out, which is the shape that the export formats need
+*/
+type ExportSeed struct {
+	Name       string       `json:"name"`      // the name of the connection
+	Interface  string       `json:"interface"` // the name of the interface that the connection comes up on
+	PrivateKey string       `json:"private_key"`
+	Addresses  []string     `json:"addresses"`
+	Dns        []string     `json:"dns"`
+	MTU        int          `json:"mtu,omitempty"`
+	ListenPort int          `json:"listen_port,omitempty"`
+	FwMark     int          `json:"fwmark,omitempty"`
+	Table      string       `json:"table,omitempty"`
+	FullTunnel bool         `json:"full_tunnel"` // a peer routes every address, so the peers endpoints have to be routed around the tunnel
+	Peers      []ExportPeer `json:"peers"`
+}
+
+type ExportPeer struct {
+	Name                string   `json:"name"`
+	PublicKey           string   `json:"public_key"`
+	PresharedKey        string   `json:"preshared_key,omitempty"`
+	Endpoint            string   `json:"endpoint"`
+	Host                string   `json:"-"`
+	Port                int      `json:"-"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+type ExportFile struct {
+	Name     string // the file name, without a directory
+	Contents []byte
+}
+
+/*
+The systemd-networkd settings that depend on how the tunnel routes
+*/
+type networkdSeed struct {
+	ExportSeed
+	Mark       int
+	RouteTable string
+	Policy     bool // route everything through the tunnel with policy rules, like wg-quick does
+}
+
+/*
+The OpenWrt settings that depend on the UCI naming rules
+*/
+type uciSeed struct {
+	ExportSeed
+	Section string
+}
+
+/*
+Split a client configuration seed up for the export formats
+
+	    :param seed: the seed that the client configuration is rendered from
+		:param name: the name of the connection
+		:param ifname: the name of the interface, cut down to the longest name the kernel allows
+*/
+func NewExportSeed(seed WireguardTemplateSeed, name string, ifname string) ExportSeed {
+	if len(ifname) > maxInterfaceName {
+		ifname = ifname[:maxInterfaceName]
+	}
+	export := ExportSeed{
+		Name:       name,
+		Interface:  ifname,
+		PrivateKey: seed.VpnClientPrivateKey,
+		Addresses:  splitList(seed.VpnClientAddress),
+		Dns:        splitList(seed.Dns),
+		MTU:        seed.MTU,
+		ListenPort: seed.ListenPort,
+		FwMark:     seed.FwMark,
+		Table:      seed.Table,
+		Peers:      []ExportPeer{},
+	}
+	for _, peer := range seed.Peers {
+		allowed := splitList(peer.AllowedIPs)
+		for _, cidr := range allowed {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Bits() == 0 {
+				export.FullTunnel = true
+			}
+		}
+		export.Peers = append(export.Peers, ExportPeer{
+			Name:                peer.Name,
+			PublicKey:           peer.Pubkey,
+			PresharedKey:        peer.PresharedKey,
+			Endpoint:            joinHostPort(peer.Address, peer.Port),
+			Host:                peer.Address,
+			Port:                peer.Port,
+			AllowedIPs:          allowed,
+			PersistentKeepalive: peer.PersistentKeepalive,
+		})
+	}
+	return export
+}
+
+/*
+Render a client configuration in one of the export formats. Most formats are a single file, systemd-networkd
+needs a .netdev and a .network file.
+
+	    :param seed: the seed that the client configuration is rendered from
+		:param format: one of the Format constants, FormatWgQuick when empty
+		:param name: the name of the connection, which the files are named after
+		:param ifname: the name of the interface that the connection comes up on
+*/
+func ExportClientConfiguration(seed WireguardTemplateSeed, format string, name string, ifname string) ([]ExportFile, error) {
+	export := NewExportSeed(seed, name, ifname)
+	switch format {
+	case "", FormatWgQuick:
+		b, err := RenderClientConfiguration(seed)
+		if err != nil {
+			return nil, err
+		}
+		return []ExportFile{{Name: name + ".conf", Contents: b}}, nil
+	case FormatNetworkManager:
+		b, err := renderExport(nmTmpl, "networkmanager.nmconnection.templ", export)
+		if err != nil {
+			return nil, &ExportError{Format: format, Msg: err.Error()}
+		}
+		return []ExportFile{{Name: name + ".nmconnection", Contents: b}}, nil
+	case FormatNetworkd:
+		netSeed := networkdSeed{ExportSeed: export}
+		if tableNumber(export.Table) != 0 {
+			netSeed.RouteTable = export.Table
+		} else if export.Table != "off" {
+			netSeed.RouteTable = "main"
+		}
+		netSeed.Mark = export.FwMark
+		if export.FullTunnel && export.Table != "off" {
+			netSeed.Policy = true
+			if netSeed.Mark == 0 {
+				netSeed.Mark = fullTunnelMark
+			}
+			if netSeed.RouteTable == "main" {
+				netSeed.RouteTable = strconv.Itoa(fullTunnelMark)
+			}
+		}
+		netdev, err := renderExport(netdevTmpl, "networkd.netdev.templ", netSeed)
+		if err != nil {
+			return nil, &ExportError{Format: format, Msg: err.Error()}
+		}
+		network, err := renderExport(networkTmpl, "networkd.network.templ", netSeed)
+		if err != nil {
+			return nil, &ExportError{Format: format, Msg: err.Error()}
+		}
+		return []ExportFile{{Name: name + ".netdev", Contents: netdev}, {Name: name + ".network", Contents: network}}, nil
+	case FormatUci:
+		b, err := renderExport(uciTmpl, "openwrt.uci.templ", uciSeed{ExportSeed: export, Section: uciSection(export.Interface)})
+		if err != nil {
+			return nil, &ExportError{Format: format, Msg: err.Error()}
+		}
+		return []ExportFile{{Name: name + ".uci", Contents: b}}, nil
+	case FormatJson:
+		b, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			return nil, &ExportError{Format: format, Msg: err.Error()}
+		}
+		return []ExportFile{{Name: name + ".json", Contents: append(b, '\n')}}, nil
+	}
+	return nil, &ExportError{Format: format, Msg: "unknown format, use one of: " + strings.Join(ExportFormats(), ", ")}
+}
+
+/*
+Get every format that client configurations can be exported in
+*/
+func ExportFormats() []string {
+	return []string{FormatWgQuick, FormatNetworkManager, FormatNetworkd, FormatUci, FormatJson}
+}
+
+/*
+Render one of the export templates
+
+	    :param text: the template
+		:param name: the name that the template defines
+		:param data: the data to render the template with
+*/
+func renderExport(text string, name string, data any) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"ipv4":        func(list []string) []string { return familyOf(list, false) },
+		"ipv6":        func(list []string) []string { return familyOf(list, true) },
+		"inc":         func(i int) int { return i + 1 },
+		"join":        strings.Join,
+		"tableNumber": tableNumber,
+		"uci":         uciQuote,
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(buff, data); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+/*
+Split a comma separated list from a seed, i.e. '10.0.0.2/32, fd00::2/128'
+
+	:param val: the list to split
+*/
+func splitList(val string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+/*
+Get the addresses or prefixes of one family from a list
+
+	    :param list: the addresses or prefixes to filter
+		:param v6: keep the IPv6 ones rather than the IPv4 ones
+*/
+func familyOf(list []string, v6 bool) []string {
+	kept := []string{}
+	for _, item := range list {
+		addr, err := netip.ParseAddr(strings.Split(item, "/")[0])
+		if err == nil && addr.Is6() == v6 {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+/*
+Get the number of a routing table, or 0 when the table is 'off', 'auto' or unset
+
+	:param table: the routing table option
+*/
+func tableNumber(table string) int {
+	n, err := strconv.Atoi(table)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+/*
+Join a host and port into an endpoint, bracketing IPv6 addresses
+
+	    :param host: the address or hostname
+		:param port: the port
+*/
+func joinHostPort(host string, port int) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + strconv.Itoa(port)
+	}
+	return host + ":" + strconv.Itoa(port)
+}
+
+/*
+Turn an interface name into a UCI section name, which can only hold letters, digits and underscores
+
+	:param name: the interface name
+*/
+func uciSection(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+/*
+Quote a value for a UCI file. UCI values are single quoted like in a shell, so a single quote has to
+close the quotes, be escaped, and open them again
+
+	:param val: the value to quote
+*/
+func uciQuote(val string) string {
+	return "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+}
+
+type ExportError struct {
+	Format string
+	Msg    string
+}
+
+func (e *ExportError) Error() string {
+	return "There was an error exporting the configuration as: " + e.Format + " " + e.Msg
+}
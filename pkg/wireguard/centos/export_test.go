@@ -0,0 +1,77 @@
+package wg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var exportSeed = WireguardTemplateSeed{
+	VpnClientPrivateKey: "clientpriv",
+	VpnClientAddress:    "10.8.0.2/32, fd00::2/128",
+	Dns:                 "10.8.0.1",
+	Peers: []WireguardTemplatePeer{
+		{Name: "exit's", Pubkey: "serverpub", Address: "5.5.5.5", Port: 51820, AllowedIPs: "0.0.0.0/0, ::/0", PersistentKeepalive: 25},
+	},
+}
+
+func TestExportNetworkd(t *testing.T) {
+	files, err := ExportClientConfiguration(exportSeed, FormatNetworkd, "phone-exit", "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "phone-exit.netdev" || files[1].Name != "phone-exit.network" {
+		t.Fatalf("expected a .netdev and a .network file, got: %+v", files)
+	}
+	netdev, network := string(files[0].Contents), string(files[1].Contents)
+	for _, want := range []string{"Name=exit\n", "FirewallMark=51820\n", "RouteTable=51820\n", "AllowedIPs=0.0.0.0/0,::/0\n", "Endpoint=5.5.5.5:51820\n"} {
+		if !strings.Contains(netdev, want) {
+			t.Errorf("expected the .netdev to contain: %q\n%s", want, netdev)
+		}
+	}
+	for _, want := range []string{"Address=fd00::2/128\n", "DNS=10.8.0.1\n", "SuppressPrefixLength=0\n", "InvertRule=true\n"} {
+		if !strings.Contains(network, want) {
+			t.Errorf("expected the .network to contain: %q\n%s", want, network)
+		}
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	files, err := ExportClientConfiguration(exportSeed, FormatUci, "phone-exit", "exit-node-with-a-long-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uci := string(files[0].Contents)
+	for _, want := range []string{"config interface 'exit_node_with_'\n", "config wireguard_exit_node_with_\n", `option description 'exit'\''s'`, "list allowed_ips '::/0'\n"} {
+		if !strings.Contains(uci, want) {
+			t.Errorf("expected the UCI section to contain: %q\n%s", want, uci)
+		}
+	}
+
+	files, err = ExportClientConfiguration(exportSeed, FormatNetworkManager, "phone-exit", "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := string(files[0].Contents)
+	for _, want := range []string{"[wireguard-peer.serverpub]\n", "allowed-ips=0.0.0.0/0;::/0;\n", "[ipv4]\nmethod=manual\naddress1=10.8.0.2/32\ndns=10.8.0.1;\n", "[ipv6]\nmethod=manual\naddress1=fd00::2/128\n"} {
+		if !strings.Contains(nm, want) {
+			t.Errorf("expected the keyfile to contain: %q\n%s", want, nm)
+		}
+	}
+
+	files, err = ExportClientConfiguration(exportSeed, FormatJson, "phone-exit", "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export ExportSeed
+	if err := json.Unmarshal(files[0].Contents, &export); err != nil {
+		t.Fatal(err)
+	}
+	if !export.FullTunnel || len(export.Addresses) != 2 || export.Peers[0].Endpoint != "5.5.5.5:51820" {
+		t.Errorf("unexpected JSON export: %+v", export)
+	}
+
+	if _, err := ExportClientConfiguration(exportSeed, "openvpn", "phone-exit", "exit"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,48 @@
+package wg
+
+import (
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// the width and height of saved QR codes in pixels
+const QrPngSize = 512
+
+/*
+Render a configuration file as a QR code that can be printed to a terminal, for scanning into
+the wireguard mobile apps
+
+	:param cfg: the rendered configuration file, see RenderClientConfiguration
+*/
+func RenderQrCode(cfg []byte) (string, error) {
+	qr, err := qrcode.New(string(cfg), qrcode.Medium)
+	if err != nil {
+		return "", &QrCodeError{Msg: err.Error()}
+	}
+	return qr.ToSmallString(false), nil
+}
+
+/*
+Render a configuration file as a QR code PNG image
+
+	    :param cfg: the rendered configuration file, see RenderClientConfiguration
+		:param size: the width and height of the image in pixels
+*/
+func RenderQrPng(cfg []byte, size int) ([]byte, error) {
+	qr, err := qrcode.New(string(cfg), qrcode.Medium)
+	if err != nil {
+		return nil, &QrCodeError{Msg: err.Error()}
+	}
+	b, err := qr.PNG(size)
+	if err != nil {
+		return nil, &QrCodeError{Msg: err.Error()}
+	}
+	return b, nil
+}
+
+type QrCodeError struct {
+	Msg string
+}
+
+func (q *QrCodeError) Error() string {
+	return "There was an error rendering the configuration as a QR code: " + q.Msg
+}
@@ -0,0 +1,33 @@
+package wg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderQrCode(t *testing.T) {
+	cfg, err := RenderClientConfiguration(WireguardTemplateSeed{
+		VpnClientPrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		VpnClientAddress:    "10.0.0.2/32",
+		Peers:               []WireguardTemplatePeer{{Pubkey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", Address: "5.5.5.5", Port: 51820, AllowedIPs: "0.0.0.0/0, ::/0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qr, err := RenderQrCode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(qr, "\n"), "\n")
+	if len(lines) < 10 || !strings.ContainsAny(qr, "█▀▄") {
+		t.Errorf("unexpected terminal QR code:\n%s", qr)
+	}
+	png, err := RenderQrPng(cfg, QrPngSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Errorf("expected a PNG image, got: %q", png[:8])
+	}
+}
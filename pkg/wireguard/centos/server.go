@@ -0,0 +1,183 @@
+package wg
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"text/template"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+//go:embed wireguard-server.conf.templ
+var serverConfTmpl string
+
+type ServerTemplateSeed struct {
+	PrivateKey string
+	Address    string // the servers VPN addresses with the prefix length of the VPN address space
+	ListenPort int
+	MTU        int
+	FwMark     int
+	Table      string
+	Peers      []ServerTemplatePeer
+}
+
+type ServerTemplatePeer struct {
+	Name         string
+	Pubkey       string
+	PresharedKey string
+	AllowedIPs   string // the clients own VPN addresses, servers never route anything else to a client
+}
+
+/*
+Build the seed for a servers wireguard configuration, with a peer for every client in the configuration, and
+for the previous keypair of every client that is still within its overlap. This is for provisioning a
+server, so the servers keypair and any missing preshared keys are made on the keyring.
+
+	    :param conf: the daemon configuration, used for the VPN address space and the peer list
+		:param kr: a keyring.DaemonKeyRing implementer to get the keys from, and to make the missing ones on
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param server: the VPN server that the configuration is for
+*/
+func NewServerTemplateSeed(conf *config.Configuration, kr keyring.DaemonKeyRing, keytagger keytags.Keytagger, server config.VpnServer) (ServerTemplateSeed, error) {
+	return newServerTemplateSeed(conf, kr, keytagger, server, true)
+}
+
+/*
+Build the seed for a servers wireguard configuration from the keys that already exist, without making any
+on the keyring, so that showing what a server should be running never changes it. A server or preshared
+key that is missing is an error, since the server cant have been configured with it.
+
+	    :param conf: the daemon configuration, used for the VPN address space and the peer list
+		:param kr: a keyring.DaemonKeyRing implementer to get the keys from
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param server: the VPN server that the configuration is for
+*/
+func ReadServerTemplateSeed(conf *config.Configuration, kr keyring.DaemonKeyRing, keytagger keytags.Keytagger, server config.VpnServer) (ServerTemplateSeed, error) {
+	return newServerTemplateSeed(conf, kr, keytagger, server, false)
+}
+
+/*
+Build the seed for a servers wireguard configuration
+
+	    :param conf: the daemon configuration, used for the VPN address space and the peer list
+		:param kr: a keyring.DaemonKeyRing implementer to get the keys from
+		:param keytagger: a keytags.Keytagger implementer to resolve key names with
+		:param server: the VPN server that the configuration is for
+		:param generate: whether the missing keys are made on the keyring, rather than being an error
+*/
+func newServerTemplateSeed(conf *config.Configuration, kr keyring.DaemonKeyRing, keytagger keytags.Keytagger, server config.VpnServer, generate bool) (ServerTemplateSeed, error) {
+	var seed ServerTemplateSeed
+	var serverKeypair keyring.Key
+	var err error
+	if generate {
+		serverKeypair, err = keyring.WireguardKey(kr, keytagger, server.Name)
+	} else {
+		serverKeypair, err = kr.GetKey(keyring.WireguardKeyname(keytagger, server.Name))
+	}
+	if err != nil {
+		return seed, &ServerConfigError{Server: server.Name, Msg: "couldnt get the wireguard keypair: " + err.Error()}
+	}
+	mask, _ := conf.Service.VpnAddressSpace.Mask.Size()
+	address := fmt.Sprintf("%s/%v", server.VpnIpv4.String(), mask)
+	if server.VpnIpv6 != nil {
+		maskV6, _ := conf.Service.VpnAddressSpaceV6.Mask.Size()
+		address = fmt.Sprintf("%s, %s/%v", address, server.VpnIpv6.String(), maskV6)
+	}
+	port := server.Port
+	if port == 0 {
+		port = conf.Service.VpnServerPort
+	}
+	clients := conf.VpnClients()
+	// the clients are held in a map, so they are sorted to keep the rendered configuration stable
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	now := time.Now()
+	peers := []ServerTemplatePeer{}
+	for _, client := range clients {
+		var psk string
+		if config.ClientTunnelOptions(client, server).PresharedKey {
+			name := keyring.PresharedKeyname(keytagger, client.Name, server.Name)
+			var key keyring.Key
+			if generate {
+				key, err = keyring.PresharedKey(kr, name)
+			} else {
+				key, err = kr.GetKey(name)
+			}
+			if err != nil {
+				return seed, &ServerConfigError{Server: server.Name, Msg: "couldnt get the preshared key for: " + client.Name + " " + err.Error()}
+			}
+			psk = key.GetSecret()
+		}
+		// a client that hasnt been moved over to its new keypair yet is still let in while the overlap lasts, on the
+		// address that was kept for its previous keypair since wireguard only routes an address to one peer
+		if client.Key.PreviousExpires.After(now) && client.Key.PreviousVpnIpv4 != nil {
+			previous, err := kr.GetKey(keyring.PreviousWireguardKeyname(keytagger, client.Name))
+			if err == nil {
+				peers = append(peers, ServerTemplatePeer{
+					Name:         client.Name + " (previous keypair)",
+					Pubkey:       previous.GetPublic(),
+					PresharedKey: psk,
+					AllowedIPs:   allowedIps(client.Key.PreviousVpnIpv4, conf.VpnIpv6For(client.Key.PreviousVpnIpv4)),
+				})
+			} else if !errors.Is(err, keyring.KeyNotFound) {
+				return seed, &ServerConfigError{Server: server.Name, Msg: "couldnt get the previous keypair for: " + client.Name + " " + err.Error()}
+			}
+		}
+		peers = append(peers, ServerTemplatePeer{Name: client.Name, Pubkey: client.Pubkey, PresharedKey: psk, AllowedIPs: allowedIps(client.VpnIpv4, client.VpnIpv6)})
+	}
+	return ServerTemplateSeed{
+		PrivateKey: serverKeypair.GetSecret(),
+		Address:    address,
+		ListenPort: port,
+		MTU:        server.Options.MTU,
+		FwMark:     server.Options.FwMark,
+		Table:      server.Options.Table,
+		Peers:      peers,
+	}, nil
+}
+
+/*
+Get the addresses a peer is allowed to use as host prefixes, i.e. '10.0.0.2/32, fd00::2/128'
+
+	    :param v4: the peers IPv4 address on the VPN
+		:param v6: the peers IPv6 address on the VPN, nil when the VPN has no IPv6 address space
+*/
+func allowedIps(v4 net.IP, v6 net.IP) string {
+	allowed := v4.String() + "/32"
+	if v6 != nil {
+		allowed = allowed + ", " + v6.String() + "/128"
+	}
+	return allowed
+}
+
+/*
+Render out a servers configuration file, with its interface and a peer block for each of its clients
+
+	:param seed: a ServerTemplateSeed struct that contains all the info needed to populate the config file
+*/
+func RenderServerConfiguration(seed ServerTemplateSeed) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	tmpl, err := template.New("wireguard-server.conf.templ").Parse(serverConfTmpl)
+	if err != nil {
+		return buff.Bytes(), &ServerConfigError{Msg: err.Error()}
+	}
+	if err = tmpl.Execute(buff, seed); err != nil {
+		return buff.Bytes(), &ServerConfigError{Msg: err.Error()}
+	}
+	return buff.Bytes(), nil
+}
+
+type ServerConfigError struct {
+	Server string
+	Msg    string
+}
+
+func (s *ServerConfigError) Error() string {
+	return "There was an error rendering the wireguard configuration for server: " + s.Server + " " + s.Msg
+}
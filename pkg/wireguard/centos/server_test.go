@@ -0,0 +1,142 @@
+package wg
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+	"git.aetherial.dev/aeth/yosai/pkg/keytags"
+	"git.aetherial.dev/aeth/yosai/pkg/secrets/keyring"
+)
+
+func TestRenderServerConfiguration(t *testing.T) {
+	conf := config.NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	conf.Service.VpnServerPort = 51820
+	conf.AddClient(net.ParseIP("10.8.0.3"), "bobpub", "bob")
+	conf.AddClient(net.ParseIP("10.8.0.2"), "alicepub", "alice")
+	alice := conf.Service.Clients["alice"]
+	alice.Options.PresharedKey = true
+	conf.Service.Clients["alice"] = alice
+	server := config.VpnServer{Name: "exit", VpnIpv4: net.ParseIP("10.8.0.1"), Options: config.TunnelOptions{MTU: 1380}}
+
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	kr.AddKey("exit_"+keytags.ConstKeytag{}.WgKeypairKeyname(), keyring.WireguardKeypair{PrivateKey: "serverpriv", PublicKey: "serverpub"})
+	seed, err := NewServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := RenderServerConfiguration(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := kr.GetKey(keyring.PresharedKeyname(keytags.ConstKeytag{}, "alice", "exit"))
+	if err != nil {
+		t.Fatalf("expected the preshared key to be generated: %s", err)
+	}
+	want := "[Interface]\n" +
+		"PrivateKey = serverpriv\n" +
+		"Address = 10.8.0.1/24\n" +
+		"ListenPort = 51820\n" +
+		"MTU = 1380\n" +
+		"\n[Peer]\n# alice\nPublicKey = alicepub\nPresharedKey = " + psk.GetSecret() + "\nAllowedIPs = 10.8.0.2/32\n" +
+		"\n[Peer]\n# bob\nPublicKey = bobpub\nAllowedIPs = 10.8.0.3/32\n"
+	if string(b) != want {
+		t.Errorf("unexpected server config:\n got: %q\nwant: %q", b, want)
+	}
+}
+
+func TestRenderServerConfigurationOverlap(t *testing.T) {
+	conf := config.NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	_, spaceV6, _ := net.ParseCIDR("fd00::/64")
+	conf.Service.VpnAddressSpaceV6 = *spaceV6
+	conf.Service.VpnServerPort = 51820
+	conf.AddClient(net.ParseIP("10.8.0.2"), "alicepub", "alice")
+	conf.AddClient(net.ParseIP("10.8.0.3"), "bobpub", "bob")
+	conf.SetKeyLifecycle("alice", config.KeyLifecycle{PreviousExpires: time.Now().Add(time.Hour), PreviousVpnIpv4: net.ParseIP("10.8.0.4")}, "")
+	conf.SetKeyLifecycle("bob", config.KeyLifecycle{PreviousExpires: time.Now().Add(-time.Hour), PreviousVpnIpv4: net.ParseIP("10.8.0.5")}, "")
+	server := config.VpnServer{Name: "exit", VpnIpv4: net.ParseIP("10.8.0.1")}
+
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	kr.AddKey(keyring.WireguardKeyname(keytags.ConstKeytag{}, "exit"), keyring.WireguardKeypair{PrivateKey: "serverpriv", PublicKey: "serverpub"})
+	kr.AddKey(keyring.PreviousWireguardKeyname(keytags.ConstKeytag{}, "alice"), keyring.WireguardKeypair{PrivateKey: "oldpriv", PublicKey: "aliceoldpub"})
+	kr.AddKey(keyring.PreviousWireguardKeyname(keytags.ConstKeytag{}, "bob"), keyring.WireguardKeypair{PrivateKey: "oldpriv", PublicKey: "boboldpub"})
+	seed, err := NewServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wireguard only routes an address to one peer, so every peer needs addresses of its own
+	routed := map[string]string{}
+	for _, peer := range seed.Peers {
+		if peer.AllowedIPs == "" {
+			t.Errorf("expected the peer: %s to have allowed IPs", peer.Name)
+		}
+		for _, prefix := range strings.Split(peer.AllowedIPs, ", ") {
+			if other, ok := routed[prefix]; ok {
+				t.Errorf("expected %s to only be routed to one peer, got: %s and %s", prefix, other, peer.Name)
+			}
+			routed[prefix] = peer.Name
+		}
+	}
+	b, err := RenderServerConfiguration(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[Interface]\n" +
+		"PrivateKey = serverpriv\n" +
+		"Address = 10.8.0.1/24\n" +
+		"ListenPort = 51820\n" +
+		"\n[Peer]\n# alice (previous keypair)\nPublicKey = aliceoldpub\nAllowedIPs = 10.8.0.4/32, fd00::4/128\n" +
+		"\n[Peer]\n# alice\nPublicKey = alicepub\nAllowedIPs = 10.8.0.2/32, fd00::2/128\n" +
+		"\n[Peer]\n# bob\nPublicKey = bobpub\nAllowedIPs = 10.8.0.3/32, fd00::3/128\n"
+	if string(b) != want {
+		t.Errorf("unexpected server config:\n got: %q\nwant: %q", b, want)
+	}
+}
+
+func TestReadServerTemplateSeed(t *testing.T) {
+	conf := config.NewConfiguration(io.Discard, "test")
+	_, space, _ := net.ParseCIDR("10.8.0.0/24")
+	conf.Service.VpnAddressSpace = *space
+	conf.AddClient(net.ParseIP("10.8.0.2"), "alicepub", "alice")
+	alice := conf.Service.Clients["alice"]
+	alice.Options.PresharedKey = true
+	conf.Service.Clients["alice"] = alice
+	server := config.VpnServer{Name: "exit", VpnIpv4: net.ParseIP("10.8.0.1")}
+	kr := keyring.NewKeyRing(conf, keytags.ConstKeytag{})
+	pskName := keyring.PresharedKeyname(keytags.ConstKeytag{}, "alice", "exit")
+
+	if _, err := ReadServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server); err == nil {
+		t.Fatal("expected a server without a keypair to fail")
+	}
+	if _, err := kr.GetKey(keyring.WireguardKeyname(keytags.ConstKeytag{}, "exit")); !errors.Is(err, keyring.KeyNotFound) {
+		t.Errorf("expected no keypair to be made for the server, got: %v", err)
+	}
+	kr.AddKey(keyring.WireguardKeyname(keytags.ConstKeytag{}, "exit"), keyring.WireguardKeypair{PrivateKey: "serverpriv", PublicKey: "serverpub"})
+	if _, err := ReadServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server); err == nil || !strings.Contains(err.Error(), "alice") {
+		t.Errorf("expected a missing preshared key to fail, got: %v", err)
+	}
+	if _, err := kr.GetKey(pskName); !errors.Is(err, keyring.KeyNotFound) {
+		t.Errorf("expected no preshared key to be made, got: %v", err)
+	}
+
+	provisioned, err := NewServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadServerTemplateSeed(conf, kr, keytags.ConstKeytag{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(provisioned, read) {
+		t.Errorf("expected the provisioned keys to be read back:\n got: %+v\nwant: %+v", read, provisioned)
+	}
+}
@@ -6,18 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+	"strconv"
+	"strings"
 	"text/template"
-)
-
-const (
-	ExitSetupSuccess = 0
-	ExitSetupFailed  = 1
-)
-
-const (
-	ENV_WG_TUN_FD             = "WG_TUN_FD"
-	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
-	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	"time"
 )
 
 //go:embed wireguard.conf.templ
@@ -26,13 +18,22 @@ var confTmpl string
 type WireguardTemplateSeed struct {
 	VpnClientPrivateKey string
 	VpnClientAddress    string
+	Dns                 string // the resolvers to use through the tunnel, comma separated. No DNS line is rendered when empty
+	MTU                 int
+	ListenPort          int
+	FwMark              int
+	Table               string
 	Peers               []WireguardTemplatePeer
 }
 
 type WireguardTemplatePeer struct {
-	Pubkey  string
-	Address string
-	Port    int
+	Name                string // the server that the peer is, for the formats that can describe their peers
+	Pubkey              string
+	PresharedKey        string
+	Address             string
+	Port                int
+	AllowedIPs          string
+	PersistentKeepalive int
 }
 
 /*
@@ -57,192 +58,43 @@ func RenderClientConfiguration(wgData WireguardTemplateSeed) ([]byte, error) {
 }
 
 /*
-Start a wireguard interface
+Start or stop a wireguard interface with wg-quick. The daemon manages its interfaces natively by
+default, see pkg/wireguard/iface, this is kept for hosts that are set up to use wg-quick.
+
+	    :param intfName: the interface name, or the path of its configuration file
+		:param state: either 'up' or 'down'
 */
 func ChangeWgInterfaceState(intfName string, state string) ([]byte, error) {
 	wgCmd := exec.Command("wg-quick", state, intfName)
 	return wgCmd.Output()
-	/*
-	   var foreground bool
-
-	   	if !foreground {
-	   		foreground = os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1"
-	   	}
-
-	   // get log level (default: info)
-
-	   	logLevel := func() int {
-	   		switch os.Getenv("LOG_LEVEL") {
-	   		case "verbose", "debug":
-	   			return device.LogLevelVerbose
-	   		case "error":
-	   			return device.LogLevelError
-	   		case "silent":
-	   			return device.LogLevelSilent
-	   		}
-	   		return device.LogLevelError
-	   	}()
-
-	   // open TUN device (or use supplied fd)
-
-	   	tdev, err := func() (tun.Device, error) {
-	   		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
-	   		if tunFdStr == "" {
-	   			return tun.CreateTUN(intfName, device.DefaultMTU)
-	   		}
-
-	   		// construct tun device from supplied fd
-
-	   		fd, err := strconv.ParseUint(tunFdStr, 10, 32)
-	   		if err != nil {
-	   			return nil, err
-	   		}
-
-	   		err = unix.SetNonblock(int(fd), true)
-	   		if err != nil {
-	   			return nil, err
-	   		}
-
-	   		file := os.NewFile(uintptr(fd), "")
-	   		return tun.CreateTUNFromFile(file, device.DefaultMTU)
-	   	}()
-
-	   	if err == nil {
-	   		realInterfaceName, err2 := tdev.Name()
-	   		if err2 == nil {
-	   			intfName = realInterfaceName
-	   		}
-	   	}
-
-	   logger := device.NewLogger(
-
-	   	logLevel,
-	   	fmt.Sprintf("(%s) ", intfName),
-
-	   )
-
-	   	if err != nil {
-	   		logger.Errorf("Failed to create TUN device: %v", err)
-	   		os.Exit(ExitSetupFailed)
-	   	}
-
-	   // open UAPI file (or use supplied fd)
-
-	   	fileUAPI, err := func() (*os.File, error) {
-	   		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
-	   		if uapiFdStr == "" {
-	   			return ipc.UAPIOpen(intfName)
-	   		}
-
-	   		// use supplied fd
-
-	   		fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
-	   		if err != nil {
-	   			return nil, err
-	   		}
-
-	   		return os.NewFile(uintptr(fd), ""), nil
-	   	}()
-
-	   	if err != nil {
-	   		logger.Errorf("UAPI listen error: %v", err)
-	   		os.Exit(ExitSetupFailed)
-	   		return
-	   	}
-
-	   // daemonize the process
-
-	   	if !foreground {
-	   		env := os.Environ()
-	   		env = append(env, fmt.Sprintf("%s=3", ENV_WG_TUN_FD))
-	   		env = append(env, fmt.Sprintf("%s=4", ENV_WG_UAPI_FD))
-	   		env = append(env, fmt.Sprintf("%s=1", ENV_WG_PROCESS_FOREGROUND))
-	   		files := [3]*os.File{}
-	   		if os.Getenv("LOG_LEVEL") != "" && logLevel != device.LogLevelSilent {
-	   			files[0], _ = os.Open(os.DevNull)
-	   			files[1] = os.Stdout
-	   			files[2] = os.Stderr
-	   		} else {
-	   			files[0], _ = os.Open(os.DevNull)
-	   			files[1], _ = os.Open(os.DevNull)
-	   			files[2], _ = os.Open(os.DevNull)
-	   		}
-	   		attr := &os.ProcAttr{
-	   			Files: []*os.File{
-	   				files[0], // stdin
-	   				files[1], // stdout
-	   				files[2], // stderr
-	   				tdev.File(),
-	   				fileUAPI,
-	   			},
-	   			Dir: ".",
-	   			Env: env,
-	   		}
-
-	   		path, err := os.Executable()
-	   		if err != nil {
-	   			logger.Errorf("Failed to determine executable: %v", err)
-	   			os.Exit(ExitSetupFailed)
-	   		}
-
-	   		process, err := os.StartProcess(
-	   			path,
-	   			os.Args,
-	   			attr,
-	   		)
-	   		if err != nil {
-	   			logger.Errorf("Failed to daemonize: %v", err)
-	   			os.Exit(ExitSetupFailed)
-	   		}
-	   		process.Release()
-	   		return
-	   	}
-
-	   device := device.NewDevice(tdev, conn.NewDefaultBind(), logger)
-
-	   logger.Verbosef("Device started")
-
-	   errs := make(chan error)
-	   term := make(chan os.Signal, 1)
-
-	   uapi, err := ipc.UAPIListen(intfName, fileUAPI)
-
-	   	if err != nil {
-	   		logger.Errorf("Failed to listen on uapi socket: %v", err)
-	   		os.Exit(ExitSetupFailed)
-	   	}
-
-	   	go func() {
-	   		for {
-	   			conn, err := uapi.Accept()
-	   			if err != nil {
-	   				errs <- err
-	   				return
-	   			}
-	   			go device.IpcHandle(conn)
-	   		}
-	   	}()
-
-	   logger.Verbosef("UAPI listener started")
-
-	   // wait for program to terminate
-
-	   signal.Notify(term, unix.SIGTERM)
-	   signal.Notify(term, os.Interrupt)
-
-	   select {
-	   case <-term:
-	   case <-errs:
-	   case <-device.Wait():
-	   }
-
-	   // clean up
+}
 
-	   uapi.Close()
-	   device.Close()
+/*
+Get the most recent handshake on a wireguard interface, across all of its peers. The zero time is
+returned if no peer has completed a handshake yet.
 
-	   logger.Verbosef("Shutting down")
-	*/
+	:param intfName: the name of the wireguard interface
+*/
+func LatestHandshake(intfName string) (time.Time, error) {
+	var latest time.Time
+	out, err := exec.Command("wg", "show", intfName, "latest-handshakes").Output()
+	if err != nil {
+		return latest, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || secs == 0 {
+			continue
+		}
+		if handshake := time.Unix(secs, 0); handshake.After(latest) {
+			latest = handshake
+		}
+	}
+	return latest, nil
 }
 
 type TemplatingError struct {
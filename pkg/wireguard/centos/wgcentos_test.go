@@ -1 +1,51 @@
 package wg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderClientDns(t *testing.T) {
+	seed := WireguardTemplateSeed{
+		VpnClientPrivateKey: "key",
+		VpnClientAddress:    "10.0.0.2/32",
+		Peers:               []WireguardTemplatePeer{{Pubkey: "pub", Address: "5.5.5.5", Port: 51820, AllowedIPs: "0.0.0.0/0"}},
+	}
+	b, err := RenderClientConfiguration(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "DNS") {
+		t.Errorf("rendered a DNS line without any servers:\n%s", b)
+	}
+	seed.Dns = "10.0.0.1, fd00::1"
+	b, err = RenderClientConfiguration(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "Address = 10.0.0.2/32\nDNS = 10.0.0.1, fd00::1\n") {
+		t.Errorf("expected the DNS line under the address:\n%s", b)
+	}
+}
+
+func TestRenderClientOptions(t *testing.T) {
+	seed := WireguardTemplateSeed{
+		VpnClientPrivateKey: "key",
+		VpnClientAddress:    "10.0.0.2/32",
+		MTU:                 1380,
+		Table:               "off",
+		Peers:               []WireguardTemplatePeer{{Pubkey: "pub", PresharedKey: "psk", Address: "5.5.5.5", Port: 51820, AllowedIPs: "0.0.0.0/0", PersistentKeepalive: 25}},
+	}
+	b, err := RenderClientConfiguration(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"MTU = 1380\n", "Table = off\n", "PresharedKey = psk\n", "PersistentKeepalive = 25\n"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("expected %q in:\n%s", line, b)
+		}
+	}
+	if strings.Contains(string(b), "ListenPort") || strings.Contains(string(b), "FwMark") {
+		t.Errorf("rendered options that werent set:\n%s", b)
+	}
+}
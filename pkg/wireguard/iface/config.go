@@ -0,0 +1,263 @@
+package iface
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const DefaultMTU = 1420
+
+/*
+A local wireguard interface, as described by a wg-quick style configuration file
+*/
+type TunnelConfig struct {
+	Name       string
+	PrivateKey wgtypes.Key
+	Addresses  []net.IPNet // the addresses of the interface, with the IP kept rather than masked off
+	ListenPort int
+	MTU        int
+	DNS        []string
+	FwMark     int    // marks the tunnels own packets, DefaultFwMark is used for full tunnels when it isnt set
+	Table      string // where the routes to the peers go, 'off', 'auto' or a table number, like wg-quick
+	Peers      []PeerConfig
+}
+
+type PeerConfig struct {
+	PublicKey           wgtypes.Key
+	PresharedKey        *wgtypes.Key
+	Endpoint            string
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive time.Duration
+}
+
+/*
+Get the name of the interface for a configuration file, which like wg-quick is the name of the file
+
+	:param conf: the path of the configuration file
+*/
+func InterfaceName(conf string) string {
+	return strings.TrimSuffix(path.Base(conf), ".conf")
+}
+
+/*
+Read a wg-quick style configuration file, naming the interface after the file
+
+	:param conf: the path of the configuration file
+*/
+func ReadConfig(conf string) (TunnelConfig, error) {
+	f, err := os.Open(conf)
+	if err != nil {
+		return TunnelConfig{}, &ConfigError{Msg: err.Error()}
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	cfg.Name = InterfaceName(conf)
+	return cfg, err
+}
+
+/*
+Parse a wg-quick style configuration, with an [Interface] section and any number of [Peer] sections.
+The wg-quick hooks and routing table options arent supported, as the interface is set up natively.
+
+	:param r: the configuration to parse
+*/
+func ParseConfig(r io.Reader) (TunnelConfig, error) {
+	cfg := TunnelConfig{MTU: DefaultMTU}
+	var peer *PeerConfig
+	var section string
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				cfg.Peers = append(cfg.Peers, PeerConfig{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			default:
+				return cfg, &ConfigError{Line: lineNum, Msg: "unknown section: " + line}
+			}
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return cfg, &ConfigError{Line: lineNum, Msg: "expected a 'Key = Value' pair"}
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		var err error
+		switch section {
+		case "interface":
+			err = cfg.set(key, val)
+		case "peer":
+			err = peer.set(key, val)
+		default:
+			err = fmt.Errorf("%s is outside of a section", key)
+		}
+		if err != nil {
+			return cfg, &ConfigError{Line: lineNum, Msg: err.Error()}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cfg, &ConfigError{Msg: err.Error()}
+	}
+	if cfg.PrivateKey == (wgtypes.Key{}) {
+		return cfg, &ConfigError{Msg: "the interface doesnt have a private key"}
+	}
+	return cfg, nil
+}
+
+func (t *TunnelConfig) set(key string, val string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		t.PrivateKey, err = wgtypes.ParseKey(val)
+	case "address":
+		t.Addresses, err = parsePrefixes(val, true)
+	case "listenport":
+		t.ListenPort, err = strconv.Atoi(val)
+	case "mtu":
+		t.MTU, err = strconv.Atoi(val)
+	case "fwmark":
+		var mark uint64
+		if val != "off" {
+			mark, err = strconv.ParseUint(val, 0, 32)
+		}
+		t.FwMark = int(mark)
+	case "table":
+		if _, _, err = parseTable(val); err == nil {
+			t.Table = val
+		}
+	case "dns":
+		for _, server := range strings.Split(val, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				t.DNS = append(t.DNS, server)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported interface option: %s", key)
+	}
+	return err
+}
+
+func (p *PeerConfig) set(key string, val string) error {
+	var err error
+	switch key {
+	case "publickey":
+		p.PublicKey, err = wgtypes.ParseKey(val)
+	case "presharedkey":
+		var psk wgtypes.Key
+		psk, err = wgtypes.ParseKey(val)
+		p.PresharedKey = &psk
+	case "endpoint":
+		p.Endpoint = val
+	case "allowedips":
+		p.AllowedIPs, err = parsePrefixes(val, false)
+	case "persistentkeepalive":
+		var secs int
+		if val != "off" {
+			secs, err = strconv.Atoi(val)
+		}
+		p.PersistentKeepalive = time.Duration(secs) * time.Second
+	default:
+		return fmt.Errorf("unsupported peer option: %s", key)
+	}
+	return err
+}
+
+/*
+Parse the routing table option of an interface
+
+	:param val: either 'off', 'auto', 'main' or a table number
+*/
+func parseTable(val string) (int, bool, error) {
+	switch strings.ToLower(val) {
+	case "", "auto":
+		return 0, true, nil
+	case "off":
+		return 0, false, nil
+	case "main":
+		return mainTable, true, nil
+	}
+	table, err := strconv.Atoi(val)
+	if err != nil || table <= 0 {
+		return 0, false, fmt.Errorf("invalid routing table: %s", val)
+	}
+	return table, true, nil
+}
+
+/*
+Get the mark for the tunnels own packets, which is also the table that a full tunnels default routes go into
+*/
+func (t TunnelConfig) fwMark() int {
+	if t.FwMark != 0 {
+		return t.FwMark
+	}
+	return DefaultFwMark
+}
+
+/*
+Parse a comma separated list of CIDRs. Bare addresses are taken to be a single host.
+
+	    :param val: the list to parse
+		:param keepHost: keep the host part of the address, rather than masking it off
+*/
+func parsePrefixes(val string, keepHost bool) ([]net.IPNet, error) {
+	var prefixes []net.IPNet
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() == nil {
+				part = part + "/128"
+			} else {
+				part = part + "/32"
+			}
+		}
+		ip, prefix, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		if keepHost {
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			prefix.IP = ip
+		}
+		prefixes = append(prefixes, *prefix)
+	}
+	return prefixes, nil
+}
+
+type ConfigError struct {
+	Line int
+	Msg  string
+}
+
+func (c *ConfigError) Error() string {
+	if c.Line > 0 {
+		return fmt.Sprintf("There was an error parsing the wireguard configuration on line %v: %s", c.Line, c.Msg)
+	}
+	return "There was an error parsing the wireguard configuration: " + c.Msg
+}
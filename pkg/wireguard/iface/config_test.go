@@ -0,0 +1,59 @@
+package iface
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConf = `
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.2/24, fd00::2 # the tunnel addresses
+DNS = 1.1.1.1, 9.9.9.9
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 5.5.5.5:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(testConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MTU != DefaultMTU || len(cfg.DNS) != 2 || len(cfg.Peers) != 1 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if len(cfg.Addresses) != 2 || cfg.Addresses[0].String() != "10.0.0.2/24" || cfg.Addresses[1].String() != "fd00::2/128" {
+		t.Errorf("unexpected addresses: %v", cfg.Addresses)
+	}
+	peer := cfg.Peers[0]
+	if peer.Endpoint != "5.5.5.5:51820" || peer.PersistentKeepalive != 25*time.Second || len(peer.AllowedIPs) != 2 {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+	if peer.AllowedIPs[0].String() != "0.0.0.0/0" {
+		t.Errorf("unexpected allowed ips: %v", peer.AllowedIPs)
+	}
+
+	cfg, err = ParseConfig(strings.NewReader(strings.Replace(testConf, "DNS =", "FwMark = 0x1234\nTable = 1000\nDNS =", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.fwMark() != 0x1234 || cfg.Table != "1000" {
+		t.Errorf("unexpected fwmark or table: %d %q", cfg.FwMark, cfg.Table)
+	}
+
+	for _, bad := range []string{
+		"[Interface]\nTable = sometimes",
+		"[Interface]\nPostUp = iptables -A FORWARD",
+		"[Interface]\nAddress = 10.0.0.2/24",
+		"PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+	} {
+		if _, err := ParseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package iface
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+
+	"git.aetherial.dev/aeth/yosai/pkg/config"
+)
+
+const (
+	ResolvConfPath       = "/etc/resolv.conf"
+	ResolvConfBackupPath = "/etc/resolv.conf.yosai"
+)
+
+/*
+Points the host at a tunnels resolvers while it is up, and puts things back once it comes down
+*/
+type Resolver interface {
+	Set(name string, servers []string) error
+	Revert(name string) error
+}
+
+/*
+Get the resolver for the configured mode, detecting systemd-resolved when no mode is set.
+Nil is returned when the hosts resolver should be left alone.
+
+	:param mode: either config.DnsLocalResolved, config.DnsLocalResolvConf, config.DnsLocalNone or empty
+*/
+func NewResolver(mode string) Resolver {
+	switch mode {
+	case config.DnsLocalNone:
+		return nil
+	case config.DnsLocalResolved:
+		return ResolvedResolver{}
+	case config.DnsLocalResolvConf:
+		return ResolvConfResolver{Path: ResolvConfPath, BackupPath: ResolvConfBackupPath}
+	}
+	if _, err := os.Stat("/run/systemd/resolve"); err == nil {
+		if _, err := exec.LookPath("resolvectl"); err == nil {
+			return ResolvedResolver{}
+		}
+	}
+	return ResolvConfResolver{Path: ResolvConfPath, BackupPath: ResolvConfBackupPath}
+}
+
+/*
+Sets the resolvers on the tunnels link in systemd-resolved, and routes every domain to that link
+so that no queries go out through the other interfaces
+*/
+type ResolvedResolver struct{}
+
+func (r ResolvedResolver) Set(name string, servers []string) error {
+	cmds := [][]string{
+		append([]string{"dns", name}, servers...),
+		{"domain", name, "~."},
+		{"default-route", name, "true"},
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvectl %s: %s %w", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+		}
+	}
+	return nil
+}
+
+func (r ResolvedResolver) Revert(name string) error {
+	if out, err := exec.Command("resolvectl", "revert", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvectl revert %s: %s %w", name, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+/*
+Overwrites resolv.conf with the tunnels resolvers, keeping the original alongside it to restore
+*/
+type ResolvConfResolver struct {
+	Path       string
+	BackupPath string
+}
+
+func (r ResolvConfResolver) Set(name string, servers []string) error {
+	// only the first tunnel takes the backup, so the original isnt lost to another tunnels resolvers
+	if _, err := os.Stat(r.BackupPath); errors.Is(err, fs.ErrNotExist) {
+		orig, err := os.ReadFile(r.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(r.BackupPath, orig, 0644); err != nil {
+			return err
+		}
+	}
+	buf := bytes.NewBufferString("# written by yosai for the " + name + " tunnel, the original is kept at " + r.BackupPath + "\n")
+	for _, server := range servers {
+		buf.WriteString("nameserver " + server + "\n")
+	}
+	return os.WriteFile(r.Path, buf.Bytes(), 0644)
+}
+
+func (r ResolvConfResolver) Revert(name string) error {
+	orig, err := os.ReadFile(r.BackupPath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.Path, orig, 0644); err != nil {
+		return err
+	}
+	return os.Remove(r.BackupPath)
+}
@@ -0,0 +1,37 @@
+package iface
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestResolvConfResolver(t *testing.T) {
+	dir := t.TempDir()
+	r := ResolvConfResolver{Path: path.Join(dir, "resolv.conf"), BackupPath: path.Join(dir, "resolv.conf.yosai")}
+	orig := "nameserver 192.168.1.1\n"
+	if err := os.WriteFile(r.Path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set("current", []string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	// a second tunnel mustnt clobber the backup of the original
+	if err := r.Set("replacement", []string{"10.0.1.1", "fd00::1"}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(r.Path)
+	if !strings.Contains(string(b), "nameserver 10.0.1.1\nnameserver fd00::1\n") || strings.Contains(string(b), "192.168.1.1") {
+		t.Errorf("unexpected resolv.conf:\n%s", b)
+	}
+	if err := r.Revert("replacement"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(r.Path); string(b) != orig {
+		t.Errorf("expected the original to be restored, got:\n%s", b)
+	}
+	if _, err := os.Stat(r.BackupPath); err == nil {
+		t.Error("the backup was left behind")
+	}
+}
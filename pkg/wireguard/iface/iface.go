@@ -0,0 +1,548 @@
+package iface
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	daemonproto "git.aetherial.dev/aeth/yosai/pkg/daemon-proto"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+/*
+The firewall mark put on the tunnels own packets when it routes everything, and the routing table
+that the default route through the tunnel goes into. This is the same scheme that wg-quick uses.
+*/
+const DefaultFwMark = 51820
+
+// the main routing table
+const mainTable = 254
+
+type PeerStatus struct {
+	PublicKey           string        `json:"public_key"`
+	Endpoint            string        `json:"endpoint"`
+	AllowedIPs          []string      `json:"allowed_ips"`
+	LastHandshake       time.Time     `json:"last_handshake"`
+	ReceiveBytes        int64         `json:"receive_bytes"`
+	TransmitBytes       int64         `json:"transmit_bytes"`
+	PersistentKeepalive time.Duration `json:"persistent_keepalive"`
+}
+
+type InterfaceStatus struct {
+	Name       string       `json:"name"`
+	PublicKey  string       `json:"public_key"`
+	ListenPort int          `json:"listen_port"`
+	Userspace  bool         `json:"userspace"` // the interface is run by wireguard-go inside of the daemon, rather than the kernel
+	Peers      []PeerStatus `json:"peers"`
+}
+
+/*
+A wireguard interface being run in userspace by the daemon
+*/
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+/*
+The state that has to be cleaned up when an interface comes down, beyond the interface itself
+*/
+type managedInterface struct {
+	userspace *userspaceDevice
+	rules     []*netlink.Rule
+	dns       bool // the hosts resolver was pointed at the interfaces DNS servers
+}
+
+/*
+Creates and configures the local wireguard interfaces without wg-quick. Kernel wireguard is set up
+over netlink, and when the kernel doesnt support it the interface is run in userspace with
+wireguard-go and a TUN device. Userspace interfaces only live as long as the daemon does.
+*/
+type Manager struct {
+	Resolver   Resolver // sets the hosts resolver to the DNS servers of an interface, nil leaves it alone
+	mu         sync.Mutex
+	interfaces map[string]*managedInterface
+	log        func(...string)
+}
+
+/*
+Create an interface manager
+
+	:param log: where to log to
+*/
+func NewManager(log func(...string)) *Manager {
+	return &Manager{interfaces: map[string]*managedInterface{}, log: log}
+}
+
+// Logging wrapper
+func (m *Manager) Log(msg ...string) {
+	mMsg := []string{"WireguardManager:"}
+	mMsg = append(mMsg, msg...)
+	m.log(mMsg...)
+}
+
+/*
+Bring up an interface, replacing it if it already exists. Everything that was set up is torn down
+again if any part of it fails.
+
+	:param cfg: the interface to bring up
+*/
+func (m *Manager) Up(cfg TunnelConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down(cfg.Name)
+	managed := &managedInterface{}
+	m.interfaces[cfg.Name] = managed
+	err := m.up(cfg, managed)
+	if err != nil {
+		m.down(cfg.Name)
+		return &InterfaceError{Name: cfg.Name, Msg: err.Error()}
+	}
+	return nil
+}
+
+func (m *Manager) up(cfg TunnelConfig, managed *managedInterface) error {
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: cfg.Name, MTU: mtu}})
+	if err != nil {
+		m.Log("Couldnt create a kernel wireguard interface:", cfg.Name, err.Error(), "falling back to userspace")
+		managed.userspace, err = startUserspace(cfg.Name, mtu)
+		if err != nil {
+			return err
+		}
+	}
+	link, err := netlink.LinkByName(cfg.Name)
+	if err != nil {
+		return err
+	}
+	fullTunnel := false
+	for i := range cfg.Peers {
+		for _, allowed := range cfg.Peers[i].AllowedIPs {
+			if ones, _ := allowed.Mask.Size(); ones == 0 {
+				fullTunnel = true
+			}
+		}
+	}
+	err = configureDevice(cfg, fullTunnel)
+	if err != nil {
+		return err
+	}
+	for i := range cfg.Addresses {
+		addr := cfg.Addresses[i]
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: &addr}); err != nil {
+			return fmt.Errorf("couldnt add the address %s: %w", addr.String(), err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	for i := range cfg.Peers {
+		for _, allowed := range cfg.Peers[i].AllowedIPs {
+			if err := m.route(link, allowed, cfg, managed); err != nil {
+				return fmt.Errorf("couldnt route %s: %w", allowed.String(), err)
+			}
+		}
+	}
+	if len(cfg.DNS) != 0 && m.Resolver != nil {
+		if err := m.Resolver.Set(cfg.Name, cfg.DNS); err != nil {
+			return fmt.Errorf("couldnt set the DNS servers: %w", err)
+		}
+		managed.dns = true
+	}
+	return nil
+}
+
+/*
+Route a peers allowed IPs through the interface. Default routes go into their own table, with rules
+that send everything through it apart from the tunnels own marked packets, so that the traffic to
+the endpoint doesnt loop back into the tunnel. Like wg-quick, a table of 'off' adds no routes, and
+a table number puts all of the routes into that table without any rules.
+
+	    :param link: the wireguard interface
+		:param dst: the allowed IPs to route
+		:param cfg: the interface configuration, with the mark and routing table
+		:param managed: where to record the rules that were added
+*/
+func (m *Manager) route(link netlink.Link, dst net.IPNet, cfg TunnelConfig, managed *managedInterface) error {
+	table, enabled, err := parseTable(cfg.Table)
+	if err != nil || !enabled {
+		return err
+	}
+	if table != 0 {
+		return netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &dst, Table: table, Scope: netlink.SCOPE_LINK})
+	}
+	ones, _ := dst.Mask.Size()
+	if ones > 0 {
+		return netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &dst, Scope: netlink.SCOPE_LINK})
+	}
+	mark := cfg.fwMark()
+	err = netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: &dst, Table: mark, Scope: netlink.SCOPE_LINK})
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	unmarked := netlink.NewRule()
+	unmarked.Family = family
+	unmarked.Mark = uint32(mark)
+	unmarked.Invert = true
+	unmarked.Table = mark
+	// let more specific routes in the main table, like the local network, keep working
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Table = mainTable
+	suppress.SuppressPrefixlen = 0
+	for _, rule := range []*netlink.Rule{unmarked, suppress} {
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+		managed.rules = append(managed.rules, rule)
+	}
+	return nil
+}
+
+/*
+Start a wireguard-go device on a new TUN device, listening on the UAPI socket so that it can be
+configured the same way as a kernel interface
+
+	    :param name: the name of the interface
+		:param mtu: the MTU of the TUN device
+*/
+func startUserspace(name string, mtu int) (*userspaceDevice, error) {
+	tdev, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("couldnt create the TUN device: %w", err)
+	}
+	dev := device.NewDevice(tdev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, fmt.Sprintf("(%s) ", name)))
+	fileUAPI, err := ipc.UAPIOpen(name)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("couldnt open the UAPI socket: %w", err)
+	}
+	uapi, err := ipc.UAPIListen(name, fileUAPI)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("couldnt listen on the UAPI socket: %w", err)
+	}
+	go func() {
+		for {
+			c, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(c)
+		}
+	}()
+	if err := dev.Up(); err != nil {
+		uapi.Close()
+		dev.Close()
+		return nil, err
+	}
+	return &userspaceDevice{device: dev, uapi: uapi}, nil
+}
+
+/*
+Set the keys and peers of an interface
+
+	    :param cfg: the interface configuration
+		:param fullTunnel: mark the tunnels own packets, so they can be routed around the tunnel
+*/
+func configureDevice(cfg TunnelConfig, fullTunnel bool) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	key := cfg.PrivateKey
+	devCfg := wgtypes.Config{PrivateKey: &key, ReplacePeers: true}
+	if cfg.ListenPort != 0 {
+		port := cfg.ListenPort
+		devCfg.ListenPort = &port
+	}
+	if fullTunnel || cfg.FwMark != 0 {
+		mark := cfg.fwMark()
+		devCfg.FirewallMark = &mark
+	}
+	for i := range cfg.Peers {
+		peer := cfg.Peers[i]
+		peerCfg := wgtypes.PeerConfig{
+			PublicKey:         peer.PublicKey,
+			PresharedKey:      peer.PresharedKey,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        peer.AllowedIPs,
+		}
+		if peer.PersistentKeepalive > 0 {
+			keepalive := peer.PersistentKeepalive
+			peerCfg.PersistentKeepaliveInterval = &keepalive
+		}
+		if peer.Endpoint != "" {
+			peerCfg.Endpoint, err = net.ResolveUDPAddr("udp", peer.Endpoint)
+			if err != nil {
+				return fmt.Errorf("couldnt resolve the endpoint %s: %w", peer.Endpoint, err)
+			}
+		}
+		devCfg.Peers = append(devCfg.Peers, peerCfg)
+	}
+	return client.ConfigureDevice(cfg.Name, devCfg)
+}
+
+/*
+Replace the AllowedIPs of peers on an interface, leaving the rest of the interface as it is. Every change
+is made at once, so AllowedIPs can be moved from one peer to another. The routes on the interface arent
+touched, so the AllowedIPs being moved have to be routed over the interface already.
+
+	    :param name: the name of the interface
+		:param allowed: the new AllowedIPs of each peer, keyed by the peers public key
+*/
+func (m *Manager) SetAllowedIPs(name string, allowed map[string][]string) error {
+	devCfg := wgtypes.Config{}
+	keys := make([]string, 0, len(allowed))
+	for key := range allowed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pubkey, err := wgtypes.ParseKey(key)
+		if err != nil {
+			return &InterfaceError{Name: name, Msg: "invalid peer public key: " + err.Error()}
+		}
+		ips := []net.IPNet{}
+		for _, cidr := range allowed[key] {
+			_, prefix, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return &InterfaceError{Name: name, Msg: err.Error()}
+			}
+			ips = append(ips, *prefix)
+		}
+		devCfg.Peers = append(devCfg.Peers, wgtypes.PeerConfig{
+			PublicKey:         pubkey,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        ips,
+		})
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return &InterfaceError{Name: name, Msg: err.Error()}
+	}
+	defer client.Close()
+	if err := client.ConfigureDevice(name, devCfg); err != nil {
+		return &InterfaceError{Name: name, Msg: err.Error()}
+	}
+	return nil
+}
+
+/*
+Take an interface down, removing it along with its routes and rules
+
+	:param name: the name of the interface
+*/
+func (m *Manager) Down(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.down(name)
+}
+
+/*
+Take an interface down without holding the lock. An interface that doesnt exist isnt an error.
+
+	:param name: the name of the interface
+*/
+func (m *Manager) down(name string) error {
+	var err error
+	managed, ok := m.interfaces[name]
+	delete(m.interfaces, name)
+	if ok && managed.dns {
+		if dnsErr := m.Resolver.Revert(name); dnsErr != nil {
+			m.Log("Couldnt revert the DNS servers for:", name, dnsErr.Error())
+		}
+	}
+	if ok {
+		for _, rule := range managed.rules {
+			if ruleErr := netlink.RuleDel(rule); ruleErr != nil && !errors.Is(ruleErr, syscall.ENOENT) {
+				m.Log("Couldnt remove a routing rule for:", name, ruleErr.Error())
+			}
+		}
+	}
+	if link, linkErr := netlink.LinkByName(name); linkErr == nil {
+		err = netlink.LinkDel(link)
+	}
+	if ok && managed.userspace != nil {
+		managed.userspace.uapi.Close()
+		managed.userspace.device.Close()
+	}
+	if err != nil {
+		return &InterfaceError{Name: name, Msg: err.Error()}
+	}
+	return nil
+}
+
+/*
+Get the live status of an interface and its peers
+
+	:param name: the name of the interface
+*/
+func (m *Manager) Status(name string) (InterfaceStatus, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return InterfaceStatus{}, &InterfaceError{Name: name, Msg: err.Error()}
+	}
+	defer client.Close()
+	dev, err := client.Device(name)
+	if err != nil {
+		return InterfaceStatus{}, &InterfaceError{Name: name, Msg: err.Error()}
+	}
+	return m.status(dev), nil
+}
+
+/*
+Get the live status of every wireguard interface on the host
+*/
+func (m *Manager) StatusAll() ([]InterfaceStatus, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, &InterfaceError{Msg: err.Error()}
+	}
+	defer client.Close()
+	devs, err := client.Devices()
+	if err != nil {
+		return nil, &InterfaceError{Msg: err.Error()}
+	}
+	statuses := []InterfaceStatus{}
+	for i := range devs {
+		statuses = append(statuses, m.status(devs[i]))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+func (m *Manager) status(dev *wgtypes.Device) InterfaceStatus {
+	m.mu.Lock()
+	managed, ok := m.interfaces[dev.Name]
+	userspace := ok && managed.userspace != nil
+	m.mu.Unlock()
+	status := InterfaceStatus{
+		Name:       dev.Name,
+		PublicKey:  dev.PublicKey.String(),
+		ListenPort: dev.ListenPort,
+		Userspace:  userspace,
+		Peers:      []PeerStatus{},
+	}
+	for _, peer := range dev.Peers {
+		peerStatus := PeerStatus{
+			PublicKey:           peer.PublicKey.String(),
+			LastHandshake:       peer.LastHandshakeTime,
+			ReceiveBytes:        peer.ReceiveBytes,
+			TransmitBytes:       peer.TransmitBytes,
+			PersistentKeepalive: peer.PersistentKeepaliveInterval,
+			AllowedIPs:          []string{},
+		}
+		if peer.Endpoint != nil {
+			peerStatus.Endpoint = peer.Endpoint.String()
+		}
+		for _, allowed := range peer.AllowedIPs {
+			peerStatus.AllowedIPs = append(peerStatus.AllowedIPs, allowed.String())
+		}
+		status.Peers = append(status.Peers, peerStatus)
+	}
+	return status
+}
+
+/*
+Get the most recent handshake on an interface, across all of its peers. The zero time is returned
+if no peer has completed a handshake yet.
+
+	:param name: the name of the interface
+*/
+func (m *Manager) Handshake(name string) (time.Time, error) {
+	var latest time.Time
+	status, err := m.Status(name)
+	if err != nil {
+		return latest, err
+	}
+	for _, peer := range status.Peers {
+		if peer.LastHandshake.After(latest) {
+			latest = peer.LastHandshake
+		}
+	}
+	return latest, nil
+}
+
+/*
+Wrapping the status of the wireguard interfaces in a route friendly interface
+
+	:param msg: a message to parse from the daemon socket
+*/
+func (m *Manager) StatusHandler(msg daemonproto.SockMessage) daemonproto.SockMessage {
+	statuses, err := m.StatusAll()
+	if err != nil {
+		return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_FAILED, []byte(err.Error()))
+	}
+	b, _ := json.Marshal(statuses)
+	return *daemonproto.NewSockMessage(daemonproto.MsgResponse, daemonproto.REQUEST_OK, b)
+}
+
+type InterfaceRouter struct {
+	routes map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage
+}
+
+func (i *InterfaceRouter) Register(method daemonproto.Method, callable func(daemonproto.SockMessage) daemonproto.SockMessage) {
+	i.routes[method] = callable
+}
+
+func (i *InterfaceRouter) Routes() map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage {
+	return i.routes
+}
+
+func NewInterfaceRouter() *InterfaceRouter {
+	return &InterfaceRouter{routes: map[daemonproto.Method]func(daemonproto.SockMessage) daemonproto.SockMessage{}}
+}
+
+/*
+Drives the interfaces from the configuration files that the vpn-config route saves, so that it can
+stand in for wg-quick wherever the tunnels are addressed by their configuration file
+*/
+type ConfTunnel struct {
+	Manager *Manager
+}
+
+func (c ConfTunnel) Up(conf string) error {
+	cfg, err := ReadConfig(conf)
+	if err != nil {
+		return err
+	}
+	return c.Manager.Up(cfg)
+}
+
+func (c ConfTunnel) Down(conf string) error {
+	return c.Manager.Down(InterfaceName(conf))
+}
+
+func (c ConfTunnel) Handshake(conf string) (time.Time, error) {
+	return c.Manager.Handshake(InterfaceName(conf))
+}
+
+type InterfaceError struct {
+	Name string
+	Msg  string
+}
+
+func (i *InterfaceError) Error() string {
+	return "There was an error managing the wireguard interface: " + i.Name + " " + i.Msg
+}